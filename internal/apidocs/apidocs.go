@@ -0,0 +1,24 @@
+// Package apidocs serves the hand-maintained OpenAPI description of the API.
+// Keep openapi.json in step with the routes in internal/router.
+package apidocs
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+//go:embed openapi.json
+var spec []byte
+
+// Spec returns the raw OpenAPI document.
+func Spec() []byte {
+	return spec
+}
+
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		w.Write(spec)
+	})
+}
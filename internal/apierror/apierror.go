@@ -0,0 +1,105 @@
+// Package apierror defines the JSON error body shared by the handlers and the
+// middleware, and the central mapping from service errors to HTTP statuses.
+package apierror
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/rs/zerolog"
+)
+
+type APIError struct {
+	Status            int               `json:"-"`
+	Code              string            `json:"error"`
+	Message           string            `json:"message,omitempty"`
+	Field             string            `json:"field,omitempty"`
+	Fields            map[string]string `json:"fields,omitempty"`
+	RetryAfterSeconds int               `json:"retry_after_seconds,omitempty"`
+}
+
+func New(status int, code, message string) *APIError {
+	return &APIError{Status: status, Code: code, Message: message}
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return e.Code
+	}
+	return e.Code + ": " + e.Message
+}
+
+type mapping struct {
+	target  error
+	status  int
+	code    string
+	message string
+}
+
+var (
+	mu       sync.RWMutex
+	mappings []mapping
+	logger   = zerolog.Nop()
+)
+
+// SetLogger sets where WriteError records the errors it hides from clients.
+func SetLogger(l zerolog.Logger) {
+	mu.Lock()
+	defer mu.Unlock()
+	logger = l
+}
+
+// Register maps a sentinel error, and anything wrapping it, to a status and
+// code. An empty message means the error's own text is sent to the client.
+func Register(target error, status int, code, message string) {
+	mu.Lock()
+	defer mu.Unlock()
+	mappings = append(mappings, mapping{target: target, status: status, code: code, message: message})
+}
+
+// FromError returns err as an APIError if it is one or wraps a registered
+// sentinel.
+func FromError(err error) (*APIError, bool) {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr, true
+	}
+
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, m := range mappings {
+		if errors.Is(err, m.target) {
+			message := m.message
+			if message == "" {
+				message = err.Error()
+			}
+			return New(m.status, m.code, message), true
+		}
+	}
+
+	return nil, false
+}
+
+// WriteError writes err as a JSON error body. Only APIErrors and registered
+// sentinels are shown to the client; anything else is logged in full and
+// reported as a generic 500, so database and driver details never leak.
+func WriteError(w http.ResponseWriter, err error) {
+	apiErr, ok := FromError(err)
+	if !ok {
+		mu.RLock()
+		logger.Error().Err(err).Msg("Internal error hidden from client")
+		mu.RUnlock()
+		apiErr = New(http.StatusInternalServerError, "internal_error", "An internal error occurred")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(apiErr.Status)
+	json.NewEncoder(w).Encode(apiErr)
+}
+
+// Write is shorthand for WriteError(w, New(status, code, message)).
+func Write(w http.ResponseWriter, status int, code, message string) {
+	WriteError(w, New(status, code, message))
+}
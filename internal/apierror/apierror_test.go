@@ -0,0 +1,85 @@
+package apierror
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+var errTestSentinel = errors.New("widget is locked")
+
+func init() {
+	Register(errTestSentinel, http.StatusConflict, "widget_locked", "")
+}
+
+func TestWriteError(t *testing.T) {
+	retry := New(http.StatusTooManyRequests, "rate_limit_exceeded", "Slow down")
+	retry.RetryAfterSeconds = 30
+
+	tests := []struct {
+		name string
+		err  error
+		want int
+		body string
+	}{
+		{"api error", New(http.StatusNotFound, "not_found", "No such widget"), http.StatusNotFound,
+			`{"error":"not_found","message":"No such widget"}`},
+		{"retry after", retry, http.StatusTooManyRequests,
+			`{"error":"rate_limit_exceeded","message":"Slow down","retry_after_seconds":30}`},
+		{"registered sentinel", errTestSentinel, http.StatusConflict,
+			`{"error":"widget_locked","message":"widget is locked"}`},
+		{"wrapped sentinel", fmt.Errorf("update failed: %w", errTestSentinel), http.StatusConflict,
+			`{"error":"widget_locked","message":"update failed: widget is locked"}`},
+		{"unmapped", errors.New("database error: connection reset"), http.StatusInternalServerError,
+			`{"error":"internal_error","message":"An internal error occurred"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			WriteError(rec, tt.err)
+
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", ct)
+			}
+			var got, want map[string]interface{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			json.Unmarshal([]byte(tt.body), &want)
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("body = %s, want %s", rec.Body.String(), tt.body)
+			}
+		})
+	}
+}
+
+func TestWriteErrorHidesWrappedDatabaseErrors(t *testing.T) {
+	var logs bytes.Buffer
+	SetLogger(zerolog.New(&logs))
+	t.Cleanup(func() { SetLogger(zerolog.Nop()) })
+
+	dbErr := fmt.Errorf("database error: %w", errors.New("Error 1146: Table 'wallet.balances' doesn't exist"))
+	rec := httptest.NewRecorder()
+	WriteError(rec, dbErr)
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want 500", rec.Code)
+	}
+	if strings.Contains(rec.Body.String(), "wallet.balances") || !strings.Contains(rec.Body.String(), "internal_error") {
+		t.Errorf("body = %s, want a generic internal_error", rec.Body.String())
+	}
+	if !strings.Contains(logs.String(), "wallet.balances") {
+		t.Errorf("log = %s, want the full error", logs.String())
+	}
+}
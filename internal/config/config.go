@@ -1,30 +1,318 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-projects/internal/models"
 
 	"github.com/joho/godotenv"
 )
 
+const (
+	EnvDevelopment = "development"
+	EnvProduction  = "production"
+)
+
+// DefaultJWTSecret is used when JWT_SECRET is unset. It is only acceptable
+// outside production.
+const DefaultJWTSecret = "default-secret-key-change-in-production"
+
 type Config struct {
-	DBUrl string
-	Port  string
+	Environment string
+
+	DBUrl       string
+	Port        string
+	BindAddress string
+
+	DBMaxOpenConns    int
+	DBMaxIdleConns    int
+	DBConnMaxLifetime time.Duration
+
+	TrustedProxies []*net.IPNet
+
+	ShutdownTimeout time.Duration
+	RequestTimeout  time.Duration
+
+	RateLimit      int
+	RateLimitBurst int
+
+	CreditRateLimit     int
+	DebitRateLimit      int
+	TransferRateLimit   int
+	WithdrawalRateLimit int
+	ExchangeRateLimit   int
+	SettlementRateLimit int
+
+	AccessLogFormat string
+
+	LogFormat    string
+	LogLevel     string
+	LogFile      string
+	LogMaxSizeMB int
+
+	IdempotencyWindow time.Duration
+
+	MaxPageSize int
+
+	MaxBodyBytes int64
+
+	CompressionMinBytes int
+
+	TracingEndpoint    string
+	TracingServiceName string
+
+	ReconcileInterval   time.Duration
+	ReconcileAutoRepair bool
+
+	MaxTransactionAmount  models.Money
+	DailyTransactionLimit models.Money
+
+	AllowMerchantSignup bool
+
+	JWTSecret       string
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+	JWTIssuer       string
+	JWTAudience     string
 }
 
-func LoadConfig() Config {
+// LoadConfig reads the configuration from the environment and .env. The
+// Config is returned even when validation fails, so the caller can still set
+// up logging before reporting the error.
+func LoadConfig() (Config, error) {
 	err := godotenv.Load()
 	if err != nil {
 		log.Println(".env dosyası bulunamadı, varsayılanlar kullanılacak")
 	}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	cfg := Config{
+		Environment: strings.ToLower(getEnv("APP_ENV", EnvDevelopment)),
+
+		DBUrl:       os.Getenv("DB_URL"),
+		Port:        getEnvPort("PORT", "8080"),
+		BindAddress: getEnvBindAddress("BIND_ADDRESS"),
+
+		DBMaxOpenConns:    getEnvInt("DB_MAX_OPEN_CONNS", 25),
+		DBMaxIdleConns:    getEnvInt("DB_MAX_IDLE_CONNS", 25),
+		DBConnMaxLifetime: getEnvDuration("DB_CONN_MAX_LIFETIME", 5*time.Minute),
+
+		TrustedProxies: getEnvCIDRs("TRUSTED_PROXIES"),
+
+		ShutdownTimeout: getEnvDuration("SHUTDOWN_TIMEOUT", 5*time.Second),
+		RequestTimeout:  getEnvDuration("REQUEST_TIMEOUT", 30*time.Second),
+
+		RateLimit:      getEnvInt("RATE_LIMIT", 10),
+		RateLimitBurst: getEnvInt("RATE_LIMIT_BURST", 20),
+
+		CreditRateLimit:     getEnvInt("CREDIT_RATE_LIMIT", 30),
+		DebitRateLimit:      getEnvInt("DEBIT_RATE_LIMIT", 30),
+		TransferRateLimit:   getEnvInt("TRANSFER_RATE_LIMIT", 10),
+		WithdrawalRateLimit: getEnvInt("WITHDRAWAL_RATE_LIMIT", 10),
+		ExchangeRateLimit:   getEnvInt("EXCHANGE_RATE_LIMIT", 10),
+		SettlementRateLimit: getEnvInt("SETTLEMENT_RATE_LIMIT", 10),
+
+		AccessLogFormat: getEnv("ACCESS_LOG_FORMAT", "console"),
+
+		LogFormat:    getEnv("LOG_FORMAT", "console"),
+		LogLevel:     getEnv("LOG_LEVEL", "info"),
+		LogFile:      getEnv("LOG_FILE", ""),
+		LogMaxSizeMB: getEnvInt("LOG_MAX_SIZE_MB", 100),
+
+		IdempotencyWindow: getEnvDuration("IDEMPOTENCY_WINDOW", 24*time.Hour),
+
+		MaxPageSize: getEnvInt("MAX_PAGE_SIZE", 100),
+
+		MaxBodyBytes: int64(getEnvInt("MAX_BODY_BYTES", 1<<20)),
+
+		CompressionMinBytes: getEnvInt("COMPRESSION_MIN_BYTES", 1024),
+
+		TracingEndpoint:    getEnv("OTEL_EXPORTER_OTLP_ENDPOINT", ""),
+		TracingServiceName: getEnv("OTEL_SERVICE_NAME", "go-projects"),
+
+		ReconcileInterval:   getEnvDuration("RECONCILE_INTERVAL", time.Hour),
+		ReconcileAutoRepair: getEnvBool("RECONCILE_AUTO_REPAIR", false),
+
+		MaxTransactionAmount:  getEnvMoney("MAX_TRANSACTION_AMOUNT", 10000000),
+		DailyTransactionLimit: getEnvMoney("DAILY_TRANSACTION_LIMIT", 50000000),
+
+		AllowMerchantSignup: getEnvBool("ALLOW_MERCHANT_SIGNUP", false),
+
+		JWTSecret:       os.Getenv("JWT_SECRET"),
+		AccessTokenTTL:  getEnvDuration("ACCESS_TOKEN_TTL", 24*time.Hour),
+		RefreshTokenTTL: getEnvDuration("REFRESH_TOKEN_TTL", 7*24*time.Hour),
+		JWTIssuer:       getEnv("JWT_ISSUER", ""),
+		JWTAudience:     getEnv("JWT_AUDIENCE", ""),
 	}
 
-	return Config{
-		DBUrl: os.Getenv("DB_URL"),
-		Port:  port,
+	if cfg.JWTSecret == "" && !cfg.IsProduction() {
+		log.Println("JWT_SECRET tanımlı değil, varsayılan anahtar kullanılacak")
+		cfg.JWTSecret = DefaultJWTSecret
 	}
+
+	return cfg, cfg.Validate()
+}
+
+func (c Config) IsProduction() bool {
+	return c.Environment == EnvProduction
+}
+
+// Validate reports every missing or unsafe required setting at once.
+func (c Config) Validate() error {
+	var errs []error
+
+	if c.Environment != EnvDevelopment && c.Environment != EnvProduction {
+		errs = append(errs, fmt.Errorf("APP_ENV geçersiz (%q): %s veya %s olmalı", c.Environment, EnvDevelopment, EnvProduction))
+	}
+
+	if c.DBUrl == "" {
+		errs = append(errs, errors.New("DB_URL tanımlı değil"))
+	}
+
+	if c.IsProduction() && (c.JWTSecret == "" || c.JWTSecret == DefaultJWTSecret) {
+		errs = append(errs, errors.New("production ortamında JWT_SECRET tanımlı olmalı ve varsayılan değer kullanılmamalı"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Addr is the listen address for http.Server; an empty BindAddress listens
+// on every interface.
+func (c Config) Addr() string {
+	return net.JoinHostPort(c.BindAddress, c.Port)
+}
+
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func getEnvInt(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("%s geçersiz (%q), varsayılan kullanılacak: %d", key, value, fallback)
+		return fallback
+	}
+
+	return parsed
+}
+
+// getEnvPort reads a TCP port number between 1 and 65535.
+func getEnvPort(key, fallback string) string {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return fallback
+	}
+
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 1 || port > 65535 {
+		log.Printf("%s geçersiz (%q), varsayılan kullanılacak: %s", key, value, fallback)
+		return fallback
+	}
+
+	return strconv.Itoa(port)
+}
+
+// getEnvBindAddress reads the IP address to listen on. IPv6 addresses are
+// given without brackets; an empty or invalid value means every interface.
+func getEnvBindAddress(key string) string {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" || value == "localhost" {
+		return value
+	}
+
+	if net.ParseIP(value) == nil {
+		log.Printf("%s geçersiz (%q), tüm arayüzler dinlenecek", key, value)
+		return ""
+	}
+
+	return value
+}
+
+func getEnvBool(key string, fallback bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("%s geçersiz (%q), varsayılan kullanılacak: %t", key, value, fallback)
+		return fallback
+	}
+
+	return parsed
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("%s geçersiz (%q), varsayılan kullanılacak: %s", key, value, fallback)
+		return fallback
+	}
+
+	return parsed
+}
+
+// getEnvCIDRs reads a comma-separated list of CIDRs; a bare IP is taken as a
+// single-host network.
+func getEnvCIDRs(key string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+
+		if ip := net.ParseIP(value); ip != nil {
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			log.Printf("%s içinde geçersiz değer (%q), yok sayılacak", key, value)
+			continue
+		}
+		networks = append(networks, network)
+	}
+
+	return networks
+}
+
+func getEnvMoney(key string, fallback models.Money) models.Money {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	parsed, err := models.ParseMoney(value)
+	if err != nil {
+		log.Printf("%s geçersiz (%q), varsayılan kullanılacak: %s", key, value, fallback)
+		return fallback
+	}
+
+	return parsed
 }
@@ -0,0 +1,145 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGetEnvPort(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{name: "unset", value: "", want: "8080"},
+		{name: "valid", value: "9090", want: "9090"},
+		{name: "surrounding spaces", value: " 3000 ", want: "3000"},
+		{name: "not a number", value: "http", want: "8080"},
+		{name: "zero", value: "0", want: "8080"},
+		{name: "too large", value: "65536", want: "8080"},
+		{name: "negative", value: "-1", want: "8080"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("PORT", tt.value)
+			if got := getEnvPort("PORT", "8080"); got != tt.want {
+				t.Errorf("getEnvPort(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddr(t *testing.T) {
+	tests := []struct {
+		bind string
+		want string
+	}{
+		{bind: "", want: ":8080"},
+		{bind: "127.0.0.1", want: "127.0.0.1:8080"},
+		{bind: "::1", want: "[::1]:8080"},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("BIND_ADDRESS", tt.bind)
+		cfg := Config{BindAddress: getEnvBindAddress("BIND_ADDRESS"), Port: "8080"}
+		if got := cfg.Addr(); got != tt.want {
+			t.Errorf("Addr() with BIND_ADDRESS=%q = %q, want %q", tt.bind, got, tt.want)
+		}
+	}
+
+	t.Setenv("BIND_ADDRESS", "not-an-ip")
+	if got := getEnvBindAddress("BIND_ADDRESS"); got != "" {
+		t.Errorf("invalid bind address = %q, want every interface", got)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := Config{Environment: EnvProduction, DBUrl: "user:pass@/wallet", JWTSecret: "a-real-secret"}
+
+	tests := []struct {
+		name    string
+		modify  func(c *Config)
+		wantErr []string
+	}{
+		{name: "valid production", modify: func(c *Config) {}},
+		{name: "development without a secret", modify: func(c *Config) { c.Environment, c.JWTSecret = EnvDevelopment, "" }},
+		{name: "missing DB_URL", modify: func(c *Config) { c.DBUrl = "" }, wantErr: []string{"DB_URL"}},
+		{name: "production without a secret", modify: func(c *Config) { c.JWTSecret = "" }, wantErr: []string{"JWT_SECRET"}},
+		{name: "production with the default secret", modify: func(c *Config) { c.JWTSecret = DefaultJWTSecret }, wantErr: []string{"JWT_SECRET"}},
+		{name: "unknown environment", modify: func(c *Config) { c.Environment = "staging" }, wantErr: []string{"APP_ENV"}},
+		{
+			name:    "every problem reported",
+			modify:  func(c *Config) { c.DBUrl, c.JWTSecret = "", "" },
+			wantErr: []string{"DB_URL", "JWT_SECRET"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := valid
+			tt.modify(&cfg)
+			err := cfg.Validate()
+
+			if len(tt.wantErr) == 0 {
+				if err != nil {
+					t.Errorf("Validate() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Validate() = nil, want an error naming %v", tt.wantErr)
+			}
+			for _, name := range tt.wantErr {
+				if !strings.Contains(err.Error(), name) {
+					t.Errorf("Validate() = %q, want it to name %s", err, name)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadConfigReportsMissingDBURL(t *testing.T) {
+	t.Setenv("DB_URL", "")
+	t.Setenv("APP_ENV", "")
+	t.Setenv("PORT", "")
+
+	cfg, err := LoadConfig()
+	if err == nil || !strings.Contains(err.Error(), "DB_URL") {
+		t.Errorf("LoadConfig() error = %v, want one naming DB_URL", err)
+	}
+	if cfg.Environment != EnvDevelopment || cfg.Port != "8080" {
+		t.Errorf("config = %s on port %s, want the defaults returned alongside the error", cfg.Environment, cfg.Port)
+	}
+}
+
+func TestLoadConfigJWTSecretFallback(t *testing.T) {
+	t.Setenv("DB_URL", "user:pass@/wallet")
+
+	t.Setenv("JWT_SECRET", "")
+	t.Setenv("APP_ENV", EnvDevelopment)
+	if cfg, err := LoadConfig(); err != nil || cfg.JWTSecret != DefaultJWTSecret {
+		t.Errorf("development: secret = %q, err = %v; want the default and no error", cfg.JWTSecret, err)
+	}
+
+	t.Setenv("APP_ENV", EnvProduction)
+	if cfg, err := LoadConfig(); err == nil || cfg.JWTSecret != "" {
+		t.Errorf("production: secret = %q, err = %v; want no fallback and an error", cfg.JWTSecret, err)
+	}
+
+	t.Setenv("JWT_SECRET", "s3cret")
+	if cfg, err := LoadConfig(); err != nil || cfg.JWTSecret != "s3cret" {
+		t.Errorf("production with a secret: secret = %q, err = %v", cfg.JWTSecret, err)
+	}
+}
+
+func TestLoadConfigMerchantSignup(t *testing.T) {
+	t.Setenv("DB_URL", "user:pass@/wallet")
+
+	for value, want := range map[string]bool{"": false, "true": true, "1": true, "false": false, "maybe": false} {
+		t.Setenv("ALLOW_MERCHANT_SIGNUP", value)
+		if cfg, _ := LoadConfig(); cfg.AllowMerchantSignup != want {
+			t.Errorf("ALLOW_MERCHANT_SIGNUP=%q: AllowMerchantSignup = %t, want %t", value, cfg.AllowMerchantSignup, want)
+		}
+	}
+}
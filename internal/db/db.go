@@ -2,75 +2,94 @@ package db
 
 import (
 	"database/sql"
-	"log"
+	"fmt"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 )
 
-func InitDB(dbURL string) *sql.DB {
-	db, err := sql.Open("mysql", dbURL)
+type seedRole struct {
+	Name        string
+	Description string
+}
+
+type seedCategory struct {
+	Code string
+	Name string
+}
+
+var defaultRoles = []seedRole{
+	{Name: "admin", Description: "Full access to all accounts and administrative operations"},
+	{Name: "user", Description: "Standard account holder"},
+	{Name: "merchant", Description: "Merchant account with settlement capabilities"},
+}
+
+var defaultTransactionCategories = []seedCategory{
+	{Code: "general", Name: "General"},
+	{Code: "salary", Name: "Salary"},
+	{Code: "rent", Name: "Rent"},
+	{Code: "utilities", Name: "Utilities"},
+	{Code: "groceries", Name: "Groceries"},
+	{Code: "transfer", Name: "Transfer"},
+	{Code: "settlement", Name: "Settlement"},
+}
+
+type PoolOptions struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+// driverName is swapped for a mock driver in tests.
+var driverName = "mysql"
+
+func InitDB(dbURL string, pool PoolOptions) (*sql.DB, error) {
+	db, err := sql.Open(driverName, dbURL)
 	if err != nil {
-		log.Fatal("Veritabanına bağlanılamadı:", err)
+		return nil, fmt.Errorf("veritabanına bağlanılamadı: %w", err)
 	}
 
+	db.SetMaxOpenConns(pool.MaxOpenConns)
+	db.SetMaxIdleConns(pool.MaxIdleConns)
+	db.SetConnMaxLifetime(pool.ConnMaxLifetime)
+
 	err = db.Ping()
 	if err != nil {
-		log.Fatal("Veritabanı yanıt vermiyor:", err)
+		db.Close()
+		return nil, fmt.Errorf("veritabanı yanıt vermiyor: %w", err)
 	}
 
-	return db
+	return db, nil
 }
 
-func RunMigrations(db *sql.DB) {
-	queries := []string{
-		`CREATE TABLE IF NOT EXISTS users (
-			id INT AUTO_INCREMENT PRIMARY KEY,
-			username VARCHAR(100),
-			email VARCHAR(100),
-			password_hash VARCHAR(255),
-			role VARCHAR(50),
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
-		);`,
-		`CREATE TABLE IF NOT EXISTS transactions (
-			id INT AUTO_INCREMENT PRIMARY KEY,
-			from_user_id INT,
-			to_user_id INT,
-			amount DECIMAL(20,2),
-			type VARCHAR(50),
-			status VARCHAR(50),
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
-		);`,
-		`CREATE TABLE IF NOT EXISTS balances (
-			user_id INT PRIMARY KEY,
-			amount DECIMAL(20,2),
-			last_updated_at DATETIME DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
-		);`,
-		`CREATE TABLE IF NOT EXISTS balance_history (
-			id INT AUTO_INCREMENT PRIMARY KEY,
-			user_id INT NOT NULL,
-			balance DECIMAL(20,2) NOT NULL,
-			change_amount DECIMAL(20,2) NOT NULL,
-			transaction_id INT,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			INDEX idx_user_id (user_id),
-			INDEX idx_created_at (created_at),
-			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
-		);`,
-		`CREATE TABLE IF NOT EXISTS audit_logs (
-			id INT AUTO_INCREMENT PRIMARY KEY,
-			entity_type VARCHAR(50),
-			entity_id INT,
-			action VARCHAR(50),
-			details TEXT,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
-		);`,
+func RunMigrations(db *sql.DB) error {
+	if err := applyMigrations(db, migrations); err != nil {
+		return err
 	}
 
-	for _, q := range queries {
-		_, err := db.Exec(q)
+	return SeedReferenceData(db)
+}
+
+func SeedReferenceData(db *sql.DB) error {
+	for _, role := range defaultRoles {
+		_, err := db.Exec(
+			"INSERT IGNORE INTO roles (name, description) VALUES (?, ?)",
+			role.Name, role.Description,
+		)
 		if err != nil {
-			log.Fatal("Migration hatası:", err)
+			return fmt.Errorf("rol verisi eklenemedi: %w", err)
 		}
 	}
+
+	for _, category := range defaultTransactionCategories {
+		_, err := db.Exec(
+			"INSERT IGNORE INTO transaction_categories (code, name) VALUES (?, ?)",
+			category.Code, category.Name,
+		)
+		if err != nil {
+			return fmt.Errorf("kategori verisi eklenemedi: %w", err)
+		}
+	}
+
+	return nil
 }
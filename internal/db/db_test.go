@@ -0,0 +1,190 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestSeedDataHasUniqueKeys(t *testing.T) {
+	roles := make(map[string]bool)
+	for _, role := range defaultRoles {
+		if roles[role.Name] {
+			t.Errorf("role %q seeded twice", role.Name)
+		}
+		roles[role.Name] = true
+	}
+
+	categories := make(map[string]bool)
+	for _, category := range defaultTransactionCategories {
+		if categories[category.Code] {
+			t.Errorf("category %q seeded twice", category.Code)
+		}
+		categories[category.Code] = true
+	}
+}
+
+// TestSeedReferenceDataTwice runs the seed against a database that already
+// holds the reference rows on the second pass. Every insert must be an
+// INSERT IGNORE on the primary key so the second pass adds nothing.
+func TestSeedReferenceDataTwice(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	roleInsert := regexp.QuoteMeta("INSERT IGNORE INTO roles (name, description) VALUES (?, ?)")
+	categoryInsert := regexp.QuoteMeta("INSERT IGNORE INTO transaction_categories (code, name) VALUES (?, ?)")
+
+	for run, affected := range []int64{1, 0} {
+		for _, role := range defaultRoles {
+			mock.ExpectExec(roleInsert).WithArgs(role.Name, role.Description).WillReturnResult(sqlmock.NewResult(0, affected))
+		}
+		for _, category := range defaultTransactionCategories {
+			mock.ExpectExec(categoryInsert).WithArgs(category.Code, category.Name).WillReturnResult(sqlmock.NewResult(0, affected))
+		}
+		if err := SeedReferenceData(db); err != nil {
+			t.Fatalf("run %d: SeedReferenceData: %v", run+1, err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatalf("run %d: %v", run+1, err)
+		}
+	}
+}
+
+// useMockDriver points InitDB at sqlmock for the length of the test and
+// returns the mock behind dsn.
+func useMockDriver(t *testing.T, dsn string) sqlmock.Sqlmock {
+	t.Helper()
+	conn, mock, err := sqlmock.NewWithDSN(dsn, sqlmock.MonitorPingsOption(true))
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	driverName = "sqlmock"
+	t.Cleanup(func() { driverName = "mysql" })
+	return mock
+}
+
+func TestInitDBAppliesPoolSettings(t *testing.T) {
+	mock := useMockDriver(t, "pool-settings")
+	mock.ExpectPing()
+
+	db, err := InitDB("pool-settings", PoolOptions{MaxOpenConns: 7, MaxIdleConns: 2, ConnMaxLifetime: time.Millisecond})
+	if err != nil {
+		t.Fatalf("InitDB: %v", err)
+	}
+	defer db.Close()
+
+	if got := db.Stats().MaxOpenConnections; got != 7 {
+		t.Errorf("MaxOpenConnections = %d, want 7", got)
+	}
+
+	// Hold four connections at once and hand them back: only two may stay
+	// idle, and those are closed once they outlive ConnMaxLifetime.
+	var conns []*sql.Conn
+	for i := 0; i < 4; i++ {
+		conn, err := db.Conn(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+	if stats := db.Stats(); stats.Idle != 2 || stats.MaxIdleClosed != 2 {
+		t.Errorf("idle = %d, closed for the idle limit = %d; want 2 and 2", stats.Idle, stats.MaxIdleClosed)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if closed := db.Stats().MaxLifetimeClosed; closed == 0 {
+		t.Error("no connection was closed for exceeding ConnMaxLifetime")
+	}
+}
+
+// TestInitDBCanBeRetried checks that a failed startup ping comes back as an
+// error the caller can act on, and that a later attempt succeeds.
+func TestInitDBCanBeRetried(t *testing.T) {
+	mock := useMockDriver(t, "startup-retry")
+	mock.ExpectPing().WillReturnError(errors.New("dial tcp 127.0.0.1:3306: connect: connection refused"))
+	mock.ExpectPing()
+
+	if _, err := InitDB("startup-retry", PoolOptions{MaxOpenConns: 1}); err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Fatalf("first attempt err = %v, want the ping failure", err)
+	}
+
+	db, err := InitDB("startup-retry", PoolOptions{MaxOpenConns: 1})
+	if err != nil {
+		t.Fatalf("second attempt: %v", err)
+	}
+	db.Close()
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestInitDBRejectsBadDSN(t *testing.T) {
+	db, err := InitDB("not a dsn", PoolOptions{MaxOpenConns: 1})
+	if err == nil {
+		db.Close()
+		t.Fatal("InitDB accepted a malformed DSN")
+	}
+	if !strings.Contains(err.Error(), "veritabanına bağlanılamadı") {
+		t.Errorf("err = %v, want the open failure", err)
+	}
+}
+
+func TestRunMigrationsReturnsErrors(t *testing.T) {
+	t.Run("failed migration stops the run", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("sqlmock: %v", err)
+		}
+		defer db.Close()
+
+		mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_migrations").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT COALESCE(MAX(version), 0) FROM schema_migrations")).
+			WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(0))
+		mock.ExpectExec("CREATE TABLE IF NOT EXISTS users").WillReturnError(errors.New("access denied"))
+
+		err = RunMigrations(db)
+		if err == nil || !strings.Contains(err.Error(), "migration 1 (initial schema) hatası") || !strings.Contains(err.Error(), "access denied") {
+			t.Fatalf("err = %v, want the wrapped migration failure", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("failed seed is returned", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("sqlmock: %v", err)
+		}
+		defer db.Close()
+
+		mock.ExpectExec("INSERT IGNORE INTO roles").WillReturnError(errors.New("read-only"))
+
+		err = SeedReferenceData(db)
+		if err == nil || !strings.Contains(err.Error(), "rol verisi eklenemedi") {
+			t.Fatalf("err = %v, want the wrapped seed failure", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+}
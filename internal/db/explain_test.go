@@ -0,0 +1,130 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// historyQuery mirrors TransactionService.GetUserTransactions.
+const historyQuery = `SELECT id, from_user_id, to_user_id, amount, type, status, created_at
+	FROM transactions
+	WHERE from_user_id = ? OR to_user_id = ?
+	ORDER BY created_at DESC
+	LIMIT 20 OFFSET 0`
+
+// openSeededMySQL connects to the scratch database named by TEST_MYSQL_DSN,
+// migrates it and fills it with enough transactions for the optimizer to
+// prefer an index over a table scan. It skips when no database is configured.
+func openSeededMySQL(tb testing.TB) *sql.DB {
+	tb.Helper()
+	dsn := os.Getenv("TEST_MYSQL_DSN")
+	if dsn == "" {
+		tb.Skip("TEST_MYSQL_DSN not set")
+	}
+
+	db, err := InitDB(dsn, PoolOptions{MaxOpenConns: 4, MaxIdleConns: 4})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { db.Close() })
+
+	if err := RunMigrations(db); err != nil {
+		tb.Fatal(err)
+	}
+
+	const users, perBatch, batches = 200, 500, 40
+	for _, q := range []string{"DELETE FROM transactions", "DELETE FROM balance_history", "DELETE FROM balances", "DELETE FROM users"} {
+		if _, err := db.Exec(q); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	for i := 1; i <= users; i++ {
+		_, err := db.Exec("INSERT INTO users (id, username, email, password_hash, role) VALUES (?, ?, ?, 'x', 'user')",
+			i, fmt.Sprintf("user%d", i), fmt.Sprintf("user%d@example.com", i))
+		if err != nil {
+			tb.Fatal(err)
+		}
+	}
+	for b := 0; b < batches; b++ {
+		values := make([]string, 0, perBatch)
+		args := make([]interface{}, 0, perBatch*3)
+		for i := 0; i < perBatch; i++ {
+			n := b*perBatch + i
+			values = append(values, "(?, ?, 10.00, 'transfer', 'completed', NOW() - INTERVAL ? MINUTE)")
+			args = append(args, n%users+1, (n*7)%users+1, n)
+		}
+		_, err := db.Exec("INSERT INTO transactions (from_user_id, to_user_id, amount, type, status, created_at) VALUES "+strings.Join(values, ", "), args...)
+		if err != nil {
+			tb.Fatal(err)
+		}
+	}
+	if _, err := db.Exec("ANALYZE TABLE transactions"); err != nil {
+		tb.Fatal(err)
+	}
+	return db
+}
+
+// TestHistoryQueryUsesIndex runs EXPLAIN on the history query against a
+// seeded MySQL database and fails if the plan scans the whole table.
+func TestHistoryQueryUsesIndex(t *testing.T) {
+	db := openSeededMySQL(t)
+
+	rows, err := db.Query("EXPLAIN "+historyQuery, 42, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		values := make([]sql.NullString, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			t.Fatal(err)
+		}
+
+		plan := map[string]string{}
+		for i, column := range columns {
+			plan[column] = values[i].String
+		}
+		if plan["table"] != "transactions" {
+			continue
+		}
+		if plan["type"] == "ALL" || !strings.Contains(plan["key"], "idx_transactions_") {
+			t.Errorf("history query plan: type=%q key=%q extra=%q, want an idx_transactions_* index", plan["type"], plan["key"], plan["Extra"])
+		}
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func BenchmarkHistoryQuery(b *testing.B) {
+	db := openSeededMySQL(b)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		userID := i%200 + 1
+		rows, err := db.Query(historyQuery, userID, userID)
+		if err != nil {
+			b.Fatal(err)
+		}
+		count := 0
+		for rows.Next() {
+			count++
+		}
+		rows.Close()
+		if count == 0 {
+			b.Fatalf("no history for user %d", userID)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// migration is one ordered schema change. Each version is applied exactly once
+// and recorded in schema_migrations; never edit a migration that has shipped,
+// add a new one instead.
+type migration struct {
+	Version    int
+	Name       string
+	Statements []string
+}
+
+var migrations = []migration{
+	{
+		Version: 1,
+		Name:    "initial schema",
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS users (
+				id INT AUTO_INCREMENT PRIMARY KEY,
+				username VARCHAR(100),
+				email VARCHAR(100),
+				password_hash VARCHAR(255),
+				role VARCHAR(50),
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				updated_at DATETIME DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+			);`,
+			`CREATE TABLE IF NOT EXISTS transactions (
+				id INT AUTO_INCREMENT PRIMARY KEY,
+				from_user_id INT,
+				to_user_id INT,
+				amount DECIMAL(20,2),
+				type VARCHAR(50),
+				status VARCHAR(50),
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+			);`,
+			`CREATE TABLE IF NOT EXISTS balances (
+				user_id INT PRIMARY KEY,
+				amount DECIMAL(20,2),
+				last_updated_at DATETIME DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+			);`,
+			`CREATE TABLE IF NOT EXISTS balance_history (
+				id INT AUTO_INCREMENT PRIMARY KEY,
+				user_id INT NOT NULL,
+				balance DECIMAL(20,2) NOT NULL,
+				change_amount DECIMAL(20,2) NOT NULL,
+				transaction_id INT,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				INDEX idx_user_id (user_id),
+				INDEX idx_created_at (created_at),
+				FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+			);`,
+			`CREATE TABLE IF NOT EXISTS audit_logs (
+				id INT AUTO_INCREMENT PRIMARY KEY,
+				entity_type VARCHAR(50),
+				entity_id INT,
+				action VARCHAR(50),
+				details TEXT,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+			);`,
+		},
+	},
+	{
+		// Databases created before versioning have the version 1 tables
+		// only, so the columns and tables added since then are applied here.
+		Version: 2,
+		Name:    "soft delete, currencies, token and reference tables",
+		Statements: []string{
+			`ALTER TABLE users
+				ADD COLUMN deleted_at DATETIME NULL,
+				ADD UNIQUE KEY uq_users_email (email),
+				ADD UNIQUE KEY uq_users_username (username),
+				ADD INDEX idx_users_created_at (created_at);`,
+			`ALTER TABLE transactions
+				ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'USD' AFTER amount,
+				ADD COLUMN to_currency CHAR(3) NULL AFTER currency,
+				ADD COLUMN to_amount DECIMAL(20,2) NULL AFTER to_currency,
+				ADD COLUMN exchange_rate DECIMAL(20,8) NULL AFTER to_amount,
+				ADD COLUMN external_reference VARCHAR(255) NULL AFTER status,
+				ADD COLUMN parent_transaction_id INT NULL AFTER external_reference,
+				ADD INDEX idx_transactions_parent (parent_transaction_id);`,
+			`ALTER TABLE balances
+				ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'USD' AFTER user_id,
+				ADD COLUMN version INT NOT NULL DEFAULT 0 AFTER amount,
+				DROP PRIMARY KEY,
+				ADD PRIMARY KEY (user_id, currency);`,
+			`ALTER TABLE balance_history
+				ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'USD' AFTER user_id,
+				MODIFY created_at DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6);`,
+			`CREATE TABLE IF NOT EXISTS transaction_status_history (
+				id INT AUTO_INCREMENT PRIMARY KEY,
+				transaction_id INT NOT NULL,
+				from_status VARCHAR(50) NULL,
+				to_status VARCHAR(50) NOT NULL,
+				created_at DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+				INDEX idx_status_history_transaction (transaction_id)
+			);`,
+			`CREATE TABLE IF NOT EXISTS idempotency_keys (
+				id INT AUTO_INCREMENT PRIMARY KEY,
+				user_id INT NOT NULL,
+				idempotency_key VARCHAR(255) NOT NULL,
+				request_hash CHAR(64) NOT NULL,
+				transaction_id INT NOT NULL,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				UNIQUE KEY uniq_user_idempotency_key (user_id, idempotency_key)
+			);`,
+			`CREATE TABLE IF NOT EXISTS refresh_tokens (
+				jti VARCHAR(64) PRIMARY KEY,
+				user_id INT NOT NULL,
+				family_id VARCHAR(64) NOT NULL,
+				expires_at DATETIME NOT NULL,
+				revoked_at DATETIME NULL,
+				replaced_by VARCHAR(64) NULL,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				INDEX idx_refresh_tokens_family (family_id),
+				INDEX idx_refresh_tokens_user (user_id)
+			);`,
+			`CREATE TABLE IF NOT EXISTS password_resets (
+				id INT AUTO_INCREMENT PRIMARY KEY,
+				user_id INT NOT NULL,
+				token_hash CHAR(64) NOT NULL,
+				expires_at DATETIME NOT NULL,
+				used_at DATETIME NULL,
+				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				UNIQUE KEY uq_password_resets_token (token_hash),
+				INDEX idx_password_resets_user (user_id)
+			);`,
+			`CREATE TABLE IF NOT EXISTS system_settings (
+				setting_key VARCHAR(100) PRIMARY KEY,
+				setting_value TEXT NOT NULL,
+				updated_at DATETIME DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+			);`,
+			`CREATE TABLE IF NOT EXISTS roles (
+				name VARCHAR(50) PRIMARY KEY,
+				description VARCHAR(255)
+			);`,
+			`CREATE TABLE IF NOT EXISTS transaction_categories (
+				code VARCHAR(50) PRIMARY KEY,
+				name VARCHAR(100) NOT NULL
+			);`,
+		},
+	},
+	{
+		// The composite indexes serve the per-user history queries, which
+		// filter on either side and order by created_at, and also back the
+		// foreign keys.
+		Version: 3,
+		Name:    "transaction indexes and user foreign keys",
+		Statements: []string{
+			`ALTER TABLE transactions
+				ADD INDEX idx_transactions_from_user (from_user_id, created_at),
+				ADD INDEX idx_transactions_to_user (to_user_id, created_at),
+				ADD INDEX idx_transactions_created_at (created_at),
+				ADD CONSTRAINT fk_transactions_from_user FOREIGN KEY (from_user_id) REFERENCES users(id),
+				ADD CONSTRAINT fk_transactions_to_user FOREIGN KEY (to_user_id) REFERENCES users(id);`,
+		},
+	},
+	{
+		Version: 4,
+		Name:    "transaction failure reason",
+		Statements: []string{
+			`ALTER TABLE transactions ADD COLUMN failure_reason VARCHAR(255) NULL AFTER status;`,
+		},
+	},
+	{
+		Version: 5,
+		Name:    "user account status",
+		Statements: []string{
+			`ALTER TABLE users ADD COLUMN status VARCHAR(20) NOT NULL DEFAULT 'active' AFTER role;`,
+		},
+	},
+	{
+		Version: 6,
+		Name:    "balance overdraft limit",
+		Statements: []string{
+			`ALTER TABLE balances ADD COLUMN overdraft_limit DECIMAL(20,2) NOT NULL DEFAULT 0 AFTER amount;`,
+		},
+	},
+	{
+		Version: 7,
+		Name:    "revoked access tokens",
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS revoked_tokens (
+				jti VARCHAR(64) PRIMARY KEY,
+				user_id INT NOT NULL,
+				expires_at DATETIME NOT NULL,
+				revoked_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				INDEX idx_revoked_tokens_expires (expires_at)
+			);`,
+		},
+	},
+	{
+		Version: 8,
+		Name:    "login attempts",
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS login_attempts (
+				email VARCHAR(255) PRIMARY KEY,
+				failed_count INT NOT NULL,
+				first_failed_at DATETIME NOT NULL,
+				locked_until DATETIME NULL
+			);`,
+		},
+	},
+	{
+		Version: 9,
+		Name:    "totp two-factor authentication",
+		Statements: []string{
+			`ALTER TABLE users
+				ADD COLUMN totp_secret VARCHAR(64) NULL,
+				ADD COLUMN totp_enabled BOOLEAN NOT NULL DEFAULT FALSE,
+				ADD COLUMN totp_last_step BIGINT NULL;`,
+		},
+	},
+	{
+		Version: 10,
+		Name:    "transaction adjustment reason",
+		Statements: []string{
+			`ALTER TABLE transactions ADD COLUMN reason VARCHAR(255) NULL AFTER failure_reason;`,
+		},
+	},
+	{
+		Version: 11,
+		Name:    "transfer memo",
+		Statements: []string{
+			`ALTER TABLE transactions ADD COLUMN memo VARCHAR(140) NULL AFTER reason;`,
+		},
+	},
+	{
+		Version: 12,
+		Name:    "user profile details",
+		Statements: []string{
+			`ALTER TABLE users
+				ADD COLUMN full_name VARCHAR(100) NULL AFTER email,
+				ADD COLUMN phone VARCHAR(16) NULL AFTER full_name,
+				ADD COLUMN avatar_url VARCHAR(512) NULL AFTER phone;`,
+		},
+	},
+}
+
+// applyMigrations runs every migration newer than the highest recorded
+// version. MySQL commits DDL implicitly, so a migration is recorded only after
+// all of its statements have succeeded; a failure leaves it unrecorded and is
+// retried on the next boot.
+func applyMigrations(db *sql.DB, migrations []migration) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INT PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		applied_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);`)
+	if err != nil {
+		return fmt.Errorf("schema_migrations tablosu oluşturulamadı: %w", err)
+	}
+
+	current, err := SchemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.Version <= current {
+			continue
+		}
+
+		for _, q := range m.Statements {
+			if _, err := db.Exec(q); err != nil {
+				return fmt.Errorf("migration %d (%s) hatası: %w", m.Version, m.Name, err)
+			}
+		}
+
+		_, err := db.Exec("INSERT INTO schema_migrations (version, name) VALUES (?, ?)", m.Version, m.Name)
+		if err != nil {
+			return fmt.Errorf("migration %d kaydedilemedi: %w", m.Version, err)
+		}
+	}
+
+	return nil
+}
+
+// SchemaVersion returns the highest applied migration version, or 0 for an
+// empty database.
+func SchemaVersion(db *sql.DB) (int, error) {
+	return SchemaVersionContext(context.Background(), db)
+}
+
+func SchemaVersionContext(ctx context.Context, db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("şema sürümü okunamadı: %w", err)
+	}
+	return version, nil
+}
+
+// LatestSchemaVersion is the version a fully migrated database reports.
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
@@ -0,0 +1,88 @@
+package db
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+var (
+	createMigrationsTable = regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS schema_migrations")
+	selectSchemaVersion   = regexp.QuoteMeta("SELECT COALESCE(MAX(version), 0) FROM schema_migrations")
+	recordMigration       = regexp.QuoteMeta("INSERT INTO schema_migrations (version, name) VALUES (?, ?)")
+)
+
+func expectSchemaVersion(mock sqlmock.Sqlmock, version int) {
+	mock.ExpectExec(createMigrationsTable).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(selectSchemaVersion).WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(version))
+}
+
+func TestMigrationVersionsAreOrdered(t *testing.T) {
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Errorf("migrations[%d].Version = %d, want %d", i, m.Version, i+1)
+		}
+		if len(m.Statements) == 0 {
+			t.Errorf("migration %d has no statements", m.Version)
+		}
+	}
+}
+
+// TestApplyMigrationsRunsEachVersionOnce applies the full list to an empty
+// database and then runs again against the recorded version: the second run
+// only reads schema_migrations and executes nothing else.
+func TestApplyMigrationsRunsEachVersionOnce(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	expectSchemaVersion(mock, 0)
+	for _, m := range migrations {
+		for range m.Statements {
+			mock.ExpectExec(".+").WillReturnResult(sqlmock.NewResult(0, 0))
+		}
+		mock.ExpectExec(recordMigration).WithArgs(m.Version, m.Name).WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	if err := applyMigrations(db, migrations); err != nil {
+		t.Fatalf("first run: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("first run: %v", err)
+	}
+
+	expectSchemaVersion(mock, len(migrations))
+	if err := applyMigrations(db, migrations); err != nil {
+		t.Fatalf("second run: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("second run: %v", err)
+	}
+}
+
+func TestApplyMigrationsResumesFromRecordedVersion(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	steps := []migration{
+		{Version: 1, Name: "one", Statements: []string{"CREATE TABLE one (id INT)"}},
+		{Version: 2, Name: "two", Statements: []string{"ALTER TABLE one ADD COLUMN name VARCHAR(10)", "CREATE INDEX idx_one_name ON one (name)"}},
+	}
+
+	expectSchemaVersion(mock, 1)
+	mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE one ADD COLUMN name VARCHAR(10)")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("CREATE INDEX idx_one_name ON one (name)")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(recordMigration).WithArgs(2, "two").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := applyMigrations(db, steps); err != nil {
+		t.Fatalf("applyMigrations: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"go-projects/internal/apierror"
+	"go-projects/internal/middleware"
+	"go-projects/internal/models"
+	"go-projects/internal/services"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
+)
+
+type AdminHandler struct {
+	reconciliationService *services.ReconciliationService
+	userService           *services.UserService
+	balanceService        *services.BalanceService
+	killSwitchService     *services.KillSwitchService
+	logger                zerolog.Logger
+}
+
+func NewAdminHandler(db *sql.DB, logger zerolog.Logger, balanceService *services.BalanceService, killSwitchService *services.KillSwitchService) *AdminHandler {
+	return &AdminHandler{
+		reconciliationService: services.NewReconciliationService(db, logger, balanceService),
+		userService:           services.NewUserService(db, logger),
+		balanceService:        balanceService,
+		killSwitchService:     killSwitchService,
+		logger:                logger,
+	}
+}
+
+func (h *AdminHandler) ReconcileAll(w http.ResponseWriter, r *http.Request) {
+	repair := false
+	if repairStr := r.URL.Query().Get("repair"); repairStr != "" {
+		parsed, err := strconv.ParseBool(repairStr)
+		if err != nil {
+			apierror.Write(w, http.StatusBadRequest, "invalid_parameter", "repair must be true or false")
+			return
+		}
+		repair = parsed
+	}
+
+	report, err := h.reconciliationService.StartReconcileAll(repair)
+	if err != nil {
+		h.logger.Error().Err(err).Msg("Failed to start reconciliation")
+		apierror.Write(w, http.StatusInternalServerError, "reconciliation_failed", "Failed to start reconciliation")
+		return
+	}
+
+	respond(w, r, http.StatusAccepted, report)
+}
+
+func (h *AdminHandler) GetReconcileJob(w http.ResponseWriter, r *http.Request) {
+	jobID := mux.Vars(r)["id"]
+
+	report, err := h.reconciliationService.GetJob(jobID)
+	if err != nil {
+		apierror.Write(w, http.StatusNotFound, "job_not_found", "Reconciliation job not found")
+		return
+	}
+
+	respond(w, r, http.StatusOK, report)
+}
+
+func (h *AdminHandler) MergeUsers(w http.ResponseWriter, r *http.Request) {
+	var req models.MergeUsersRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondWithDecodeError(w, err)
+		return
+	}
+
+	adminID, ok := middleware.GetUserID(r)
+	if !ok {
+		apierror.Write(w, http.StatusUnauthorized, "unauthorized", "User not authenticated")
+		return
+	}
+
+	result, err := h.userService.MergeUsers(r.Context(), &req, adminID, h.balanceService)
+	if err != nil {
+		h.logger.Error().Err(err).Msg("User merge failed")
+		apierror.WriteError(w, err)
+		return
+	}
+
+	respond(w, r, http.StatusOK, result)
+}
+
+func (h *AdminHandler) GetKillSwitch(w http.ResponseWriter, r *http.Request) {
+	respond(w, r, http.StatusOK, h.killSwitchService.Status())
+}
+
+func (h *AdminHandler) ActivateKillSwitch(w http.ResponseWriter, r *http.Request) {
+	var req models.KillSwitchRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondWithDecodeError(w, err)
+		return
+	}
+
+	adminID, ok := middleware.GetUserID(r)
+	if !ok {
+		apierror.Write(w, http.StatusUnauthorized, "unauthorized", "User not authenticated")
+		return
+	}
+
+	if req.Reason == "" {
+		apierror.Write(w, http.StatusBadRequest, "missing_reason", "A reason is required to halt transactions")
+		return
+	}
+
+	status, err := h.killSwitchService.Activate(req.Reason, adminID)
+	if err != nil {
+		h.logger.Error().Err(err).Msg("Failed to activate kill switch")
+		apierror.Write(w, http.StatusInternalServerError, "kill_switch_failed", "Failed to activate kill switch")
+		return
+	}
+
+	respond(w, r, http.StatusOK, status)
+}
+
+func (h *AdminHandler) ClearKillSwitch(w http.ResponseWriter, r *http.Request) {
+	adminID, ok := middleware.GetUserID(r)
+	if !ok {
+		apierror.Write(w, http.StatusUnauthorized, "unauthorized", "User not authenticated")
+		return
+	}
+
+	status, err := h.killSwitchService.Clear(adminID)
+	if err != nil {
+		h.logger.Error().Err(err).Msg("Failed to clear kill switch")
+		apierror.Write(w, http.StatusInternalServerError, "kill_switch_failed", "Failed to clear kill switch")
+		return
+	}
+
+	respond(w, r, http.StatusOK, status)
+}
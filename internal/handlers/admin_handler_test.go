@@ -0,0 +1,25 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go-projects/internal/services"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
+)
+
+func TestGetReconcileJobUnknownID(t *testing.T) {
+	db, _ := newMockDB(t)
+	handler := NewAdminHandler(db, zerolog.Nop(), services.NewBalanceService(db, zerolog.Nop()), services.NewKillSwitchService(db, zerolog.Nop()))
+
+	req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/api/v1/admin/reconcile-all/missing", nil), map[string]string{"id": "missing"})
+	rec := httptest.NewRecorder()
+	handler.GetReconcileJob(rec, req)
+
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want 404", rec.Code)
+	}
+}
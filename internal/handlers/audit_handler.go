@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go-projects/internal/apierror"
+	"go-projects/internal/middleware"
+	"go-projects/internal/models"
+	"go-projects/internal/services"
+
+	"github.com/rs/zerolog"
+)
+
+type AuditHandler struct {
+	auditService *services.AuditService
+	logger       zerolog.Logger
+	maxPageSize  int
+}
+
+func NewAuditHandler(db *sql.DB, logger zerolog.Logger, maxPageSize int) *AuditHandler {
+	return &AuditHandler{
+		auditService: services.NewAuditService(db, logger),
+		logger:       logger,
+		maxPageSize:  maxPageSize,
+	}
+}
+
+func (h *AuditHandler) ListLogs(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	limit, offset, err := middleware.ParsePagination(r, h.maxPageSize)
+	if err != nil {
+		apierror.WriteError(w, err)
+		return
+	}
+
+	filter := models.AuditLogFilter{
+		EntityType: query.Get("entity_type"),
+		Action:     query.Get("action"),
+		Limit:      limit,
+		Offset:     offset,
+	}
+
+	if entityIDStr := query.Get("entity_id"); entityIDStr != "" {
+		entityID, err := strconv.Atoi(entityIDStr)
+		if err != nil {
+			apierror.Write(w, http.StatusBadRequest, "invalid_entity_id", "Invalid entity ID")
+			return
+		}
+		filter.EntityID = &entityID
+	}
+
+	if fromStr := query.Get("from"); fromStr != "" {
+		from, err := time.Parse(time.RFC3339, fromStr)
+		if err != nil {
+			apierror.Write(w, http.StatusBadRequest, "invalid_time", "Invalid from time. Use RFC3339 format")
+			return
+		}
+		filter.From = &from
+	}
+	if toStr := query.Get("to"); toStr != "" {
+		to, err := time.Parse(time.RFC3339, toStr)
+		if err != nil {
+			apierror.Write(w, http.StatusBadRequest, "invalid_time", "Invalid to time. Use RFC3339 format")
+			return
+		}
+		filter.To = &to
+	}
+
+	logs, total, err := h.auditService.ListLogs(filter)
+	if err != nil {
+		h.logger.Error().Err(err).Msg("Failed to list audit logs")
+		writeFetchError(w, err, "Failed to fetch audit logs")
+		return
+	}
+
+	respond(w, r, http.StatusOK, models.PaginatedResponse{
+		Items:      logs,
+		Limit:      filter.Limit,
+		Offset:     filter.Offset,
+		TotalCount: total,
+	})
+}
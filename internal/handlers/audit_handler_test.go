@@ -0,0 +1,25 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestListLogsRejectsBadFilters(t *testing.T) {
+	db, mock := newMockDB(t)
+	handler := NewAuditHandler(db, zerolog.Nop(), 100)
+
+	for _, query := range []string{"entity_id=abc", "from=yesterday", "to=2026-13-01"} {
+		rec := httptest.NewRecorder()
+		handler.ListLogs(rec, httptest.NewRequest(http.MethodGet, "/api/v1/audit-logs?"+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", query, rec.Code)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
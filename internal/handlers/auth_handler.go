@@ -2,9 +2,12 @@ package handlers
 
 import (
 	"database/sql"
-	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
+	"strings"
 
+	"go-projects/internal/apierror"
 	"go-projects/internal/middleware"
 	"go-projects/internal/models"
 	"go-projects/internal/services"
@@ -13,114 +16,302 @@ import (
 )
 
 type AuthHandler struct {
-	userService *services.UserService
-	authService *services.AuthService
-	logger      zerolog.Logger
+	userService       *services.UserService
+	authService       *services.AuthService
+	revocationService *services.TokenRevocationService
+	registration      services.RegistrationPolicy
+	logger            zerolog.Logger
 }
 
-func NewAuthHandler(db *sql.DB, logger zerolog.Logger) *AuthHandler {
+func NewAuthHandler(db *sql.DB, logger zerolog.Logger, authService *services.AuthService, revocationService *services.TokenRevocationService, registration services.RegistrationPolicy) *AuthHandler {
 	userService := services.NewUserService(db, logger)
-	authService := services.NewAuthService(logger)
 
 	return &AuthHandler{
-		userService: userService,
-		authService: authService,
-		logger:      logger,
+		userService:       userService,
+		authService:       authService,
+		revocationService: revocationService,
+		registration:      registration,
+		logger:            logger,
 	}
 }
 
 func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
 	var req models.RegisterRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		h.respondWithError(w, http.StatusBadRequest, "invalid_request", "Invalid request body")
+	if err := decodeJSON(r, &req); err != nil {
+		respondWithDecodeError(w, err)
 		return
 	}
 
-	user, err := h.userService.Register(&req)
-	if err != nil {
-		h.logger.Error().Err(err).Msg("Registration failed")
-		h.respondWithError(w, http.StatusBadRequest, "registration_failed", err.Error())
+	if !validRequest(w, &req) {
 		return
 	}
 
-	token, err := h.authService.GenerateToken(user.ID, user.Email, user.Role)
+	user, err := h.userService.Register(r.Context(), &req, h.registration)
 	if err != nil {
-		h.logger.Error().Err(err).Msg("Token generation failed")
-		h.respondWithError(w, http.StatusInternalServerError, "token_generation_failed", "Failed to generate token")
+		h.logger.Error().Err(err).Msg("Registration failed")
+		apierror.WriteError(w, err)
 		return
 	}
 
-	h.respondWithJSON(w, http.StatusCreated, models.AuthResponse{
-		User:  user,
-		Token: token,
-	})
+	h.respondWithTokens(w, r, http.StatusCreated, user)
 }
 
 func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 	var req models.LoginRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		h.respondWithError(w, http.StatusBadRequest, "invalid_request", "Invalid request body")
+	if err := decodeJSON(r, &req); err != nil {
+		respondWithDecodeError(w, err)
+		return
+	}
+
+	if !validRequest(w, &req) {
 		return
 	}
 
-	user, err := h.userService.Authenticate(&req)
+	user, err := h.userService.Authenticate(r.Context(), &req)
+	if errors.Is(err, services.ErrAccountLocked) {
+		h.logger.Warn().Str("email", req.Email).Msg("Login refused, account locked")
+		apierror.WriteError(w, err)
+		return
+	}
 	if err != nil {
 		h.logger.Warn().Str("email", req.Email).Msg("Login failed")
-		h.respondWithError(w, http.StatusUnauthorized, "authentication_failed", "Invalid email or password")
+		apierror.Write(w, http.StatusUnauthorized, "authentication_failed", "Invalid email or password")
 		return
 	}
 
-	token, err := h.authService.GenerateToken(user.ID, user.Email, user.Role)
+	if err := h.authService.VerifyLoginTOTP(r.Context(), user, req.TOTPCode); err != nil {
+		h.logger.Warn().Err(err).Int("user_id", user.ID).Msg("Login second factor failed")
+		apierror.WriteError(w, err)
+		return
+	}
+
+	h.respondWithTokens(w, r, http.StatusOK, user)
+}
+
+func (h *AuthHandler) EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.GetUserID(r)
+	if !ok {
+		apierror.Write(w, http.StatusUnauthorized, "unauthorized", "User not authenticated")
+		return
+	}
+
+	enrollment, err := h.authService.EnrollTOTP(r.Context(), userID)
 	if err != nil {
-		h.logger.Error().Err(err).Msg("Token generation failed")
-		h.respondWithError(w, http.StatusInternalServerError, "token_generation_failed", "Failed to generate token")
+		apierror.WriteError(w, err)
 		return
 	}
 
-	h.respondWithJSON(w, http.StatusOK, models.AuthResponse{
-		User:  user,
-		Token: token,
-	})
+	respond(w, r, http.StatusOK, enrollment)
 }
 
-func (h *AuthHandler) Refresh(w http.ResponseWriter, r *http.Request) {
+func (h *AuthHandler) ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
 	userID, ok := middleware.GetUserID(r)
 	if !ok {
-		h.respondWithError(w, http.StatusUnauthorized, "unauthorized", "User not authenticated")
+		apierror.Write(w, http.StatusUnauthorized, "unauthorized", "User not authenticated")
 		return
 	}
 
-	user, err := h.userService.GetUserByID(userID)
+	var req models.TOTPConfirmRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondWithDecodeError(w, err)
+		return
+	}
+	if !validRequest(w, &req) {
+		return
+	}
+
+	if err := h.authService.ConfirmTOTP(r.Context(), userID, req.Code); err != nil {
+		apierror.WriteError(w, err)
+		return
+	}
+
+	respond(w, r, http.StatusOK, map[string]string{
+		"message": "Two-factor authentication enabled",
+	})
+}
+
+func (h *AuthHandler) Refresh(w http.ResponseWriter, r *http.Request) {
+	var req models.RefreshRequest
+	if err := decodeJSON(r, &req); err != nil && err != io.EOF {
+		respondWithDecodeError(w, err)
+		return
+	}
+
+	if req.RefreshToken == "" {
+		if cookie, err := r.Cookie("refresh_token"); err == nil {
+			req.RefreshToken = cookie.Value
+		}
+	}
+
+	if req.RefreshToken == "" {
+		apierror.Write(w, http.StatusBadRequest, "missing_refresh_token", "Refresh token is required")
+		return
+	}
+
+	resp, err := h.authService.RefreshToken(r.Context(), req.RefreshToken)
 	if err != nil {
-		h.respondWithError(w, http.StatusNotFound, "user_not_found", "User not found")
+		h.logger.Warn().Err(err).Msg("Refresh token rejected")
+		if _, ok := apierror.FromError(err); ok {
+			apierror.WriteError(w, err)
+			return
+		}
+		apierror.Write(w, http.StatusInternalServerError, "refresh_failed", "Failed to refresh token")
 		return
 	}
 
-	token, err := h.authService.GenerateToken(user.ID, user.Email, user.Role)
+	respond(w, r, http.StatusOK, resp)
+}
+
+func (h *AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetTokenClaims(r)
+	if !ok {
+		apierror.Write(w, http.StatusUnauthorized, "unauthorized", "User not authenticated")
+		return
+	}
+	if claims.ID == "" || claims.ExpiresAt == nil {
+		apierror.Write(w, http.StatusBadRequest, "token_not_revocable", "Token cannot be revoked; it will expire on its own")
+		return
+	}
+
+	err := h.revocationService.Revoke(r.Context(), claims.ID, claims.UserID, claims.ExpiresAt.Time)
 	if err != nil {
-		h.logger.Error().Err(err).Msg("Token generation failed")
-		h.respondWithError(w, http.StatusInternalServerError, "token_generation_failed", "Failed to generate token")
+		apierror.Write(w, http.StatusInternalServerError, "logout_failed", "Failed to log out")
 		return
 	}
 
-	h.respondWithJSON(w, http.StatusOK, models.AuthResponse{
-		User:  user,
-		Token: token,
+	if err := h.authService.RevokeRefreshTokens(r.Context(), claims.UserID); err != nil {
+		apierror.Write(w, http.StatusInternalServerError, "logout_failed", "Failed to log out")
+		return
+	}
+
+	respond(w, r, http.StatusOK, map[string]string{
+		"message": "Logged out",
 	})
 }
 
-func (h *AuthHandler) respondWithError(w http.ResponseWriter, code int, errorCode, message string) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(code)
-	json.NewEncoder(w).Encode(map[string]string{
-		"error":   errorCode,
-		"message": message,
+// ValidateToken lets gateways introspect an access token taken from the body
+// or, failing that, the Authorization header.
+func (h *AuthHandler) ValidateToken(w http.ResponseWriter, r *http.Request) {
+	var req models.ValidateTokenRequest
+	if err := decodeJSON(r, &req); err != nil && err != io.EOF {
+		respondWithDecodeError(w, err)
+		return
+	}
+
+	if req.Token == "" {
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			req.Token = token
+		}
+	}
+
+	if req.Token == "" {
+		apierror.Write(w, http.StatusBadRequest, "missing_token", "Token is required")
+		return
+	}
+
+	claims, err := h.authService.ValidateToken(req.Token)
+	if err != nil || claims.TokenType == services.TokenTypeRefresh {
+		apierror.Write(w, http.StatusUnauthorized, "invalid_token", "Invalid or expired token")
+		return
+	}
+
+	if claims.ID != "" {
+		revoked, err := h.revocationService.IsRevoked(r.Context(), claims.ID)
+		if err != nil {
+			h.logger.Error().Err(err).Msg("Token revocation check failed")
+			apierror.Write(w, http.StatusServiceUnavailable, "token_check_failed", "Unable to verify token")
+			return
+		}
+		if revoked {
+			apierror.Write(w, http.StatusUnauthorized, "token_revoked", "Token has been revoked")
+			return
+		}
+	}
+
+	info := models.TokenInfo{
+		Valid:  true,
+		UserID: claims.UserID,
+		Email:  claims.Email,
+		Role:   claims.Role,
+	}
+	if claims.ExpiresAt != nil {
+		info.ExpiresAt = &claims.ExpiresAt.Time
+	}
+
+	respond(w, r, http.StatusOK, info)
+}
+
+func (h *AuthHandler) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var req models.ForgotPasswordRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondWithDecodeError(w, err)
+		return
+	}
+
+	if !validRequest(w, &req) {
+		return
+	}
+
+	if err := h.userService.RequestPasswordReset(r.Context(), req.Email); err != nil {
+		h.logger.Error().Err(err).Msg("Password reset request failed")
+		apierror.Write(w, http.StatusInternalServerError, "reset_failed", "Failed to process password reset request")
+		return
+	}
+
+	respond(w, r, http.StatusAccepted, map[string]string{
+		"message": "If the email is registered, a password reset link has been sent",
 	})
 }
 
-func (h *AuthHandler) respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(code)
-	json.NewEncoder(w).Encode(payload)
+func (h *AuthHandler) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var req models.ResetPasswordRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondWithDecodeError(w, err)
+		return
+	}
+
+	if !validRequest(w, &req) {
+		return
+	}
+
+	err := h.userService.ResetPassword(r.Context(), req.Token, req.NewPassword)
+	if err != nil {
+		if _, ok := apierror.FromError(err); ok {
+			apierror.WriteError(w, err)
+			return
+		}
+		h.logger.Error().Err(err).Msg("Password reset failed")
+		apierror.Write(w, http.StatusInternalServerError, "reset_failed", "Failed to reset password")
+		return
+	}
+
+	respond(w, r, http.StatusOK, map[string]string{
+		"message": "Password has been reset",
+	})
+}
+
+func (h *AuthHandler) respondWithTokens(w http.ResponseWriter, r *http.Request, code int, user *models.User) {
+	token, err := h.authService.GenerateToken(user.ID, user.Email, user.Role)
+	if err != nil {
+		h.logger.Error().Err(err).Msg("Token generation failed")
+		apierror.Write(w, http.StatusInternalServerError, "token_generation_failed", "Failed to generate token")
+		return
+	}
+
+	refreshToken, err := h.authService.GenerateRefreshToken(user.ID)
+	if err != nil {
+		h.logger.Error().Err(err).Msg("Refresh token generation failed")
+		apierror.Write(w, http.StatusInternalServerError, "token_generation_failed", "Failed to generate token")
+		return
+	}
+
+	if code == http.StatusCreated {
+		w.Header().Set("Location", userLocation(user.ID))
+	}
+	respond(w, r, code, models.AuthResponse{
+		User:         user,
+		Token:        token,
+		RefreshToken: refreshToken,
+	})
 }
 
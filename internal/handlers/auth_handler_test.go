@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"go-projects/internal/middleware"
+	"go-projects/internal/models"
+	"go-projects/internal/services"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog"
+)
+
+func TestRegisterSetsLocation(t *testing.T) {
+	db, mock := newMockDB(t)
+	handler := NewAuthHandler(db, zerolog.Nop(), newTestAuthService(t, db, services.TokenConfig{Secret: "handler-test-secret", AccessTTL: time.Hour, RefreshTTL: time.Hour}), services.NewTokenRevocationService(db, zerolog.Nop()), services.RegistrationPolicy{})
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id FROM users WHERE email = ? OR username = ?")).
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO users")).WillReturnResult(sqlmock.NewResult(42, 1))
+	mock.ExpectQuery(regexp.QuoteMeta("FROM users WHERE id = ?")).WithArgs(42).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "email", "full_name", "phone", "avatar_url", "password_hash", "role", "status", "created_at", "updated_at"}).
+			AddRow(42, "eve", "eve@example.com", nil, nil, nil, "hash", "user", "active", time.Now(), time.Now()))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO refresh_tokens")).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/auth/register",
+		strings.NewReader(`{"username":"eve","email":"eve@example.com","password":"password123"}`))
+	rec := httptest.NewRecorder()
+	handler.Register(rec, req)
+
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status = %d (%s), want 201", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("Location"); got != "/api/v1/users/42" {
+		t.Errorf("Location = %q, want /api/v1/users/42", got)
+	}
+}
+
+func TestLogoutRevokesAccessAndRefreshTokens(t *testing.T) {
+	db, mock := newMockDB(t)
+	handler := NewAuthHandler(db, zerolog.Nop(), newTestAuthService(t, db, services.TokenConfig{Secret: "handler-test-secret", AccessTTL: time.Hour, RefreshTTL: time.Hour}), services.NewTokenRevocationService(db, zerolog.Nop()), services.RegistrationPolicy{})
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	mock.ExpectExec(regexp.QuoteMeta("INSERT IGNORE INTO revoked_tokens (jti, user_id, expires_at) VALUES (?, ?, ?)")).
+		WithArgs("access-jti", 7, expires).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM revoked_tokens WHERE expires_at < ?")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE refresh_tokens SET revoked_at = NOW() WHERE user_id = ? AND revoked_at IS NULL")).
+		WithArgs(7).WillReturnResult(sqlmock.NewResult(0, 2))
+
+	claims := &middleware.Claims{
+		UserID:           7,
+		Role:             "user",
+		RegisteredClaims: jwt.RegisteredClaims{ID: "access-jti", ExpiresAt: jwt.NewNumericDate(expires)},
+	}
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/auth/logout", nil)
+	req = req.WithContext(context.WithValue(req.Context(), middleware.TokenClaimsKey, claims))
+	rec := httptest.NewRecorder()
+	handler.Logout(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d (%s), want 200", rec.Code, rec.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestValidateToken(t *testing.T) {
+	db, mock := newMockDB(t)
+	handler := NewAuthHandler(db, zerolog.Nop(), newTestAuthService(t, db, services.TokenConfig{Secret: "handler-test-secret", AccessTTL: time.Hour, RefreshTTL: time.Hour}), services.NewTokenRevocationService(db, zerolog.Nop()), services.RegistrationPolicy{})
+
+	valid, err := newTestAuthService(t, db, services.TokenConfig{Secret: "handler-test-secret", AccessTTL: time.Hour}).GenerateToken(7, "eve@example.com", "merchant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := newTestAuthService(t, db, services.TokenConfig{Secret: "handler-test-secret", AccessTTL: -time.Minute}).GenerateToken(7, "eve@example.com", "merchant")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	validate := func(body, authorization string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/auth/validate", strings.NewReader(body))
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		rec := httptest.NewRecorder()
+		handler.ValidateToken(rec, req)
+		return rec
+	}
+
+	for _, tt := range []struct {
+		name, body, authorization string
+	}{
+		{"body", `{"token":"` + valid + `"}`, ""},
+		{"header", "", "Bearer " + valid},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mock.ExpectQuery(regexp.QuoteMeta("SELECT 1 FROM revoked_tokens WHERE jti = ?")).WillReturnError(sql.ErrNoRows)
+
+			res := validate(tt.body, tt.authorization)
+			if res.Code != http.StatusOK {
+				t.Fatalf("status = %d (%s), want 200", res.Code, res.Body.String())
+			}
+			var info models.TokenInfo
+			if err := json.NewDecoder(res.Body).Decode(&info); err != nil {
+				t.Fatal(err)
+			}
+			if !info.Valid || info.UserID != 7 || info.Email != "eve@example.com" || info.Role != "merchant" {
+				t.Errorf("info = %+v, want the token's claims", info)
+			}
+			if info.ExpiresAt == nil || time.Until(*info.ExpiresAt) <= 0 {
+				t.Errorf("expires_at = %v, want a future expiry", info.ExpiresAt)
+			}
+		})
+	}
+
+	t.Run("expired", func(t *testing.T) {
+		if res := validate(`{"token":"`+expired+`"}`, ""); res.Code != http.StatusUnauthorized {
+			t.Errorf("status = %d, want 401", res.Code)
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		if res := validate("", ""); res.Code != http.StatusBadRequest {
+			t.Errorf("status = %d, want 400", res.Code)
+		}
+	})
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -1,41 +1,101 @@
 package handlers
 
 import (
-	"database/sql"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
 	"strconv"
 	"time"
 
+	"go-projects/internal/apierror"
 	"go-projects/internal/middleware"
+	"go-projects/internal/models"
 	"go-projects/internal/services"
 
+	"github.com/gorilla/mux"
 	"github.com/rs/zerolog"
 )
 
 type BalanceHandler struct {
 	balanceService *services.BalanceService
 	logger         zerolog.Logger
+	maxPageSize    int
+	draining       <-chan struct{}
 }
 
-func NewBalanceHandler(db *sql.DB, logger zerolog.Logger) *BalanceHandler {
+func NewBalanceHandler(balanceService *services.BalanceService, logger zerolog.Logger, maxPageSize int, draining <-chan struct{}) *BalanceHandler {
 	return &BalanceHandler{
-		balanceService: services.NewBalanceService(db, logger),
+		balanceService: balanceService,
 		logger:         logger,
+		maxPageSize:    maxPageSize,
+		draining:       draining,
+	}
+}
+
+// streamHeartbeatInterval keeps idle event streams from being closed by
+// proxies.
+const streamHeartbeatInterval = 15 * time.Second
+
+// StreamBalance pushes the caller's balance as Server-Sent Events each time
+// a change to it commits. The stream ends when the client disconnects or the
+// server starts draining.
+func (h *BalanceHandler) StreamBalance(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.GetUserID(r)
+	if !ok {
+		apierror.Write(w, http.StatusUnauthorized, "unauthorized", "User not authenticated")
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		apierror.Write(w, http.StatusInternalServerError, "streaming_unsupported", "Streaming is not supported")
+		return
+	}
+
+	updates, unsubscribe := h.balanceService.SubscribeUpdates(userID)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, ": connected\n\n")
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-h.draining:
+			return
+		case <-heartbeat.C:
+			io.WriteString(w, ": heartbeat\n\n")
+		case update := <-updates:
+			data, err := json.Marshal(update)
+			if err != nil {
+				h.logger.Error().Err(err).Msg("Failed to encode balance update")
+				continue
+			}
+			fmt.Fprintf(w, "event: balance\ndata: %s\n\n", data)
+		}
+		flusher.Flush()
 	}
 }
 
 func (h *BalanceHandler) GetCurrentBalance(w http.ResponseWriter, r *http.Request) {
 	currentUserID, ok := middleware.GetUserID(r)
 	if !ok {
-		h.respondWithError(w, http.StatusUnauthorized, "unauthorized", "User not authenticated")
+		apierror.Write(w, http.StatusUnauthorized, "unauthorized", "User not authenticated")
 		return
 	}
 
-	userRole, _ := middleware.GetUserRole(r)
-	
 	var userID int
-	if userRole == "admin" {
+	if middleware.IsAdmin(r) {
 		userIDStr := r.URL.Query().Get("user_id")
 		if userIDStr != "" {
 			if uid, err := strconv.Atoi(userIDStr); err == nil {
@@ -50,44 +110,44 @@ func (h *BalanceHandler) GetCurrentBalance(w http.ResponseWriter, r *http.Reques
 		userID = currentUserID
 	}
 
-	balance, err := h.balanceService.GetBalance(userID)
+	currency, err := queryCurrency(r)
+	if err != nil {
+		apierror.WriteError(w, err)
+		return
+	}
+
+	balance, err := h.balanceService.GetBalance(r.Context(), userID, currency)
 	if err != nil {
 		h.logger.Error().Err(err).Msg("Failed to fetch balance")
-		h.respondWithError(w, http.StatusInternalServerError, "fetch_failed", "Failed to fetch balance")
+		writeFetchError(w, err, "Failed to fetch balance")
+		return
+	}
+
+	// last_updated_at only has second precision; the row version changes on
+	// every write, so two updates within a second still yield a new tag.
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if notModified(w, r, weakETag(balance.UserID, balance.Currency, balance.Version, balance.Amount, balance.LastUpdatedAt.UnixNano())) {
 		return
 	}
 
-	h.respondWithJSON(w, http.StatusOK, balance)
+	respond(w, r, http.StatusOK, balance)
 }
 
 func (h *BalanceHandler) GetHistoricalBalance(w http.ResponseWriter, r *http.Request) {
 	currentUserID, ok := middleware.GetUserID(r)
 	if !ok {
-		h.respondWithError(w, http.StatusUnauthorized, "unauthorized", "User not authenticated")
+		apierror.Write(w, http.StatusUnauthorized, "unauthorized", "User not authenticated")
 		return
 	}
 
-	limitStr := r.URL.Query().Get("limit")
-	offsetStr := r.URL.Query().Get("offset")
-
-	limit := 50 // default
-	offset := 0 // default
-
-	if limitStr != "" {
-		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
-			limit = l
-		}
-	}
-	if offsetStr != "" {
-		if o, err := strconv.Atoi(offsetStr); err == nil && o >= 0 {
-			offset = o
-		}
+	limit, offset, err := middleware.ParsePagination(r, h.maxPageSize)
+	if err != nil {
+		apierror.WriteError(w, err)
+		return
 	}
 
-	userRole, _ := middleware.GetUserRole(r)
-	
 	var userID int
-	if userRole == "admin" {
+	if middleware.IsAdmin(r) {
 		userIDStr := r.URL.Query().Get("user_id")
 		if userIDStr != "" {
 			if uid, err := strconv.Atoi(userIDStr); err == nil {
@@ -102,39 +162,37 @@ func (h *BalanceHandler) GetHistoricalBalance(w http.ResponseWriter, r *http.Req
 		userID = currentUserID
 	}
 
-	history, err := h.balanceService.GetBalanceHistory(userID, limit, offset)
+	history, err := h.balanceService.GetBalanceHistory(r.Context(), userID, limit, offset)
 	if err != nil {
 		h.logger.Error().Err(err).Msg("Failed to fetch balance history")
-		h.respondWithError(w, http.StatusInternalServerError, "fetch_failed", "Failed to fetch balance history")
+		writeFetchError(w, err, "Failed to fetch balance history")
 		return
 	}
 
-	h.respondWithJSON(w, http.StatusOK, history)
+	respond(w, r, http.StatusOK, history)
 }
 
 func (h *BalanceHandler) GetBalanceAtTime(w http.ResponseWriter, r *http.Request) {
 	currentUserID, ok := middleware.GetUserID(r)
 	if !ok {
-		h.respondWithError(w, http.StatusUnauthorized, "unauthorized", "User not authenticated")
+		apierror.Write(w, http.StatusUnauthorized, "unauthorized", "User not authenticated")
 		return
 	}
 
 	timeStr := r.URL.Query().Get("time")
 	if timeStr == "" {
-		h.respondWithError(w, http.StatusBadRequest, "missing_parameter", "time parameter is required")
+		apierror.Write(w, http.StatusBadRequest, "missing_parameter", "time parameter is required")
 		return
 	}
 
 	targetTime, err := time.Parse(time.RFC3339, timeStr)
 	if err != nil {
-		h.respondWithError(w, http.StatusBadRequest, "invalid_time", "Invalid time format. Use RFC3339 format")
+		apierror.Write(w, http.StatusBadRequest, "invalid_time", "Invalid time format. Use RFC3339 format")
 		return
 	}
 
-	userRole, _ := middleware.GetUserRole(r)
-	
 	var userID int
-	if userRole == "admin" {
+	if middleware.IsAdmin(r) {
 		userIDStr := r.URL.Query().Get("user_id")
 		if userIDStr != "" {
 			if uid, err := strconv.Atoi(userIDStr); err == nil {
@@ -149,32 +207,195 @@ func (h *BalanceHandler) GetBalanceAtTime(w http.ResponseWriter, r *http.Request
 		userID = currentUserID
 	}
 
-	balance, err := h.balanceService.GetBalanceAtTime(userID, targetTime)
+	currency, err := queryCurrency(r)
+	if err != nil {
+		apierror.WriteError(w, err)
+		return
+	}
+
+	balance, err := h.balanceService.GetBalanceAtTime(r.Context(), userID, currency, targetTime)
 	if err != nil {
 		h.logger.Error().Err(err).Msg("Failed to fetch balance at time")
-		h.respondWithError(w, http.StatusInternalServerError, "fetch_failed", "Failed to fetch balance at time")
+		writeFetchError(w, err, "Failed to fetch balance at time")
 		return
 	}
 
-	h.respondWithJSON(w, http.StatusOK, map[string]interface{}{
+	respond(w, r, http.StatusOK, map[string]interface{}{
 		"user_id":    userID,
+		"currency":   currency,
 		"balance":    balance,
 		"at_time":    targetTime,
 	})
 }
 
-func (h *BalanceHandler) respondWithError(w http.ResponseWriter, code int, errorCode, message string) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(code)
-	json.NewEncoder(w).Encode(map[string]string{
-		"error":   errorCode,
-		"message": message,
+var timelineIntervals = map[string]time.Duration{
+	"hour": time.Hour,
+	"day":  24 * time.Hour,
+	"week": 7 * 24 * time.Hour,
+}
+
+func (h *BalanceHandler) GetBalanceTimeline(w http.ResponseWriter, r *http.Request) {
+	currentUserID, ok := middleware.GetUserID(r)
+	if !ok {
+		apierror.Write(w, http.StatusUnauthorized, "unauthorized", "User not authenticated")
+		return
+	}
+
+	query := r.URL.Query()
+
+	intervalName := query.Get("interval")
+	if intervalName == "" {
+		intervalName = "day"
+	}
+	interval, ok := timelineIntervals[intervalName]
+	if !ok {
+		apierror.Write(w, http.StatusBadRequest, "invalid_interval", "interval must be hour, day or week")
+		return
+	}
+
+	if query.Get("from") == "" || query.Get("to") == "" {
+		apierror.Write(w, http.StatusBadRequest, "missing_parameter", "from and to parameters are required")
+		return
+	}
+
+	from, err := time.Parse(time.RFC3339, query.Get("from"))
+	if err != nil {
+		apierror.Write(w, http.StatusBadRequest, "invalid_time", "Invalid from time. Use RFC3339 format")
+		return
+	}
+	to, err := time.Parse(time.RFC3339, query.Get("to"))
+	if err != nil {
+		apierror.Write(w, http.StatusBadRequest, "invalid_time", "Invalid to time. Use RFC3339 format")
+		return
+	}
+	if from.After(to) {
+		apierror.Write(w, http.StatusBadRequest, "invalid_range", "from must be before to")
+		return
+	}
+
+	userID := currentUserID
+	if middleware.IsAdmin(r) {
+		if uid, err := strconv.Atoi(query.Get("user_id")); err == nil {
+			userID = uid
+		}
+	}
+
+	currency, err := queryCurrency(r)
+	if err != nil {
+		apierror.WriteError(w, err)
+		return
+	}
+
+	points, err := h.balanceService.GetBalanceTimeline(r.Context(), userID, currency, from, to, interval)
+	if err != nil {
+		h.logger.Error().Err(err).Msg("Failed to build balance timeline")
+		writeFetchError(w, err, "Failed to fetch balance timeline")
+		return
+	}
+
+	respond(w, r, http.StatusOK, map[string]interface{}{
+		"user_id":  userID,
+		"currency": currency,
+		"interval": intervalName,
+		"from":     from,
+		"to":       to,
+		"points":   points,
+	})
+}
+
+func (h *BalanceHandler) ReconcileBalance(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(mux.Vars(r)["userID"])
+	if err != nil {
+		apierror.Write(w, http.StatusBadRequest, "invalid_user_id", "Invalid user ID")
+		return
+	}
+
+	correct := false
+	if correctStr := r.URL.Query().Get("correct"); correctStr != "" {
+		correct, err = strconv.ParseBool(correctStr)
+		if err != nil {
+			apierror.Write(w, http.StatusBadRequest, "invalid_parameter", "correct must be true or false")
+			return
+		}
+	}
+
+	currency, err := queryCurrency(r)
+	if err != nil {
+		apierror.WriteError(w, err)
+		return
+	}
+
+	currentUserID, _ := middleware.GetUserID(r)
+
+	result, err := h.balanceService.ReconcileBalance(r.Context(), userID, currency, correct, currentUserID)
+	if err != nil {
+		h.logger.Error().Err(err).Int("user_id", userID).Msg("Balance reconciliation failed")
+		apierror.Write(w, http.StatusInternalServerError, "reconcile_failed", "Failed to reconcile balance")
+		return
+	}
+
+	respond(w, r, http.StatusOK, result)
+}
+func (h *BalanceHandler) GetBulkBalances(w http.ResponseWriter, r *http.Request) {
+	var req models.BulkBalanceRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondWithDecodeError(w, err)
+		return
+	}
+	if !validRequest(w, &req) {
+		return
+	}
+
+	currency, err := models.NormalizeCurrency(req.Currency)
+	if err != nil {
+		apierror.WriteError(w, err)
+		return
+	}
+
+	balances, missing, err := h.balanceService.GetBalances(r.Context(), req.UserIDs, currency)
+	if err != nil {
+		h.logger.Error().Err(err).Msg("Failed to fetch balances")
+		writeFetchError(w, err, "Failed to fetch balances")
+		return
+	}
+
+	respond(w, r, http.StatusOK, models.BulkBalanceResponse{
+		Currency: currency,
+		Balances: balances,
+		Missing:  missing,
 	})
 }
 
-func (h *BalanceHandler) respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(code)
-	json.NewEncoder(w).Encode(payload)
+func (h *BalanceHandler) SetOverdraftLimit(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(mux.Vars(r)["userID"])
+	if err != nil {
+		apierror.Write(w, http.StatusBadRequest, "invalid_user_id", "Invalid user ID")
+		return
+	}
+
+	var req models.OverdraftLimitRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondWithDecodeError(w, err)
+		return
+	}
+	if !validRequest(w, &req) {
+		return
+	}
+
+	currency, err := models.NormalizeCurrency(req.Currency)
+	if err != nil {
+		apierror.WriteError(w, err)
+		return
+	}
+
+	currentUserID, _ := middleware.GetUserID(r)
+
+	balance, err := h.balanceService.SetOverdraftLimit(r.Context(), userID, currency, req.OverdraftLimit, currentUserID)
+	if err != nil {
+		apierror.WriteError(w, err)
+		return
+	}
+
+	respond(w, r, http.StatusOK, balance)
 }
 
@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"go-projects/internal/models"
+	"go-projects/internal/services"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/rs/zerolog"
+)
+
+var balanceQuery = regexp.QuoteMeta("SELECT user_id, currency, amount, overdraft_limit, version, last_updated_at FROM balances WHERE user_id = ? AND currency = ?")
+
+func balanceRow(version int, updated time.Time) *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"user_id", "currency", "amount", "overdraft_limit", "version", "last_updated_at"}).
+		AddRow(2, "USD", "40.00", 0, version, updated)
+}
+
+func TestGetCurrentBalanceETag(t *testing.T) {
+	db, mock := newMockDB(t)
+	handler := NewBalanceHandler(services.NewBalanceService(db, zerolog.Nop()), zerolog.Nop(), 100, nil)
+	updated := time.Date(2026, 9, 1, 12, 0, 0, 0, time.UTC)
+	get := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/balances/current", nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rec := httptest.NewRecorder()
+		handler.GetCurrentBalance(rec, withUser(req, 2, "user"))
+		return rec
+	}
+
+	mock.ExpectQuery(balanceQuery).WithArgs(2, "USD").WillReturnRows(balanceRow(3, updated))
+	first := get("")
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" {
+		t.Fatalf("first read = %d with ETag %q, want 200 with an ETag", first.Code, etag)
+	}
+	if cc := first.Header().Get("Cache-Control"); cc != "private, no-cache" {
+		t.Errorf("Cache-Control = %q, want private, no-cache", cc)
+	}
+
+	mock.ExpectQuery(balanceQuery).WithArgs(2, "USD").WillReturnRows(balanceRow(3, updated))
+	if rec := get(etag); rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Errorf("unchanged balance = %d with %d body bytes, want an empty 304", rec.Code, rec.Body.Len())
+	}
+
+	// A write within the same second bumps only the version.
+	mock.ExpectQuery(balanceQuery).WithArgs(2, "USD").WillReturnRows(balanceRow(4, updated))
+	if rec := get(etag); rec.Code != http.StatusOK || rec.Header().Get("ETag") == etag {
+		t.Errorf("changed balance = %d with ETag %q, want 200 with a new tag", rec.Code, rec.Header().Get("ETag"))
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStreamBalanceDeliversCommittedUpdates(t *testing.T) {
+	db, mock := newMockDB(t)
+	balances := services.NewBalanceService(db, zerolog.Nop())
+	draining := make(chan struct{})
+	handler := NewBalanceHandler(balances, zerolog.Nop(), 100, draining)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.StreamBalance(w, withUser(r, 2, "user"))
+	}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q, want text/event-stream", ct)
+	}
+	events := bufio.NewReader(resp.Body)
+	if line, _ := events.ReadString('\n'); line != ": connected\n" {
+		t.Fatalf("first line = %q, want the connected comment", line)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT amount, overdraft_limit, version FROM balances")).WithArgs(2, "USD").
+		WillReturnRows(sqlmock.NewRows([]string{"amount", "overdraft_limit", "version"}).AddRow("40.00", "0.00", 3))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE balances SET amount = ?")).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO balance_history")).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	if err := balances.UpdateBalance(context.Background(), 2, "USD", 250); err != nil {
+		t.Fatalf("UpdateBalance: %v", err)
+	}
+
+	var event, data string
+	for data == "" {
+		line, err := events.ReadString('\n')
+		if err != nil {
+			t.Fatalf("stream ended before the update: %v", err)
+		}
+		if v, ok := strings.CutPrefix(line, "event: "); ok {
+			event = strings.TrimSpace(v)
+		}
+		if v, ok := strings.CutPrefix(line, "data: "); ok {
+			data = strings.TrimSpace(v)
+		}
+	}
+	var update models.BalanceUpdate
+	if err := json.Unmarshal([]byte(data), &update); err != nil {
+		t.Fatalf("decode %q: %v", data, err)
+	}
+	if event != "balance" || update.UserID != 2 || update.Balance != 4250 || update.ChangeAmount != 250 {
+		t.Errorf("event %q = %+v, want a balance event for user 2 at 42.50", event, update)
+	}
+
+	close(draining)
+	if _, err := io.ReadAll(events); err != nil {
+		t.Errorf("stream did not end cleanly on drain: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go-projects/internal/apierror"
+)
+
+func decodeJSON(r *http.Request, dst interface{}) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(dst)
+}
+
+func unknownField(err error) (string, bool) {
+	name, ok := strings.CutPrefix(err.Error(), "json: unknown field ")
+	if !ok {
+		return "", false
+	}
+	if unquoted, uerr := strconv.Unquote(name); uerr == nil {
+		name = unquoted
+	}
+	return name, true
+}
+
+func respondWithDecodeError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		apierror.Write(w, http.StatusRequestEntityTooLarge, "request_too_large", "Request body is too large")
+		return
+	}
+
+	if isAmountError(err) {
+		respondWithValidationErrors(w, map[string]string{"amount": err.Error()})
+		return
+	}
+
+	if field, ok := unknownField(err); ok {
+		apiErr := apierror.New(http.StatusBadRequest, "unknown_field", "Unknown field "+strconv.Quote(field))
+		apiErr.Field = field
+		apierror.WriteError(w, apiErr)
+		return
+	}
+
+	apierror.Write(w, http.StatusBadRequest, "invalid_request", "Invalid request body")
+}
@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go-projects/internal/models"
+)
+
+func TestDecodeJSONRejectsUnknownFields(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		code  int
+		error string
+		field string
+	}{
+		{"unknown field", `{"user_id":1,"amount":5,"note":"x"}`, http.StatusBadRequest, "unknown_field", "note"},
+		{"malformed json", `{"user_id":`, http.StatusBadRequest, "invalid_request", ""},
+		{"three decimals", `{"user_id":1,"amount":1.005}`, http.StatusUnprocessableEntity, "validation_failed", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req models.CreditRequest
+			err := decodeJSON(httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body)), &req)
+			if err == nil {
+				t.Fatal("decodeJSON accepted the body")
+			}
+
+			rec := httptest.NewRecorder()
+			respondWithDecodeError(rec, err)
+
+			var resp map[string]interface{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != tt.code || resp["error"] != tt.error {
+				t.Errorf("got %d %v, want %d %s", rec.Code, resp["error"], tt.code, tt.error)
+			}
+			if tt.field != "" && resp["field"] != tt.field {
+				t.Errorf("field = %v, want %s", resp["field"], tt.field)
+			}
+		})
+	}
+}
+
+func TestDecodeJSONAcceptsKnownFields(t *testing.T) {
+	var req models.CreditRequest
+	err := decodeJSON(httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"user_id":1,"amount":5.25}`)), &req)
+	if err != nil {
+		t.Fatalf("decodeJSON: %v", err)
+	}
+	if req.UserID != 1 || req.Amount != 525 {
+		t.Errorf("decoded %+v", req)
+	}
+}
+
+func TestDecodeJSONOversizedBodyIs413(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"user_id":1,"amount":5,"currency":"USD"}`))
+	req.Body = http.MaxBytesReader(rec, req.Body, 16)
+
+	var credit models.CreditRequest
+	err := decodeJSON(req, &credit)
+	if err == nil {
+		t.Fatal("decodeJSON read past the body limit")
+	}
+	respondWithDecodeError(rec, err)
+
+	if rec.Code != http.StatusRequestEntityTooLarge || !strings.Contains(rec.Body.String(), "request_too_large") {
+		t.Errorf("got %d %s, want 413 request_too_large", rec.Code, rec.Body.String())
+	}
+}
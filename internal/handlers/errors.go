@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+
+	"go-projects/internal/apierror"
+	"go-projects/internal/models"
+	"go-projects/internal/services"
+)
+
+// Service errors that reach a client are mapped here, in one place, rather
+// than in each handler.
+func init() {
+	apierror.Register(context.DeadlineExceeded, http.StatusServiceUnavailable, "request_timeout", "Request timed out")
+	apierror.Register(services.ErrIdempotencyConflict, http.StatusConflict, "idempotency_conflict", "")
+	apierror.Register(services.ErrTransactionLimitExceeded, http.StatusUnprocessableEntity, "transaction_limit_exceeded", "")
+	apierror.Register(services.ErrDailyLimitExceeded, http.StatusUnprocessableEntity, "daily_limit_exceeded", "")
+	apierror.Register(services.ErrShuttingDown, http.StatusServiceUnavailable, "shutting_down", "")
+	apierror.Register(services.ErrAlreadyRefunded, http.StatusConflict, "already_refunded", "")
+	apierror.Register(services.ErrCurrencyMismatch, http.StatusUnprocessableEntity, "currency_mismatch", "")
+	apierror.Register(services.ErrInsufficientBalance, http.StatusUnprocessableEntity, "insufficient_balance", "Insufficient balance")
+	apierror.Register(services.ErrInvalidCursor, http.StatusBadRequest, "invalid_cursor", "")
+	apierror.Register(services.ErrTransactionNotFound, http.StatusNotFound, "transaction_not_found", "Transaction not found")
+	apierror.Register(services.ErrInvalidTransactionState, http.StatusConflict, "invalid_transaction_state", "")
+	apierror.Register(services.ErrAccountFrozen, http.StatusForbidden, "account_frozen", "")
+	apierror.Register(services.ErrInvalidAmount, http.StatusBadRequest, "invalid_amount", "")
+	apierror.Register(services.ErrInvalidExchangeRate, http.StatusBadRequest, "invalid_exchange_rate", "")
+	apierror.Register(services.ErrSameAccount, http.StatusBadRequest, "same_account", "")
+	apierror.Register(services.ErrReceiverNotFound, http.StatusUnprocessableEntity, "receiver_not_found", "")
+	apierror.Register(services.ErrSameCurrency, http.StatusBadRequest, "same_currency", "")
+	apierror.Register(services.ErrMissingDestination, http.StatusBadRequest, "missing_destination", "")
+	apierror.Register(services.ErrMissingReference, http.StatusBadRequest, "missing_reference", "")
+	apierror.Register(models.ErrInvalidCurrency, http.StatusBadRequest, "invalid_currency", "")
+	apierror.Register(services.ErrTimelineTooLarge, http.StatusBadRequest, "range_too_large", "")
+	apierror.Register(services.ErrInvalidRefreshToken, http.StatusUnauthorized, "invalid_refresh_token", "Invalid or expired refresh token")
+	apierror.Register(services.ErrRefreshTokenReused, http.StatusUnauthorized, "invalid_refresh_token", "Invalid or expired refresh token")
+	apierror.Register(services.ErrInvalidResetToken, http.StatusBadRequest, "invalid_reset_token", "")
+	apierror.Register(services.ErrInvalidRole, http.StatusBadRequest, "invalid_role", "")
+	apierror.Register(services.ErrUserExists, http.StatusConflict, "user_exists", "")
+	apierror.Register(services.ErrTOTPRequired, http.StatusUnauthorized, "totp_required", "")
+	apierror.Register(services.ErrInvalidTOTPCode, http.StatusUnauthorized, "invalid_totp_code", "")
+	apierror.Register(services.ErrTOTPNotEnrolled, http.StatusConflict, "totp_not_enrolled", "")
+	apierror.Register(services.ErrTOTPAlreadyEnabled, http.StatusConflict, "totp_already_enabled", "")
+	apierror.Register(services.ErrAccountLocked, http.StatusLocked, "account_locked", "")
+	apierror.Register(services.ErrUserNotFound, http.StatusNotFound, "user_not_found", "User not found")
+	apierror.Register(services.ErrAdminRequired, http.StatusForbidden, "forbidden", "")
+	apierror.Register(services.ErrCannotDeleteSelf, http.StatusBadRequest, "cannot_delete_self", "")
+	apierror.Register(services.ErrSameUser, http.StatusBadRequest, "same_user", "")
+	apierror.Register(services.ErrMergeCrossTransfers, http.StatusConflict, "merge_conflict", "")
+}
+
+// writeFetchError sends the mapping registered for err, such as the 503 for a
+// request that ran past its deadline, and a 500 fetch_failed otherwise.
+func writeFetchError(w http.ResponseWriter, err error, message string) {
+	if _, ok := apierror.FromError(err); ok {
+		apierror.WriteError(w, err)
+		return
+	}
+	apierror.Write(w, http.StatusInternalServerError, "fetch_failed", message)
+}
@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go-projects/internal/apierror"
+	"go-projects/internal/models"
+	"go-projects/internal/services"
+)
+
+func TestServiceErrorMapping(t *testing.T) {
+	tests := []struct {
+		err      error
+		wantCode int
+		wantErr  string
+	}{
+		{services.ErrIdempotencyConflict, http.StatusConflict, "idempotency_conflict"},
+		{services.ErrTransactionLimitExceeded, http.StatusUnprocessableEntity, "transaction_limit_exceeded"},
+		{services.ErrShuttingDown, http.StatusServiceUnavailable, "shutting_down"},
+		{services.ErrAlreadyRefunded, http.StatusConflict, "already_refunded"},
+		{services.ErrCurrencyMismatch, http.StatusUnprocessableEntity, "currency_mismatch"},
+		{services.ErrInsufficientBalance, http.StatusUnprocessableEntity, "insufficient_balance"},
+		{services.ErrTransactionNotFound, http.StatusNotFound, "transaction_not_found"},
+		{services.ErrInvalidTransactionState, http.StatusConflict, "invalid_transaction_state"},
+		{services.ErrAccountFrozen, http.StatusForbidden, "account_frozen"},
+		{services.ErrInvalidAmount, http.StatusBadRequest, "invalid_amount"},
+		{services.ErrInvalidExchangeRate, http.StatusBadRequest, "invalid_exchange_rate"},
+		{services.ErrSameAccount, http.StatusBadRequest, "same_account"},
+		{services.ErrReceiverNotFound, http.StatusUnprocessableEntity, "receiver_not_found"},
+		{services.ErrSameCurrency, http.StatusBadRequest, "same_currency"},
+		{services.ErrMissingDestination, http.StatusBadRequest, "missing_destination"},
+		{models.ErrInvalidCurrency, http.StatusBadRequest, "invalid_currency"},
+		{services.ErrRefreshTokenReused, http.StatusUnauthorized, "invalid_refresh_token"},
+		{fmt.Errorf("credit failed: %w", services.ErrDailyLimitExceeded), http.StatusUnprocessableEntity, "daily_limit_exceeded"},
+		{errors.New("database error: connection reset"), http.StatusInternalServerError, "internal_error"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.wantErr, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			apierror.WriteError(rec, tt.err)
+
+			var body apierror.APIError
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != tt.wantCode || body.Code != tt.wantErr {
+				t.Errorf("%v: got %d %q, want %d %q", tt.err, rec.Code, body.Code, tt.wantCode, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWriteFetchError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantCode   string
+	}{
+		{"deadline exceeded", fmt.Errorf("database error: %w", context.DeadlineExceeded), http.StatusServiceUnavailable, "request_timeout"},
+		{"mapped sentinel", services.ErrTimelineTooLarge, http.StatusBadRequest, "range_too_large"},
+		{"unmapped error", errors.New("connection reset"), http.StatusInternalServerError, "fetch_failed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			writeFetchError(rec, tt.err, "Failed to fetch balance")
+
+			var body apierror.APIError
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != tt.wantStatus || body.Code != tt.wantCode {
+				t.Errorf("got %d %q, want %d %q", rec.Code, body.Code, tt.wantStatus, tt.wantCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNotModified(t *testing.T) {
+	current := weakETag(1, "completed", 10.0)
+	changed := weakETag(1, "rolled_back", 10.0)
+	if current == changed {
+		t.Fatal("ETag did not change with the resource")
+	}
+
+	tests := []struct {
+		name        string
+		ifNoneMatch string
+		want        bool
+	}{
+		{"no header", "", false},
+		{"matching", current, true},
+		{"strong form of the same tag", current[2:], true},
+		{"one of several", `"other", ` + current, true},
+		{"wildcard", "*", true},
+		{"changed resource", changed, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.ifNoneMatch != "" {
+				req.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			rec := httptest.NewRecorder()
+
+			if got := notModified(rec, req, current); got != tt.want {
+				t.Fatalf("notModified = %v, want %v", got, tt.want)
+			}
+			if rec.Header().Get("ETag") != current {
+				t.Errorf("ETag header = %q, want %q", rec.Header().Get("ETag"), current)
+			}
+			if tt.want && rec.Code != http.StatusNotModified {
+				t.Errorf("status = %d, want 304", rec.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	appdb "go-projects/internal/db"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/rs/zerolog"
+)
+
+func TestReady(t *testing.T) {
+	latest := appdb.LatestSchemaVersion()
+	schemaQuery := regexp.QuoteMeta("SELECT COALESCE(MAX(version), 0) FROM schema_migrations")
+
+	tests := []struct {
+		name           string
+		ready          bool
+		pingErr        error
+		schema         int
+		schemaErr      error
+		want           int
+		wantMigrations string
+	}{
+		{name: "current schema", ready: true, schema: latest, want: http.StatusOK, wantMigrations: "ok"},
+		{name: "schema ahead of this build", ready: true, schema: latest + 1, want: http.StatusOK, wantMigrations: "ok"},
+		{name: "migrations pending", ready: true, schema: latest - 1, want: http.StatusServiceUnavailable, wantMigrations: "pending"},
+		{name: "schema version unreadable", ready: true, schemaErr: errors.New("no such table"), want: http.StatusServiceUnavailable, wantMigrations: "unknown"},
+		{name: "database unreachable", ready: true, pingErr: errors.New("connection refused"), want: http.StatusServiceUnavailable},
+		{name: "draining", want: http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+			if err != nil {
+				t.Fatalf("sqlmock: %v", err)
+			}
+			defer db.Close()
+			if tt.ready {
+				mock.ExpectPing().WillReturnError(tt.pingErr)
+			}
+			if tt.ready && tt.pingErr == nil {
+				query := mock.ExpectQuery(schemaQuery)
+				if tt.schemaErr != nil {
+					query.WillReturnError(tt.schemaErr)
+				} else {
+					query.WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(tt.schema))
+				}
+			}
+
+			handler := NewHealthHandler(db, zerolog.Nop(), func() bool { return tt.ready })
+			rec := httptest.NewRecorder()
+			handler.Ready(rec, httptest.NewRequest(http.MethodGet, "/health/ready", nil))
+
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+			var body struct {
+				Migrations    string `json:"migrations"`
+				SchemaVersion *int   `json:"schema_version"`
+				Latest        *int   `json:"latest_schema_version"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("decode %q: %v", rec.Body.String(), err)
+			}
+			if body.Migrations != tt.wantMigrations {
+				t.Errorf("migrations = %q, want %q", body.Migrations, tt.wantMigrations)
+			}
+			if tt.wantMigrations == "ok" || tt.wantMigrations == "pending" {
+				if body.SchemaVersion == nil || *body.SchemaVersion != tt.schema || body.Latest == nil || *body.Latest != latest {
+					t.Errorf("body = %s, want schema_version %d of %d", rec.Body.String(), tt.schema, latest)
+				}
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestLiveDoesNotTouchTheDatabase(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	rec := httptest.NewRecorder()
+	NewHealthHandler(db, zerolog.Nop(), func() bool { return false }).Live(rec, httptest.NewRequest(http.MethodGet, "/health/live", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("status = %d, want 200", rec.Code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"testing"
+
+	"go-projects/internal/middleware"
+	"go-projects/internal/services"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/rs/zerolog"
+)
+
+func newMockDB(t *testing.T) (*sql.DB, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, mock
+}
+
+// withUser returns r as the Authentication middleware would pass it on for
+// the given user.
+func withUser(r *http.Request, userID int, role string) *http.Request {
+	ctx := context.WithValue(r.Context(), middleware.UserIDKey, userID)
+	ctx = context.WithValue(ctx, middleware.UserRoleKey, role)
+	return r.WithContext(ctx)
+}
+
+// newTestAuthService builds an AuthService, failing the test if its token
+// settings are refused.
+func newTestAuthService(t *testing.T, db *sql.DB, tokens services.TokenConfig) *services.AuthService {
+	t.Helper()
+	service, err := services.NewAuthService(db, zerolog.Nop(), tokens)
+	if err != nil {
+		t.Fatalf("NewAuthService: %v", err)
+	}
+	return service
+}
@@ -0,0 +1,11 @@
+package handlers
+
+import "strconv"
+
+func transactionLocation(id int) string {
+	return "/api/v1/transactions/" + strconv.Itoa(id)
+}
+
+func userLocation(id int) string {
+	return "/api/v1/users/" + strconv.Itoa(id)
+}
@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"go-projects/internal/models"
+)
+
+// respond writes payload as XML when the Accept header prefers it and as
+// JSON otherwise. Error bodies from apierror stay JSON.
+func respond(w http.ResponseWriter, r *http.Request, code int, payload interface{}) {
+	w.Header().Add("Vary", "Accept")
+
+	if prefersXML(r.Header.Get("Accept")) {
+		// Not every payload has an XML form; those fall through to JSON.
+		if body, err := marshalXML(payload); err == nil {
+			w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+			w.WriteHeader(code)
+			w.Write(body)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(payload)
+}
+
+// prefersXML reports whether the highest-weighted media range in accept is
+// an XML type. Ties go to JSON, as does an empty or unparsable header.
+func prefersXML(accept string) bool {
+	bestJSON, bestXML := -1.0, -1.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if qStr, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(qStr, 64); err != nil {
+				continue
+			}
+		}
+
+		switch mediaType {
+		case "application/xml", "text/xml":
+			bestXML = max(bestXML, q)
+		case "application/json", "application/*", "*/*":
+			bestJSON = max(bestJSON, q)
+		}
+	}
+	return bestXML > 0 && bestXML > bestJSON
+}
+
+type xmlList struct {
+	XMLName xml.Name    `xml:"response"`
+	Items   interface{} `xml:"item"`
+}
+
+// xmlMap encodes the map payloads the handlers build inline.
+type xmlMap map[string]interface{}
+
+func (m xmlMap) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	return models.MarshalXMLMap(e, start, m)
+}
+
+func marshalXML(payload interface{}) ([]byte, error) {
+	switch p := payload.(type) {
+	case map[string]interface{}:
+		payload = xmlMap(p)
+	case map[string]string:
+		m := make(xmlMap, len(p))
+		for key, value := range p {
+			m[key] = value
+		}
+		payload = m
+	default:
+		if v := reflect.ValueOf(payload); v.Kind() == reflect.Slice {
+			payload = xmlList{Items: payload}
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	if err := xml.NewEncoder(&buf).EncodeElement(payload, xml.StartElement{Name: xml.Name{Local: "response"}}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
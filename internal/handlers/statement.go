@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"go-projects/internal/models"
+
+	"github.com/go-pdf/fpdf"
+)
+
+var statementHeader = []string{"date", "type", "counterparty", "amount", "running_balance"}
+
+func writeStatementCSV(w io.Writer, statement *models.Statement) error {
+	writer := csv.NewWriter(w)
+
+	if err := writer.Write(statementHeader); err != nil {
+		return err
+	}
+
+	for _, entry := range statement.Entries {
+		record := []string{
+			entry.Date.UTC().Format(time.RFC3339),
+			entry.Type,
+			entry.Counterparty,
+			entry.Amount.String(),
+			entry.RunningBalance.String(),
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+func writeStatementPDF(w io.Writer, statement *models.Statement) error {
+	pdf := fpdf.New("P", "mm", "A4", "")
+	pdf.AddPage()
+
+	pdf.SetFont("Helvetica", "B", 14)
+	pdf.Cell(0, 10, "Account Statement")
+	pdf.Ln(10)
+
+	pdf.SetFont("Helvetica", "", 10)
+	pdf.Cell(0, 6, fmt.Sprintf("User: %d  Currency: %s", statement.UserID, statement.Currency))
+	pdf.Ln(6)
+	pdf.Cell(0, 6, fmt.Sprintf("Period: %s - %s",
+		statement.From.UTC().Format("2006-01-02 15:04"), statement.To.UTC().Format("2006-01-02 15:04")))
+	pdf.Ln(6)
+	pdf.Cell(0, 6, "Opening balance: "+statement.OpeningBalance.String())
+	pdf.Ln(10)
+
+	widths := []float64{40, 25, 45, 35, 45}
+
+	pdf.SetFont("Helvetica", "B", 10)
+	for i, title := range statementHeader {
+		pdf.CellFormat(widths[i], 7, title, "1", 0, "C", false, 0, "")
+	}
+	pdf.Ln(-1)
+
+	pdf.SetFont("Helvetica", "", 9)
+	for _, entry := range statement.Entries {
+		pdf.CellFormat(widths[0], 6, entry.Date.UTC().Format("2006-01-02 15:04"), "1", 0, "L", false, 0, "")
+		pdf.CellFormat(widths[1], 6, entry.Type, "1", 0, "L", false, 0, "")
+		pdf.CellFormat(widths[2], 6, entry.Counterparty, "1", 0, "L", false, 0, "")
+		pdf.CellFormat(widths[3], 6, entry.Amount.String(), "1", 0, "R", false, 0, "")
+		pdf.CellFormat(widths[4], 6, entry.RunningBalance.String(), "1", 0, "R", false, 0, "")
+		pdf.Ln(-1)
+	}
+
+	pdf.Ln(4)
+	pdf.SetFont("Helvetica", "B", 10)
+	pdf.Cell(0, 6, "Closing balance: "+statement.ClosingBalance.String()+"  ("+strconv.Itoa(len(statement.Entries))+" transactions)")
+
+	return pdf.Output(w)
+}
@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"go-projects/internal/models"
+)
+
+func TestWriteStatementCSV(t *testing.T) {
+	date := time.Date(2026, 9, 1, 12, 0, 0, 0, time.UTC)
+	statement := &models.Statement{
+		UserID: 1,
+		Entries: []*models.StatementEntry{
+			{TransactionID: 1, Date: date, Type: "transfer", Counterparty: "user:2", Amount: 2000, RunningBalance: 7000},
+			{TransactionID: 2, Date: date, Type: "withdrawal", Counterparty: "IBAN, 1", Amount: -3000, RunningBalance: 4000},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := writeStatementCSV(&buf, statement); err != nil {
+		t.Fatalf("writeStatementCSV: %v", err)
+	}
+
+	want := strings.Join([]string{
+		"date,type,counterparty,amount,running_balance",
+		"2026-09-01T12:00:00Z,transfer,user:2,20.00,70.00",
+		`2026-09-01T12:00:00Z,withdrawal,"IBAN, 1",-30.00,40.00`,
+		"",
+	}, "\n")
+	if buf.String() != want {
+		t.Errorf("csv =\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestWriteStatementPDF(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeStatementPDF(&buf, &models.Statement{UserID: 1}); err != nil {
+		t.Fatalf("writeStatementPDF: %v", err)
+	}
+	if !bytes.HasPrefix(buf.Bytes(), []byte("%PDF-")) {
+		t.Error("output is not a PDF")
+	}
+}
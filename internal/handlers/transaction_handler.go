@@ -1,11 +1,13 @@
 package handlers
 
 import (
-	"database/sql"
-	"encoding/json"
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
+	"go-projects/internal/apierror"
 	"go-projects/internal/middleware"
 	"go-projects/internal/models"
 	"go-projects/internal/services"
@@ -16,127 +18,263 @@ import (
 
 type TransactionHandler struct {
 	transactionService *services.TransactionService
-	logger zerolog.Logger
+	rateLimiter        *middleware.TransactionRateLimiter
+	maxPageSize        int
+	logger             zerolog.Logger
 }
 
-func NewTransactionHandler(db *sql.DB, logger zerolog.Logger, balanceService *services.BalanceService) *TransactionHandler {
+func NewTransactionHandler(transactionService *services.TransactionService, logger zerolog.Logger, rateLimiter *middleware.TransactionRateLimiter, maxPageSize int) *TransactionHandler {
 	return &TransactionHandler{
-		transactionService: services.NewTransactionService(db, logger, balanceService),
-		logger: logger,
+		transactionService: transactionService,
+		rateLimiter:        rateLimiter,
+		maxPageSize:        maxPageSize,
+		logger:             logger,
 	}
 }
 
 func (h *TransactionHandler) Credit(w http.ResponseWriter, r *http.Request) {
 	var req models.CreditRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		h.respondWithError(w, http.StatusBadRequest, "invalid_request", "Invalid request body")
+	if err := decodeJSON(r, &req); err != nil {
+		respondWithDecodeError(w, err)
 		return
 	}
 
-	userRole, ok := middleware.GetUserRole(r)
-	if !ok || userRole != string(models.RoleAdmin) {
-		h.respondWithError(w, http.StatusForbidden, "forbidden", "Only admins can credit accounts")
+	if !validRequest(w, &req) {
 		return
 	}
 
-	transaction, err := h.transactionService.Credit(&req)
+	if !middleware.IsAdmin(r) {
+		apierror.Write(w, http.StatusForbidden, "forbidden", "Only admins can credit accounts")
+		return
+	}
+
+	if strings.TrimSpace(req.Reason) == "" {
+		respondWithValidationErrors(w, models.ValidationErrors{"reason": "is required for manual adjustments"})
+		return
+	}
+
+	currentUserID, _ := middleware.GetUserID(r)
+	if !h.rateLimiter.Allow(currentUserID, string(models.TransactionTypeCredit)) {
+		apierror.Write(w, http.StatusTooManyRequests, "rate_limit_exceeded", "Too many credit requests. Please try again later.")
+		return
+	}
+
+	transaction, err := h.transactionService.Credit(r.Context(), &req, idempotencyKeyFromRequest(r, currentUserID))
 	if err != nil {
 		h.logger.Error().Err(err).Msg("Credit transaction failed")
-		h.respondWithError(w, http.StatusBadRequest, "transaction_failed", err.Error())
+		apierror.WriteError(w, err)
 		return
 	}
 
-	h.respondWithJSON(w, http.StatusCreated, transaction)
+	w.Header().Set("Location", transactionLocation(transaction.ID))
+	respond(w, r, http.StatusCreated, transaction)
 }
 
 func (h *TransactionHandler) Debit(w http.ResponseWriter, r *http.Request) {
 	var req models.DebitRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		h.respondWithError(w, http.StatusBadRequest, "invalid_request", "Invalid request body")
+	if err := decodeJSON(r, &req); err != nil {
+		respondWithDecodeError(w, err)
+		return
+	}
+
+	if !validRequest(w, &req) {
 		return
 	}
 
 	currentUserID, ok := middleware.GetUserID(r)
 	if !ok {
-		h.respondWithError(w, http.StatusUnauthorized, "unauthorized", "User not authenticated")
+		apierror.Write(w, http.StatusUnauthorized, "unauthorized", "User not authenticated")
 		return
 	}
 
-	userRole, _ := middleware.GetUserRole(r)
-	
-	if userRole != string(models.RoleAdmin) && currentUserID != req.UserID {
-		h.respondWithError(w, http.StatusForbidden, "forbidden", "You can only debit your own account")
+	if !middleware.IsAdmin(r) && currentUserID != req.UserID {
+		apierror.Write(w, http.StatusForbidden, "forbidden", "You can only debit your own account")
+		return
+	}
+
+	// An admin debiting someone else's account is a manual adjustment.
+	if currentUserID != req.UserID && strings.TrimSpace(req.Reason) == "" {
+		respondWithValidationErrors(w, models.ValidationErrors{"reason": "is required for manual adjustments"})
+		return
+	}
+
+	if !h.rateLimiter.Allow(currentUserID, string(models.TransactionTypeDebit)) {
+		apierror.Write(w, http.StatusTooManyRequests, "rate_limit_exceeded", "Too many debit requests. Please try again later.")
 		return
 	}
 
-	transaction, err := h.transactionService.Debit(&req)
+	transaction, err := h.transactionService.Debit(r.Context(), &req, idempotencyKeyFromRequest(r, currentUserID))
 	if err != nil {
 		h.logger.Error().Err(err).Msg("Debit transaction failed")
-		h.respondWithError(w, http.StatusBadRequest, "transaction_failed", err.Error())
+		apierror.WriteError(w, err)
 		return
 	}
 
-	h.respondWithJSON(w, http.StatusCreated, transaction)
+	w.Header().Set("Location", transactionLocation(transaction.ID))
+	respond(w, r, http.StatusCreated, transaction)
 }
 
 func (h *TransactionHandler) Transfer(w http.ResponseWriter, r *http.Request) {
 	var req models.TransferRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		h.respondWithError(w, http.StatusBadRequest, "invalid_request", "Invalid request body")
+	if err := decodeJSON(r, &req); err != nil {
+		respondWithDecodeError(w, err)
+		return
+	}
+
+	if !validRequest(w, &req) {
 		return
 	}
 
 	currentUserID, ok := middleware.GetUserID(r)
 	if !ok {
-		h.respondWithError(w, http.StatusUnauthorized, "unauthorized", "User not authenticated")
+		apierror.Write(w, http.StatusUnauthorized, "unauthorized", "User not authenticated")
 		return
 	}
 
-	userRole, _ := middleware.GetUserRole(r)
-	
-	if userRole != string(models.RoleAdmin) && currentUserID != req.FromUserID {
-		h.respondWithError(w, http.StatusForbidden, "forbidden", "You can only transfer from your own account")
+	if !middleware.IsAdmin(r) && currentUserID != req.FromUserID {
+		apierror.Write(w, http.StatusForbidden, "forbidden", "You can only transfer from your own account")
+		return
+	}
+
+	// The receiver is credited at the given rate, so only admins may set one.
+	if !middleware.IsAdmin(r) && req.ExchangeRate != 0 {
+		apierror.Write(w, http.StatusForbidden, "forbidden", "Only admins can set an exchange rate")
+		return
+	}
+
+	if !h.rateLimiter.Allow(currentUserID, string(models.TransactionTypeTransfer)) {
+		apierror.Write(w, http.StatusTooManyRequests, "rate_limit_exceeded", "Too many transfer requests. Please try again later.")
 		return
 	}
 
-	transaction, err := h.transactionService.Transfer(&req)
+	transaction, err := h.transactionService.Transfer(r.Context(), &req, idempotencyKeyFromRequest(r, currentUserID))
 	if err != nil {
 		h.logger.Error().Err(err).Msg("Transfer transaction failed")
-		h.respondWithError(w, http.StatusBadRequest, "transaction_failed", err.Error())
+		apierror.WriteError(w, err)
 		return
 	}
 
-	h.respondWithJSON(w, http.StatusCreated, transaction)
+	w.Header().Set("Location", transactionLocation(transaction.ID))
+	respond(w, r, http.StatusCreated, transaction)
 }
 
-func (h *TransactionHandler) GetHistory(w http.ResponseWriter, r *http.Request) {
+func (h *TransactionHandler) Exchange(w http.ResponseWriter, r *http.Request) {
+	var req models.ExchangeRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondWithDecodeError(w, err)
+		return
+	}
+
+	if !validRequest(w, &req) {
+		return
+	}
+
+	// The route is admin-only: the rate comes from the caller, and there is
+	// no server-side rate source to check it against.
+	currentUserID, _ := middleware.GetUserID(r)
+
+	if !h.rateLimiter.Allow(currentUserID, string(models.TransactionTypeExchange)) {
+		apierror.Write(w, http.StatusTooManyRequests, "rate_limit_exceeded", "Too many exchange requests. Please try again later.")
+		return
+	}
+
+	transaction, err := h.transactionService.Exchange(r.Context(), &req, idempotencyKeyFromRequest(r, currentUserID))
+	if err != nil {
+		h.logger.Error().Err(err).Msg("Exchange transaction failed")
+		apierror.WriteError(w, err)
+		return
+	}
+
+	w.Header().Set("Location", transactionLocation(transaction.ID))
+	respond(w, r, http.StatusCreated, transaction)
+}
+
+func (h *TransactionHandler) Withdraw(w http.ResponseWriter, r *http.Request) {
+	var req models.WithdrawRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondWithDecodeError(w, err)
+		return
+	}
+
+	if !validRequest(w, &req) {
+		return
+	}
+
 	currentUserID, ok := middleware.GetUserID(r)
 	if !ok {
-		h.respondWithError(w, http.StatusUnauthorized, "unauthorized", "User not authenticated")
+		apierror.Write(w, http.StatusUnauthorized, "unauthorized", "User not authenticated")
 		return
 	}
 
-	limitStr := r.URL.Query().Get("limit")
-	offsetStr := r.URL.Query().Get("offset")
+	userRole, _ := middleware.GetUserRole(r)
 
-	limit := 50 // default
-	offset := 0 // default
+	if userRole != string(models.RoleMerchant) && !middleware.IsAdmin(r) {
+		apierror.Write(w, http.StatusForbidden, "forbidden", "Only merchants can withdraw funds")
+		return
+	}
 
-	if limitStr != "" {
-		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
-			limit = l
-		}
+	if !middleware.IsAdmin(r) && currentUserID != req.UserID {
+		apierror.Write(w, http.StatusForbidden, "forbidden", "You can only withdraw from your own account")
+		return
 	}
-	if offsetStr != "" {
-		if o, err := strconv.Atoi(offsetStr); err == nil && o >= 0 {
-			offset = o
-		}
+
+	if !h.rateLimiter.Allow(currentUserID, string(models.TransactionTypeWithdrawal)) {
+		apierror.Write(w, http.StatusTooManyRequests, "rate_limit_exceeded", "Too many withdrawal requests. Please try again later.")
+		return
+	}
+
+	transaction, err := h.transactionService.Withdraw(r.Context(), &req, idempotencyKeyFromRequest(r, currentUserID))
+	if err != nil {
+		h.logger.Error().Err(err).Msg("Withdrawal transaction failed")
+		apierror.WriteError(w, err)
+		return
+	}
+
+	w.Header().Set("Location", transactionLocation(transaction.ID))
+	respond(w, r, http.StatusCreated, transaction)
+}
+
+func (h *TransactionHandler) Refund(w http.ResponseWriter, r *http.Request) {
+	transactionID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		apierror.Write(w, http.StatusBadRequest, "invalid_transaction_id", "Invalid transaction ID")
+		return
+	}
+
+	var req models.RefundRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondWithDecodeError(w, err)
+		return
+	}
+
+	currentUserID, _ := middleware.GetUserID(r)
+
+	refund, err := h.transactionService.Refund(r.Context(), transactionID, currentUserID, req.Reason)
+	if err != nil {
+		h.logger.Error().Err(err).Int("transaction_id", transactionID).Msg("Refund failed")
+		apierror.WriteError(w, err)
+		return
+	}
+
+	w.Header().Set("Location", transactionLocation(refund.ID))
+	respond(w, r, http.StatusCreated, refund)
+}
+
+func (h *TransactionHandler) GetHistory(w http.ResponseWriter, r *http.Request) {
+	currentUserID, ok := middleware.GetUserID(r)
+	if !ok {
+		apierror.Write(w, http.StatusUnauthorized, "unauthorized", "User not authenticated")
+		return
+	}
+
+	limit, offset, err := middleware.ParsePagination(r, h.maxPageSize)
+	if err != nil {
+		apierror.WriteError(w, err)
+		return
 	}
 
-	userRole, _ := middleware.GetUserRole(r)
-	
 	var userID int
-	if userRole == string(models.RoleAdmin) {
+	if middleware.IsAdmin(r) {
 		userIDStr := r.URL.Query().Get("user_id")
 		if userIDStr != "" {
 			if uid, err := strconv.Atoi(userIDStr); err == nil {
@@ -151,14 +289,112 @@ func (h *TransactionHandler) GetHistory(w http.ResponseWriter, r *http.Request)
 		userID = currentUserID
 	}
 
-	transactions, err := h.transactionService.GetUserTransactions(userID, limit, offset)
+	// Any cursor parameter, even an empty one, switches to keyset paging.
+	if _, useCursor := r.URL.Query()["cursor"]; useCursor {
+		transactions, nextCursor, err := h.transactionService.GetUserTransactionsCursor(r.Context(), userID, r.URL.Query().Get("cursor"), limit)
+		if err != nil {
+			h.logger.Error().Err(err).Msg("Failed to fetch transaction history")
+			writeFetchError(w, err, "Failed to fetch transaction history")
+			return
+		}
+
+		respond(w, r, http.StatusOK, models.CursorPage{
+			Items:      transactions,
+			Limit:      limit,
+			NextCursor: nextCursor,
+		})
+		return
+	}
+
+	transactions, err := h.transactionService.GetUserTransactions(r.Context(), userID, limit, offset)
 	if err != nil {
 		h.logger.Error().Err(err).Msg("Failed to fetch transaction history")
-		h.respondWithError(w, http.StatusInternalServerError, "fetch_failed", "Failed to fetch transaction history")
+		writeFetchError(w, err, "Failed to fetch transaction history")
 		return
 	}
 
-	h.respondWithJSON(w, http.StatusOK, transactions)
+	totalCount, err := h.transactionService.CountUserTransactions(r.Context(), userID)
+	if err != nil {
+		h.logger.Error().Err(err).Msg("Failed to count transactions")
+		writeFetchError(w, err, "Failed to fetch transaction history")
+		return
+	}
+
+	respond(w, r, http.StatusOK, models.PaginatedResponse{
+		Items:      transactions,
+		Limit:      limit,
+		Offset:     offset,
+		TotalCount: totalCount,
+	})
+}
+
+func (h *TransactionHandler) ExportStatement(w http.ResponseWriter, r *http.Request) {
+	currentUserID, ok := middleware.GetUserID(r)
+	if !ok {
+		apierror.Write(w, http.StatusUnauthorized, "unauthorized", "User not authenticated")
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "pdf" {
+		apierror.Write(w, http.StatusBadRequest, "invalid_format", "format must be csv or pdf")
+		return
+	}
+
+	to := time.Now()
+	if toStr := r.URL.Query().Get("to"); toStr != "" {
+		parsed, err := time.Parse(time.RFC3339, toStr)
+		if err != nil {
+			apierror.Write(w, http.StatusBadRequest, "invalid_time", "Invalid to time. Use RFC3339 format")
+			return
+		}
+		to = parsed
+	}
+
+	from := to.AddDate(0, 0, -30)
+	if fromStr := r.URL.Query().Get("from"); fromStr != "" {
+		parsed, err := time.Parse(time.RFC3339, fromStr)
+		if err != nil {
+			apierror.Write(w, http.StatusBadRequest, "invalid_time", "Invalid from time. Use RFC3339 format")
+			return
+		}
+		from = parsed
+	}
+
+	if from.After(to) {
+		apierror.Write(w, http.StatusBadRequest, "invalid_range", "from must be before to")
+		return
+	}
+
+	currency, err := queryCurrency(r)
+	if err != nil {
+		apierror.WriteError(w, err)
+		return
+	}
+
+	statement, err := h.transactionService.GetStatement(r.Context(), currentUserID, currency, from, to)
+	if err != nil {
+		h.logger.Error().Err(err).Int("user_id", currentUserID).Msg("Failed to build statement")
+		writeFetchError(w, err, "Failed to build statement")
+		return
+	}
+
+	filename := fmt.Sprintf("statement-%d-%s-%s-%s.%s", currentUserID, currency, from.Format("20060102"), to.Format("20060102"), format)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+
+	if format == "pdf" {
+		w.Header().Set("Content-Type", "application/pdf")
+		err = writeStatementPDF(w, statement)
+	} else {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		err = writeStatementCSV(w, statement)
+	}
+	if err != nil {
+		h.logger.Error().Err(err).Int("user_id", currentUserID).Str("format", format).Msg("Failed to write statement")
+	}
 }
 
 func (h *TransactionHandler) GetTransaction(w http.ResponseWriter, r *http.Request) {
@@ -166,47 +402,317 @@ func (h *TransactionHandler) GetTransaction(w http.ResponseWriter, r *http.Reque
 	transactionIDStr := vars["id"]
 	transactionID, err := strconv.Atoi(transactionIDStr)
 	if err != nil {
-		h.respondWithError(w, http.StatusBadRequest, "invalid_transaction_id", "Invalid transaction ID")
+		apierror.Write(w, http.StatusBadRequest, "invalid_transaction_id", "Invalid transaction ID")
 		return
 	}
 
 	currentUserID, ok := middleware.GetUserID(r)
 	if !ok {
-		h.respondWithError(w, http.StatusUnauthorized, "unauthorized", "User not authenticated")
+		apierror.Write(w, http.StatusUnauthorized, "unauthorized", "User not authenticated")
 		return
 	}
 
-	transaction, err := h.transactionService.GetTransactionByID(transactionID)
+	transaction, err := h.transactionService.GetTransactionByID(r.Context(), transactionID)
 	if err != nil {
-		h.respondWithError(w, http.StatusNotFound, "transaction_not_found", "Transaction not found")
+		apierror.WriteError(w, err)
 		return
 	}
 
-	userRole, _ := middleware.GetUserRole(r)
-	
-	if userRole != string(models.RoleAdmin) {
-		if (transaction.FromUserID != nil && *transaction.FromUserID != currentUserID) &&
-			(transaction.ToUserID != nil && *transaction.ToUserID != currentUserID) {
-			h.respondWithError(w, http.StatusForbidden, "forbidden", "You can only view your own transactions")
+	if !middleware.IsAdmin(r) {
+		// Withdrawals have no to_user_id, so a nil side must not count as
+		// belonging to the caller.
+		isFrom := transaction.FromUserID != nil && *transaction.FromUserID == currentUserID
+		isTo := transaction.ToUserID != nil && *transaction.ToUserID == currentUserID
+		if !isFrom && !isTo {
+			apierror.Write(w, http.StatusForbidden, "forbidden", "You can only view your own transactions")
 			return
 		}
 	}
 
-	h.respondWithJSON(w, http.StatusOK, transaction)
+	if notModified(w, r, weakETag(transaction.ID, transaction.Status, transaction.Amount)) {
+		return
+	}
+
+	respond(w, r, http.StatusOK, transaction)
 }
 
-func (h *TransactionHandler) respondWithError(w http.ResponseWriter, code int, errorCode, message string) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(code)
-	json.NewEncoder(w).Encode(map[string]string{
-		"error":   errorCode,
-		"message": message,
-	})
+func (h *TransactionHandler) GetAccountState(w http.ResponseWriter, r *http.Request) {
+	transactionID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		apierror.Write(w, http.StatusBadRequest, "invalid_transaction_id", "Invalid transaction ID")
+		return
+	}
+
+	currentUserID, ok := middleware.GetUserID(r)
+	if !ok {
+		apierror.Write(w, http.StatusUnauthorized, "unauthorized", "User not authenticated")
+		return
+	}
+
+	transaction, err := h.transactionService.GetTransactionByID(r.Context(), transactionID)
+	if err != nil {
+		apierror.WriteError(w, err)
+		return
+	}
+
+	isFrom := transaction.FromUserID != nil && *transaction.FromUserID == currentUserID
+	isTo := transaction.ToUserID != nil && *transaction.ToUserID == currentUserID
+
+	var userID int
+	if middleware.IsAdmin(r) {
+		if userIDStr := r.URL.Query().Get("user_id"); userIDStr != "" {
+			uid, err := strconv.Atoi(userIDStr)
+			if err != nil {
+				apierror.Write(w, http.StatusBadRequest, "invalid_user_id", "Invalid user ID")
+				return
+			}
+			userID = uid
+		} else if transaction.FromUserID != nil {
+			userID = *transaction.FromUserID
+		} else if transaction.ToUserID != nil {
+			userID = *transaction.ToUserID
+		}
+	} else {
+		if !isFrom && !isTo {
+			apierror.Write(w, http.StatusForbidden, "forbidden", "You can only view your own transactions")
+			return
+		}
+		userID = currentUserID
+	}
+
+	limit, offset, err := middleware.ParsePagination(r, h.maxPageSize)
+	if err != nil {
+		apierror.WriteError(w, err)
+		return
+	}
+
+	state, err := h.transactionService.GetAccountStateAt(r.Context(), userID, transactionID, limit, offset)
+	if err != nil {
+		h.logger.Error().Err(err).Msg("Failed to reconstruct account state")
+		writeFetchError(w, err, "Failed to fetch account state")
+		return
+	}
+
+	respond(w, r, http.StatusOK, state)
+}
+
+func (h *TransactionHandler) GetStatusHistory(w http.ResponseWriter, r *http.Request) {
+	transactionID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		apierror.Write(w, http.StatusBadRequest, "invalid_transaction_id", "Invalid transaction ID")
+		return
+	}
+
+	currentUserID, ok := middleware.GetUserID(r)
+	if !ok {
+		apierror.Write(w, http.StatusUnauthorized, "unauthorized", "User not authenticated")
+		return
+	}
+
+	transaction, err := h.transactionService.GetTransactionByID(r.Context(), transactionID)
+	if err != nil {
+		apierror.WriteError(w, err)
+		return
+	}
+
+	if !middleware.IsAdmin(r) {
+		isFrom := transaction.FromUserID != nil && *transaction.FromUserID == currentUserID
+		isTo := transaction.ToUserID != nil && *transaction.ToUserID == currentUserID
+		if !isFrom && !isTo {
+			apierror.Write(w, http.StatusForbidden, "forbidden", "You can only view your own transactions")
+			return
+		}
+	}
+
+	history, err := h.transactionService.GetStatusHistory(r.Context(), transactionID)
+	if err != nil {
+		h.logger.Error().Err(err).Msg("Failed to fetch status history")
+		writeFetchError(w, err, "Failed to fetch status history")
+		return
+	}
+
+	respond(w, r, http.StatusOK, history)
 }
 
-func (h *TransactionHandler) respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(code)
-	json.NewEncoder(w).Encode(payload)
+func (h *TransactionHandler) GetMySummary(w http.ResponseWriter, r *http.Request) {
+	currentUserID, ok := middleware.GetUserID(r)
+	if !ok {
+		apierror.Write(w, http.StatusUnauthorized, "unauthorized", "User not authenticated")
+		return
+	}
+
+	currency, err := queryCurrency(r)
+	if err != nil {
+		apierror.WriteError(w, err)
+		return
+	}
+
+	summary, err := h.transactionService.GetAccountSummary(r.Context(), currentUserID, currency)
+	if err != nil {
+		h.logger.Error().Err(err).Msg("Failed to fetch account summary")
+		writeFetchError(w, err, "Failed to fetch account summary")
+		return
+	}
+
+	respond(w, r, http.StatusOK, summary)
+}
+
+// SettlementRateBucket is the TransactionRateLimiter bucket for merchant
+// settlements. They are booked as credits but limited separately, so a
+// merchant cannot use up an admin's credit budget or the other way round.
+const SettlementRateBucket = "settlement"
+
+// Settle credits the calling merchant's own account from an external
+// settlement. The merchant can only ever credit itself, and the settlement
+// reference makes retries safe.
+func (h *TransactionHandler) Settle(w http.ResponseWriter, r *http.Request) {
+	var req models.SettlementRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondWithDecodeError(w, err)
+		return
+	}
+
+	if !validRequest(w, &req) {
+		return
+	}
+
+	currentUserID, ok := middleware.GetUserID(r)
+	if !ok {
+		apierror.Write(w, http.StatusUnauthorized, "unauthorized", "User not authenticated")
+		return
+	}
+
+	if !h.rateLimiter.Allow(currentUserID, SettlementRateBucket) {
+		apierror.Write(w, http.StatusTooManyRequests, "rate_limit_exceeded", "Too many settlement requests. Please try again later.")
+		return
+	}
+
+	transaction, err := h.transactionService.Settle(r.Context(), currentUserID, &req)
+	if err != nil {
+		h.logger.Error().Err(err).Msg("Settlement failed")
+		apierror.WriteError(w, err)
+		return
+	}
+
+	w.Header().Set("Location", transactionLocation(transaction.ID))
+	respond(w, r, http.StatusCreated, transaction)
+}
+
+// GetStats returns the caller's transaction stats; admins may pass user_id
+// to query another user.
+func (h *TransactionHandler) GetStats(w http.ResponseWriter, r *http.Request) {
+	currentUserID, ok := middleware.GetUserID(r)
+	if !ok {
+		apierror.Write(w, http.StatusUnauthorized, "unauthorized", "User not authenticated")
+		return
+	}
+
+	userID := currentUserID
+	if userIDStr := r.URL.Query().Get("user_id"); userIDStr != "" {
+		uid, err := strconv.Atoi(userIDStr)
+		if err != nil {
+			apierror.Write(w, http.StatusBadRequest, "invalid_user_id", "Invalid user ID")
+			return
+		}
+		if uid != currentUserID && !middleware.IsAdmin(r) {
+			apierror.Write(w, http.StatusForbidden, "forbidden", "You can only view your own stats")
+			return
+		}
+		userID = uid
+	}
+
+	from, ok := optionalTimeParam(w, r, "from")
+	if !ok {
+		return
+	}
+	to, ok := optionalTimeParam(w, r, "to")
+	if !ok {
+		return
+	}
+	if !from.IsZero() && !to.IsZero() && from.After(to) {
+		apierror.Write(w, http.StatusBadRequest, "invalid_range", "from must be before to")
+		return
+	}
+
+	currency, err := queryCurrency(r)
+	if err != nil {
+		apierror.WriteError(w, err)
+		return
+	}
+
+	stats, err := h.transactionService.GetUserStats(r.Context(), userID, currency, from, to)
+	if err != nil {
+		h.logger.Error().Err(err).Msg("Failed to fetch transaction stats")
+		writeFetchError(w, err, "Failed to fetch transaction stats")
+		return
+	}
+
+	respond(w, r, http.StatusOK, stats)
+}
+
+// GetMerchantStats returns the calling merchant's settlement and payment
+// totals.
+func (h *TransactionHandler) GetMerchantStats(w http.ResponseWriter, r *http.Request) {
+	currentUserID, ok := middleware.GetUserID(r)
+	if !ok {
+		apierror.Write(w, http.StatusUnauthorized, "unauthorized", "User not authenticated")
+		return
+	}
+
+	from, ok := optionalTimeParam(w, r, "from")
+	if !ok {
+		return
+	}
+	to, ok := optionalTimeParam(w, r, "to")
+	if !ok {
+		return
+	}
+	if !from.IsZero() && !to.IsZero() && from.After(to) {
+		apierror.Write(w, http.StatusBadRequest, "invalid_range", "from must be before to")
+		return
+	}
+
+	currency, err := queryCurrency(r)
+	if err != nil {
+		apierror.WriteError(w, err)
+		return
+	}
+
+	stats, err := h.transactionService.GetMerchantStats(r.Context(), currentUserID, currency, from, to)
+	if err != nil {
+		h.logger.Error().Err(err).Msg("Failed to fetch merchant stats")
+		writeFetchError(w, err, "Failed to fetch merchant stats")
+		return
+	}
+
+	respond(w, r, http.StatusOK, stats)
+}
+
+// optionalTimeParam parses an RFC3339 query parameter, returning the zero
+// time when it is absent. On a parse error it writes a 400 and returns false.
+func optionalTimeParam(w http.ResponseWriter, r *http.Request, name string) (time.Time, bool) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return time.Time{}, true
+	}
+
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		apierror.Write(w, http.StatusBadRequest, "invalid_time", "Invalid "+name+" time. Use RFC3339 format")
+		return time.Time{}, false
+	}
+	return parsed, true
+}
+
+func idempotencyKeyFromRequest(r *http.Request, userID int) *models.IdempotencyKey {
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		return nil
+	}
+
+	return &models.IdempotencyKey{
+		UserID: userID,
+		Key:    key,
+	}
 }
 
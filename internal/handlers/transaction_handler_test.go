@@ -0,0 +1,427 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"go-projects/internal/lifecycle"
+	"go-projects/internal/middleware"
+	"go-projects/internal/models"
+	"go-projects/internal/services"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
+)
+
+var (
+	transactionByIDQuery = regexp.QuoteMeta("FROM transactions WHERE id = ?")
+	transactionColumns   = []string{"id", "from_user_id", "to_user_id", "amount", "currency", "to_currency", "to_amount", "exchange_rate", "type", "status", "failure_reason", "reason", "memo", "external_reference", "parent_transaction_id", "created_at"}
+)
+
+// transactionRow is a credit of 10.00 to user 2.
+func transactionRow(id int, status string) *sqlmock.Rows {
+	return sqlmock.NewRows(transactionColumns).AddRow(id, nil, 2, 10.0, "USD", nil, nil, nil, "credit", status, nil, nil, nil, nil, nil, time.Now())
+}
+
+// withdrawalRow is a withdrawal of 10.00 by user 3.
+func withdrawalRow(id int) *sqlmock.Rows {
+	return sqlmock.NewRows(transactionColumns).AddRow(id, 3, nil, 10.0, "USD", nil, nil, nil, "withdrawal", "completed", nil, nil, nil, "IBAN-1", nil, time.Now())
+}
+
+func newTestTransactionHandler(t *testing.T) (*TransactionHandler, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock := newMockDB(t)
+	balances := services.NewBalanceService(db, zerolog.Nop())
+	transactions := services.NewTransactionService(db, zerolog.Nop(), balances, time.Minute, services.TransactionLimits{}, lifecycle.NewTracker())
+	return NewTransactionHandler(transactions, zerolog.Nop(), middleware.NewTransactionRateLimiter(nil), 100), mock
+}
+
+func TestCreditReusedIdempotencyKeyConflicts(t *testing.T) {
+	handler, mock := newTestTransactionHandler(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("FROM idempotency_keys")).WithArgs(1, "key-1").
+		WillReturnRows(sqlmock.NewRows([]string{"request_hash", "transaction_id", "created_at"}).AddRow("another-request", 9, time.Now()))
+	mock.ExpectRollback()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/transactions/credit", strings.NewReader(`{"user_id":2,"amount":10,"reason":"goodwill"}`))
+	req.Header.Set("Idempotency-Key", "key-1")
+	rec := httptest.NewRecorder()
+	handler.Credit(rec, withUser(req, 1, "admin"))
+
+	if rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), "idempotency_conflict") {
+		t.Errorf("got %d %s, want 409 idempotency_conflict", rec.Code, rec.Body.String())
+	}
+}
+
+func TestCreditSetsLocation(t *testing.T) {
+	handler, mock := newTestTransactionHandler(t)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO transactions")).WillReturnResult(sqlmock.NewResult(7, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO transaction_status_history")).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT amount, overdraft_limit, version FROM balances")).
+		WillReturnRows(sqlmock.NewRows([]string{"amount", "overdraft_limit", "version"}).AddRow("0.00", "0.00", 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE balances")).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO balance_history")).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE transactions SET status")).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO transaction_status_history")).WillReturnResult(sqlmock.NewResult(2, 1))
+	mock.ExpectCommit()
+	mock.ExpectQuery(transactionByIDQuery).WithArgs(7).WillReturnRows(transactionRow(7, "completed"))
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/transactions/credit", strings.NewReader(`{"user_id":2,"amount":10,"reason":"goodwill"}`))
+	rec := httptest.NewRecorder()
+	handler.Credit(rec, withUser(req, 1, "admin"))
+
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status = %d (%s), want 201", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("Location"); got != "/api/v1/transactions/7" {
+		t.Errorf("Location = %q, want /api/v1/transactions/7", got)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGetTransactionETag(t *testing.T) {
+	handler, mock := newTestTransactionHandler(t)
+	get := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/api/v1/transactions/5", nil), map[string]string{"id": "5"})
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rec := httptest.NewRecorder()
+		handler.GetTransaction(rec, withUser(req, 2, "user"))
+		return rec
+	}
+
+	mock.ExpectQuery(transactionByIDQuery).WithArgs(5).WillReturnRows(transactionRow(5, "completed"))
+	first := get("")
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" {
+		t.Fatalf("first read = %d with ETag %q, want 200 with an ETag", first.Code, etag)
+	}
+
+	mock.ExpectQuery(transactionByIDQuery).WithArgs(5).WillReturnRows(transactionRow(5, "completed"))
+	if rec := get(etag); rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Errorf("unchanged read = %d with %d body bytes, want 304 and no body", rec.Code, rec.Body.Len())
+	}
+
+	mock.ExpectQuery(transactionByIDQuery).WithArgs(5).WillReturnRows(transactionRow(5, "rolled_back"))
+	if rec := get(etag); rec.Code != http.StatusOK || rec.Header().Get("ETag") == etag {
+		t.Errorf("changed read = %d with ETag %q, want 200 and a new ETag", rec.Code, rec.Header().Get("ETag"))
+	}
+}
+
+func TestGetTransactionLookupErrors(t *testing.T) {
+	handler, mock := newTestTransactionHandler(t)
+	get := func() *httptest.ResponseRecorder {
+		req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/api/v1/transactions/5", nil), map[string]string{"id": "5"})
+		rec := httptest.NewRecorder()
+		handler.GetTransaction(rec, withUser(req, 2, "user"))
+		return rec
+	}
+
+	mock.ExpectQuery(transactionByIDQuery).WithArgs(5).WillReturnError(sql.ErrNoRows)
+	if rec := get(); rec.Code != http.StatusNotFound || !strings.Contains(rec.Body.String(), "transaction_not_found") {
+		t.Errorf("missing transaction: got %d %s, want 404 transaction_not_found", rec.Code, rec.Body.String())
+	}
+
+	mock.ExpectQuery(transactionByIDQuery).WithArgs(5).WillReturnError(errors.New("connection reset"))
+	if rec := get(); rec.Code != http.StatusInternalServerError || strings.Contains(rec.Body.String(), "connection reset") {
+		t.Errorf("database failure: got %d %s, want a generic 500", rec.Code, rec.Body.String())
+	}
+}
+
+func TestGetTransactionOwnership(t *testing.T) {
+	tests := []struct {
+		name   string
+		row    *sqlmock.Rows
+		userID int
+		role   string
+		want   int
+	}{
+		{"recipient of a credit", transactionRow(5, "completed"), 2, "user", http.StatusOK},
+		{"stranger to a credit", transactionRow(5, "completed"), 4, "user", http.StatusForbidden},
+		{"merchant of a withdrawal", withdrawalRow(5), 3, "merchant", http.StatusOK},
+		{"stranger to a withdrawal", withdrawalRow(5), 4, "user", http.StatusForbidden},
+		{"admin", withdrawalRow(5), 1, "admin", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, mock := newTestTransactionHandler(t)
+			mock.ExpectQuery(transactionByIDQuery).WithArgs(5).WillReturnRows(tt.row)
+
+			req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/api/v1/transactions/5", nil), map[string]string{"id": "5"})
+			rec := httptest.NewRecorder()
+			handler.GetTransaction(rec, withUser(req, tt.userID, tt.role))
+
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithdrawRequiresMerchant(t *testing.T) {
+	handler, _ := newTestTransactionHandler(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/transactions/withdraw", strings.NewReader(`{"user_id":2,"amount":10,"destination":"IBAN-1"}`))
+	rec := httptest.NewRecorder()
+	handler.Withdraw(rec, withUser(req, 2, "user"))
+
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("status = %d, want 403 for a regular user", rec.Code)
+	}
+}
+
+func TestTransferExchangeRateIsAdminOnly(t *testing.T) {
+	handler, mock := newTestTransactionHandler(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/transactions/transfer",
+		strings.NewReader(`{"from_user_id":2,"to_user_id":3,"amount":10,"currency":"USD","to_currency":"EUR","exchange_rate":0.9}`))
+	rec := httptest.NewRecorder()
+	handler.Transfer(rec, withUser(req, 2, "user"))
+
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("status = %d (%s), want 403 for a user-supplied exchange rate", rec.Code, rec.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGetHistoryClampsLimitAndReportsTotal(t *testing.T) {
+	handler, mock := newTestTransactionHandler(t)
+
+	mock.ExpectQuery(regexp.QuoteMeta("LIMIT ? OFFSET ?")).WithArgs(2, 2, 100, 20).
+		WillReturnRows(transactionRow(5, "completed"))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM transactions")).WithArgs(2, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(21))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/transactions/history?limit=500&offset=20", nil)
+	rec := httptest.NewRecorder()
+	handler.GetHistory(rec, withUser(req, 2, "user"))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d (%s), want 200", rec.Code, rec.Body.String())
+	}
+	var page struct {
+		Items      []json.RawMessage `json:"items"`
+		Limit      int               `json:"limit"`
+		Offset     int               `json:"offset"`
+		TotalCount int               `json:"total_count"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Items) != 1 || page.Limit != 100 || page.Offset != 20 || page.TotalCount != 21 {
+		t.Errorf("page = %+v, want 1 item, limit 100, offset 20, total 21", page)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCreditValidationReturns422(t *testing.T) {
+	handler, mock := newTestTransactionHandler(t)
+
+	for body, field := range map[string]string{
+		`{"user_id":2,"amount":1.005}`: "amount",
+		`{"user_id":2,"amount":0}`:     "amount",
+		`{"amount":10}`:                "user_id",
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/transactions/credit", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		handler.Credit(rec, withUser(req, 1, "admin"))
+
+		var resp struct {
+			Error  string            `json:"error"`
+			Fields map[string]string `json:"fields"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		if rec.Code != http.StatusUnprocessableEntity || resp.Fields[field] == "" {
+			t.Errorf("%s: got %d %s, want 422 naming %s", body, rec.Code, rec.Body.String(), field)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSettleRequiresReference(t *testing.T) {
+	handler, mock := newTestTransactionHandler(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/merchant/settlements", strings.NewReader(`{"amount":10}`))
+	rec := httptest.NewRecorder()
+	handler.Settle(rec, withUser(req, 4, "merchant"))
+
+	if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), `"reference"`) {
+		t.Errorf("got %d %s, want 422 naming the reference", rec.Code, rec.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSettleHasItsOwnRateLimit(t *testing.T) {
+	handler, mock := newTestTransactionHandler(t)
+	handler.rateLimiter = middleware.NewTransactionRateLimiter(map[string]int{"credit": 1, SettlementRateBucket: 1})
+	t.Cleanup(handler.rateLimiter.Stop)
+
+	// An exhausted credit budget does not block settlements.
+	handler.rateLimiter.Allow(4, "credit")
+	mock.ExpectBegin().WillReturnError(errors.New("db down"))
+
+	settle := func() int {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/merchant/settlements", strings.NewReader(`{"amount":10,"reference":"payout-1"}`))
+		rec := httptest.NewRecorder()
+		handler.Settle(rec, withUser(req, 4, "merchant"))
+		return rec.Code
+	}
+
+	if code := settle(); code == http.StatusTooManyRequests {
+		t.Fatalf("first settlement was rate limited")
+	}
+	if code := settle(); code != http.StatusTooManyRequests {
+		t.Errorf("second settlement status = %d, want 429", code)
+	}
+}
+
+func TestManualAdjustmentsRequireReason(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		userID int
+		role   string
+		call   func(h *TransactionHandler) http.HandlerFunc
+	}{
+		{"admin credit", `{"user_id":2,"amount":10}`, 1, "admin", func(h *TransactionHandler) http.HandlerFunc { return h.Credit }},
+		{"blank reason", `{"user_id":2,"amount":10,"reason":"  "}`, 1, "admin", func(h *TransactionHandler) http.HandlerFunc { return h.Credit }},
+		{"admin debit of another user", `{"user_id":2,"amount":10}`, 1, "admin", func(h *TransactionHandler) http.HandlerFunc { return h.Debit }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, mock := newTestTransactionHandler(t)
+
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/transactions", strings.NewReader(tt.body))
+			rec := httptest.NewRecorder()
+			tt.call(handler)(rec, withUser(req, tt.userID, tt.role))
+
+			if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), `"reason"`) {
+				t.Errorf("got %d %s, want 422 naming the reason", rec.Code, rec.Body.String())
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// A user debiting their own account is not a manual adjustment.
+func TestOwnDebitNeedsNoReason(t *testing.T) {
+	handler, mock := newTestTransactionHandler(t)
+	mock.ExpectBegin().WillReturnError(errors.New("db down"))
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/transactions/debit", strings.NewReader(`{"user_id":2,"amount":10}`))
+	rec := httptest.NewRecorder()
+	handler.Debit(rec, withUser(req, 2, "user"))
+
+	if rec.Code == http.StatusUnprocessableEntity {
+		t.Errorf("own debit was rejected: %s", rec.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGetStatsOtherUserIsAdminOnly(t *testing.T) {
+	handler, mock := newTestTransactionHandler(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/transactions/stats?user_id=3", nil)
+	rec := httptest.NewRecorder()
+	handler.GetStats(rec, withUser(req, 2, "user"))
+
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("status = %d, want 403 for another user's stats", rec.Code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGetTransactionNegotiatesContentType(t *testing.T) {
+	tests := []struct {
+		accept  string
+		wantXML bool
+	}{
+		{"", false},
+		{"application/json", false},
+		{"application/xml", true},
+		{"text/xml", true},
+		{"application/json;q=0.5, application/xml", true},
+		{"application/xml;q=0.5, */*", false},
+		{"text/html", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			handler, mock := newTestTransactionHandler(t)
+			mock.ExpectQuery(transactionByIDQuery).WithArgs(5).WillReturnRows(transactionRow(5, "completed"))
+
+			req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/api/v1/transactions/5", nil), map[string]string{"id": "5"})
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			rec := httptest.NewRecorder()
+			handler.GetTransaction(rec, withUser(req, 2, "user"))
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d (%s), want 200", rec.Code, rec.Body.String())
+			}
+			if vary := rec.Header().Get("Vary"); !strings.Contains(vary, "Accept") {
+				t.Errorf("Vary = %q, want it to include Accept", vary)
+			}
+
+			// Amounts are decimal strings in XML and numbers in JSON.
+			var transaction struct {
+				ID     int    `json:"id" xml:"id"`
+				Status string `json:"status" xml:"status"`
+			}
+			contentType := rec.Header().Get("Content-Type")
+			if tt.wantXML {
+				if !strings.HasPrefix(contentType, "application/xml") {
+					t.Fatalf("Content-Type = %q, want application/xml", contentType)
+				}
+				if err := xml.Unmarshal(rec.Body.Bytes(), &transaction); err != nil {
+					t.Fatalf("decode XML: %v\n%s", err, rec.Body.String())
+				}
+				if !strings.Contains(rec.Body.String(), "<amount>10.00</amount>") {
+					t.Errorf("body = %s, want the amount as a decimal string", rec.Body.String())
+				}
+			} else {
+				if contentType != "application/json" {
+					t.Fatalf("Content-Type = %q, want application/json", contentType)
+				}
+				if err := json.Unmarshal(rec.Body.Bytes(), &transaction); err != nil {
+					t.Fatalf("decode JSON: %v\n%s", err, rec.Body.String())
+				}
+			}
+			if transaction.ID != 5 || transaction.Status != string(models.TransactionStatusCompleted) {
+				t.Errorf("transaction = %+v, want completed transaction 5", transaction)
+			}
+		})
+	}
+}
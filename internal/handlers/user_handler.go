@@ -2,10 +2,10 @@ package handlers
 
 import (
 	"database/sql"
-	"encoding/json"
 	"net/http"
 	"strconv"
 
+	"go-projects/internal/apierror"
 	"go-projects/internal/middleware"
 	"go-projects/internal/models"
 	"go-projects/internal/services"
@@ -16,25 +16,85 @@ import (
 
 type UserHandler struct {
 	userService *services.UserService
-	logger zerolog.Logger
+	logger      zerolog.Logger
+	maxPageSize int
 }
 
-func NewUserHandler(db *sql.DB, logger zerolog.Logger) *UserHandler {
+func NewUserHandler(db *sql.DB, logger zerolog.Logger, maxPageSize int) *UserHandler {
 	return &UserHandler{
 		userService: services.NewUserService(db, logger),
-		logger: logger,
+		logger:      logger,
+		maxPageSize: maxPageSize,
 	}
 }
 
+func (h *UserHandler) CreateUser(w http.ResponseWriter, r *http.Request) {
+	var req models.CreateUserRequest
+	if err := decodeJSON(r, &req); err != nil {
+		respondWithDecodeError(w, err)
+		return
+	}
+	if !validRequest(w, &req) {
+		return
+	}
+
+	currentUserID, _ := middleware.GetUserID(r)
+
+	user, temporaryPassword, err := h.userService.CreateUser(r.Context(), &req, currentUserID)
+	if err != nil {
+		apierror.WriteError(w, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	respond(w, r, http.StatusCreated, models.CreateUserResponse{
+		User:              user,
+		TemporaryPassword: temporaryPassword,
+	})
+}
+
 func (h *UserHandler) GetUsers(w http.ResponseWriter, r *http.Request) {
-	userRole, ok := middleware.GetUserRole(r)
-	if !ok || userRole != string(models.RoleAdmin) {
-		h.respondWithError(w, http.StatusForbidden, "forbidden", "Only admins can view all users")
+	if !middleware.IsAdmin(r) {
+		apierror.Write(w, http.StatusForbidden, "forbidden", "Only admins can view all users")
+		return
+	}
+
+	if email := r.URL.Query().Get("email"); email != "" {
+		user, err := h.userService.GetUserByEmail(r.Context(), email)
+		if err != nil {
+			apierror.WriteError(w, err)
+			return
+		}
+
+		user.PasswordHash = ""
+		respond(w, r, http.StatusOK, user)
 		return
 	}
 
-	h.respondWithJSON(w, http.StatusOK, map[string]string{
-		"message": "Get all users - implementation needed",
+	limit, offset, err := middleware.ParsePagination(r, h.maxPageSize)
+	if err != nil {
+		apierror.WriteError(w, err)
+		return
+	}
+
+	role := r.URL.Query().Get("role")
+	if role != "" && !models.UserRole(role).IsValid() {
+		apierror.Write(w, http.StatusBadRequest, "invalid_role", services.ErrInvalidRole.Error())
+		return
+	}
+
+	users, total, err := h.userService.ListUsers(r.Context(), limit, offset, role)
+	if err != nil {
+		h.logger.Error().Err(err).Msg("Failed to list users")
+		writeFetchError(w, err, "Failed to fetch users")
+		return
+	}
+
+	respond(w, r, http.StatusOK, map[string]interface{}{
+		"users":       users,
+		"total_count": total,
+		"limit":       limit,
+		"offset":      offset,
 	})
 }
 
@@ -43,31 +103,48 @@ func (h *UserHandler) GetUser(w http.ResponseWriter, r *http.Request) {
 	userIDStr := vars["id"]
 	userID, err := strconv.Atoi(userIDStr)
 	if err != nil {
-		h.respondWithError(w, http.StatusBadRequest, "invalid_user_id", "Invalid user ID")
+		apierror.Write(w, http.StatusBadRequest, "invalid_user_id", "Invalid user ID")
 		return
 	}
 
 	currentUserID, ok := middleware.GetUserID(r)
 	if !ok {
-		h.respondWithError(w, http.StatusUnauthorized, "unauthorized", "User not authenticated")
+		apierror.Write(w, http.StatusUnauthorized, "unauthorized", "User not authenticated")
 		return
 	}
 
-	userRole, _ := middleware.GetUserRole(r)
-	
-	if userRole != string(models.RoleAdmin) && currentUserID != userID {
-		h.respondWithError(w, http.StatusForbidden, "forbidden", "You can only view your own profile")
+	if !middleware.IsAdmin(r) && currentUserID != userID {
+		apierror.Write(w, http.StatusForbidden, "forbidden", "You can only view your own profile")
 		return
 	}
 
-	user, err := h.userService.GetUserByID(userID)
+	user, err := h.userService.GetUserByID(r.Context(), userID)
 	if err != nil {
-		h.respondWithError(w, http.StatusNotFound, "user_not_found", "User not found")
+		apierror.WriteError(w, err)
 		return
 	}
 
 	user.PasswordHash = ""
-	h.respondWithJSON(w, http.StatusOK, user)
+	respond(w, r, http.StatusOK, user)
+}
+
+// GetCurrentUser returns the caller's own profile without the client having
+// to know its user ID.
+func (h *UserHandler) GetCurrentUser(w http.ResponseWriter, r *http.Request) {
+	currentUserID, ok := middleware.GetUserID(r)
+	if !ok {
+		apierror.Write(w, http.StatusUnauthorized, "unauthorized", "User not authenticated")
+		return
+	}
+
+	user, err := h.userService.GetUserByID(r.Context(), currentUserID)
+	if err != nil {
+		apierror.WriteError(w, err)
+		return
+	}
+
+	user.PasswordHash = ""
+	respond(w, r, http.StatusOK, user)
 }
 
 func (h *UserHandler) UpdateUser(w http.ResponseWriter, r *http.Request) {
@@ -75,58 +152,63 @@ func (h *UserHandler) UpdateUser(w http.ResponseWriter, r *http.Request) {
 	userIDStr := vars["id"]
 	userID, err := strconv.Atoi(userIDStr)
 	if err != nil {
-		h.respondWithError(w, http.StatusBadRequest, "invalid_user_id", "Invalid user ID")
+		apierror.Write(w, http.StatusBadRequest, "invalid_user_id", "Invalid user ID")
 		return
 	}
 
 	currentUserID, ok := middleware.GetUserID(r)
 	if !ok {
-		h.respondWithError(w, http.StatusUnauthorized, "unauthorized", "User not authenticated")
+		apierror.Write(w, http.StatusUnauthorized, "unauthorized", "User not authenticated")
 		return
 	}
 
-	userRole, _ := middleware.GetUserRole(r)
-	
-	if userRole != string(models.RoleAdmin) && currentUserID != userID {
-		h.respondWithError(w, http.StatusForbidden, "forbidden", "You can only update your own profile")
+	if !middleware.IsAdmin(r) && currentUserID != userID {
+		apierror.Write(w, http.StatusForbidden, "forbidden", "You can only update your own profile")
 		return
 	}
 
-	var updateReq struct {
-		Username string `json:"username,omitempty"`
-		Email    string `json:"email,omitempty"`
-		Role     string `json:"role,omitempty"`
+	var updateReq models.UpdateUserRequest
+	if err := decodeJSON(r, &updateReq); err != nil {
+		respondWithDecodeError(w, err)
+		return
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&updateReq); err != nil {
-		h.respondWithError(w, http.StatusBadRequest, "invalid_request", "Invalid request body")
+	if updateReq.Role != "" && !models.UserRole(updateReq.Role).IsValid() {
+		apierror.Write(w, http.StatusBadRequest, "invalid_role", services.ErrInvalidRole.Error())
 		return
 	}
-
-	user, err := h.userService.GetUserByID(userID)
-	if err != nil {
-		h.respondWithError(w, http.StatusNotFound, "user_not_found", "User not found")
+	if !validRequest(w, &updateReq) {
 		return
 	}
 
-	if updateReq.Username != "" {
-		user.Username = updateReq.Username
-	}
-	if updateReq.Email != "" {
-		user.Email = updateReq.Email
+	// Username and email go first: their uniqueness check is the one failure
+	// a valid request can still hit, and nothing else has been written yet.
+	if _, err := h.userService.UpdateProfile(r.Context(), userID, updateReq.Username, updateReq.Email); err != nil {
+		apierror.WriteError(w, err)
+		return
 	}
-	
-	if updateReq.Role != "" && userRole == string(models.RoleAdmin) {
-		err = h.userService.UpdateUserRole(userID, updateReq.Role, currentUserID)
+
+	if updateReq.Role != "" && middleware.IsAdmin(r) {
+		err = h.userService.UpdateUserRole(r.Context(), userID, updateReq.Role, currentUserID)
 		if err != nil {
-			h.respondWithError(w, http.StatusBadRequest, "update_failed", err.Error())
+			apierror.WriteError(w, err)
 			return
 		}
-		user.Role = updateReq.Role
+	}
+
+	if err = h.userService.UpdateProfileDetails(r.Context(), userID, updateReq.ProfileDetails); err != nil {
+		apierror.WriteError(w, err)
+		return
+	}
+
+	user, err := h.userService.GetUserByID(r.Context(), userID)
+	if err != nil {
+		apierror.WriteError(w, err)
+		return
 	}
 
 	user.PasswordHash = ""
-	h.respondWithJSON(w, http.StatusOK, map[string]interface{}{
+	respond(w, r, http.StatusOK, map[string]interface{}{
 		"message": "User updated successfully",
 		"user":    user,
 	})
@@ -137,39 +219,64 @@ func (h *UserHandler) DeleteUser(w http.ResponseWriter, r *http.Request) {
 	userIDStr := vars["id"]
 	userID, err := strconv.Atoi(userIDStr)
 	if err != nil {
-		h.respondWithError(w, http.StatusBadRequest, "invalid_user_id", "Invalid user ID")
+		apierror.Write(w, http.StatusBadRequest, "invalid_user_id", "Invalid user ID")
+		return
+	}
+
+	if !middleware.IsAdmin(r) {
+		apierror.Write(w, http.StatusForbidden, "forbidden", "Only admins can delete users")
+		return
+	}
+
+	currentUserID, ok := middleware.GetUserID(r)
+	if !ok {
+		apierror.Write(w, http.StatusUnauthorized, "unauthorized", "User not authenticated")
 		return
 	}
 
-	userRole, ok := middleware.GetUserRole(r)
-	if !ok || userRole != string(models.RoleAdmin) {
-		h.respondWithError(w, http.StatusForbidden, "forbidden", "Only admins can delete users")
+	_, err = h.userService.GetUserByID(r.Context(), userID)
+	if err != nil {
+		apierror.WriteError(w, err)
 		return
 	}
 
-	_, err = h.userService.GetUserByID(userID)
+	err = h.userService.DeleteUser(r.Context(), userID, currentUserID)
 	if err != nil {
-		h.respondWithError(w, http.StatusNotFound, "user_not_found", "User not found")
+		h.logger.Error().Err(err).Int("user_id", userID).Msg("User deletion failed")
+		apierror.WriteError(w, err)
 		return
 	}
 
-	h.respondWithJSON(w, http.StatusOK, map[string]string{
+	respond(w, r, http.StatusOK, map[string]string{
 		"message": "User deleted successfully",
 	})
 }
 
-func (h *UserHandler) respondWithError(w http.ResponseWriter, code int, errorCode, message string) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(code)
-	json.NewEncoder(w).Encode(map[string]string{
-		"error":   errorCode,
-		"message": message,
-	})
+func (h *UserHandler) FreezeUser(w http.ResponseWriter, r *http.Request) {
+	h.setUserStatus(w, r, models.UserStatusFrozen)
+}
+
+func (h *UserHandler) UnfreezeUser(w http.ResponseWriter, r *http.Request) {
+	h.setUserStatus(w, r, models.UserStatusActive)
 }
 
-func (h *UserHandler) respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(code)
-	json.NewEncoder(w).Encode(payload)
+func (h *UserHandler) setUserStatus(w http.ResponseWriter, r *http.Request, status models.UserStatus) {
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		apierror.Write(w, http.StatusBadRequest, "invalid_user_id", "Invalid user ID")
+		return
+	}
+
+	currentUserID, _ := middleware.GetUserID(r)
+
+	if err := h.userService.SetUserStatus(r.Context(), userID, status, currentUserID); err != nil {
+		apierror.WriteError(w, err)
+		return
+	}
+
+	respond(w, r, http.StatusOK, map[string]interface{}{
+		"user_id": userID,
+		"status":  status,
+	})
 }
 
@@ -0,0 +1,310 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
+)
+
+func TestUpdateUserRejectsUnknownRole(t *testing.T) {
+	db, mock := newMockDB(t)
+	handler := NewUserHandler(db, zerolog.Nop(), 100)
+
+	req := httptest.NewRequest(http.MethodPut, "/api/v1/users/7", strings.NewReader(`{"role":"superuser"}`))
+	req = mux.SetURLVars(req, map[string]string{"id": "7"})
+	rec := httptest.NewRecorder()
+	handler.UpdateUser(rec, withUser(req, 1, "admin"))
+
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "invalid_role") {
+		t.Errorf("got %d %s, want 400 invalid_role", rec.Code, rec.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUpdateUserProfileDetails(t *testing.T) {
+	db, mock := newMockDB(t)
+	handler := NewUserHandler(db, zerolog.Nop(), 100)
+
+	userRow := func(phone interface{}) *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"id", "username", "email", "full_name", "phone", "avatar_url", "password_hash", "role", "status", "created_at", "updated_at"}).
+			AddRow(7, "eve", "eve@example.com", "Eve", phone, nil, "hash", "user", "active", time.Now(), time.Now())
+	}
+	mock.ExpectQuery(regexp.QuoteMeta("FROM users WHERE id = ?")).WithArgs(7).WillReturnRows(userRow("+905551234567"))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET phone = ? WHERE id = ? AND deleted_at IS NULL")).
+		WithArgs(nil, 7).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta("FROM users WHERE id = ?")).WithArgs(7).WillReturnRows(userRow(nil))
+
+	req := httptest.NewRequest(http.MethodPut, "/api/v1/users/7", strings.NewReader(`{"phone":""}`))
+	req = mux.SetURLVars(req, map[string]string{"id": "7"})
+	rec := httptest.NewRecorder()
+	handler.UpdateUser(rec, withUser(req, 7, "user"))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d (%s), want 200", rec.Code, rec.Body.String())
+	}
+	var resp struct {
+		User map[string]interface{} `json:"user"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.User["full_name"] != "Eve" {
+		t.Errorf("full_name = %v, want it left as Eve", resp.User["full_name"])
+	}
+	if _, ok := resp.User["phone"]; ok {
+		t.Errorf("phone = %v, want it cleared", resp.User["phone"])
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestUpdateUserTakenUsernameWritesNothing checks that a 409 from the
+// username check leaves the role and profile details in the same request
+// unwritten.
+func TestUpdateUserTakenUsernameWritesNothing(t *testing.T) {
+	db, mock := newMockDB(t)
+	handler := NewUserHandler(db, zerolog.Nop(), 100)
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id FROM users WHERE (username = ?) AND id <> ? LIMIT 1")).
+		WithArgs("bob", 7).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(8))
+
+	req := httptest.NewRequest(http.MethodPut, "/api/v1/users/7", strings.NewReader(`{"username":"bob","role":"merchant","full_name":"Bob"}`))
+	req = mux.SetURLVars(req, map[string]string{"id": "7"})
+	rec := httptest.NewRecorder()
+	handler.UpdateUser(rec, withUser(req, 1, "admin"))
+
+	if rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), "user_exists") {
+		t.Errorf("got %d %s, want 409 user_exists", rec.Code, rec.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUpdateUserRejectsInvalidProfileDetails(t *testing.T) {
+	db, mock := newMockDB(t)
+	handler := NewUserHandler(db, zerolog.Nop(), 100)
+
+	req := httptest.NewRequest(http.MethodPut, "/api/v1/users/7", strings.NewReader(`{"phone":"555-1234","avatar_url":"ftp://example.com/a.png"}`))
+	req = mux.SetURLVars(req, map[string]string{"id": "7"})
+	rec := httptest.NewRecorder()
+	handler.UpdateUser(rec, withUser(req, 7, "user"))
+
+	if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), `"phone"`) || !strings.Contains(rec.Body.String(), `"avatar_url"`) {
+		t.Errorf("got %d %s, want 422 naming phone and avatar_url", rec.Code, rec.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGetUserErrors(t *testing.T) {
+	db, mock := newMockDB(t)
+	handler := NewUserHandler(db, zerolog.Nop(), 100)
+	get := func() *httptest.ResponseRecorder {
+		req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/api/v1/users/7", nil), map[string]string{"id": "7"})
+		rec := httptest.NewRecorder()
+		handler.GetUser(rec, withUser(req, 1, "admin"))
+		return rec
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta("FROM users WHERE id = ?")).WithArgs(7).WillReturnError(sql.ErrNoRows)
+	if rec := get(); rec.Code != http.StatusNotFound || !strings.Contains(rec.Body.String(), "user_not_found") {
+		t.Errorf("missing user: got %d %s, want 404 user_not_found", rec.Code, rec.Body.String())
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta("FROM users WHERE id = ?")).WithArgs(7).
+		WillReturnError(errors.New("Error 1054: Unknown column 'deleted_at'"))
+	if rec := get(); rec.Code != http.StatusInternalServerError || strings.Contains(rec.Body.String(), "deleted_at") {
+		t.Errorf("database failure: got %d %s, want a generic 500", rec.Code, rec.Body.String())
+	}
+}
+
+func TestGetUsersReturnsPageWithTotal(t *testing.T) {
+	db, mock := newMockDB(t)
+	handler := NewUserHandler(db, zerolog.Nop(), 100)
+
+	now := time.Now()
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM users`).WithArgs("merchant").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+	mock.ExpectQuery(`ORDER BY created_at DESC`).WithArgs("merchant", 2, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "email", "full_name", "phone", "avatar_url", "role", "status", "created_at", "updated_at"}).
+			AddRow(4, "shop", "shop@example.com", nil, nil, nil, "merchant", "active", now, now))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/users?limit=2&offset=1&role=merchant", nil)
+	rec := httptest.NewRecorder()
+	handler.GetUsers(rec, withUser(req, 1, "admin"))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d (%s), want 200", rec.Code, rec.Body.String())
+	}
+	var resp struct {
+		Users      []map[string]interface{} `json:"users"`
+		TotalCount int                      `json:"total_count"`
+		Limit      int                      `json:"limit"`
+		Offset     int                      `json:"offset"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Users) != 1 || resp.TotalCount != 3 || resp.Limit != 2 || resp.Offset != 1 {
+		t.Errorf("response = %+v, want one user of 3 with limit 2 and offset 1", resp)
+	}
+	if _, ok := resp.Users[0]["password_hash"]; ok {
+		t.Error("listing exposes password_hash")
+	}
+}
+
+func TestGetUsersRequiresAdmin(t *testing.T) {
+	db, _ := newMockDB(t)
+	handler := NewUserHandler(db, zerolog.Nop(), 100)
+
+	rec := httptest.NewRecorder()
+	handler.GetUsers(rec, withUser(httptest.NewRequest(http.MethodGet, "/api/v1/users", nil), 2, "user"))
+
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("status = %d, want 403", rec.Code)
+	}
+}
+
+func TestCreateUserReturnsTemporaryPassword(t *testing.T) {
+	db, mock := newMockDB(t)
+	handler := NewUserHandler(db, zerolog.Nop(), 100)
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id FROM users WHERE email = ? OR username = ?")).WillReturnError(sql.ErrNoRows)
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO users")).
+		WithArgs("carol", "carol@example.com", sqlmock.AnyArg(), "merchant").WillReturnResult(sqlmock.NewResult(42, 1))
+	mock.ExpectQuery(regexp.QuoteMeta("FROM users WHERE id = ?")).WithArgs(42).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "email", "full_name", "phone", "avatar_url", "password_hash", "role", "status", "created_at", "updated_at"}).
+			AddRow(42, "carol", "carol@example.com", nil, nil, nil, "hash", "merchant", "active", time.Now(), time.Now()))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_logs")).WithArgs("user", 42, "created", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/users", strings.NewReader(`{"username":"carol","email":"carol@example.com","role":"merchant"}`))
+	rec := httptest.NewRecorder()
+	handler.CreateUser(rec, withUser(req, 1, "admin"))
+
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status = %d (%s), want 201", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("Cache-Control"); got != "no-store" {
+		t.Errorf("Cache-Control = %q, want no-store", got)
+	}
+	var resp struct {
+		User              map[string]interface{} `json:"user"`
+		TemporaryPassword string                 `json:"temporary_password"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.TemporaryPassword == "" || resp.User["role"] != "merchant" {
+		t.Errorf("response = %s, want the merchant and a temporary password", rec.Body.String())
+	}
+	if _, ok := resp.User["password_hash"]; ok {
+		t.Error("response exposes password_hash")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCreateUserRequiresRole(t *testing.T) {
+	db, mock := newMockDB(t)
+	handler := NewUserHandler(db, zerolog.Nop(), 100)
+
+	for _, body := range []string{
+		`{"username":"carol","email":"carol@example.com"}`,
+		`{"username":"carol","email":"carol@example.com","role":"superuser"}`,
+	} {
+		rec := httptest.NewRecorder()
+		handler.CreateUser(rec, withUser(httptest.NewRequest(http.MethodPost, "/api/v1/users", strings.NewReader(body)), 1, "admin"))
+
+		if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), `"role"`) {
+			t.Errorf("%s: got %d %s, want 422 naming role", body, rec.Code, rec.Body.String())
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGetCurrentUser(t *testing.T) {
+	db, mock := newMockDB(t)
+	handler := NewUserHandler(db, zerolog.Nop(), 100)
+
+	mock.ExpectQuery(regexp.QuoteMeta("FROM users WHERE id = ?")).WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "email", "full_name", "phone", "avatar_url", "password_hash", "role", "status", "created_at", "updated_at"}).
+			AddRow(7, "eve", "eve@example.com", nil, nil, nil, "hash", "user", "active", time.Now(), time.Now()))
+
+	rec := httptest.NewRecorder()
+	handler.GetCurrentUser(rec, withUser(httptest.NewRequest(http.MethodGet, "/api/v1/users/me", nil), 7, "user"))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d (%s), want 200", rec.Code, rec.Body.String())
+	}
+	var user map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &user); err != nil {
+		t.Fatal(err)
+	}
+	if user["id"] != float64(7) || user["username"] != "eve" {
+		t.Errorf("user = %v, want the caller", user)
+	}
+	if _, ok := user["password_hash"]; ok {
+		t.Error("profile exposes password_hash")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGetUsersByEmail(t *testing.T) {
+	db, mock := newMockDB(t)
+	handler := NewUserHandler(db, zerolog.Nop(), 100)
+	byEmail := regexp.QuoteMeta("FROM users WHERE email = ? AND deleted_at IS NULL")
+	get := func(email string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/users?email="+email, nil)
+		rec := httptest.NewRecorder()
+		handler.GetUsers(rec, withUser(req, 1, "admin"))
+		return rec
+	}
+
+	now := time.Now()
+	mock.ExpectQuery(byEmail).WithArgs("shop@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "email", "full_name", "phone", "avatar_url", "password_hash", "role", "status", "created_at", "updated_at"}).
+			AddRow(4, "shop", "shop@example.com", nil, nil, nil, "$2a$10$secret", "merchant", "active", now, now))
+	rec := get("shop@example.com")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("found: status = %d (%s), want 200", rec.Code, rec.Body.String())
+	}
+	var user map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &user); err != nil {
+		t.Fatal(err)
+	}
+	if user["id"] != float64(4) || user["email"] != "shop@example.com" {
+		t.Errorf("found: user = %v, want user 4", user)
+	}
+	if strings.Contains(rec.Body.String(), "secret") {
+		t.Errorf("found: response exposes the password hash: %s", rec.Body.String())
+	}
+
+	mock.ExpectQuery(byEmail).WithArgs("nobody@example.com").WillReturnError(sql.ErrNoRows)
+	if rec := get("nobody@example.com"); rec.Code != http.StatusNotFound || !strings.Contains(rec.Body.String(), "user_not_found") {
+		t.Errorf("not found: got %d %s, want 404 user_not_found", rec.Code, rec.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"go-projects/internal/apierror"
+	"go-projects/internal/models"
+)
+
+type validatable interface {
+	Validate() error
+}
+
+// validRequest writes a 422 with per-field messages and returns false when
+// req fails validation.
+func validRequest(w http.ResponseWriter, req validatable) bool {
+	err := req.Validate()
+	if err == nil {
+		return true
+	}
+
+	var fields models.ValidationErrors
+	if !errors.As(err, &fields) {
+		fields = models.ValidationErrors{"request": err.Error()}
+	}
+
+	respondWithValidationErrors(w, fields)
+	return false
+}
+
+func respondWithValidationErrors(w http.ResponseWriter, fields models.ValidationErrors) {
+	apiErr := apierror.New(http.StatusUnprocessableEntity, "validation_failed", "Request validation failed")
+	apiErr.Fields = fields
+	apierror.WriteError(w, apiErr)
+}
+
+// isAmountError reports whether a decode failure came from Money rejecting
+// the amount (bad format or more than two decimals) rather than bad JSON.
+func isAmountError(err error) bool {
+	return errors.Is(err, models.ErrInvalidAmount)
+}
+
+// queryCurrency reads the optional currency query parameter, defaulting to
+// models.DefaultCurrency.
+func queryCurrency(r *http.Request) (string, error) {
+	return models.NormalizeCurrency(r.URL.Query().Get("currency"))
+}
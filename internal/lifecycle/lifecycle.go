@@ -0,0 +1,88 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+type Tracker struct {
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+	draining bool
+	drained  chan struct{}
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{drained: make(chan struct{})}
+}
+
+// Begin registers an in-flight operation. It refuses new work once draining
+// has started so that Wait cannot race with wg.Add.
+func (t *Tracker) Begin() (func(), bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.draining {
+		return nil, false
+	}
+
+	t.wg.Add(1)
+	return t.wg.Done, true
+}
+
+func (t *Tracker) Drain() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.draining {
+		t.draining = true
+		close(t.drained)
+	}
+}
+
+// Draining is closed once Drain is called, so long-lived requests such as
+// event streams can end before the server shuts down.
+func (t *Tracker) Draining() <-chan struct{} {
+	return t.drained
+}
+
+func (t *Tracker) Ready() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return !t.draining
+}
+
+func (t *Tracker) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shutdown drains tracker, stops the server with stopServer and then waits
+// for in-flight operations until ctx ends, logging each step as a phase. If
+// ctx ends first the remaining operations are abandoned and the phase is
+// logged as a forced close.
+func Shutdown(ctx context.Context, phases *Phases, tracker *Tracker, stopServer func(context.Context) error) error {
+	tracker.Drain()
+	phases.Done("draining")
+
+	serverErr := stopServer(ctx)
+	phases.Done("requests drained")
+
+	if err := tracker.Wait(ctx); err != nil {
+		phases.Done("forced close")
+		return errors.Join(serverErr, err)
+	}
+	phases.Done("in-flight work finished")
+
+	return serverErr
+}
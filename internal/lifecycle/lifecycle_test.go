@@ -0,0 +1,54 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTrackerRefusesWorkWhileDraining(t *testing.T) {
+	tracker := NewTracker()
+
+	done, ok := tracker.Begin()
+	if !ok {
+		t.Fatal("Begin refused before draining")
+	}
+
+	tracker.Drain()
+	if tracker.Ready() {
+		t.Error("tracker still ready after Drain")
+	}
+	if _, ok := tracker.Begin(); ok {
+		t.Error("Begin accepted new work while draining")
+	}
+
+	waited := make(chan error, 1)
+	go func() { waited <- tracker.Wait(context.Background()) }()
+
+	select {
+	case <-waited:
+		t.Fatal("Wait returned with an operation still in flight")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	done()
+	if err := <-waited; err != nil {
+		t.Errorf("Wait = %v after the last operation finished", err)
+	}
+}
+
+func TestTrackerWaitHonoursDeadline(t *testing.T) {
+	tracker := NewTracker()
+	if _, ok := tracker.Begin(); !ok {
+		t.Fatal("Begin refused")
+	}
+	tracker.Drain()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := tracker.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Wait = %v, want DeadlineExceeded for a stuck operation", err)
+	}
+}
@@ -0,0 +1,62 @@
+package lifecycle
+
+import (
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Phases logs each step of a startup or shutdown sequence with how long the
+// step took and how long the sequence has been running.
+type Phases struct {
+	logger zerolog.Logger
+	name   string
+	now    func() time.Time
+	start  time.Time
+	last   time.Time
+}
+
+// NewPhases starts timing the sequence at start, which may be earlier than
+// the logger itself, e.g. the moment main began.
+func NewPhases(logger zerolog.Logger, name string, start time.Time) *Phases {
+	return newPhases(logger, name, start, time.Now)
+}
+
+func newPhases(logger zerolog.Logger, name string, start time.Time, now func() time.Time) *Phases {
+	return &Phases{
+		logger: logger,
+		name:   name,
+		now:    now,
+		start:  start,
+		last:   start,
+	}
+}
+
+// Done logs phase as finished and returns how long it took since the
+// previous phase.
+func (p *Phases) Done(phase string) time.Duration {
+	now := p.now()
+	took := now.Sub(p.last)
+	p.last = now
+
+	p.logger.Info().
+		Str("lifecycle", p.name).
+		Str("phase", phase).
+		Dur("duration", took).
+		Dur("elapsed", now.Sub(p.start)).
+		Msgf("%s: %s", p.name, phase)
+
+	return took
+}
+
+// Complete logs the end of the sequence and returns its total duration.
+func (p *Phases) Complete() time.Duration {
+	elapsed := p.now().Sub(p.start)
+
+	p.logger.Info().
+		Str("lifecycle", p.name).
+		Dur("elapsed", elapsed).
+		Msgf("%s complete", p.name)
+
+	return elapsed
+}
@@ -0,0 +1,143 @@
+package lifecycle
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// fakeClock returns start and then moves forward only when advanced.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+type phaseLog struct {
+	Phase    string  `json:"phase"`
+	Duration float64 `json:"duration"`
+	Elapsed  float64 `json:"elapsed"`
+}
+
+func decodePhases(t *testing.T, buf *bytes.Buffer) []phaseLog {
+	t.Helper()
+	var logs []phaseLog
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var entry phaseLog
+		if err := dec.Decode(&entry); err != nil {
+			t.Fatalf("decode log: %v", err)
+		}
+		logs = append(logs, entry)
+	}
+	return logs
+}
+
+func TestPhasesTimeEachStep(t *testing.T) {
+	var buf bytes.Buffer
+	clock := &fakeClock{now: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	phases := newPhases(zerolog.New(&buf), "startup", clock.Now(), clock.Now)
+
+	clock.Advance(200 * time.Millisecond)
+	if took := phases.Done("config loaded"); took != 200*time.Millisecond {
+		t.Errorf("config phase took %s, want 200ms", took)
+	}
+	clock.Advance(time.Second)
+	if took := phases.Done("database connected"); took != time.Second {
+		t.Errorf("database phase took %s, want 1s", took)
+	}
+	if total := phases.Complete(); total != 1200*time.Millisecond {
+		t.Errorf("Complete = %s, want 1.2s", total)
+	}
+
+	logs := decodePhases(t, &buf)
+	if len(logs) != 3 {
+		t.Fatalf("got %d log lines, want 3", len(logs))
+	}
+	if got := logs[1]; got.Phase != "database connected" || got.Duration != 1000 || got.Elapsed != 1200 {
+		t.Errorf("second phase = %+v, want 1000ms of 1200ms elapsed", got)
+	}
+}
+
+func TestShutdownPhases(t *testing.T) {
+	tests := []struct {
+		name       string
+		stuck      bool
+		wantPhases []string
+		wantErr    error
+	}{
+		{
+			name:       "in-flight work finishes",
+			wantPhases: []string{"draining", "requests drained", "in-flight work finished"},
+		},
+		{
+			name:       "in-flight work outlives the deadline",
+			stuck:      true,
+			wantPhases: []string{"draining", "requests drained", "forced close"},
+			wantErr:    context.DeadlineExceeded,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			clock := &fakeClock{now: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+			phases := newPhases(zerolog.New(&buf), "shutdown", clock.Now(), clock.Now)
+
+			tracker := NewTracker()
+			if tt.stuck {
+				if _, ok := tracker.Begin(); !ok {
+					t.Fatal("Begin refused")
+				}
+			}
+
+			ctx := context.Background()
+			if tt.stuck {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithDeadline(ctx, time.Now())
+				defer cancel()
+			}
+
+			err := Shutdown(ctx, phases, tracker, func(context.Context) error {
+				if tracker.Ready() {
+					t.Error("server stopped before draining began")
+				}
+				clock.Advance(3 * time.Second)
+				return nil
+			})
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Errorf("Shutdown = %v, want %v", err, tt.wantErr)
+			}
+
+			logs := decodePhases(t, &buf)
+			if len(logs) != len(tt.wantPhases) {
+				t.Fatalf("logged %+v, want phases %v", logs, tt.wantPhases)
+			}
+			for i, want := range tt.wantPhases {
+				if logs[i].Phase != want {
+					t.Errorf("phase %d = %q, want %q", i, logs[i].Phase, want)
+				}
+			}
+			if logs[1].Duration != 3000 {
+				t.Errorf("request drain took %vms, want 3000", logs[1].Duration)
+			}
+		})
+	}
+}
+
+func TestShutdownReportsServerError(t *testing.T) {
+	phases := newPhases(zerolog.Nop(), "shutdown", time.Now(), time.Now)
+	stopErr := errors.New("listener close failed")
+
+	err := Shutdown(context.Background(), phases, NewTracker(), func(context.Context) error { return stopErr })
+	if !errors.Is(err, stopErr) {
+		t.Errorf("Shutdown = %v, want the server error", err)
+	}
+}
@@ -1,13 +1,64 @@
 package logger
 
 import (
+	"io"
 	"os"
+	"time"
 
 	"github.com/rs/zerolog"
-	"github.com/rs/zerolog/log"
+	"gopkg.in/natefinch/lumberjack.v2"
 )
 
-func InitLogger() zerolog.Logger {
-	logger := log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+const FormatJSON = "json"
+
+type Options struct {
+	Format    string
+	Level     string
+	File      string
+	MaxSizeMB int
+
+	// StandardFieldNames switches every event to the ts/level/msg keys used
+	// by the JSON access log schema.
+	StandardFieldNames bool
+}
+
+// UseStandardFieldNames renames zerolog's timestamp and message keys to ts
+// and msg and records timestamps with sub-second precision. zerolog keeps
+// these names in package globals, so this affects every logger.
+func UseStandardFieldNames() {
+	zerolog.TimestampFieldName = "ts"
+	zerolog.MessageFieldName = "msg"
+	zerolog.TimeFieldFormat = time.RFC3339Nano
+}
+
+func InitLogger(opts Options) zerolog.Logger {
+	level, err := zerolog.ParseLevel(opts.Level)
+	if err != nil || opts.Level == "" {
+		level = zerolog.InfoLevel
+	}
+
+	if opts.StandardFieldNames {
+		UseStandardFieldNames()
+	}
+
+	var out io.Writer = zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.RFC3339}
+	if opts.Format == FormatJSON {
+		out = os.Stderr
+	}
+
+	// The file always gets JSON so it can be shipped to an aggregator as is.
+	if opts.File != "" {
+		out = zerolog.MultiLevelWriter(out, &lumberjack.Logger{
+			Filename: opts.File,
+			MaxSize:  opts.MaxSizeMB,
+		})
+	}
+
+	logger := zerolog.New(out).Level(level).With().Timestamp().Logger()
+
+	if err != nil && opts.Level != "" {
+		logger.Warn().Str("level", opts.Level).Msg("Unknown log level, defaulting to info")
+	}
+
 	return logger
 }
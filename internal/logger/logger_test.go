@@ -0,0 +1,37 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInitLoggerWritesJSONAtConfiguredLevel(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "app.log")
+	log := InitLogger(Options{Format: FormatJSON, Level: "warn", File: file, MaxSizeMB: 1})
+
+	log.Info().Msg("dropped")
+	log.Warn().Str("component", "test").Msg("kept")
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+	if len(lines) != 1 {
+		t.Fatalf("got %d lines, want only the warn event:\n%s", len(lines), data)
+	}
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(lines[0], &entry); err != nil {
+		t.Fatalf("log line is not JSON: %v\n%s", err, lines[0])
+	}
+	if entry["level"] != "warn" || entry["message"] != "kept" || entry["component"] != "test" {
+		t.Errorf("unexpected entry: %v", entry)
+	}
+	if _, ok := entry["time"]; !ok {
+		t.Errorf("entry has no timestamp: %v", entry)
+	}
+}
@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	HTTPRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "Total number of HTTP requests by route, method and status.",
+		},
+		[]string{"path", "method", "status"},
+	)
+
+	HTTPRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "HTTP request latency by route and method.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"path", "method"},
+	)
+
+	TransactionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "transactions_total",
+			Help: "Total number of transactions by type and outcome.",
+		},
+		[]string{"type", "result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(HTTPRequestsTotal, HTTPRequestDuration, TransactionsTotal)
+}
+
+func RecordTransaction(transactionType string, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	TransactionsTotal.WithLabelValues(transactionType, result).Inc()
+}
+
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -1,16 +1,32 @@
 package middleware
 
 import (
+	"bufio"
+	"compress/gzip"
 	"context"
-	"encoding/json"
+	"io"
+	"math"
+	"net"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"go-projects/internal/apierror"
+	"go-projects/internal/metrics"
+	"go-projects/internal/models"
+	"go-projects/internal/tracing"
+
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
 	"github.com/rs/cors"
 	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
 	"golang.org/x/time/rate"
 )
 
@@ -20,20 +36,21 @@ const (
 	UserIDKey contextKey = "user_id"
 	UserRoleKey contextKey = "user_role"
 	UserEmailKey contextKey = "user_email"
+	RequestIDKey contextKey = "request_id"
+	TokenClaimsKey contextKey = "token_claims"
+	ClientIPKey contextKey = "client_ip"
+
+	requestStateKey contextKey = "request_state"
 )
 
 type Claims struct {
-	UserID int    `json:"user_id"`
-	Email  string `json:"email"`
-	Role   string `json:"role"`
+	UserID    int    `json:"user_id"`
+	Email     string `json:"email"`
+	Role      string `json:"role"`
+	TokenType string `json:"token_type,omitempty"`
 	jwt.RegisteredClaims
 }
 
-type ErrorResponse struct {
-	Error   string `json:"error"`
-	Message string `json:"message,omitempty"`
-}
-
 func CORS() func(http.Handler) http.Handler {
 	c := cors.New(cors.Options{
 		AllowedOrigins: []string{"*"},
@@ -58,26 +75,185 @@ func SecurityHeaders() func(http.Handler) http.Handler {
 	}
 }
 
+const rateLimiterIdleTimeout = 10 * time.Minute
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
 type RateLimiter struct {
-	limiter *rate.Limiter
+	rate    rate.Limit
+	burst   int
+	clients map[string]*clientLimiter
+	mu      sync.Mutex
+	stop    chan struct{}
+	once    sync.Once
 }
 
 func NewRateLimiter(r rate.Limit, b int) *RateLimiter {
-	return &RateLimiter{
-		limiter: rate.NewLimiter(r, b),
+	rl := &RateLimiter{
+		rate:    r,
+		burst:   b,
+		clients: make(map[string]*clientLimiter),
+		stop:    make(chan struct{}),
+	}
+
+	go rl.cleanup(time.Minute)
+
+	return rl
+}
+
+func (rl *RateLimiter) Stop() {
+	rl.once.Do(func() {
+		close(rl.stop)
+	})
+}
+
+func (rl *RateLimiter) cleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-rl.stop:
+			return
+		case now := <-ticker.C:
+			rl.evictIdle(now)
+		}
+	}
+}
+
+func (rl *RateLimiter) evictIdle(now time.Time) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	for key, client := range rl.clients {
+		if now.Sub(client.lastSeen) > rateLimiterIdleTimeout {
+			delete(rl.clients, key)
+		}
+	}
+}
+
+// Allow reports whether the caller identified by key may proceed now.
+func (rl *RateLimiter) Allow(key string) bool {
+	return rl.limiterFor(key).Allow()
+}
+
+func (rl *RateLimiter) limiterFor(key string) *rate.Limiter {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	client, ok := rl.clients[key]
+	if !ok {
+		client = &clientLimiter{limiter: rate.NewLimiter(rl.rate, rl.burst)}
+		rl.clients[key] = client
+	}
+	client.lastSeen = time.Now()
+
+	return client.limiter
+}
+
+func rateLimitKey(r *http.Request) string {
+	if userID, ok := r.Context().Value(UserIDKey).(int); ok {
+		return "user:" + strconv.Itoa(userID)
+	}
+
+	return "ip:" + GetClientIP(r)
+}
+
+// ClientIP resolves the real client address and stores it in the context.
+// Forwarding headers are only honoured when the direct peer is one of the
+// trusted proxies; X-Forwarded-For is walked from the right, skipping
+// trusted hops, so a client cannot spoof its address by prepending entries.
+func ClientIP(trustedProxies []*net.IPNet) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			clientIP := resolveClientIP(r, trustedProxies)
+			ctx := context.WithValue(r.Context(), ClientIPKey, clientIP)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func resolveClientIP(r *http.Request, trustedProxies []*net.IPNet) string {
+	peer := remoteHost(r)
+	if !isTrustedProxy(peer, trustedProxies) {
+		return peer
+	}
+
+	if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+		hops := strings.Split(strings.Join(forwarded, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				// Anything left of a malformed entry cannot be trusted.
+				return peer
+			}
+			if !isTrustedProxy(hop, trustedProxies) {
+				return hop
+			}
+			peer = hop
+		}
+		return peer
 	}
+
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(realIP) != nil {
+		return realIP
+	}
+
+	return peer
 }
 
+func isTrustedProxy(host string, trustedProxies []*net.IPNet) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// GetClientIP returns the address stored by ClientIP, falling back to the
+// direct peer when the middleware did not run.
+func GetClientIP(r *http.Request) string {
+	if clientIP, ok := r.Context().Value(ClientIPKey).(string); ok {
+		return clientIP
+	}
+	return remoteHost(r)
+}
+
+// Middleware keys on the authenticated user when it runs after
+// Authentication and falls back to the remote IP otherwise.
 func (rl *RateLimiter) Middleware() func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if !rl.limiter.Allow() {
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(http.StatusTooManyRequests)
-				json.NewEncoder(w).Encode(ErrorResponse{
-					Error:   "rate_limit_exceeded",
-					Message: "Too many requests. Please try again later.",
-				})
+			reservation := rl.limiterFor(rateLimitKey(r)).Reserve()
+			if !reservation.OK() {
+				apierror.Write(w, http.StatusTooManyRequests, "rate_limit_exceeded", "Too many requests. Please try again later.")
+				return
+			}
+
+			if delay := reservation.Delay(); delay > 0 {
+				reservation.Cancel()
+
+				retryAfter := int(math.Ceil(delay.Seconds()))
+				w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+				apiErr := apierror.New(http.StatusTooManyRequests, "rate_limit_exceeded", "Too many requests. Please try again later.")
+				apiErr.RetryAfterSeconds = retryAfter
+				apierror.WriteError(w, apiErr)
 				return
 			}
 			next.ServeHTTP(w, r)
@@ -85,7 +261,47 @@ func (rl *RateLimiter) Middleware() func(http.Handler) http.Handler {
 	}
 }
 
-func RequestLogging(logger zerolog.Logger) func(http.Handler) http.Handler {
+// TransactionRateLimiter keeps one keyed RateLimiter per transaction type,
+// so each user gets a separate per-minute budget for every type and idle
+// users are evicted like in the request limiter.
+type TransactionRateLimiter struct {
+	limiters map[string]*RateLimiter
+}
+
+// NewTransactionRateLimiter takes a per-minute limit for each transaction
+// type. Types with a limit of zero or less are not limited.
+func NewTransactionRateLimiter(limits map[string]int) *TransactionRateLimiter {
+	limiters := make(map[string]*RateLimiter, len(limits))
+	for transactionType, perMinute := range limits {
+		if perMinute <= 0 {
+			continue
+		}
+		limiters[transactionType] = NewRateLimiter(rate.Every(time.Minute/time.Duration(perMinute)), perMinute)
+	}
+	return &TransactionRateLimiter{limiters: limiters}
+}
+
+func (rl *TransactionRateLimiter) Allow(userID int, transactionType string) bool {
+	limiter, ok := rl.limiters[transactionType]
+	if !ok {
+		return true
+	}
+	return limiter.Allow("user:" + strconv.Itoa(userID))
+}
+
+func (rl *TransactionRateLimiter) Stop() {
+	for _, limiter := range rl.limiters {
+		limiter.Stop()
+	}
+}
+
+const AccessLogFormatJSON = "json"
+
+type requestState struct {
+	userID int
+}
+
+func RequestLogging(logger zerolog.Logger, format string) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			start := time.Now()
@@ -94,22 +310,32 @@ func RequestLogging(logger zerolog.Logger) func(http.Handler) http.Handler {
 				requestID = generateRequestID()
 			}
 
-			ctx := context.WithValue(r.Context(), "request_id", requestID)
+			state := &requestState{}
+			ctx := context.WithValue(r.Context(), RequestIDKey, requestID)
+			ctx = context.WithValue(ctx, requestStateKey, state)
 			r = r.WithContext(ctx)
 
-			logger.Info().
-				Str("request_id", requestID).
-				Str("method", r.Method).
-				Str("path", r.URL.Path).
-				Str("remote_addr", r.RemoteAddr).
-				Str("user_agent", r.UserAgent()).
-				Msg("Incoming request")
+			if format != AccessLogFormatJSON {
+				logger.Info().
+					Str("request_id", requestID).
+					Str("method", r.Method).
+					Str("path", r.URL.Path).
+					Str("remote_addr", GetClientIP(r)).
+					Str("user_agent", r.UserAgent()).
+					Msg("Incoming request")
+			}
 
 			wrapped := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
 
 			next.ServeHTTP(wrapped, r)
 
 			duration := time.Since(start)
+
+			if format == AccessLogFormatJSON {
+				writeAccessLog(logger, r, requestID, state, wrapped.statusCode, duration)
+				return
+			}
+
 			logger.Info().
 				Str("request_id", requestID).
 				Str("method", r.Method).
@@ -121,6 +347,30 @@ func RequestLogging(logger zerolog.Logger) func(http.Handler) http.Handler {
 	}
 }
 
+// writeAccessLog emits the request as one event through logger, so it honours
+// the configured level and outputs. The ts and msg keys come from
+// logger.UseStandardFieldNames.
+func writeAccessLog(logger zerolog.Logger, r *http.Request, requestID string, state *requestState, statusCode int, duration time.Duration) {
+	level := zerolog.InfoLevel
+	if statusCode >= 500 {
+		level = zerolog.ErrorLevel
+	} else if statusCode >= 400 {
+		level = zerolog.WarnLevel
+	}
+
+	event := logger.WithLevel(level).
+		Str("http.method", r.Method).
+		Int("http.status_code", statusCode).
+		Str("http.path", r.URL.Path).
+		Float64("duration_ms", float64(duration.Microseconds())/1000).
+		Str("request.id", requestID).
+		Str("client.ip", GetClientIP(r))
+	if state.userID != 0 {
+		event = event.Int("user.id", state.userID)
+	}
+	event.Msg("Request completed")
+}
+
 type responseWriter struct {
 	http.ResponseWriter
 	statusCode int
@@ -131,22 +381,35 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
+func (rw *responseWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 func generateRequestID() string {
 	return strconv.FormatInt(time.Now().UnixNano(), 36)
 }
 
-func Authentication(jwtSecret string, logger zerolog.Logger) func(http.Handler) http.Handler {
+// Authentication validates the bearer token. Tokens carrying a jti are also
+// checked against isRevoked; older tokens without one cannot be revoked.
+func Authentication(jwtSecret, issuer, audience string, isRevoked func(ctx context.Context, jti string) (bool, error), logger zerolog.Logger) func(http.Handler) http.Handler {
+	parserOpts := []jwt.ParserOption{jwt.WithIssuer(issuer)}
+	if audience != "" {
+		parserOpts = append(parserOpts, jwt.WithAudience(audience))
+	}
+
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			authHeader := r.Header.Get("Authorization")
 			if authHeader == "" {
-				respondWithError(w, http.StatusUnauthorized, "missing_authorization", "Authorization header is required")
+				apierror.Write(w, http.StatusUnauthorized, "missing_authorization", "Authorization header is required")
 				return
 			}
 
 			parts := strings.Split(authHeader, " ")
 			if len(parts) != 2 || parts[0] != "Bearer" {
-				respondWithError(w, http.StatusUnauthorized, "invalid_authorization", "Invalid authorization header format")
+				apierror.Write(w, http.StatusUnauthorized, "invalid_authorization", "Invalid authorization header format")
 				return
 			}
 
@@ -158,29 +421,104 @@ func Authentication(jwtSecret string, logger zerolog.Logger) func(http.Handler)
 					return nil, jwt.ErrSignatureInvalid
 				}
 				return []byte(jwtSecret), nil
-			})
+			}, parserOpts...)
 
 			if err != nil || !token.Valid {
 				logger.Warn().Err(err).Msg("Invalid token")
-				respondWithError(w, http.StatusUnauthorized, "invalid_token", "Invalid or expired token")
+				apierror.Write(w, http.StatusUnauthorized, "invalid_token", "Invalid or expired token")
 				return
 			}
 
+			if claims.TokenType == "refresh" {
+				apierror.Write(w, http.StatusUnauthorized, "invalid_token", "Refresh tokens cannot be used for authentication")
+				return
+			}
+
+			if claims.ID != "" {
+				revoked, err := isRevoked(r.Context(), claims.ID)
+				if err != nil {
+					logger.Error().Err(err).Msg("Token revocation check failed")
+					apierror.Write(w, http.StatusServiceUnavailable, "token_check_failed", "Unable to verify token")
+					return
+				}
+				if revoked {
+					apierror.Write(w, http.StatusUnauthorized, "token_revoked", "Token has been revoked")
+					return
+				}
+			}
+
+			if state, ok := r.Context().Value(requestStateKey).(*requestState); ok {
+				state.userID = claims.UserID
+			}
+
+			if claims.ExpiresAt != nil {
+				setTokenExpiryHeaders(w, time.Until(claims.ExpiresAt.Time))
+			}
+
 			ctx := context.WithValue(r.Context(), UserIDKey, claims.UserID)
 			ctx = context.WithValue(ctx, UserRoleKey, claims.Role)
 			ctx = context.WithValue(ctx, UserEmailKey, claims.Email)
+			ctx = context.WithValue(ctx, TokenClaimsKey, claims)
 
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
 
+// tokenRefreshThreshold is how close to expiry a token must be before
+// responses recommend refreshing it.
+const tokenRefreshThreshold = 5 * time.Minute
+
+func setTokenExpiryHeaders(w http.ResponseWriter, remaining time.Duration) {
+	if remaining < 0 {
+		remaining = 0
+	}
+	w.Header().Set("X-Token-Expires-In", strconv.Itoa(int(remaining/time.Second)))
+	if remaining <= tokenRefreshThreshold {
+		w.Header().Set("X-Token-Refresh-Recommended", "true")
+	}
+}
+
+// DefaultPageSize is the limit used when a list request does not give one.
+const DefaultPageSize = 50
+
+// ParsePagination reads the limit and offset query parameters. A missing
+// limit defaults to DefaultPageSize and one above maxLimit is capped;
+// malformed or negative values are rejected.
+func ParsePagination(r *http.Request, maxLimit int) (limit, offset int, err error) {
+	query := r.URL.Query()
+
+	limit = DefaultPageSize
+	if limitStr := query.Get("limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 {
+			apiErr := apierror.New(http.StatusBadRequest, "invalid_pagination", "limit must be a positive integer")
+			apiErr.Field = "limit"
+			return 0, 0, apiErr
+		}
+	}
+	if maxLimit > 0 && limit > maxLimit {
+		limit = maxLimit
+	}
+
+	if offsetStr := query.Get("offset"); offsetStr != "" {
+		offset, err = strconv.Atoi(offsetStr)
+		if err != nil || offset < 0 {
+			apiErr := apierror.New(http.StatusBadRequest, "invalid_pagination", "offset must be a non-negative integer")
+			apiErr.Field = "offset"
+			return 0, 0, apiErr
+		}
+	}
+
+	return limit, offset, nil
+}
+
 func RequireRole(allowedRoles ...string) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			userRole, ok := r.Context().Value(UserRoleKey).(string)
 			if !ok {
-				respondWithError(w, http.StatusForbidden, "forbidden", "User role not found")
+				apierror.Write(w, http.StatusForbidden, "forbidden", "User role not found")
 				return
 			}
 
@@ -193,7 +531,34 @@ func RequireRole(allowedRoles ...string) func(http.Handler) http.Handler {
 			}
 
 			if !allowed {
-				respondWithError(w, http.StatusForbidden, "forbidden", "Insufficient permissions")
+				apierror.Write(w, http.StatusForbidden, "forbidden", "Insufficient permissions")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireCapability asks authorize whether the caller may perform action on
+// its own account. Unlike RequireRole it goes by the stored role rather than
+// the token's claim, so a user whose role was changed since login is refused.
+func RequireCapability(action string, authorize func(ctx context.Context, userID int, action string, resourceID *int) (bool, error)) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userID, ok := GetUserID(r)
+			if !ok {
+				apierror.Write(w, http.StatusUnauthorized, "unauthorized", "User not authenticated")
+				return
+			}
+
+			allowed, err := authorize(r.Context(), userID, action, &userID)
+			if err != nil {
+				apierror.WriteError(w, err)
+				return
+			}
+			if !allowed {
+				apierror.Write(w, http.StatusForbidden, "forbidden", "Insufficient permissions")
 				return
 			}
 
@@ -208,7 +573,42 @@ func RequestValidation() func(http.Handler) http.Handler {
 			if r.Method == "POST" || r.Method == "PUT" {
 				contentType := r.Header.Get("Content-Type")
 				if !strings.Contains(contentType, "application/json") {
-					respondWithError(w, http.StatusBadRequest, "invalid_content_type", "Content-Type must be application/json")
+					apierror.Write(w, http.StatusBadRequest, "invalid_content_type", "Content-Type must be application/json")
+					return
+				}
+
+				// Chunked requests have no Content-Length, so peek at the body
+				// instead of trusting the header to detect an empty payload.
+				if r.Body == nil || r.Body == http.NoBody {
+					apierror.Write(w, http.StatusBadRequest, "empty_body", "Request body must not be empty")
+					return
+				}
+
+				body := bufio.NewReader(r.Body)
+				if _, err := body.Peek(1); err != nil {
+					if err == io.EOF {
+						apierror.Write(w, http.StatusBadRequest, "empty_body", "Request body must not be empty")
+						return
+					}
+					apierror.Write(w, http.StatusBadRequest, "invalid_request", "Failed to read request body")
+					return
+				}
+				r.Body = struct {
+					io.Reader
+					io.Closer
+				}{body, r.Body}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func KillSwitch(isActive func() (bool, string)) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "GET" {
+				if active, reason := isActive(); active {
+					apierror.Write(w, http.StatusServiceUnavailable, "transactions_halted", reason)
 					return
 				}
 			}
@@ -228,7 +628,7 @@ func ErrorHandling(logger zerolog.Logger) func(http.Handler) http.Handler {
 						Str("method", r.Method).
 						Msg("Panic recovered")
 
-					respondWithError(w, http.StatusInternalServerError, "internal_error", "An internal error occurred")
+					apierror.Write(w, http.StatusInternalServerError, "internal_error", "An internal error occurred")
 				}
 			}()
 
@@ -261,6 +661,297 @@ func PerformanceMonitoring(logger zerolog.Logger) func(http.Handler) http.Handle
 	}
 }
 
+// BodyLimit caps request bodies at maxBytes. A declared Content-Length over
+// the limit is rejected up front; otherwise reads past the limit fail and the
+// decoder reports 413.
+func BodyLimit(maxBytes int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > maxBytes {
+				apierror.Write(w, http.StatusRequestEntityTooLarge, "request_too_large", "Request body is too large")
+				return
+			}
+
+			r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Compression gzips responses for clients that accept it. Output is held
+// back until minSize bytes have been written, so small bodies go out
+// uncompressed; flushed (streamed) responses are never compressed.
+func Compression(minSize int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Accept-Encoding")
+			if r.Method == http.MethodHead || !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			gw := &gzipResponseWriter{ResponseWriter: w, minSize: minSize}
+			defer gw.close()
+			next.ServeHTTP(gw, r)
+		})
+	}
+}
+
+func acceptsGzip(acceptEncoding string) bool {
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if weight, err := strconv.ParseFloat(q, 64); err == nil && weight == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+var gzipWriterPool = sync.Pool{
+	New: func() interface{} { return gzip.NewWriter(io.Discard) },
+}
+
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	minSize int
+	status  int
+	buf     []byte
+	gz      *gzip.Writer
+	started bool
+}
+
+func (gw *gzipResponseWriter) WriteHeader(code int) {
+	if gw.status == 0 {
+		gw.status = code
+	}
+}
+
+func (gw *gzipResponseWriter) Write(b []byte) (int, error) {
+	if gw.status == 0 {
+		gw.status = http.StatusOK
+	}
+	if gw.gz != nil {
+		return gw.gz.Write(b)
+	}
+	if gw.started {
+		return gw.ResponseWriter.Write(b)
+	}
+
+	gw.buf = append(gw.buf, b...)
+	if len(gw.buf) < gw.minSize {
+		return len(b), nil
+	}
+	if err := gw.start(gw.compressible()); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// compressible rules out bodies that are already encoded or have no content.
+func (gw *gzipResponseWriter) compressible() bool {
+	if gw.Header().Get("Content-Encoding") != "" {
+		return false
+	}
+	if gw.status == http.StatusNoContent || gw.status == http.StatusNotModified {
+		return false
+	}
+	return !strings.HasPrefix(gw.Header().Get("Content-Type"), "text/event-stream")
+}
+
+// start sends the held-back status and buffer, compressed or not.
+func (gw *gzipResponseWriter) start(compress bool) error {
+	gw.started = true
+	if gw.status == 0 {
+		gw.status = http.StatusOK
+	}
+
+	if compress {
+		header := gw.Header()
+		if header.Get("Content-Type") == "" {
+			// net/http would otherwise sniff the compressed bytes.
+			header.Set("Content-Type", http.DetectContentType(gw.buf))
+		}
+		header.Del("Content-Length")
+		header.Set("Content-Encoding", "gzip")
+		gw.ResponseWriter.WriteHeader(gw.status)
+
+		gw.gz = gzipWriterPool.Get().(*gzip.Writer)
+		gw.gz.Reset(gw.ResponseWriter)
+	} else {
+		gw.ResponseWriter.WriteHeader(gw.status)
+	}
+
+	buf := gw.buf
+	gw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	if gw.gz != nil {
+		_, err := gw.gz.Write(buf)
+		return err
+	}
+	_, err := gw.ResponseWriter.Write(buf)
+	return err
+}
+
+func (gw *gzipResponseWriter) Flush() {
+	if !gw.started {
+		gw.start(false)
+	}
+	if gw.gz != nil {
+		gw.gz.Flush()
+	}
+	if f, ok := gw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (gw *gzipResponseWriter) close() {
+	if gw.gz != nil {
+		gw.gz.Close()
+		gzipWriterPool.Put(gw.gz)
+		gw.gz = nil
+		return
+	}
+	if !gw.started && gw.status != 0 {
+		gw.start(false)
+	}
+}
+
+// Timeout puts a deadline on the request context. Services pass that context
+// to the database, so a slow query is cancelled instead of hanging the
+// request; if the handler then returns without responding, a 503 is sent.
+// Routes whose path template is listed in exempt, such as event streams, get
+// no deadline.
+func Timeout(d time.Duration, exempt ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if route := mux.CurrentRoute(r); route != nil {
+				if tmpl, err := route.GetPathTemplate(); err == nil && slices.Contains(exempt, tmpl) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+
+			tw := &timeoutWriter{ResponseWriter: w}
+			next.ServeHTTP(tw, r.WithContext(ctx))
+
+			if !tw.wrote && ctx.Err() == context.DeadlineExceeded {
+				apierror.Write(w, http.StatusServiceUnavailable, "request_timeout", "Request timed out")
+			}
+		})
+	}
+}
+
+type timeoutWriter struct {
+	http.ResponseWriter
+	wrote bool
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.wrote = true
+	tw.ResponseWriter.WriteHeader(code)
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.wrote = true
+	return tw.ResponseWriter.Write(b)
+}
+
+func (tw *timeoutWriter) Flush() {
+	if f, ok := tw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func Draining(isReady func() bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !isReady() {
+				w.Header().Set("Connection", "close")
+				apierror.Write(w, http.StatusServiceUnavailable, "shutting_down", "Server is shutting down")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func Metrics() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+
+			wrapped := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+			next.ServeHTTP(wrapped, r)
+
+			// Route templates keep label cardinality bounded; raw paths would
+			// create a series per transaction ID.
+			path := "unmatched"
+			if route := mux.CurrentRoute(r); route != nil {
+				if tmpl, err := route.GetPathTemplate(); err == nil {
+					path = tmpl
+				}
+			}
+
+			metrics.HTTPRequestsTotal.WithLabelValues(path, r.Method, strconv.Itoa(wrapped.statusCode)).Inc()
+			metrics.HTTPRequestDuration.WithLabelValues(path, r.Method).Observe(time.Since(start).Seconds())
+		})
+	}
+}
+
+// Tracing starts a span per request, continuing any trace the caller sent in
+// a traceparent header. Spans are named after the route template and carry
+// the request ID so a trace can be matched with its access log line.
+func Tracing() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+			path := "unmatched"
+			if route := mux.CurrentRoute(r); route != nil {
+				if tmpl, err := route.GetPathTemplate(); err == nil {
+					path = tmpl
+				}
+			}
+
+			requestID, _ := RequestIDFromContext(ctx)
+			ctx, span := tracing.Start(ctx, r.Method+" "+path,
+				attribute.String("http.request.method", r.Method),
+				attribute.String("http.route", path),
+				attribute.String("request.id", requestID),
+			)
+			defer span.End()
+
+			wrapped := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+			next.ServeHTTP(wrapped, r.WithContext(ctx))
+
+			span.SetAttributes(attribute.Int("http.response.status_code", wrapped.statusCode))
+			if wrapped.statusCode >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, http.StatusText(wrapped.statusCode))
+			}
+		})
+	}
+}
+
+func GetRequestID(r *http.Request) (string, bool) {
+	return RequestIDFromContext(r.Context())
+}
+
+func RequestIDFromContext(ctx context.Context) (string, bool) {
+	requestID, ok := ctx.Value(RequestIDKey).(string)
+	return requestID, ok && requestID != ""
+}
+
 func GetUserID(r *http.Request) (int, bool) {
 	userID, ok := r.Context().Value(UserIDKey).(int)
 	return userID, ok
@@ -271,12 +962,13 @@ func GetUserRole(r *http.Request) (string, bool) {
 	return role, ok
 }
 
-func respondWithError(w http.ResponseWriter, statusCode int, errorCode, message string) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(statusCode)
-	json.NewEncoder(w).Encode(ErrorResponse{
-		Error:   errorCode,
-		Message: message,
-	})
+// IsAdmin reports whether the authenticated caller has the admin role.
+func IsAdmin(r *http.Request) bool {
+	role, ok := GetUserRole(r)
+	return ok && role == string(models.RoleAdmin)
 }
 
+func GetTokenClaims(r *http.Request) (*Claims, bool) {
+	claims, ok := r.Context().Value(TokenClaimsKey).(*Claims)
+	return claims, ok
+}
@@ -0,0 +1,969 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go-projects/internal/apierror"
+	"go-projects/internal/logger"
+	"go-projects/internal/metrics"
+	"go-projects/internal/tracing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"golang.org/x/time/rate"
+)
+
+func TestTransactionRateLimiterKeysOnUserAndType(t *testing.T) {
+	limiter := NewTransactionRateLimiter(map[string]int{
+		"transfer":   2,
+		"withdrawal": 1,
+		"credit":     0,
+	})
+	defer limiter.Stop()
+
+	for i := 0; i < 2; i++ {
+		if !limiter.Allow(1, "transfer") {
+			t.Fatalf("transfer %d rejected within the burst", i+1)
+		}
+	}
+	if limiter.Allow(1, "transfer") {
+		t.Error("third transfer in the same minute allowed")
+	}
+
+	if !limiter.Allow(2, "transfer") {
+		t.Error("another user's transfer rejected")
+	}
+	if !limiter.Allow(1, "withdrawal") {
+		t.Error("withdrawal rejected after the transfer budget ran out")
+	}
+	if limiter.Allow(1, "withdrawal") {
+		t.Error("second withdrawal in the same minute allowed")
+	}
+
+	for i := 0; i < 5; i++ {
+		if !limiter.Allow(1, "credit") || !limiter.Allow(1, "balance") {
+			t.Fatal("type without a positive limit was rate limited")
+		}
+	}
+}
+
+func TestRequestLoggingJSONKeys(t *testing.T) {
+	timestampField, messageField, timeFormat := zerolog.TimestampFieldName, zerolog.MessageFieldName, zerolog.TimeFieldFormat
+	t.Cleanup(func() {
+		zerolog.TimestampFieldName, zerolog.MessageFieldName, zerolog.TimeFieldFormat = timestampField, messageField, timeFormat
+	})
+	logger.UseStandardFieldNames()
+
+	var buf bytes.Buffer
+	log := zerolog.New(&buf).With().Timestamp().Logger()
+
+	handler := RequestLogging(log, AccessLogFormatJSON)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Context().Value(requestStateKey).(*requestState).userID = 42
+		w.WriteHeader(http.StatusNotFound)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/balances/current", nil)
+	req.Header.Set("X-Request-ID", "req-1")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	if len(lines) != 1 {
+		t.Fatalf("got %d log lines, want a single event:\n%s", len(lines), buf.String())
+	}
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(lines[0], &entry); err != nil {
+		t.Fatalf("access log is not JSON: %v\n%s", err, lines[0])
+	}
+
+	for _, key := range []string{"ts", "level", "msg", "http.method", "http.status_code", "http.path", "duration_ms", "user.id", "request.id", "client.ip"} {
+		if _, ok := entry[key]; !ok {
+			t.Errorf("missing key %q in %s", key, lines[0])
+		}
+	}
+
+	if _, err := time.Parse(time.RFC3339Nano, entry["ts"].(string)); err != nil {
+		t.Errorf("ts = %v: %v", entry["ts"], err)
+	}
+	if _, ok := entry["duration_ms"].(float64); !ok {
+		t.Errorf("duration_ms = %#v, want a number", entry["duration_ms"])
+	}
+	if entry["level"] != "warn" || entry["http.status_code"] != float64(http.StatusNotFound) {
+		t.Errorf("level = %v, status = %v, want warn and 404", entry["level"], entry["http.status_code"])
+	}
+	if entry["user.id"] != float64(42) || entry["request.id"] != "req-1" {
+		t.Errorf("user.id = %v, request.id = %v", entry["user.id"], entry["request.id"])
+	}
+}
+
+func TestRequestLoggingJSONRespectsLevel(t *testing.T) {
+	var buf bytes.Buffer
+	log := zerolog.New(&buf).Level(zerolog.WarnLevel)
+
+	handler := RequestLogging(log, AccessLogFormatJSON)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/health", nil))
+
+	if buf.Len() != 0 {
+		t.Errorf("info-level access log written at warn level: %s", buf.String())
+	}
+}
+
+func TestRequestValidationDetectsEmptyChunkedBody(t *testing.T) {
+	var got string
+	handler := RequestValidation()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got = string(body)
+	}))
+
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{name: "empty", body: "", want: http.StatusBadRequest},
+		{name: "with payload", body: `{"amount":10}`, want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got = ""
+			// A plain reader hides the length, as a chunked request would.
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/transactions/credit", io.MultiReader(strings.NewReader(tt.body)))
+			req.ContentLength = -1
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.want)
+			}
+			if tt.want == http.StatusOK && got != tt.body {
+				t.Errorf("handler read %q, want %q", got, tt.body)
+			}
+		})
+	}
+}
+
+func TestKillSwitchBlocksWritesOnly(t *testing.T) {
+	handler := KillSwitch(func() (bool, string) { return true, "incident" })(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for method, want := range map[string]int{
+		http.MethodGet:  http.StatusOK,
+		http.MethodPost: http.StatusServiceUnavailable,
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, "/api/v1/transactions/credit", nil))
+		if rec.Code != want {
+			t.Errorf("%s: status = %d, want %d", method, rec.Code, want)
+		}
+	}
+}
+
+func TestRateLimiterKeysHaveIndependentBuckets(t *testing.T) {
+	limiter := NewRateLimiter(rate.Every(time.Hour), 1)
+	defer limiter.Stop()
+
+	handler := limiter.Middleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	asUser := func(userID int) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/balances/current", nil)
+		return req.WithContext(context.WithValue(req.Context(), UserIDKey, userID))
+	}
+	fromIP := func(ip string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/auth/login", nil)
+		req.RemoteAddr = ip + ":4321"
+		return req
+	}
+
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, req := range []*http.Request{asUser(1), asUser(2), fromIP("203.0.113.1"), fromIP("203.0.113.2")} {
+		if rec := serve(req); rec.Code != http.StatusOK {
+			t.Errorf("first request from a new key: status = %d", rec.Code)
+		}
+	}
+
+	rec := serve(asUser(1))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("second request for user 1: status = %d, want 429", rec.Code)
+	}
+	var body apierror.APIError
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Header().Get("Retry-After") != "3600" || body.RetryAfterSeconds != 3600 {
+		t.Errorf("Retry-After = %q, retry_after_seconds = %d; want 3600 for an hourly bucket",
+			rec.Header().Get("Retry-After"), body.RetryAfterSeconds)
+	}
+	if rec := serve(fromIP("203.0.113.1")); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("second request from the same IP: status = %d, want 429", rec.Code)
+	}
+	if rec := serve(asUser(3)); rec.Code != http.StatusOK {
+		t.Errorf("user 3 throttled by the other keys: status = %d", rec.Code)
+	}
+}
+
+func TestRateLimiterEvictsIdleKeys(t *testing.T) {
+	limiter := NewRateLimiter(rate.Every(time.Hour), 1)
+	limiter.Stop()
+	limiter.Stop()
+
+	limiter.Allow("user:1")
+	limiter.Allow("user:2")
+	limiter.clients["user:1"].lastSeen = time.Now().Add(-rateLimiterIdleTimeout - time.Second)
+
+	limiter.evictIdle(time.Now())
+
+	if _, ok := limiter.clients["user:1"]; ok {
+		t.Error("idle key kept")
+	}
+	if _, ok := limiter.clients["user:2"]; !ok {
+		t.Error("active key evicted")
+	}
+	if !limiter.Allow("user:1") {
+		t.Error("evicted key did not start with a fresh bucket")
+	}
+}
+
+func TestMetricsLabelsRequestsByRouteTemplate(t *testing.T) {
+	r := mux.NewRouter()
+	r.Use(Metrics())
+	r.HandleFunc("/api/v1/transactions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}).Methods("GET")
+
+	counter := metrics.HTTPRequestsTotal.WithLabelValues("/api/v1/transactions/{id}", "GET", "404")
+	before := testutil.ToFloat64(counter)
+
+	for _, id := range []string{"1", "2", "3"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/v1/transactions/"+id, nil))
+	}
+
+	if got := testutil.ToFloat64(counter) - before; got != 3 {
+		t.Errorf("route series grew by %v, want 3 under one template label", got)
+	}
+}
+
+func TestGetRequestID(t *testing.T) {
+	var got string
+	var found bool
+	handler := RequestLogging(zerolog.Nop(), "console")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, found = GetRequestID(r)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Request-ID", "abc-123")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if !found || got != "abc-123" {
+		t.Errorf("GetRequestID = %q, %v; want the X-Request-ID header", got, found)
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if !found || got == "" {
+		t.Error("no request ID generated when the header is absent")
+	}
+
+	if id, ok := GetRequestID(httptest.NewRequest(http.MethodGet, "/", nil)); ok {
+		t.Errorf("GetRequestID outside RequestLogging = %q, want none", id)
+	}
+
+	// A plain string key must not be mistaken for the typed one.
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), "request_id", "spoofed"))
+	if id, ok := GetRequestID(req); ok {
+		t.Errorf("GetRequestID read an untyped key: %q", id)
+	}
+}
+
+func TestBodyLimit(t *testing.T) {
+	var readErr error
+	handler := BodyLimit(16)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, readErr = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	oversized := strings.Repeat("x", 17)
+
+	// A declared Content-Length over the limit is refused before the handler runs.
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(oversized)))
+	if rec.Code != http.StatusRequestEntityTooLarge || !strings.Contains(rec.Body.String(), "request_too_large") {
+		t.Errorf("declared oversized body: got %d %s, want 413 request_too_large", rec.Code, rec.Body.String())
+	}
+
+	// Without a Content-Length the read itself fails at the limit.
+	req := httptest.NewRequest(http.MethodPost, "/", io.NopCloser(strings.NewReader(oversized)))
+	req.ContentLength = -1
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	var tooLarge *http.MaxBytesError
+	if !errors.As(readErr, &tooLarge) {
+		t.Errorf("streamed oversized body: read error = %v, want *http.MaxBytesError", readErr)
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", strings.NewReader("small")))
+	if readErr != nil {
+		t.Errorf("body under the limit: read error = %v", readErr)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	tests := []struct {
+		name     string
+		handler  http.HandlerFunc
+		wantCode int
+		wantBody string
+	}{
+		{
+			name: "slow handler",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				<-r.Context().Done()
+			},
+			wantCode: http.StatusServiceUnavailable,
+			wantBody: `{"error":"request_timeout","message":"Request timed out"}`,
+		},
+		{
+			name: "handler responded before the deadline",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusAccepted)
+				<-r.Context().Done()
+			},
+			wantCode: http.StatusAccepted,
+		},
+		{
+			name:     "fast handler",
+			handler:  func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) },
+			wantCode: http.StatusOK,
+			wantBody: "ok",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			Timeout(20*time.Millisecond)(tt.handler).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if rec.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantCode)
+			}
+			if got := strings.TrimSpace(rec.Body.String()); got != tt.wantBody {
+				t.Errorf("body = %q, want %q", got, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestTimeoutSkipsExemptRoutes(t *testing.T) {
+	outlive := func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+		w.Write([]byte("data: still open\n\n"))
+	}
+
+	r := mux.NewRouter()
+	r.Use(Timeout(20*time.Millisecond, "/balances/stream"))
+	r.HandleFunc("/balances/stream", outlive)
+	r.HandleFunc("/balances", outlive)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/balances/stream", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "still open") {
+		t.Errorf("stream = %d %q, want it to outlive the timeout", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/balances", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("non-exempt route status = %d, want 503", rec.Code)
+	}
+}
+
+func TestAuthenticationChecksRevocation(t *testing.T) {
+	const secret = "middleware-test-secret"
+	sign := func(jti string) string {
+		claims := &Claims{
+			UserID: 7,
+			Role:   "user",
+			RegisteredClaims: jwt.RegisteredClaims{
+				ID:        jti,
+				Issuer:    "go-projects",
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+			},
+		}
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	revoked := map[string]bool{"revoked-jti": true}
+	var checked []string
+	isRevoked := func(ctx context.Context, jti string) (bool, error) {
+		checked = append(checked, jti)
+		if jti == "broken-jti" {
+			return false, errors.New("connection reset")
+		}
+		return revoked[jti], nil
+	}
+	handler := Authentication(secret, "go-projects", "", isRevoked, zerolog.Nop())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		name     string
+		jti      string
+		wantCode int
+		wantErr  string
+	}{
+		{"revoked token", "revoked-jti", http.StatusUnauthorized, "token_revoked"},
+		{"live token", "live-jti", http.StatusNoContent, ""},
+		{"revocation store down", "broken-jti", http.StatusServiceUnavailable, "token_check_failed"},
+		{"token without a jti", "", http.StatusNoContent, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checked = nil
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/balances/current", nil)
+			req.Header.Set("Authorization", "Bearer "+sign(tt.jti))
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status = %d (%s), want %d", rec.Code, rec.Body.String(), tt.wantCode)
+			}
+			if tt.wantErr != "" {
+				var body apierror.APIError
+				if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Code != tt.wantErr {
+					t.Errorf("body = %s, want error %q", rec.Body.String(), tt.wantErr)
+				}
+			}
+			if tt.jti == "" && len(checked) != 0 {
+				t.Errorf("token without a jti was looked up: %v", checked)
+			}
+		})
+	}
+}
+
+func TestRequireRoleMerchantRoutes(t *testing.T) {
+	handler := RequireRole("merchant", "admin")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		role string
+		want int
+	}{
+		{role: "user", want: http.StatusForbidden},
+		{role: "merchant", want: http.StatusNoContent},
+		{role: "admin", want: http.StatusNoContent},
+		{role: "", want: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.role, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/merchant/settlements", nil)
+			if tt.role != "" {
+				req = req.WithContext(context.WithValue(req.Context(), UserRoleKey, tt.role))
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequireCapability(t *testing.T) {
+	var gotUser int
+	var gotAction string
+	var gotResource *int
+	authorize := func(allowed bool, err error) func(ctx context.Context, userID int, action string, resourceID *int) (bool, error) {
+		return func(ctx context.Context, userID int, action string, resourceID *int) (bool, error) {
+			gotUser, gotAction, gotResource = userID, action, resourceID
+			return allowed, err
+		}
+	}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	tests := []struct {
+		name    string
+		allowed bool
+		err     error
+		want    int
+	}{
+		{"allowed", true, nil, http.StatusNoContent},
+		{"denied", false, nil, http.StatusForbidden},
+		{"lookup fails", false, errors.New("db down"), http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := RequireCapability("settle_own_account", authorize(tt.allowed, tt.err))(next)
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/merchant/settlements", nil)
+			req = req.WithContext(context.WithValue(req.Context(), UserIDKey, 4))
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+			if gotUser != 4 || gotAction != "settle_own_account" || gotResource == nil || *gotResource != 4 {
+				t.Errorf("authorize(%d, %q, %v), want the caller's own account", gotUser, gotAction, gotResource)
+			}
+		})
+	}
+
+	t.Run("unauthenticated", func(t *testing.T) {
+		handler := RequireCapability("settle_own_account", authorize(true, nil))(next)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/merchant/settlements", nil))
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("status = %d, want 401", rec.Code)
+		}
+	})
+}
+
+func TestIsAdmin(t *testing.T) {
+	tests := []struct {
+		name string
+		role interface{}
+		want bool
+	}{
+		{name: "admin", role: "admin", want: true},
+		{name: "user", role: "user", want: false},
+		{name: "merchant", role: "merchant", want: false},
+		{name: "case differs", role: "Admin", want: false},
+		{name: "wrong type", role: 1, want: false},
+		{name: "unauthenticated", role: nil, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.role != nil {
+				req = req.WithContext(context.WithValue(req.Context(), UserRoleKey, tt.role))
+			}
+			if got := IsAdmin(req); got != tt.want {
+				t.Errorf("IsAdmin = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveClientIP(t *testing.T) {
+	_, proxies, err := net.ParseCIDR("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted := []*net.IPNet{proxies}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		trusted    []*net.IPNet
+		headers    map[string][]string
+		want       string
+	}{
+		{
+			name:       "no trusted proxies configured",
+			remoteAddr: "10.0.0.1:5000",
+			headers:    map[string][]string{"X-Forwarded-For": {"198.51.100.7"}},
+			want:       "10.0.0.1",
+		},
+		{
+			name:       "untrusted peer cannot spoof",
+			remoteAddr: "203.0.113.5:5000",
+			trusted:    trusted,
+			headers:    map[string][]string{"X-Forwarded-For": {"198.51.100.7"}, "X-Real-IP": {"198.51.100.8"}},
+			want:       "203.0.113.5",
+		},
+		{
+			name:       "trusted proxy forwards the client",
+			remoteAddr: "10.0.0.1:5000",
+			trusted:    trusted,
+			headers:    map[string][]string{"X-Forwarded-For": {"198.51.100.7"}},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "entries prepended by the client are ignored",
+			remoteAddr: "10.0.0.1:5000",
+			trusted:    trusted,
+			headers:    map[string][]string{"X-Forwarded-For": {"6.6.6.6, 198.51.100.7"}},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "trusted hops are skipped",
+			remoteAddr: "10.0.0.1:5000",
+			trusted:    trusted,
+			headers:    map[string][]string{"X-Forwarded-For": {"198.51.100.7", "10.0.0.9"}},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "malformed hop stops the walk",
+			remoteAddr: "10.0.0.1:5000",
+			trusted:    trusted,
+			headers:    map[string][]string{"X-Forwarded-For": {"198.51.100.7, not-an-ip, 10.0.0.9"}},
+			want:       "10.0.0.9",
+		},
+		{
+			name:       "only trusted hops",
+			remoteAddr: "10.0.0.1:5000",
+			trusted:    trusted,
+			headers:    map[string][]string{"X-Forwarded-For": {"10.0.0.3"}},
+			want:       "10.0.0.3",
+		},
+		{
+			name:       "X-Real-IP from a trusted proxy",
+			remoteAddr: "10.0.0.1:5000",
+			trusted:    trusted,
+			headers:    map[string][]string{"X-Real-IP": {"198.51.100.9"}},
+			want:       "198.51.100.9",
+		},
+		{
+			name:       "invalid X-Real-IP",
+			remoteAddr: "10.0.0.1:5000",
+			trusted:    trusted,
+			headers:    map[string][]string{"X-Real-IP": {"localhost"}},
+			want:       "10.0.0.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for name, values := range tt.headers {
+				for _, value := range values {
+					req.Header.Add(name, value)
+				}
+			}
+
+			if got := resolveClientIP(req, tt.trusted); got != tt.want {
+				t.Errorf("resolveClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientIPStoresResolvedAddress(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+
+	var got string
+	handler := ClientIP([]*net.IPNet{proxies})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = GetClientIP(r)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.1.2.3:443"
+	req.Header.Set("X-Forwarded-For", "198.51.100.7")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if got != "198.51.100.7" {
+		t.Errorf("GetClientIP = %q, want the forwarded client", got)
+	}
+}
+
+func TestAuthenticationReportsTokenExpiry(t *testing.T) {
+	const secret = "middleware-test-secret"
+	handler := Authentication(secret, "go-projects", "", func(ctx context.Context, jti string) (bool, error) {
+		return false, nil
+	}, zerolog.Nop())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		name        string
+		expiresIn   time.Duration
+		wantSeconds []string
+		wantRefresh string
+	}{
+		// Signing truncates the expiry to the second, so allow one less.
+		{"near expiry", 90 * time.Second, []string{"89", "90"}, "true"},
+		{"at the threshold", tokenRefreshThreshold, []string{"299", "300"}, "true"},
+		{"fresh token", time.Hour, []string{"3599", "3600"}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := &Claims{
+				UserID: 7,
+				Role:   "user",
+				RegisteredClaims: jwt.RegisteredClaims{
+					Issuer:    "go-projects",
+					ExpiresAt: jwt.NewNumericDate(time.Now().Add(tt.expiresIn)),
+				},
+			}
+			token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/balances/current", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusNoContent {
+				t.Fatalf("status = %d (%s), want 204", rec.Code, rec.Body.String())
+			}
+			got := rec.Header().Get("X-Token-Expires-In")
+			if got != tt.wantSeconds[0] && got != tt.wantSeconds[1] {
+				t.Errorf("X-Token-Expires-In = %q, want one of %v", got, tt.wantSeconds)
+			}
+			if got := rec.Header().Get("X-Token-Refresh-Recommended"); got != tt.wantRefresh {
+				t.Errorf("X-Token-Refresh-Recommended = %q, want %q", got, tt.wantRefresh)
+			}
+		})
+	}
+}
+
+func TestParsePagination(t *testing.T) {
+	tests := []struct {
+		query      string
+		wantLimit  int
+		wantOffset int
+	}{
+		{query: "", wantLimit: DefaultPageSize, wantOffset: 0},
+		{query: "limit=10&offset=20", wantLimit: 10, wantOffset: 20},
+		{query: "offset=0", wantLimit: DefaultPageSize, wantOffset: 0},
+		{query: "limit=1000", wantLimit: 100, wantOffset: 0},
+		{query: "limit=100", wantLimit: 100, wantOffset: 0},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/?"+tt.query, nil)
+		limit, offset, err := ParsePagination(req, 100)
+		if err != nil {
+			t.Errorf("%q: %v", tt.query, err)
+			continue
+		}
+		if limit != tt.wantLimit || offset != tt.wantOffset {
+			t.Errorf("%q: limit, offset = %d, %d; want %d, %d", tt.query, limit, offset, tt.wantLimit, tt.wantOffset)
+		}
+	}
+}
+
+func TestParsePaginationDefaultCappedByMax(t *testing.T) {
+	limit, _, err := ParsePagination(httptest.NewRequest(http.MethodGet, "/", nil), 20)
+	if err != nil || limit != 20 {
+		t.Errorf("limit = %d, %v; want the default capped at 20", limit, err)
+	}
+}
+
+func TestParsePaginationRejectsInvalidValues(t *testing.T) {
+	tests := []struct {
+		query string
+		field string
+	}{
+		{query: "limit=0", field: "limit"},
+		{query: "limit=-5", field: "limit"},
+		{query: "limit=ten", field: "limit"},
+		{query: "limit=1.5", field: "limit"},
+		{query: "offset=-1", field: "offset"},
+		{query: "offset=abc", field: "offset"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/?"+tt.query, nil)
+		_, _, err := ParsePagination(req, 100)
+
+		apiErr, ok := apierror.FromError(err)
+		if !ok {
+			t.Errorf("%q: err = %v, want an API error", tt.query, err)
+			continue
+		}
+		if apiErr.Status != http.StatusBadRequest || apiErr.Code != "invalid_pagination" || apiErr.Field != tt.field {
+			t.Errorf("%q: got %d %s on %q, want 400 invalid_pagination on %q", tt.query, apiErr.Status, apiErr.Code, apiErr.Field, tt.field)
+		}
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := map[string]bool{
+		"gzip":                 true,
+		"GZIP":                 true,
+		"deflate, gzip;q=0.5":  true,
+		"br, gzip":             true,
+		"gzip;q=0":             false,
+		"gzip; q=0.0, deflate": false,
+		"deflate, br":          false,
+		"identity":             false,
+		"":                     false,
+	}
+
+	for header, want := range tests {
+		if got := acceptsGzip(header); got != want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", header, got, want)
+		}
+	}
+}
+
+func TestCompressionGzipsLargeResponses(t *testing.T) {
+	payload := map[string][]string{"transactions": {}}
+	for i := 0; i < 200; i++ {
+		payload["transactions"] = append(payload["transactions"], "transaction entry")
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := Compression(1024)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body[:10])
+		w.Write(body[10:])
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/transactions/history", nil)
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	rec := httptest.NewRecorder()
+	// The status must still reach the logging and metrics wrapper.
+	tracked := &responseWriter{ResponseWriter: rec, statusCode: http.StatusOK}
+	handler.ServeHTTP(tracked, req)
+
+	if rec.Code != http.StatusCreated || tracked.statusCode != http.StatusCreated {
+		t.Errorf("status = %d, tracked %d; want 201", rec.Code, tracked.statusCode)
+	}
+	if rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", rec.Header().Get("Content-Encoding"))
+	}
+	if rec.Header().Get("Vary") != "Accept-Encoding" {
+		t.Errorf("Vary = %q", rec.Header().Get("Vary"))
+	}
+	if rec.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("Content-Type = %q", rec.Header().Get("Content-Type"))
+	}
+
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded, body) {
+		t.Error("decompressed body differs from what the handler wrote")
+	}
+}
+
+func TestCompressionSkipsSmallAndUnacceptedResponses(t *testing.T) {
+	body := []byte(`{"error":"not_found"}`)
+	handler := Compression(1024)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(body)
+	}))
+
+	for _, acceptEncoding := range []string{"gzip", ""} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("Accept-Encoding %q: status = %d, want 404", acceptEncoding, rec.Code)
+		}
+		if rec.Header().Get("Content-Encoding") != "" {
+			t.Errorf("Accept-Encoding %q: small body compressed", acceptEncoding)
+		}
+		if !bytes.Equal(rec.Body.Bytes(), body) {
+			t.Errorf("Accept-Encoding %q: body = %q", acceptEncoding, rec.Body)
+		}
+	}
+}
+
+func TestCompressionLeavesStreamsAlone(t *testing.T) {
+	handler := Compression(16)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: {\"balance\":\"10.00\"}\n\n"))
+		w.(http.Flusher).Flush()
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/balances/stream", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Header().Get("Content-Encoding") != "" {
+		t.Error("event stream compressed")
+	}
+	if !strings.HasPrefix(rec.Body.String(), "data: ") {
+		t.Errorf("body = %q", rec.Body)
+	}
+}
+
+func TestTracingRecordsRequestSpan(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := tracing.NewProvider(sdktrace.NewSimpleSpanProcessor(exporter), "test")
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	r := mux.NewRouter()
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), RequestIDKey, "req-42")))
+		})
+	})
+	r.Use(Tracing())
+	r.HandleFunc("/api/v1/transactions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	const parent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/transactions/7", nil)
+	req.Header.Set("traceparent", parent)
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("recorded %d spans, want 1", len(spans))
+	}
+	span := spans[0]
+	if span.Name != "GET /api/v1/transactions/{id}" {
+		t.Errorf("span name = %q, want the route template", span.Name)
+	}
+	if got := span.SpanContext.TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("trace id = %s, want the incoming traceparent's", got)
+	}
+	attrs := map[string]string{}
+	for _, attr := range span.Attributes {
+		attrs[string(attr.Key)] = attr.Value.Emit()
+	}
+	if attrs["request.id"] != "req-42" || attrs["http.response.status_code"] != "500" || attrs["http.route"] != "/api/v1/transactions/{id}" {
+		t.Errorf("attributes = %v, want request id, route and status", attrs)
+	}
+	if span.Status.Code != codes.Error {
+		t.Errorf("status = %v, want an error for a 5xx response", span.Status)
+	}
+}
@@ -0,0 +1,25 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+type AuditLog struct {
+	ID         int             `json:"id" xml:"id"`
+	EntityType string          `json:"entity_type" xml:"entity_type"`
+	EntityID   int             `json:"entity_id" xml:"entity_id"`
+	Action     string          `json:"action" xml:"action"`
+	Details    json.RawMessage `json:"details" xml:"details"`
+	CreatedAt  time.Time       `json:"created_at" xml:"created_at"`
+}
+
+type AuditLogFilter struct {
+	EntityType string
+	EntityID   *int
+	Action     string
+	From       *time.Time
+	To         *time.Time
+	Limit      int
+	Offset     int
+}
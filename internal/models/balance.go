@@ -3,16 +3,101 @@ package models
 import "time"
 
 type Balance struct {
+	UserID         int       `json:"user_id" xml:"user_id"`
+	Currency       string    `json:"currency" xml:"currency"`
+	Amount         Money     `json:"amount" xml:"amount"`
+	OverdraftLimit Money     `json:"overdraft_limit" xml:"overdraft_limit"`
+	Version        int       `json:"-" xml:"-"`
+	LastUpdatedAt  time.Time `json:"last_updated_at" xml:"last_updated_at"`
+}
+
+// Available is how much can be taken out, including the overdraft allowance.
+func (b *Balance) Available() Money {
+	return b.Amount + b.OverdraftLimit
+}
+
+// BalanceUpdate is pushed to balance stream subscribers after a committed
+// change.
+type BalanceUpdate struct {
 	UserID        int       `json:"user_id"`
-	Amount        float64   `json:"amount"`
-	LastUpdatedAt time.Time `json:"last_updated_at"`
+	Currency      string    `json:"currency"`
+	Balance       Money     `json:"balance"`
+	ChangeAmount  Money     `json:"change_amount"`
+	TransactionID *int64    `json:"transaction_id,omitempty"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+type OverdraftLimitRequest struct {
+	Currency       string `json:"currency,omitempty"`
+	OverdraftLimit Money  `json:"overdraft_limit"`
+}
+
+// MaxBulkBalanceUsers bounds how many users one bulk balance query may name.
+const MaxBulkBalanceUsers = 500
+
+type BulkBalanceRequest struct {
+	UserIDs  []int  `json:"user_ids"`
+	Currency string `json:"currency,omitempty"`
+}
+
+// BulkBalanceResponse lists balances in request order. Users without a
+// balance row in the currency have a zero balance; IDs that match no user
+// are listed in Missing instead.
+type BulkBalanceResponse struct {
+	Currency string     `json:"currency" xml:"currency"`
+	Balances []*Balance `json:"balances" xml:"balance"`
+	Missing  []int      `json:"missing" xml:"missing"`
 }
 
 type BalanceHistory struct {
-	ID            int       `json:"id"`
-	UserID        int       `json:"user_id"`
-	Balance       float64   `json:"balance"`
-	ChangeAmount  float64   `json:"change_amount"`
-	TransactionID *int      `json:"transaction_id,omitempty"`
-	CreatedAt     time.Time `json:"created_at"`
+	ID            int       `json:"id" xml:"id"`
+	UserID        int       `json:"user_id" xml:"user_id"`
+	Currency      string    `json:"currency" xml:"currency"`
+	Balance       Money     `json:"balance" xml:"balance"`
+	ChangeAmount  Money     `json:"change_amount" xml:"change_amount"`
+	TransactionID *int      `json:"transaction_id,omitempty" xml:"transaction_id,omitempty"`
+	CreatedAt     time.Time `json:"created_at" xml:"created_at"`
+}
+
+type BalanceDiscrepancy struct {
+	UserID            int    `json:"user_id" xml:"user_id"`
+	Currency          string `json:"currency" xml:"currency"`
+	StoredBalance     Money  `json:"stored_balance" xml:"stored_balance"`
+	CalculatedBalance Money  `json:"calculated_balance" xml:"calculated_balance"`
+	Repaired          bool   `json:"repaired" xml:"repaired"`
+}
+
+type BalancePoint struct {
+	At      time.Time `json:"at" xml:"at"`
+	Balance Money     `json:"balance" xml:"balance"`
+}
+
+type BalanceReconciliation struct {
+	UserID            int    `json:"user_id" xml:"user_id"`
+	Currency          string `json:"currency" xml:"currency"`
+	StoredBalance     Money  `json:"stored_balance" xml:"stored_balance"`
+	CalculatedBalance Money  `json:"calculated_balance" xml:"calculated_balance"`
+	Matches           bool   `json:"matches" xml:"matches"`
+	Corrected         bool   `json:"corrected" xml:"corrected"`
+}
+
+type ReconciliationStatus string
+
+const (
+	ReconciliationStatusPending   ReconciliationStatus = "pending"
+	ReconciliationStatusRunning   ReconciliationStatus = "running"
+	ReconciliationStatusCompleted ReconciliationStatus = "completed"
+	ReconciliationStatusFailed    ReconciliationStatus = "failed"
+)
+
+type ReconciliationReport struct {
+	ID            string                `json:"id" xml:"id"`
+	Status        ReconciliationStatus  `json:"status" xml:"status"`
+	Repair        bool                  `json:"repair" xml:"repair"`
+	Processed     int                   `json:"processed" xml:"processed"`
+	Total         int                   `json:"total" xml:"total"`
+	Discrepancies []*BalanceDiscrepancy `json:"discrepancies" xml:"discrepancies"`
+	Error         string                `json:"error,omitempty" xml:"error,omitempty"`
+	StartedAt     time.Time             `json:"started_at" xml:"started_at"`
+	FinishedAt    *time.Time            `json:"finished_at,omitempty" xml:"finished_at,omitempty"`
 }
@@ -0,0 +1,36 @@
+package models
+
+import (
+	"errors"
+	"math"
+	"strings"
+)
+
+// DefaultCurrency is used wherever a request or stored row does not name a
+// currency, so clients written before multi-currency support keep working.
+const DefaultCurrency = "USD"
+
+var ErrInvalidCurrency = errors.New("currency must be a three-letter ISO 4217 code")
+
+// NormalizeCurrency upper-cases an ISO 4217 code and maps an empty value to
+// DefaultCurrency.
+func NormalizeCurrency(code string) (string, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if code == "" {
+		return DefaultCurrency, nil
+	}
+	if len(code) != 3 {
+		return "", ErrInvalidCurrency
+	}
+	for _, c := range code {
+		if c < 'A' || c > 'Z' {
+			return "", ErrInvalidCurrency
+		}
+	}
+	return code, nil
+}
+
+// Convert applies an exchange rate and rounds to the nearest minor unit.
+func (m Money) Convert(rate float64) Money {
+	return Money(math.Round(float64(m) * rate))
+}
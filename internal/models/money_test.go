@@ -0,0 +1,181 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Money
+	}{
+		{in: "10", want: 1000},
+		{in: "10.5", want: 1050},
+		{in: "10.50", want: 1050},
+		{in: "1.000", want: 100},
+		{in: ".5", want: 50},
+		{in: "+1.00", want: 100},
+		{in: " 2.25 ", want: 225},
+		{in: "-5.25", want: -525},
+		{in: "-0.01", want: -1},
+		{in: "92233720368547757.99", want: 9223372036854775799},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseMoney(tt.in)
+		if err != nil {
+			t.Errorf("ParseMoney(%q): %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseMoney(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseMoneyRejects(t *testing.T) {
+	for _, in := range []string{
+		"", " ", ".", "1.", "-", "--5", "+-5", "1.2.3", "1,00", "abc",
+		"1.005", "0.001", "1.0050",
+		"Inf", "+Inf", "-Inf", "Infinity", "NaN", "1e3",
+		"92233720368547758.00", "99999999999999999999", "-99999999999999999999",
+	} {
+		if got, err := ParseMoney(in); !errors.Is(err, ErrInvalidAmount) {
+			t.Errorf("ParseMoney(%q) = %d, %v; want ErrInvalidAmount", in, got, err)
+		}
+	}
+}
+
+func TestMoneyString(t *testing.T) {
+	tests := []struct {
+		in   Money
+		want string
+	}{
+		{in: 0, want: "0.00"},
+		{in: 5, want: "0.05"},
+		{in: 1230, want: "12.30"},
+		{in: -1, want: "-0.01"},
+		{in: -1050, want: "-10.50"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.in.String(); got != tt.want {
+			t.Errorf("Money(%d).String() = %q, want %q", int64(tt.in), got, tt.want)
+		}
+	}
+}
+
+func TestMoneyUnmarshalJSON(t *testing.T) {
+	type payload struct {
+		Amount Money `json:"amount"`
+	}
+
+	accepted := map[string]Money{
+		`{"amount": 12.34}`:   1234,
+		`{"amount": "12.34"}`: 1234,
+		`{"amount": 0.1}`:     10,
+		`{"amount": -3}`:      -300,
+		`{"amount": null}`:    0,
+	}
+	for in, want := range accepted {
+		var p payload
+		if err := json.Unmarshal([]byte(in), &p); err != nil {
+			t.Errorf("%s: %v", in, err)
+			continue
+		}
+		if p.Amount != want {
+			t.Errorf("%s: amount = %d, want %d", in, p.Amount, want)
+		}
+	}
+
+	for _, in := range []string{
+		`{"amount": 1.005}`,
+		`{"amount": "1.005"}`,
+		`{"amount": "Inf"}`,
+		`{"amount": "NaN"}`,
+		`{"amount": 1e309}`,
+		`{"amount": 1e2}`,
+		`{"amount": 100000000000000000000}`,
+		`{"amount": true}`,
+	} {
+		var p payload
+		if err := json.Unmarshal([]byte(in), &p); err == nil {
+			t.Errorf("%s: accepted as %s", in, p.Amount)
+		}
+	}
+}
+
+func TestMoneyMarshalJSON(t *testing.T) {
+	data, err := json.Marshal(map[string]Money{"amount": 1230})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"amount":12.30}` {
+		t.Errorf("got %s, want two decimal places", data)
+	}
+
+	var back map[string]Money
+	if err := json.Unmarshal(data, &back); err != nil || back["amount"] != 1230 {
+		t.Errorf("round trip = %v, %v", back, err)
+	}
+}
+
+func TestRepeatedSmallTransfersDoNotDrift(t *testing.T) {
+	cent, err := ParseMoney("0.01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dime, err := ParseMoney("0.10")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	from, to := Money(10000), Money(0)
+	for i := 0; i < 10000; i++ {
+		from -= cent
+		to += cent
+	}
+	if from != 0 || to != 10000 {
+		t.Errorf("after 10000 transfers of 0.01: from = %s, to = %s; want 0.00 and 100.00", from, to)
+	}
+
+	// 1000 float64 additions of 0.10 come to 99.9999999999986.
+	var total Money
+	for i := 0; i < 1000; i++ {
+		total += dime
+	}
+	if total.String() != "100.00" {
+		t.Errorf("1000 x 0.10 = %s, want 100.00", total)
+	}
+}
+
+func TestMoneyScan(t *testing.T) {
+	tests := []struct {
+		src  interface{}
+		want Money
+	}{
+		{src: []byte("12.34"), want: 1234},
+		{src: "-0.50", want: -50},
+		{src: int64(7), want: 700},
+		{src: 0.3, want: 30},
+		{src: nil, want: 0},
+	}
+
+	for _, tt := range tests {
+		var m Money
+		if err := m.Scan(tt.src); err != nil {
+			t.Errorf("Scan(%#v): %v", tt.src, err)
+			continue
+		}
+		if m != tt.want {
+			t.Errorf("Scan(%#v) = %d, want %d", tt.src, m, tt.want)
+		}
+	}
+
+	var m Money
+	if err := m.Scan(true); err == nil {
+		t.Error("Scan(bool) succeeded")
+	}
+}
@@ -0,0 +1,16 @@
+package models
+
+type PaginatedResponse struct {
+	Items      interface{} `json:"items" xml:"items"`
+	Limit      int         `json:"limit" xml:"limit"`
+	Offset     int         `json:"offset" xml:"offset"`
+	TotalCount int         `json:"total_count" xml:"total_count"`
+}
+
+// CursorPage is returned instead of PaginatedResponse when a client pages
+// with ?cursor=. NextCursor is omitted on the last page.
+type CursorPage struct {
+	Items      interface{} `json:"items" xml:"items"`
+	Limit      int         `json:"limit" xml:"limit"`
+	NextCursor string      `json:"next_cursor,omitempty" xml:"next_cursor,omitempty"`
+}
@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+type StatementEntry struct {
+	TransactionID  int       `json:"transaction_id" xml:"transaction_id"`
+	Date           time.Time `json:"date" xml:"date"`
+	Type           string    `json:"type" xml:"type"`
+	Counterparty   string    `json:"counterparty" xml:"counterparty"`
+	Amount         Money     `json:"amount" xml:"amount"`
+	RunningBalance Money     `json:"running_balance" xml:"running_balance"`
+}
+
+type Statement struct {
+	UserID         int               `json:"user_id" xml:"user_id"`
+	Currency       string            `json:"currency" xml:"currency"`
+	From           time.Time         `json:"from" xml:"from"`
+	To             time.Time         `json:"to" xml:"to"`
+	OpeningBalance Money             `json:"opening_balance" xml:"opening_balance"`
+	ClosingBalance Money             `json:"closing_balance" xml:"closing_balance"`
+	Entries        []*StatementEntry `json:"entries" xml:"entries"`
+}
@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+type KillSwitchStatus struct {
+	Active    bool       `json:"active" xml:"active"`
+	Reason    string     `json:"reason,omitempty" xml:"reason,omitempty"`
+	UpdatedBy int        `json:"updated_by,omitempty" xml:"updated_by,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty" xml:"updated_at,omitempty"`
+}
+
+type KillSwitchRequest struct {
+	Reason string `json:"reason"`
+}
@@ -3,21 +3,50 @@ package models
 import "time"
 
 type Transaction struct {
-	ID         int       `json:"id"`
-	FromUserID *int      `json:"from_user_id,omitempty"`
-	ToUserID   *int      `json:"to_user_id,omitempty"`
-	Amount     float64   `json:"amount"`
-	Type       string    `json:"type"`
-	Status     string    `json:"status"`
-	CreatedAt  time.Time `json:"created_at"`
+	ID                  int       `json:"id" xml:"id"`
+	FromUserID          *int      `json:"from_user_id,omitempty" xml:"from_user_id,omitempty"`
+	ToUserID            *int      `json:"to_user_id,omitempty" xml:"to_user_id,omitempty"`
+	Amount              Money     `json:"amount" xml:"amount"`
+	Currency            string    `json:"currency" xml:"currency"`
+	ToCurrency          *string   `json:"to_currency,omitempty" xml:"to_currency,omitempty"`
+	ToAmount            *Money    `json:"to_amount,omitempty" xml:"to_amount,omitempty"`
+	ExchangeRate        *float64  `json:"exchange_rate,omitempty" xml:"exchange_rate,omitempty"`
+	Type                string    `json:"type" xml:"type"`
+	Status              string    `json:"status" xml:"status"`
+	FailureReason       *string   `json:"failure_reason,omitempty" xml:"failure_reason,omitempty"`
+	Reason              *string   `json:"reason,omitempty" xml:"reason,omitempty"`
+	Memo                *string   `json:"memo,omitempty" xml:"memo,omitempty"`
+	ExternalReference   *string   `json:"external_reference,omitempty" xml:"external_reference,omitempty"`
+	ParentTransactionID *int      `json:"parent_transaction_id,omitempty" xml:"parent_transaction_id,omitempty"`
+	CreatedAt           time.Time `json:"created_at" xml:"created_at"`
+}
+
+// CreditedCurrency is the currency the receiving side was paid in, which
+// differs from Currency only for cross-currency transfers.
+func (t *Transaction) CreditedCurrency() string {
+	if t.ToCurrency != nil {
+		return *t.ToCurrency
+	}
+	return t.Currency
+}
+
+// CreditedAmount is the amount the receiving side was paid.
+func (t *Transaction) CreditedAmount() Money {
+	if t.ToAmount != nil {
+		return *t.ToAmount
+	}
+	return t.Amount
 }
 
 type TransactionType string
 
 const (
-	TransactionTypeCredit   TransactionType = "credit"
-	TransactionTypeDebit    TransactionType = "debit"
-	TransactionTypeTransfer TransactionType = "transfer"
+	TransactionTypeCredit     TransactionType = "credit"
+	TransactionTypeDebit      TransactionType = "debit"
+	TransactionTypeTransfer   TransactionType = "transfer"
+	TransactionTypeWithdrawal TransactionType = "withdrawal"
+	TransactionTypeRefund     TransactionType = "refund"
+	TransactionTypeExchange   TransactionType = "exchange"
 )
 
 type TransactionStatus string
@@ -29,18 +58,120 @@ const (
 	TransactionStatusRolledBack TransactionStatus = "rolled_back"
 )
 
+type IdempotencyKey struct {
+	UserID int
+	Key    string
+}
+
 type CreditRequest struct {
-	UserID int     `json:"user_id"`
-	Amount float64 `json:"amount"`
+	UserID   int    `json:"user_id"`
+	Amount   Money  `json:"amount"`
+	Currency string `json:"currency,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// SettlementRequest is a merchant crediting its own account with funds
+// settled outside the system; Reference identifies the external payout.
+type SettlementRequest struct {
+	Amount    Money  `json:"amount"`
+	Currency  string `json:"currency,omitempty"`
+	Reference string `json:"reference"`
+}
+
+// TransactionStats aggregates a user's transactions in one currency. The
+// count and totals cover completed transactions; CountByType and
+// CountByStatus cover every attempt, including failed and rolled back ones.
+// From and To are omitted when the range is unbounded.
+type TransactionStats struct {
+	UserID           int        `json:"user_id" xml:"user_id"`
+	Currency         string     `json:"currency" xml:"currency"`
+	From             *time.Time `json:"from,omitempty" xml:"from,omitempty"`
+	To               *time.Time `json:"to,omitempty" xml:"to,omitempty"`
+	TransactionCount int        `json:"transaction_count" xml:"transaction_count"`
+	TotalCredited    Money      `json:"total_credited" xml:"total_credited"`
+	TotalDebited     Money      `json:"total_debited" xml:"total_debited"`
+	Net              Money      `json:"net" xml:"net"`
+	CountByType      Counts     `json:"count_by_type" xml:"count_by_type"`
+	CountByStatus    Counts     `json:"count_by_status" xml:"count_by_status"`
+}
+
+// MerchantStats summarises a merchant's completed inflows in one currency:
+// settlements and payments received as transfers. From and To are omitted
+// when the range is unbounded.
+type MerchantStats struct {
+	UserID          int        `json:"user_id" xml:"user_id"`
+	Currency        string     `json:"currency" xml:"currency"`
+	From            *time.Time `json:"from,omitempty" xml:"from,omitempty"`
+	To              *time.Time `json:"to,omitempty" xml:"to,omitempty"`
+	SettlementCount int        `json:"settlement_count" xml:"settlement_count"`
+	TotalSettled    Money      `json:"total_settled" xml:"total_settled"`
+	PaymentCount    int        `json:"payment_count" xml:"payment_count"`
+	TotalReceived   Money      `json:"total_received" xml:"total_received"`
 }
 
 type DebitRequest struct {
-	UserID int     `json:"user_id"`
-	Amount float64 `json:"amount"`
+	UserID   int    `json:"user_id"`
+	Amount   Money  `json:"amount"`
+	Currency string `json:"currency,omitempty"`
+	Reason   string `json:"reason,omitempty"`
 }
 
+// TransferRequest moves Amount in Currency out of the sender. When ToCurrency
+// differs, the receiver is credited Amount converted at ExchangeRate.
 type TransferRequest struct {
-	FromUserID int     `json:"from_user_id"`
-	ToUserID   int     `json:"to_user_id"`
-	Amount     float64 `json:"amount"`
+	FromUserID   int     `json:"from_user_id"`
+	ToUserID     int     `json:"to_user_id"`
+	Amount       Money   `json:"amount"`
+	Currency     string  `json:"currency,omitempty"`
+	ToCurrency   string  `json:"to_currency,omitempty"`
+	ExchangeRate float64 `json:"exchange_rate,omitempty"`
+	Memo         string  `json:"memo,omitempty"`
+}
+
+type WithdrawRequest struct {
+	UserID      int    `json:"user_id"`
+	Amount      Money  `json:"amount"`
+	Currency    string `json:"currency,omitempty"`
+	Destination string `json:"destination"`
+}
+
+// ExchangeRequest converts Amount of FromCurrency into ToCurrency within one
+// user's wallet at Rate units of ToCurrency per unit of FromCurrency.
+type ExchangeRequest struct {
+	UserID       int     `json:"user_id"`
+	FromCurrency string  `json:"from_currency"`
+	ToCurrency   string  `json:"to_currency"`
+	Amount       Money   `json:"amount"`
+	Rate         float64 `json:"rate"`
+}
+
+type RefundRequest struct {
+	Reason string `json:"reason"`
+}
+
+type AccountSummary struct {
+	UserID              int        `json:"user_id" xml:"user_id"`
+	TotalTransactions   int        `json:"total_transactions" xml:"total_transactions"`
+	PendingTransactions int        `json:"pending_transactions" xml:"pending_transactions"`
+	MonthTransactions   int        `json:"month_transactions" xml:"month_transactions"`
+	Currency            string     `json:"currency" xml:"currency"`
+	Balance             Money      `json:"balance" xml:"balance"`
+	LastTransactionAt   *time.Time `json:"last_transaction_at,omitempty" xml:"last_transaction_at,omitempty"`
+}
+
+type AccountState struct {
+	UserID           int            `json:"user_id" xml:"user_id"`
+	TransactionID    int            `json:"transaction_id" xml:"transaction_id"`
+	Currency         string         `json:"currency" xml:"currency"`
+	Balance          Money          `json:"balance" xml:"balance"`
+	TargetRolledBack bool           `json:"target_rolled_back" xml:"target_rolled_back"`
+	Transactions     []*Transaction `json:"transactions" xml:"transactions"`
+}
+
+type TransactionStatusChange struct {
+	ID            int       `json:"id" xml:"id"`
+	TransactionID int       `json:"transaction_id" xml:"transaction_id"`
+	FromStatus    *string   `json:"from_status,omitempty" xml:"from_status,omitempty"`
+	ToStatus      string    `json:"to_status" xml:"to_status"`
+	CreatedAt     time.Time `json:"created_at" xml:"created_at"`
 }
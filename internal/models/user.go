@@ -3,13 +3,17 @@ package models
 import "time"
 
 type User struct {
-	ID           int       `json:"id"`
-	Username     string    `json:"username"`
-	Email        string    `json:"email"`
-	PasswordHash string    `json:"-"`
-	Role         string    `json:"role"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
+	ID           int       `json:"id" xml:"id"`
+	Username     string    `json:"username" xml:"username"`
+	Email        string    `json:"email" xml:"email"`
+	FullName     *string   `json:"full_name,omitempty" xml:"full_name,omitempty"`
+	Phone        *string   `json:"phone,omitempty" xml:"phone,omitempty"`
+	AvatarURL    *string   `json:"avatar_url,omitempty" xml:"avatar_url,omitempty"`
+	PasswordHash string    `json:"-" xml:"-"`
+	Role         string    `json:"role" xml:"role"`
+	Status       string    `json:"status" xml:"status"`
+	CreatedAt    time.Time `json:"created_at" xml:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at" xml:"updated_at"`
 }
 
 type UserRole string
@@ -20,6 +24,24 @@ const (
 	RoleMerchant UserRole = "merchant"
 )
 
+func (r UserRole) IsValid() bool {
+	switch r {
+	case RoleAdmin, RoleUser, RoleMerchant:
+		return true
+	default:
+		return false
+	}
+}
+
+// UserStatus controls whether an account may move money out. Frozen accounts
+// can still receive credits.
+type UserStatus string
+
+const (
+	UserStatusActive UserStatus = "active"
+	UserStatusFrozen UserStatus = "frozen"
+)
+
 type RegisterRequest struct {
 	Username string `json:"username"`
 	Email    string `json:"email"`
@@ -27,12 +49,94 @@ type RegisterRequest struct {
 	Role     string `json:"role"`
 }
 
+// ProfileDetails are the optional profile fields. A nil field is left as it
+// is; an empty string clears it.
+type ProfileDetails struct {
+	FullName  *string `json:"full_name,omitempty"`
+	Phone     *string `json:"phone,omitempty"`
+	AvatarURL *string `json:"avatar_url,omitempty"`
+}
+
+// UpdateUserRequest is a partial update; only the fields present change.
+type UpdateUserRequest struct {
+	Username string `json:"username,omitempty"`
+	Email    string `json:"email,omitempty"`
+	Role     string `json:"role,omitempty"`
+	ProfileDetails
+}
+
+// CreateUserRequest is an admin creating an account with an explicit role.
+// Leaving Password empty has a temporary password generated.
+type CreateUserRequest struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Password string `json:"password,omitempty"`
+	Role     string `json:"role"`
+}
+
+// CreateUserResponse carries the generated temporary password, if any. It is
+// shown only in this response.
+type CreateUserResponse struct {
+	User              *User  `json:"user" xml:"user"`
+	TemporaryPassword string `json:"temporary_password,omitempty" xml:"temporary_password,omitempty"`
+}
+
 type LoginRequest struct {
 	Email    string `json:"email"`
 	Password string `json:"password"`
+	TOTPCode string `json:"totp_code,omitempty"`
 }
 
-type AuthResponse struct {
-	User  *User  `json:"user"`
+type TOTPEnrollment struct {
+	Secret     string `json:"secret" xml:"secret"`
+	OTPAuthURL string `json:"otpauth_url" xml:"otpauth_url"`
+}
+
+type TOTPConfirmRequest struct {
+	Code string `json:"code"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+type ResetPasswordRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+type ValidateTokenRequest struct {
 	Token string `json:"token,omitempty"`
 }
+
+// TokenInfo is the decoded form of a valid access token.
+type TokenInfo struct {
+	Valid     bool       `json:"valid" xml:"valid"`
+	UserID    int        `json:"user_id" xml:"user_id"`
+	Email     string     `json:"email" xml:"email"`
+	Role      string     `json:"role" xml:"role"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty" xml:"expires_at,omitempty"`
+}
+
+type AuthResponse struct {
+	User         *User  `json:"user" xml:"user"`
+	Token        string `json:"token,omitempty" xml:"token,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty" xml:"refresh_token,omitempty"`
+}
+
+type MergeUsersRequest struct {
+	SourceUserID int `json:"source_user_id"`
+	TargetUserID int `json:"target_user_id"`
+}
+
+type MergeUsersResult struct {
+	SourceUserID        int             `json:"source_user_id" xml:"source_user_id"`
+	TargetUserID        int             `json:"target_user_id" xml:"target_user_id"`
+	MovedTransactions   int64           `json:"moved_transactions" xml:"moved_transactions"`
+	MovedHistoryEntries int64           `json:"moved_history_entries" xml:"moved_history_entries"`
+	CombinedBalances    CurrencyAmounts `json:"combined_balances" xml:"combined_balances"`
+}
@@ -0,0 +1,16 @@
+package models
+
+import "testing"
+
+func TestUserRoleIsValid(t *testing.T) {
+	for _, role := range []UserRole{RoleAdmin, RoleUser, RoleMerchant} {
+		if !role.IsValid() {
+			t.Errorf("%q reported invalid", role)
+		}
+	}
+	for _, role := range []UserRole{"", "superuser", "Admin"} {
+		if role.IsValid() {
+			t.Errorf("%q reported valid", role)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package models
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+var emailPattern = regexp.MustCompile(`^[a-zA-Z0-9._%+\-]+@[a-zA-Z0-9.\-]+\.[a-zA-Z]{2,}$`)
+
+// phonePattern accepts E.164 numbers: a plus sign and up to 15 digits.
+var phonePattern = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+
+const (
+	minUsernameLength = 3
+	maxUsernameLength = 50
+	minPasswordLength = 8
+
+	maxReferenceLength = 255
+	maxMemoLength      = 140
+
+	maxFullNameLength  = 100
+	maxAvatarURLLength = 512
+)
+
+type ValidationErrors map[string]string
+
+func (v ValidationErrors) Error() string {
+	fields := make([]string, 0, len(v))
+	for field, message := range v {
+		fields = append(fields, field+": "+message)
+	}
+	sort.Strings(fields)
+	return "validation failed: " + strings.Join(fields, "; ")
+}
+
+func (v ValidationErrors) orNil() error {
+	if len(v) == 0 {
+		return nil
+	}
+	return v
+}
+
+func validateUsernameAndEmail(errs ValidationErrors, username, email string) {
+	switch n := utf8.RuneCountInString(strings.TrimSpace(username)); {
+	case n == 0:
+		errs["username"] = "is required"
+	case n < minUsernameLength || n > maxUsernameLength:
+		errs["username"] = "must be between 3 and 50 characters"
+	}
+
+	if email == "" {
+		errs["email"] = "is required"
+	} else if !emailPattern.MatchString(email) {
+		errs["email"] = "must be a valid email address"
+	}
+}
+
+func (r *RegisterRequest) Validate() error {
+	errs := ValidationErrors{}
+
+	validateUsernameAndEmail(errs, r.Username, r.Email)
+
+	if r.Password == "" {
+		errs["password"] = "is required"
+	} else if len(r.Password) < minPasswordLength {
+		errs["password"] = "must be at least 8 characters"
+	}
+
+	if r.Role != "" && !UserRole(r.Role).IsValid() {
+		errs["role"] = "must be one of admin, user, merchant"
+	}
+
+	return errs.orNil()
+}
+
+func (r *CreateUserRequest) Validate() error {
+	errs := ValidationErrors{}
+
+	validateUsernameAndEmail(errs, r.Username, r.Email)
+
+	if r.Password != "" && len(r.Password) < minPasswordLength {
+		errs["password"] = "must be at least 8 characters"
+	}
+
+	if r.Role == "" {
+		errs["role"] = "is required"
+	} else if !UserRole(r.Role).IsValid() {
+		errs["role"] = "must be one of admin, user, merchant"
+	}
+
+	return errs.orNil()
+}
+
+func (r *UpdateUserRequest) Validate() error {
+	errs := ValidationErrors{}
+
+	if r.Username != "" {
+		if n := utf8.RuneCountInString(strings.TrimSpace(r.Username)); n < minUsernameLength || n > maxUsernameLength {
+			errs["username"] = "must be between 3 and 50 characters"
+		}
+	}
+
+	if r.Email != "" && !emailPattern.MatchString(r.Email) {
+		errs["email"] = "must be a valid email address"
+	}
+
+	if r.FullName != nil && utf8.RuneCountInString(*r.FullName) > maxFullNameLength {
+		errs["full_name"] = fmt.Sprintf("must be at most %d characters", maxFullNameLength)
+	}
+
+	if r.Phone != nil && *r.Phone != "" && !phonePattern.MatchString(*r.Phone) {
+		errs["phone"] = "must be in E.164 format, e.g. +905551234567"
+	}
+
+	if r.AvatarURL != nil && *r.AvatarURL != "" {
+		if len(*r.AvatarURL) > maxAvatarURLLength {
+			errs["avatar_url"] = fmt.Sprintf("must be at most %d characters", maxAvatarURLLength)
+		} else if u, err := url.Parse(*r.AvatarURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs["avatar_url"] = "must be an absolute http or https URL"
+		}
+	}
+
+	return errs.orNil()
+}
+
+func (r *LoginRequest) Validate() error {
+	errs := ValidationErrors{}
+	if r.Email == "" {
+		errs["email"] = "is required"
+	}
+	if r.Password == "" {
+		errs["password"] = "is required"
+	}
+	return errs.orNil()
+}
+
+func (r *TOTPConfirmRequest) Validate() error {
+	errs := ValidationErrors{}
+	if r.Code == "" {
+		errs["code"] = "is required"
+	}
+	return errs.orNil()
+}
+
+func (r *ForgotPasswordRequest) Validate() error {
+	errs := ValidationErrors{}
+	if r.Email == "" {
+		errs["email"] = "is required"
+	} else if !emailPattern.MatchString(r.Email) {
+		errs["email"] = "must be a valid email address"
+	}
+	return errs.orNil()
+}
+
+func (r *ResetPasswordRequest) Validate() error {
+	errs := ValidationErrors{}
+	if r.Token == "" {
+		errs["token"] = "is required"
+	}
+	if r.NewPassword == "" {
+		errs["new_password"] = "is required"
+	} else if len(r.NewPassword) < minPasswordLength {
+		errs["new_password"] = "must be at least 8 characters"
+	}
+	return errs.orNil()
+}
+
+// validateAmount only has to check the sign: Money is decoded from its
+// decimal text by ParseMoney, which already rejects NaN, infinities,
+// exponents and more than two decimal places.
+func validateAmount(errs ValidationErrors, amount Money) {
+	if amount <= 0 {
+		errs["amount"] = "must be greater than zero"
+	}
+}
+
+// validateRate rejects non-finite and negative exchange rates; zero is only
+// allowed when the rate is optional.
+func validateRate(errs ValidationErrors, field string, rate float64, required bool) {
+	if math.IsNaN(rate) || math.IsInf(rate, 0) {
+		errs[field] = "must be a finite number"
+		return
+	}
+	if rate < 0 || (required && rate == 0) {
+		errs[field] = "must be greater than zero"
+	}
+}
+
+func validateCurrency(errs ValidationErrors, field, code string) {
+	if _, err := NormalizeCurrency(code); err != nil {
+		errs[field] = "must be a three-letter ISO 4217 code"
+	}
+}
+
+func validateReference(errs ValidationErrors, field, reference string) {
+	if utf8.RuneCountInString(reference) > maxReferenceLength {
+		errs[field] = "must be at most 255 characters"
+	}
+}
+
+func (r *CreditRequest) Validate() error {
+	errs := ValidationErrors{}
+	if r.UserID <= 0 {
+		errs["user_id"] = "is required"
+	}
+	validateAmount(errs, r.Amount)
+	validateCurrency(errs, "currency", r.Currency)
+	validateReference(errs, "reason", r.Reason)
+	return errs.orNil()
+}
+
+func (r *SettlementRequest) Validate() error {
+	errs := ValidationErrors{}
+	validateAmount(errs, r.Amount)
+	validateCurrency(errs, "currency", r.Currency)
+	if strings.TrimSpace(r.Reference) == "" {
+		errs["reference"] = "is required"
+	} else {
+		validateReference(errs, "reference", r.Reference)
+	}
+	return errs.orNil()
+}
+
+func (r *DebitRequest) Validate() error {
+	errs := ValidationErrors{}
+	if r.UserID <= 0 {
+		errs["user_id"] = "is required"
+	}
+	validateAmount(errs, r.Amount)
+	validateCurrency(errs, "currency", r.Currency)
+	validateReference(errs, "reason", r.Reason)
+	return errs.orNil()
+}
+
+func (r *TransferRequest) Validate() error {
+	errs := ValidationErrors{}
+	if r.FromUserID <= 0 {
+		errs["from_user_id"] = "is required"
+	}
+	if r.ToUserID <= 0 {
+		errs["to_user_id"] = "is required"
+	} else if r.ToUserID == r.FromUserID {
+		errs["to_user_id"] = "must differ from from_user_id"
+	}
+	validateAmount(errs, r.Amount)
+	validateCurrency(errs, "currency", r.Currency)
+	validateCurrency(errs, "to_currency", r.ToCurrency)
+	validateRate(errs, "exchange_rate", r.ExchangeRate, false)
+	if utf8.RuneCountInString(r.Memo) > maxMemoLength {
+		errs["memo"] = fmt.Sprintf("must be at most %d characters", maxMemoLength)
+	}
+	return errs.orNil()
+}
+
+func (r *WithdrawRequest) Validate() error {
+	errs := ValidationErrors{}
+	if r.UserID <= 0 {
+		errs["user_id"] = "is required"
+	}
+	if strings.TrimSpace(r.Destination) == "" {
+		errs["destination"] = "is required"
+	}
+	validateAmount(errs, r.Amount)
+	validateCurrency(errs, "currency", r.Currency)
+	return errs.orNil()
+}
+
+func (r *OverdraftLimitRequest) Validate() error {
+	errs := ValidationErrors{}
+	if r.OverdraftLimit < 0 {
+		errs["overdraft_limit"] = "must not be negative"
+	}
+	validateCurrency(errs, "currency", r.Currency)
+	return errs.orNil()
+}
+
+func (r *BulkBalanceRequest) Validate() error {
+	errs := ValidationErrors{}
+	switch {
+	case len(r.UserIDs) == 0:
+		errs["user_ids"] = "is required"
+	case len(r.UserIDs) > MaxBulkBalanceUsers:
+		errs["user_ids"] = fmt.Sprintf("must not list more than %d users", MaxBulkBalanceUsers)
+	default:
+		for _, id := range r.UserIDs {
+			if id <= 0 {
+				errs["user_ids"] = "must only contain positive IDs"
+				break
+			}
+		}
+	}
+	validateCurrency(errs, "currency", r.Currency)
+	return errs.orNil()
+}
+
+func (r *ExchangeRequest) Validate() error {
+	errs := ValidationErrors{}
+	if r.UserID <= 0 {
+		errs["user_id"] = "is required"
+	}
+	validateAmount(errs, r.Amount)
+	if strings.TrimSpace(r.FromCurrency) == "" {
+		errs["from_currency"] = "is required"
+	} else {
+		validateCurrency(errs, "from_currency", r.FromCurrency)
+	}
+	if strings.TrimSpace(r.ToCurrency) == "" {
+		errs["to_currency"] = "is required"
+	} else {
+		validateCurrency(errs, "to_currency", r.ToCurrency)
+	}
+	if _, ok := errs["to_currency"]; !ok && strings.EqualFold(strings.TrimSpace(r.FromCurrency), strings.TrimSpace(r.ToCurrency)) {
+		errs["to_currency"] = "must differ from from_currency"
+	}
+	validateRate(errs, "rate", r.Rate, true)
+	return errs.orNil()
+}
@@ -0,0 +1,134 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestRequestValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		req    interface{ Validate() error }
+		fields []string
+	}{
+		{"valid registration", &RegisterRequest{Username: "ayse", Email: "ayse@example.com", Password: "password123"}, nil},
+		{"registration missing everything", &RegisterRequest{}, []string{"username", "email", "password"}},
+		{"short username and password", &RegisterRequest{Username: "ab", Email: "ab@example.com", Password: "short"}, []string{"username", "password"}},
+		{"malformed email", &RegisterRequest{Username: "ayse", Email: "ayse@", Password: "password123"}, []string{"email"}},
+		{"unknown role", &RegisterRequest{Username: "ayse", Email: "ayse@example.com", Password: "password123", Role: "root"}, []string{"role"}},
+		{"login without password", &LoginRequest{Email: "ayse@example.com"}, []string{"password"}},
+		{"credit of zero", &CreditRequest{UserID: 1}, []string{"amount"}},
+		{"debit without user", &DebitRequest{Amount: 100}, []string{"user_id"}},
+		{"transfer to self", &TransferRequest{FromUserID: 1, ToUserID: 1, Amount: 100}, []string{"to_user_id"}},
+		{"withdrawal without destination", &WithdrawRequest{UserID: 1, Amount: 100, Destination: "  "}, []string{"destination"}},
+		{"transfer with a memo", &TransferRequest{FromUserID: 1, ToUserID: 2, Amount: 100, Memo: strings.Repeat("ü", 140)}, nil},
+		{"transfer with an over-long memo", &TransferRequest{FromUserID: 1, ToUserID: 2, Amount: 100, Memo: strings.Repeat("m", 141)}, []string{"memo"}},
+		{"empty profile update", &UpdateUserRequest{}, nil},
+		{"valid profile details", &UpdateUserRequest{ProfileDetails: ProfileDetails{FullName: ptr("Ayşe Yılmaz"), Phone: ptr("+905551234567"), AvatarURL: ptr("https://cdn.example.com/a.png")}}, nil},
+		{"profile details cleared", &UpdateUserRequest{ProfileDetails: ProfileDetails{FullName: ptr(""), Phone: ptr(""), AvatarURL: ptr("")}}, nil},
+		{"short username update", &UpdateUserRequest{Username: "ab"}, []string{"username"}},
+		{"malformed email update", &UpdateUserRequest{Email: "ayse@"}, []string{"email"}},
+		{"over-long full name", &UpdateUserRequest{ProfileDetails: ProfileDetails{FullName: ptr(strings.Repeat("a", 101))}}, []string{"full_name"}},
+		{"phone without country code", &UpdateUserRequest{ProfileDetails: ProfileDetails{Phone: ptr("05551234567")}}, []string{"phone"}},
+		{"phone with separators", &UpdateUserRequest{ProfileDetails: ProfileDetails{Phone: ptr("+90 555 123 45 67")}}, []string{"phone"}},
+		{"relative avatar URL", &UpdateUserRequest{ProfileDetails: ProfileDetails{AvatarURL: ptr("/avatars/a.png")}}, []string{"avatar_url"}},
+		{"non-http avatar URL", &UpdateUserRequest{ProfileDetails: ProfileDetails{AvatarURL: ptr("javascript:alert(1)")}}, []string{"avatar_url"}},
+		{"valid bulk balances", &BulkBalanceRequest{UserIDs: []int{1, 2}}, nil},
+		{"bulk balances without users", &BulkBalanceRequest{}, []string{"user_ids"}},
+		{"bulk balances with a bad ID", &BulkBalanceRequest{UserIDs: []int{1, 0}, Currency: "US"}, []string{"user_ids", "currency"}},
+		{"too many bulk balances", &BulkBalanceRequest{UserIDs: make([]int, MaxBulkBalanceUsers+1)}, []string{"user_ids"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.req.Validate()
+			if tt.fields == nil {
+				if err != nil {
+					t.Fatalf("Validate = %v, want nil", err)
+				}
+				return
+			}
+
+			var errs ValidationErrors
+			if !errors.As(err, &errs) {
+				t.Fatalf("Validate = %v, want ValidationErrors", err)
+			}
+			if len(errs) != len(tt.fields) {
+				t.Errorf("got errors for %v, want %v", errs, tt.fields)
+			}
+			for _, field := range tt.fields {
+				if _, ok := errs[field]; !ok {
+					t.Errorf("no error for %s in %v", field, errs)
+				}
+			}
+		})
+	}
+}
+
+type validatable interface {
+	Validate() error
+}
+
+func fieldError(t *testing.T, err error, field string) {
+	t.Helper()
+	var errs ValidationErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("err = %v, want ValidationErrors", err)
+	}
+	if _, ok := errs[field]; !ok {
+		t.Errorf("no error for %s in %v", field, errs)
+	}
+}
+
+func TestAmountValidation(t *testing.T) {
+	requests := map[string]func(Money) validatable{
+		"credit": func(m Money) validatable { return &CreditRequest{UserID: 1, Amount: m, Currency: "USD"} },
+		"debit":  func(m Money) validatable { return &DebitRequest{UserID: 1, Amount: m, Currency: "USD"} },
+		"transfer": func(m Money) validatable {
+			return &TransferRequest{FromUserID: 1, ToUserID: 2, Amount: m, Currency: "USD"}
+		},
+	}
+
+	for name, build := range requests {
+		t.Run(name, func(t *testing.T) {
+			if err := build(1).Validate(); err != nil {
+				t.Errorf("0.01: %v", err)
+			}
+			fieldError(t, build(0).Validate(), "amount")
+			fieldError(t, build(-100).Validate(), "amount")
+		})
+	}
+}
+
+func TestAmountDecodingRejectsUnsafeValues(t *testing.T) {
+	for _, body := range []string{
+		`{"user_id": 1, "amount": 1.005}`,
+		`{"user_id": 1, "amount": "Inf"}`,
+		`{"user_id": 1, "amount": "NaN"}`,
+		`{"user_id": 1, "amount": 1e400}`,
+	} {
+		var req CreditRequest
+		if err := json.Unmarshal([]byte(body), &req); !errors.Is(err, ErrInvalidAmount) {
+			t.Errorf("%s: err = %v, want ErrInvalidAmount", body, err)
+		}
+	}
+}
+
+func TestTransferRejectsNonFiniteRate(t *testing.T) {
+	for _, rate := range []float64{math.Inf(1), math.Inf(-1), math.NaN(), -1} {
+		req := &TransferRequest{FromUserID: 1, ToUserID: 2, Amount: 100, Currency: "USD", ToCurrency: "EUR", ExchangeRate: rate}
+		fieldError(t, req.Validate(), "exchange_rate")
+	}
+}
+
+func TestExchangeRequiresFiniteRate(t *testing.T) {
+	for _, rate := range []float64{0, math.Inf(1), math.NaN(), -0.5} {
+		req := &ExchangeRequest{UserID: 1, FromCurrency: "USD", ToCurrency: "EUR", Amount: 100, Rate: rate}
+		fieldError(t, req.Validate(), "rate")
+	}
+}
+
+func ptr(s string) *string { return &s }
@@ -0,0 +1,40 @@
+package models
+
+import (
+	"encoding/xml"
+	"sort"
+)
+
+// Counts and CurrencyAmounts are maps that also encode as XML, which
+// encoding/xml cannot do for plain maps. Each key becomes a child element.
+type Counts map[string]int
+
+type CurrencyAmounts map[string]Money
+
+func (c Counts) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	return MarshalXMLMap(e, start, c)
+}
+
+func (c CurrencyAmounts) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	return MarshalXMLMap(e, start, c)
+}
+
+// MarshalXMLMap writes m as start with one child element per key, in sorted
+// key order.
+func MarshalXMLMap[V any](e *xml.Encoder, start xml.StartElement, m map[string]V) error {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := e.EncodeElement(m[key], xml.StartElement{Name: xml.Name{Local: key}}); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
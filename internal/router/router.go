@@ -3,10 +3,15 @@ package router
 import (
 	"database/sql"
 	"net/http"
-	"os"
 
+	"go-projects/internal/apidocs"
+	"go-projects/internal/apierror"
+	"go-projects/internal/config"
 	"go-projects/internal/handlers"
+	"go-projects/internal/lifecycle"
+	"go-projects/internal/metrics"
 	"go-projects/internal/middleware"
+	"go-projects/internal/models"
 	"go-projects/internal/services"
 
 	"github.com/gorilla/mux"
@@ -14,68 +19,175 @@ import (
 	"golang.org/x/time/rate"
 )
 
-func SetupRouter(db *sql.DB, logger zerolog.Logger) *mux.Router {
-	balanceService := services.NewBalanceService(db, logger)
-
-	authHandler := handlers.NewAuthHandler(db, logger)
-	userHandler := handlers.NewUserHandler(db, logger)
-	transactionHandler := handlers.NewTransactionHandler(db, logger, balanceService)
-	balanceHandler := handlers.NewBalanceHandler(db, logger)
-
-	jwtSecret := os.Getenv("JWT_SECRET")
-	if jwtSecret == "" {
-		jwtSecret = "default-secret-key-change-in-production"
-		logger.Warn().Msg("JWT_SECRET not set, using default key")
+// SetupRouter wires the handlers. balanceService is shared with main so that
+// balance changes made outside HTTP requests, such as scheduled reconciliation
+// repairs, reach the same stream subscribers. The returned stop function ends
+// the rate limiters' cleanup goroutines and is called on shutdown.
+func SetupRouter(db *sql.DB, logger zerolog.Logger, cfg config.Config, inFlight *lifecycle.Tracker, balanceService *services.BalanceService) (*mux.Router, func(), error) {
+	apierror.SetLogger(logger)
+
+	authService, err := services.NewAuthService(db, logger, services.TokenConfig{
+		Secret:     cfg.JWTSecret,
+		AccessTTL:  cfg.AccessTokenTTL,
+		RefreshTTL: cfg.RefreshTokenTTL,
+		Issuer:     cfg.JWTIssuer,
+		Audience:   cfg.JWTAudience,
+		Production: cfg.IsProduction(),
+	})
+	if err != nil {
+		return nil, nil, err
 	}
 
+	transactionService := services.NewTransactionService(db, logger, balanceService, cfg.IdempotencyWindow, services.TransactionLimits{
+		MaxAmount:  cfg.MaxTransactionAmount,
+		DailyLimit: cfg.DailyTransactionLimit,
+	}, inFlight)
+	killSwitchService := services.NewKillSwitchService(db, logger)
+	userService := services.NewUserService(db, logger)
+	revocationService := services.NewTokenRevocationService(db, logger)
+
+	transactionRateLimiter := middleware.NewTransactionRateLimiter(map[string]int{
+		string(models.TransactionTypeCredit):     cfg.CreditRateLimit,
+		string(models.TransactionTypeDebit):      cfg.DebitRateLimit,
+		string(models.TransactionTypeTransfer):   cfg.TransferRateLimit,
+		string(models.TransactionTypeWithdrawal): cfg.WithdrawalRateLimit,
+		string(models.TransactionTypeExchange):   cfg.ExchangeRateLimit,
+		handlers.SettlementRateBucket:            cfg.SettlementRateLimit,
+	})
+
+	authHandler := handlers.NewAuthHandler(db, logger, authService, revocationService, services.RegistrationPolicy{
+		AllowMerchant: cfg.AllowMerchantSignup,
+	})
+	userHandler := handlers.NewUserHandler(db, logger, cfg.MaxPageSize)
+	transactionHandler := handlers.NewTransactionHandler(transactionService, logger, transactionRateLimiter, cfg.MaxPageSize)
+	balanceHandler := handlers.NewBalanceHandler(balanceService, logger, cfg.MaxPageSize, inFlight.Draining())
+	adminHandler := handlers.NewAdminHandler(db, logger, balanceService, killSwitchService)
+	auditHandler := handlers.NewAuditHandler(db, logger, cfg.MaxPageSize)
+	healthHandler := handlers.NewHealthHandler(db, logger, inFlight.Ready)
+
+	authenticate := middleware.Authentication(cfg.JWTSecret, cfg.JWTIssuer, cfg.JWTAudience, revocationService.IsRevoked, logger)
+	requireAdmin := middleware.RequireRole(string(models.RoleAdmin))
+
 	r := mux.NewRouter()
 
-	rateLimiter := middleware.NewRateLimiter(rate.Limit(10), 20)
+	rateLimiter := middleware.NewRateLimiter(rate.Limit(cfg.RateLimit), cfg.RateLimitBurst)
+	limit := rateLimiter.Middleware()
 
 	r.Use(middleware.ErrorHandling(logger))
+	r.Use(middleware.ClientIP(cfg.TrustedProxies))
+	r.Use(middleware.Metrics())
 	r.Use(middleware.PerformanceMonitoring(logger))
-	r.Use(middleware.RequestLogging(logger))
+	r.Use(middleware.RequestLogging(logger, cfg.AccessLogFormat))
+	r.Use(middleware.Tracing())
 	r.Use(middleware.SecurityHeaders())
 	r.Use(middleware.CORS())
-	r.Use(rateLimiter.Middleware())
 
 	api := r.PathPrefix("/api/v1").Subrouter()
+	api.Use(middleware.Draining(inFlight.Ready))
+	api.Use(middleware.BodyLimit(cfg.MaxBodyBytes))
+	api.Use(middleware.Compression(cfg.CompressionMinBytes))
+	api.Use(middleware.Timeout(cfg.RequestTimeout, "/api/v1/balances/stream"))
+
+	api.Handle("/openapi.json", apidocs.Handler()).Methods("GET")
 
 	auth := api.PathPrefix("/auth").Subrouter()
+	auth.Use(limit)
 	auth.HandleFunc("/register", authHandler.Register).Methods("POST")
 	auth.HandleFunc("/login", authHandler.Login).Methods("POST")
-	
-	protectedAuth := auth.PathPrefix("").Subrouter()
-	protectedAuth.Use(middleware.Authentication(jwtSecret, logger))
-	protectedAuth.HandleFunc("/refresh", authHandler.Refresh).Methods("POST")
+	auth.HandleFunc("/refresh", authHandler.Refresh).Methods("POST")
+	auth.HandleFunc("/refresh-token", authHandler.Refresh).Methods("POST")
+	auth.HandleFunc("/validate", authHandler.ValidateToken).Methods("POST")
+	auth.HandleFunc("/forgot-password", authHandler.ForgotPassword).Methods("POST")
+	auth.HandleFunc("/reset-password", authHandler.ResetPassword).Methods("POST")
+	auth.Handle("/logout", authenticate(http.HandlerFunc(authHandler.Logout))).Methods("POST")
+	auth.Handle("/2fa/enroll", authenticate(requireAdmin(http.HandlerFunc(authHandler.EnrollTOTP)))).Methods("POST")
+	auth.Handle("/2fa/confirm", authenticate(requireAdmin(http.HandlerFunc(authHandler.ConfirmTOTP)))).Methods("POST")
 
 	users := api.PathPrefix("/users").Subrouter()
-	users.Use(middleware.Authentication(jwtSecret, logger))
+	users.Use(authenticate)
+	users.Use(limit)
 	users.HandleFunc("", userHandler.GetUsers).Methods("GET")
+	users.Handle("", requireAdmin(http.HandlerFunc(userHandler.CreateUser))).Methods("POST")
+	users.HandleFunc("/me", userHandler.GetCurrentUser).Methods("GET")
 	users.HandleFunc("/{id}", userHandler.GetUser).Methods("GET")
 	users.HandleFunc("/{id}", userHandler.UpdateUser).Methods("PUT")
 	users.HandleFunc("/{id}", userHandler.DeleteUser).Methods("DELETE")
+	users.Handle("/{id}/freeze", requireAdmin(http.HandlerFunc(userHandler.FreezeUser))).Methods("POST")
+	users.Handle("/{id}/unfreeze", requireAdmin(http.HandlerFunc(userHandler.UnfreezeUser))).Methods("POST")
 
 	transactions := api.PathPrefix("/transactions").Subrouter()
-	transactions.Use(middleware.Authentication(jwtSecret, logger))
+	transactions.Use(authenticate)
+	transactions.Use(limit)
+	transactions.Use(middleware.KillSwitch(killSwitchService.Active))
 	transactions.Use(middleware.RequestValidation())
 	transactions.HandleFunc("/credit", transactionHandler.Credit).Methods("POST")
 	transactions.HandleFunc("/debit", transactionHandler.Debit).Methods("POST")
 	transactions.HandleFunc("/transfer", transactionHandler.Transfer).Methods("POST")
+	transactions.HandleFunc("/withdraw", transactionHandler.Withdraw).Methods("POST")
+	transactions.Handle("/exchange", requireAdmin(http.HandlerFunc(transactionHandler.Exchange))).Methods("POST")
 	transactions.HandleFunc("/history", transactionHandler.GetHistory).Methods("GET")
+	transactions.HandleFunc("/export", transactionHandler.ExportStatement).Methods("GET")
+	transactions.HandleFunc("/stats", transactionHandler.GetStats).Methods("GET")
 	transactions.HandleFunc("/{id}", transactionHandler.GetTransaction).Methods("GET")
+	transactions.HandleFunc("/{id}/account-state", transactionHandler.GetAccountState).Methods("GET")
+	transactions.HandleFunc("/{id}/status-history", transactionHandler.GetStatusHistory).Methods("GET")
+	transactions.Handle("/{id}/refund", requireAdmin(http.HandlerFunc(transactionHandler.Refund))).Methods("POST")
 
 	balances := api.PathPrefix("/balances").Subrouter()
-	balances.Use(middleware.Authentication(jwtSecret, logger))
+	balances.Use(authenticate)
+	balances.Use(limit)
 	balances.HandleFunc("/current", balanceHandler.GetCurrentBalance).Methods("GET")
 	balances.HandleFunc("/historical", balanceHandler.GetHistoricalBalance).Methods("GET")
 	balances.HandleFunc("/at-time", balanceHandler.GetBalanceAtTime).Methods("GET")
-	r.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(`{"status":"ok"}`))
-	}).Methods("GET")
+	balances.HandleFunc("/timeline", balanceHandler.GetBalanceTimeline).Methods("GET")
+	balances.HandleFunc("/stream", balanceHandler.StreamBalance).Methods("GET")
+	balances.Handle("/bulk", requireAdmin(http.HandlerFunc(balanceHandler.GetBulkBalances))).Methods("POST")
+	balances.Handle("/{userID}/overdraft-limit", requireAdmin(http.HandlerFunc(balanceHandler.SetOverdraftLimit))).Methods("PUT")
+	balances.Handle("/{userID}/reconcile", requireAdmin(http.HandlerFunc(balanceHandler.ReconcileBalance))).Methods("POST")
+
+	me := api.PathPrefix("/me").Subrouter()
+	me.Use(authenticate)
+	me.Use(limit)
+	me.HandleFunc("/summary", transactionHandler.GetMySummary).Methods("GET")
+
+	merchant := api.PathPrefix("/merchant").Subrouter()
+	merchant.Use(authenticate)
+	merchant.Use(limit)
+	merchant.Use(middleware.RequireRole(string(models.RoleMerchant), string(models.RoleAdmin)))
+	merchant.Use(middleware.RequestValidation())
+	merchant.Handle("/settlements", middleware.KillSwitch(killSwitchService.Active)(
+		middleware.RequireCapability("settle_own_account", userService.IsAuthorized)(http.HandlerFunc(transactionHandler.Settle)),
+	)).Methods("POST")
+	merchant.Handle("/stats", middleware.RequireCapability("view_own_stats", userService.IsAuthorized)(http.HandlerFunc(transactionHandler.GetMerchantStats))).Methods("GET")
+
+	admin := api.PathPrefix("/admin").Subrouter()
+	admin.Use(authenticate)
+	admin.Use(limit)
+	admin.Use(requireAdmin)
+	admin.HandleFunc("/reconcile-all", adminHandler.ReconcileAll).Methods("POST")
+	admin.HandleFunc("/reconcile-all/{id}", adminHandler.GetReconcileJob).Methods("GET")
+	admin.HandleFunc("/users/merge", adminHandler.MergeUsers).Methods("POST")
+	admin.HandleFunc("/kill-switch", adminHandler.GetKillSwitch).Methods("GET")
+	admin.HandleFunc("/kill-switch", adminHandler.ActivateKillSwitch).Methods("POST")
+	admin.HandleFunc("/kill-switch", adminHandler.ClearKillSwitch).Methods("DELETE")
+
+	auditLogs := api.PathPrefix("/audit-logs").Subrouter()
+	auditLogs.Use(authenticate)
+	auditLogs.Use(limit)
+	auditLogs.Use(requireAdmin)
+	auditLogs.HandleFunc("", auditHandler.ListLogs).Methods("GET")
+
+	r.Handle("/metrics", metrics.Handler()).Methods("GET")
+
+	r.HandleFunc("/health", healthHandler.Live).Methods("GET")
+	r.HandleFunc("/health/live", healthHandler.Live).Methods("GET")
+	r.HandleFunc("/health/ready", healthHandler.Ready).Methods("GET")
+
+	stop := func() {
+		rateLimiter.Stop()
+		transactionRateLimiter.Stop()
+	}
 
-	return r
+	return r, stop, nil
 }
 
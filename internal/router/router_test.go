@@ -0,0 +1,372 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"go-projects/internal/apidocs"
+	"go-projects/internal/config"
+	"go-projects/internal/lifecycle"
+	"go-projects/internal/services"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
+)
+
+const testJWTSecret = "router-test-secret"
+
+var (
+	testConfig = config.Config{
+		RateLimit:       100,
+		RateLimitBurst:  100,
+		MaxPageSize:     100,
+		MaxBodyBytes:    1 << 20,
+		RequestTimeout:  time.Minute,
+		AccessTokenTTL:  time.Hour,
+		RefreshTokenTTL: time.Hour,
+		JWTSecret:       testJWTSecret,
+	}
+	testTokens = services.TokenConfig{Secret: testJWTSecret, AccessTTL: time.Hour, RefreshTTL: time.Hour}
+)
+
+func newTestRouter(t *testing.T) (http.Handler, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	router, stop, err := SetupRouter(db, zerolog.Nop(), testConfig, lifecycle.NewTracker(), services.NewBalanceService(db, zerolog.Nop()))
+	if err != nil {
+		t.Fatalf("SetupRouter: %v", err)
+	}
+	t.Cleanup(stop)
+	return router, mock
+}
+
+func expiredAccessToken(t *testing.T, userID int) string {
+	t.Helper()
+	claims := &services.Claims{
+		UserID:    userID,
+		Email:     "user@example.com",
+		Role:      "user",
+		TokenType: services.TokenTypeAccess,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Minute)),
+			IssuedAt:  jwt.NewNumericDate(time.Now().Add(-time.Hour)),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(testJWTSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// newRefreshToken issues a refresh token for userID against a throwaway
+// database; the router's mock then only sees the refresh itself.
+func newRefreshToken(t *testing.T, userID int) string {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO refresh_tokens")).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	auth, err := services.NewAuthService(db, zerolog.Nop(), testTokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := auth.GenerateRefreshToken(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestRefreshWithExpiredAccessToken(t *testing.T) {
+	router, mock := newTestRouter(t)
+	refreshToken := newRefreshToken(t, 7)
+
+	now := time.Now()
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("FROM refresh_tokens WHERE jti = ? FOR UPDATE")).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "family_id", "revoked_at"}).AddRow(7, "family", nil))
+	mock.ExpectQuery(regexp.QuoteMeta("FROM users WHERE id = ?")).WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "email", "full_name", "phone", "avatar_url", "password_hash", "role", "status", "created_at", "updated_at"}).
+			AddRow(7, "user", "user@example.com", nil, nil, nil, "hash", "user", "active", now, now))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO refresh_tokens")).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE refresh_tokens SET revoked_at = NOW(), replaced_by = ?")).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/auth/refresh", strings.NewReader(`{"refresh_token":"`+refreshToken+`"}`))
+	req.Header.Set("Authorization", "Bearer "+expiredAccessToken(t, 7))
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d (%s), want 200", rec.Code, rec.Body.String())
+	}
+	var resp struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.Token == "" || resp.RefreshToken == "" {
+		t.Errorf("response %s lacks new tokens", rec.Body.String())
+	}
+}
+
+func TestRefreshRejectsAccessToken(t *testing.T) {
+	router, _ := newTestRouter(t)
+	auth, err := services.NewAuthService(nil, zerolog.Nop(), testTokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accessToken, err := auth.GenerateToken(7, "user@example.com", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/auth/refresh", strings.NewReader(`{"refresh_token":"`+accessToken+`"}`))
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want 401 for an access token", rec.Code)
+	}
+}
+
+func TestRefreshTokenCannotAuthenticate(t *testing.T) {
+	router, _ := newTestRouter(t)
+	refreshToken := newRefreshToken(t, 7)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/users/7", nil)
+	req.Header.Set("Authorization", "Bearer "+refreshToken)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want 401 for a refresh token", rec.Code)
+	}
+}
+
+func accessToken(t *testing.T, userID int, role string) string {
+	t.Helper()
+	claims := &services.Claims{
+		UserID:    userID,
+		Email:     role + "@example.com",
+		Role:      role,
+		TokenType: services.TokenTypeAccess,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(testJWTSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// TestAdminRoutesRejectOtherRoles sends user and merchant tokens to every
+// admin-only route; each must be refused before its handler touches the
+// database.
+func TestAdminRoutesRejectOtherRoles(t *testing.T) {
+	router, mock := newTestRouter(t)
+
+	routes := []struct{ method, path string }{
+		{http.MethodPost, "/api/v1/auth/2fa/enroll"},
+		{http.MethodPost, "/api/v1/auth/2fa/confirm"},
+		{http.MethodPost, "/api/v1/users"},
+		{http.MethodPost, "/api/v1/users/2/freeze"},
+		{http.MethodPost, "/api/v1/users/2/unfreeze"},
+		{http.MethodPost, "/api/v1/transactions/exchange"},
+		{http.MethodPost, "/api/v1/transactions/5/refund"},
+		{http.MethodPut, "/api/v1/balances/2/overdraft-limit"},
+		{http.MethodPost, "/api/v1/balances/2/reconcile"},
+		{http.MethodPost, "/api/v1/admin/reconcile-all"},
+		{http.MethodPost, "/api/v1/admin/users/merge"},
+		{http.MethodPost, "/api/v1/admin/kill-switch"},
+		{http.MethodGet, "/api/v1/audit-logs"},
+	}
+
+	for _, role := range []string{"user", "merchant"} {
+		token := accessToken(t, 1, role)
+		for _, route := range routes {
+			req := httptest.NewRequest(route.method, route.path, strings.NewReader("{}"))
+			req.Header.Set("Authorization", "Bearer "+token)
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusForbidden {
+				t.Errorf("%s %s as %s: status = %d, want 403: %s", route.method, route.path, role, rec.Code, rec.Body)
+			}
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestMerchantRoutesCheckStoredRole covers both guards on the merchant
+// routes: RequireRole on the token's claim, then IsAuthorized on the role in
+// the database.
+func TestMerchantRoutesCheckStoredRole(t *testing.T) {
+	userByID := regexp.QuoteMeta("FROM users WHERE id = ? AND deleted_at IS NULL")
+	userRow := func(role string) *sqlmock.Rows {
+		now := time.Now()
+		return sqlmock.NewRows([]string{"id", "username", "email", "full_name", "phone", "avatar_url", "password_hash", "role", "status", "created_at", "updated_at"}).
+			AddRow(4, "shop", "shop@example.com", nil, nil, nil, "hash", role, "active", now, now)
+	}
+	get := func(router http.Handler, role string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/merchant/stats", nil)
+		req.Header.Set("Authorization", "Bearer "+accessToken(t, 4, role))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("user token", func(t *testing.T) {
+		router, mock := newTestRouter(t)
+		if rec := get(router, "user"); rec.Code != http.StatusForbidden {
+			t.Errorf("status = %d, want 403", rec.Code)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("merchant since demoted", func(t *testing.T) {
+		router, mock := newTestRouter(t)
+		mock.ExpectQuery(userByID).WithArgs(4).WillReturnRows(userRow("user"))
+		if rec := get(router, "merchant"); rec.Code != http.StatusForbidden {
+			t.Errorf("status = %d, want 403", rec.Code)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("merchant", func(t *testing.T) {
+		router, mock := newTestRouter(t)
+		mock.ExpectQuery(userByID).WithArgs(4).WillReturnRows(userRow("merchant"))
+		mock.ExpectQuery(regexp.QuoteMeta("FROM transactions")).
+			WillReturnRows(sqlmock.NewRows([]string{"settlements", "settled", "payments", "received"}).AddRow(1, 10.0, 0, 0))
+
+		rec := get(router, "merchant")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body)
+		}
+		var stats struct {
+			SettlementCount int `json:"settlement_count"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil || stats.SettlementCount != 1 {
+			t.Errorf("stats = %+v (%v), want one settlement", stats, err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+// TestCurrentUserRouteIsNotAnID checks that /users/me reaches the profile
+// handler for the caller instead of being parsed as /users/{id}.
+func TestCurrentUserRouteIsNotAnID(t *testing.T) {
+	router, mock := newTestRouter(t)
+	now := time.Now()
+	mock.ExpectQuery(regexp.QuoteMeta("FROM users WHERE id = ? AND deleted_at IS NULL")).WithArgs(4).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "email", "full_name", "phone", "avatar_url", "password_hash", "role", "status", "created_at", "updated_at"}).
+			AddRow(4, "shop", "shop@example.com", nil, nil, nil, "hash", "user", "active", now, now))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/users/me", nil)
+	req.Header.Set("Authorization", "Bearer "+accessToken(t, 4, "user"))
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"username":"shop"`) {
+		t.Errorf("got %d %s, want the caller's profile", rec.Code, rec.Body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSetupRouterRefusesDefaultSecretInProduction(t *testing.T) {
+	db, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	cfg := testConfig
+	cfg.Environment = config.EnvProduction
+	cfg.JWTSecret = config.DefaultJWTSecret
+	router, stop, err := SetupRouter(db, zerolog.Nop(), cfg, lifecycle.NewTracker(), services.NewBalanceService(db, zerolog.Nop()))
+	if !errors.Is(err, services.ErrDefaultJWTSecret) || router != nil || stop != nil {
+		t.Errorf("SetupRouter err = %v, want ErrDefaultJWTSecret and no router", err)
+	}
+}
+
+func TestOpenAPISpecCoversEveryRoute(t *testing.T) {
+	db, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	defer db.Close()
+	router, stop, err := SetupRouter(db, zerolog.Nop(), testConfig, lifecycle.NewTracker(), services.NewBalanceService(db, zerolog.Nop()))
+	if err != nil {
+		t.Fatalf("SetupRouter: %v", err)
+	}
+	defer stop()
+
+	var spec struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(apidocs.Spec(), &spec); err != nil {
+		t.Fatalf("openapi.json: %v", err)
+	}
+
+	routes := 0
+	err = router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			// Subrouter prefixes carry no methods of their own.
+			return nil
+		}
+		for _, method := range methods {
+			routes++
+			if _, ok := spec.Paths[path][strings.ToLower(method)]; !ok {
+				t.Errorf("%s %s is routed but missing from openapi.json", method, path)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if routes == 0 {
+		t.Fatal("walked no routes")
+	}
+
+	for _, path := range []string{"/api/v1/auth/login", "/api/v1/users/{id}", "/api/v1/transactions/transfer", "/api/v1/balances/current"} {
+		if _, ok := spec.Paths[path]; !ok {
+			t.Errorf("openapi.json does not list %s", path)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"go-projects/internal/models"
+
+	"github.com/rs/zerolog"
+)
+
+type AuditService struct {
+	db     *sql.DB
+	logger zerolog.Logger
+}
+
+func NewAuditService(db *sql.DB, logger zerolog.Logger) *AuditService {
+	return &AuditService{
+		db:     db,
+		logger: logger,
+	}
+}
+
+func (s *AuditService) Log(entityType string, entityID int, action string, details interface{}) error {
+	if err := writeAuditLog(s.db, entityType, entityID, action, details); err != nil {
+		s.logger.Error().Err(err).Str("entity_type", entityType).Int("entity_id", entityID).Str("action", action).Msg("Error writing audit log")
+		return err
+	}
+
+	return nil
+}
+
+func writeAuditLog(db execer, entityType string, entityID int, action string, details interface{}) error {
+	encoded, err := json.Marshal(details)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit details: %w", err)
+	}
+
+	_, err = db.Exec(
+		"INSERT INTO audit_logs (entity_type, entity_id, action, details) VALUES (?, ?, ?, ?)",
+		entityType, entityID, action, string(encoded),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+
+	return nil
+}
+
+func (s *AuditService) ListLogs(filter models.AuditLogFilter) ([]*models.AuditLog, int, error) {
+	where := "WHERE 1 = 1"
+	args := []interface{}{}
+
+	if filter.EntityType != "" {
+		where += " AND entity_type = ?"
+		args = append(args, filter.EntityType)
+	}
+	if filter.EntityID != nil {
+		where += " AND entity_id = ?"
+		args = append(args, *filter.EntityID)
+	}
+	if filter.Action != "" {
+		where += " AND action = ?"
+		args = append(args, filter.Action)
+	}
+	if filter.From != nil {
+		where += " AND created_at >= ?"
+		args = append(args, *filter.From)
+	}
+	if filter.To != nil {
+		where += " AND created_at <= ?"
+		args = append(args, *filter.To)
+	}
+
+	var total int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM audit_logs "+where, args...).Scan(&total)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Error counting audit logs")
+		return nil, 0, fmt.Errorf("database error: %w", err)
+	}
+
+	query := `
+		SELECT id, entity_type, entity_id, action, details, created_at
+		FROM audit_logs
+		` + where + `
+		ORDER BY created_at DESC, id DESC
+		LIMIT ? OFFSET ?
+	`
+
+	rows, err := s.db.Query(query, append(args, filter.Limit, filter.Offset)...)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Error listing audit logs")
+		return nil, 0, fmt.Errorf("database error: %w", err)
+	}
+	defer rows.Close()
+
+	logs := []*models.AuditLog{}
+	for rows.Next() {
+		var entry models.AuditLog
+		var entityType, action, details sql.NullString
+		var entityID sql.NullInt64
+
+		err := rows.Scan(&entry.ID, &entityType, &entityID, &action, &details, &entry.CreatedAt)
+		if err != nil {
+			return nil, 0, fmt.Errorf("error scanning audit log: %w", err)
+		}
+
+		entry.EntityType = entityType.String
+		entry.EntityID = int(entityID.Int64)
+		entry.Action = action.String
+		if details.Valid && json.Valid([]byte(details.String)) {
+			entry.Details = json.RawMessage(details.String)
+		} else {
+			entry.Details = json.RawMessage("null")
+		}
+
+		logs = append(logs, &entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("error reading audit logs: %w", err)
+	}
+
+	return logs, total, nil
+}
@@ -0,0 +1,49 @@
+package services
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"go-projects/internal/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/rs/zerolog"
+)
+
+func TestListLogsAppliesFilters(t *testing.T) {
+	db, mock := newMockDB(t)
+	service := NewAuditService(db, zerolog.Nop())
+	entityID := 7
+	from := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+
+	where := "WHERE 1 = 1 AND entity_type = ? AND entity_id = ? AND action = ? AND created_at >= ?"
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM audit_logs "+where)).
+		WithArgs("user", 7, "role_changed", from).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+	mock.ExpectQuery(regexp.QuoteMeta(where)).
+		WithArgs("user", 7, "role_changed", from, 1, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "entity_type", "entity_id", "action", "details", "created_at"}).
+			AddRow(3, "user", 7, "role_changed", "not json", time.Now()))
+
+	logs, total, err := service.ListLogs(models.AuditLogFilter{
+		EntityType: "user",
+		EntityID:   &entityID,
+		Action:     "role_changed",
+		From:       &from,
+		Limit:      1,
+		Offset:     1,
+	})
+	if err != nil {
+		t.Fatalf("ListLogs: %v", err)
+	}
+	if total != 2 || len(logs) != 1 {
+		t.Fatalf("got %d of %d logs, want 1 of 2", len(logs), total)
+	}
+	if string(logs[0].Details) != "null" {
+		t.Errorf("details = %s, want null for a malformed row", logs[0].Details)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -1,51 +1,96 @@
 package services
 
 import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
 	"errors"
-	"os"
+	"fmt"
 	"time"
 
+	"go-projects/internal/config"
+	"go-projects/internal/models"
+
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/rs/zerolog"
 )
 
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token reuse detected")
+	ErrMissingJWTSecret    = errors.New("JWT secret is empty")
+	ErrDefaultJWTSecret    = errors.New("JWT_SECRET must be set to a non-default value in production")
+)
+
 type AuthService struct {
-	secretKey []byte
-	logger    zerolog.Logger
+	db          *sql.DB
+	userService *UserService
+	secretKey   []byte
+	tokens      TokenConfig
+	logger      zerolog.Logger
+}
+
+type TokenConfig struct {
+	Secret     string
+	AccessTTL  time.Duration
+	RefreshTTL time.Duration
+	Issuer     string
+	Audience   string
+	Production bool
 }
 
+const (
+	TokenTypeAccess  = "access"
+	TokenTypeRefresh = "refresh"
+)
+
 type Claims struct {
-	UserID int    `json:"user_id"`
-	Email  string `json:"email"`
-	Role   string `json:"role"`
+	UserID    int    `json:"user_id"`
+	Email     string `json:"email"`
+	Role      string `json:"role"`
+	TokenType string `json:"token_type,omitempty"`
 	jwt.RegisteredClaims
 }
 
-func NewAuthService(logger zerolog.Logger) *AuthService {
-	secretKey := os.Getenv("JWT_SECRET")
-	if secretKey == "" {
-		secretKey = "default-secret-key-change-in-production"
-		logger.Warn().Msg("JWT_SECRET not set, using default key")
+// NewAuthService signs and verifies tokens with tokens.Secret. In
+// production the built-in default secret is refused.
+func NewAuthService(db *sql.DB, logger zerolog.Logger, tokens TokenConfig) (*AuthService, error) {
+	if tokens.Secret == "" {
+		return nil, ErrMissingJWTSecret
+	}
+	if tokens.Production && tokens.Secret == config.DefaultJWTSecret {
+		return nil, ErrDefaultJWTSecret
 	}
 
 	return &AuthService{
-		secretKey: []byte(secretKey),
-		logger:    logger,
-	}
+		db:          db,
+		userService: NewUserService(db, logger),
+		secretKey:   []byte(tokens.Secret),
+		tokens:      tokens,
+		logger:      logger,
+	}, nil
 }
 
 func (s *AuthService) GenerateToken(userID int, email, role string) (string, error) {
-	expirationTime := time.Now().Add(24 * time.Hour)
+	jti, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+
+	expirationTime := time.Now().Add(s.tokens.AccessTTL)
 
 	claims := &Claims{
-		UserID: userID,
-		Email:  email,
-		Role:   role,
-		RegisteredClaims: jwt.RegisteredClaims{
+		UserID:    userID,
+		Email:     email,
+		Role:      role,
+		TokenType: TokenTypeAccess,
+		RegisteredClaims: s.registeredClaims(jwt.RegisteredClaims{
+			ID:        jti,
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			NotBefore: jwt.NewNumericDate(time.Now()),
-		},
+		}),
 	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
@@ -59,35 +104,88 @@ func (s *AuthService) GenerateToken(userID int, email, role string) (string, err
 }
 
 func (s *AuthService) GenerateRefreshToken(userID int) (string, error) {
-	expirationTime := time.Now().Add(7 * 24 * time.Hour)
+	familyID, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+
+	tokenString, _, err := s.issueRefreshToken(s.db, userID, familyID)
+	return tokenString, err
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func (s *AuthService) issueRefreshToken(db execer, userID int, familyID string) (string, string, error) {
+	jti, err := newTokenID()
+	if err != nil {
+		return "", "", err
+	}
+
+	expirationTime := time.Now().Add(s.tokens.RefreshTTL)
 
 	claims := &Claims{
-		UserID: userID,
-		RegisteredClaims: jwt.RegisteredClaims{
+		UserID:    userID,
+		TokenType: TokenTypeRefresh,
+		RegisteredClaims: s.registeredClaims(jwt.RegisteredClaims{
+			ID:        jti,
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
-		},
+		}),
 	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	tokenString, err := token.SignedString(s.secretKey)
 	if err != nil {
 		s.logger.Error().Err(err).Msg("Error generating refresh token")
-		return "", err
+		return "", "", err
 	}
 
-	return tokenString, nil
+	_, err = db.Exec(
+		"INSERT INTO refresh_tokens (jti, user_id, family_id, expires_at) VALUES (?, ?, ?, ?)",
+		jti, userID, familyID, expirationTime,
+	)
+	if err != nil {
+		s.logger.Error().Err(err).Int("user_id", userID).Msg("Error storing refresh token")
+		return "", "", fmt.Errorf("failed to store refresh token: %w", err)
+	}
+
+	return tokenString, jti, nil
+}
+
+func (s *AuthService) registeredClaims(claims jwt.RegisteredClaims) jwt.RegisteredClaims {
+	claims.Issuer = s.tokens.Issuer
+	if s.tokens.Audience != "" {
+		claims.Audience = jwt.ClaimStrings{s.tokens.Audience}
+	}
+	return claims
+}
+
+func newTokenID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate token id: %w", err)
+	}
+	return hex.EncodeToString(b), nil
 }
 
 func (s *AuthService) ValidateToken(tokenString string) (*Claims, error) {
 	claims := &Claims{}
 
+	// jwt.WithAudience("") would demand an aud claim, which tokens only
+	// carry when an audience is configured.
+	opts := []jwt.ParserOption{jwt.WithIssuer(s.tokens.Issuer)}
+	if s.tokens.Audience != "" {
+		opts = append(opts, jwt.WithAudience(s.tokens.Audience))
+	}
+
 	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, errors.New("invalid signing method")
 		}
 		return s.secretKey, nil
-	})
+	}, opts...)
 
 	if err != nil {
 		return nil, err
@@ -100,12 +198,86 @@ func (s *AuthService) ValidateToken(tokenString string) (*Claims, error) {
 	return claims, nil
 }
 
-func (s *AuthService) RefreshToken(refreshToken string) (string, error) {
-	_, err := s.ValidateToken(refreshToken)
+// RevokeRefreshTokens revokes every live refresh token of a user, so a
+// logged-out session cannot be renewed from another copy of its tokens.
+func (s *AuthService) RevokeRefreshTokens(ctx context.Context, userID int) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE refresh_tokens SET revoked_at = NOW() WHERE user_id = ? AND revoked_at IS NULL", userID)
 	if err != nil {
-		return "", errors.New("invalid refresh token")
+		s.logger.Error().Err(err).Int("user_id", userID).Msg("Error revoking refresh tokens")
+		return fmt.Errorf("failed to revoke refresh tokens: %w", err)
 	}
-
-	return "", errors.New("refresh token implementation requires user lookup")
+	return nil
 }
 
+func (s *AuthService) RefreshToken(ctx context.Context, refreshToken string) (*models.AuthResponse, error) {
+	claims, err := s.ValidateToken(refreshToken)
+	if err != nil || claims.TokenType != TokenTypeRefresh || claims.ID == "" {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Error starting refresh transaction")
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var userID int
+	var familyID string
+	var revokedAt sql.NullTime
+	err = tx.QueryRowContext(ctx,
+		"SELECT user_id, family_id, revoked_at FROM refresh_tokens WHERE jti = ? FOR UPDATE",
+		claims.ID,
+	).Scan(&userID, &familyID, &revokedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Error looking up refresh token")
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	if revokedAt.Valid {
+		_, err = tx.ExecContext(ctx, "UPDATE refresh_tokens SET revoked_at = NOW() WHERE family_id = ? AND revoked_at IS NULL", familyID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to revoke token family: %w", err)
+		}
+		if err = tx.Commit(); err != nil {
+			return nil, fmt.Errorf("failed to commit token family revocation: %w", err)
+		}
+
+		s.logger.Warn().Int("user_id", userID).Str("family_id", familyID).Msg("Refresh token reuse detected, token family revoked")
+		return nil, ErrRefreshTokenReused
+	}
+
+	user, err := s.userService.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	newRefreshToken, newJTI, err := s.issueRefreshToken(tx, userID, familyID)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE refresh_tokens SET revoked_at = NOW(), replaced_by = ? WHERE jti = ?", newJTI, claims.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to rotate refresh token: %w", err)
+	}
+
+	accessToken, err := s.GenerateToken(user.ID, user.Email, user.Role)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		s.logger.Error().Err(err).Msg("Error committing refresh token rotation")
+		return nil, fmt.Errorf("failed to commit refresh: %w", err)
+	}
+
+	return &models.AuthResponse{
+		User:         user,
+		Token:        accessToken,
+		RefreshToken: newRefreshToken,
+	}, nil
+}
@@ -0,0 +1,172 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"go-projects/internal/config"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/rs/zerolog"
+)
+
+var (
+	testTokens         = TokenConfig{Secret: "auth-test-secret", AccessTTL: time.Hour, RefreshTTL: time.Hour}
+	refreshInsertQuery = regexp.QuoteMeta("INSERT INTO refresh_tokens (jti, user_id, family_id, expires_at) VALUES (?, ?, ?, ?)")
+	refreshLookupQuery = regexp.QuoteMeta("SELECT user_id, family_id, revoked_at FROM refresh_tokens WHERE jti = ? FOR UPDATE")
+)
+
+// newRefreshToken issues a refresh token for userID and returns it with the
+// jti it was stored under.
+func newRefreshToken(t *testing.T, service *AuthService, mock sqlmock.Sqlmock, userID int) (token, jti string) {
+	t.Helper()
+	mock.ExpectExec(refreshInsertQuery).
+		WithArgs(sqlmock.AnyArg(), userID, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	token, err := service.GenerateRefreshToken(userID)
+	if err != nil {
+		t.Fatalf("GenerateRefreshToken: %v", err)
+	}
+	claims, err := service.ValidateToken(token)
+	if err != nil {
+		t.Fatalf("ValidateToken: %v", err)
+	}
+	return token, claims.ID
+}
+
+func TestRefreshTokenRotates(t *testing.T) {
+	db, mock := newMockDB(t)
+	service := mustAuthService(t, db, testTokens)
+	token, jti := newRefreshToken(t, service, mock, 7)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(refreshLookupQuery).WithArgs(jti).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "family_id", "revoked_at"}).AddRow(7, "family-1", nil))
+	mock.ExpectQuery(userByIDQuery).WithArgs(7).WillReturnRows(userRow(7, "user"))
+	mock.ExpectExec(refreshInsertQuery).
+		WithArgs(sqlmock.AnyArg(), 7, "family-1", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE refresh_tokens SET revoked_at = NOW(), replaced_by = ? WHERE jti = ?")).
+		WithArgs(sqlmock.AnyArg(), jti).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	resp, err := service.RefreshToken(context.Background(), token)
+	if err != nil {
+		t.Fatalf("RefreshToken: %v", err)
+	}
+	if resp.RefreshToken == "" || resp.RefreshToken == token {
+		t.Error("refresh did not issue a new refresh token")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRefreshTokenReuseRevokesFamily(t *testing.T) {
+	db, mock := newMockDB(t)
+	service := mustAuthService(t, db, testTokens)
+	token, jti := newRefreshToken(t, service, mock, 7)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(refreshLookupQuery).WithArgs(jti).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "family_id", "revoked_at"}).AddRow(7, "family-1", time.Now()))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE refresh_tokens SET revoked_at = NOW() WHERE family_id = ? AND revoked_at IS NULL")).
+		WithArgs("family-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	if _, err := service.RefreshToken(context.Background(), token); !errors.Is(err, ErrRefreshTokenReused) {
+		t.Fatalf("err = %v, want ErrRefreshTokenReused", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRefreshTokenUnknownJTI(t *testing.T) {
+	db, mock := newMockDB(t)
+	service := mustAuthService(t, db, testTokens)
+	token, jti := newRefreshToken(t, service, mock, 7)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(refreshLookupQuery).WithArgs(jti).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "family_id", "revoked_at"}))
+	mock.ExpectRollback()
+
+	if _, err := service.RefreshToken(context.Background(), token); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Fatalf("err = %v, want ErrInvalidRefreshToken", err)
+	}
+}
+
+func TestValidateTokenChecksIssuerAndAudience(t *testing.T) {
+	issuer := mustAuthService(t, nil, TokenConfig{Secret: "auth-test-secret", AccessTTL: time.Hour, Issuer: "bank", Audience: "api"})
+	token, err := issuer.GenerateToken(7, "user@example.com", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		tokens TokenConfig
+		valid  bool
+	}{
+		{"same issuer and audience", TokenConfig{Secret: "auth-test-secret", Issuer: "bank", Audience: "api"}, true},
+		{"other issuer", TokenConfig{Secret: "auth-test-secret", Issuer: "other", Audience: "api"}, false},
+		{"other audience", TokenConfig{Secret: "auth-test-secret", Issuer: "bank", Audience: "admin"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := mustAuthService(t, nil, tt.tokens).ValidateToken(token)
+			if (err == nil) != tt.valid {
+				t.Errorf("ValidateToken err = %v, want valid = %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestNewAuthServiceSecret(t *testing.T) {
+	tests := []struct {
+		name       string
+		secret     string
+		production bool
+		wantErr    error
+	}{
+		{name: "missing secret", wantErr: ErrMissingJWTSecret},
+		{name: "default secret in development", secret: config.DefaultJWTSecret},
+		{name: "default secret in production", secret: config.DefaultJWTSecret, production: true, wantErr: ErrDefaultJWTSecret},
+		{name: "real secret in production", secret: "s3cret", production: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service, err := NewAuthService(nil, zerolog.Nop(), TokenConfig{Secret: tt.secret, AccessTTL: time.Hour, Production: tt.production})
+			if !errors.Is(err, tt.wantErr) || (err == nil) != (service != nil) {
+				t.Errorf("NewAuthService = (%v, %v), want error %v", service, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestCustomSecretSignsAndVerifies checks that the configured secret, not the
+// environment, is what tokens are signed and verified with.
+func TestCustomSecretSignsAndVerifies(t *testing.T) {
+	t.Setenv("JWT_SECRET", "environment-secret")
+	issuer := mustAuthService(t, nil, TokenConfig{Secret: "injected-secret", AccessTTL: time.Hour})
+	token, err := issuer.GenerateToken(7, "user@example.com", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := mustAuthService(t, nil, TokenConfig{Secret: "injected-secret"}).ValidateToken(token); err != nil {
+		t.Errorf("same secret: ValidateToken = %v, want valid", err)
+	}
+	if _, err := mustAuthService(t, nil, TokenConfig{Secret: "environment-secret"}).ValidateToken(token); err == nil {
+		t.Error("token signed with the injected secret validated under the environment secret")
+	}
+}
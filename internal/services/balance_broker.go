@@ -0,0 +1,61 @@
+package services
+
+import (
+	"sync"
+
+	"go-projects/internal/models"
+)
+
+// balanceUpdateBuffer is how many updates a slow subscriber may fall behind
+// before newer ones are dropped. Every update carries the full balance, so a
+// dropped one is superseded by the next.
+const balanceUpdateBuffer = 16
+
+// balanceBroker fans committed balance updates out to per-user subscribers.
+type balanceBroker struct {
+	mu          sync.Mutex
+	subscribers map[int]map[chan models.BalanceUpdate]struct{}
+}
+
+func newBalanceBroker() *balanceBroker {
+	return &balanceBroker{
+		subscribers: make(map[int]map[chan models.BalanceUpdate]struct{}),
+	}
+}
+
+func (b *balanceBroker) subscribe(userID int) (<-chan models.BalanceUpdate, func()) {
+	ch := make(chan models.BalanceUpdate, balanceUpdateBuffer)
+
+	b.mu.Lock()
+	if b.subscribers[userID] == nil {
+		b.subscribers[userID] = make(map[chan models.BalanceUpdate]struct{})
+	}
+	b.subscribers[userID][ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			delete(b.subscribers[userID], ch)
+			if len(b.subscribers[userID]) == 0 {
+				delete(b.subscribers, userID)
+			}
+		})
+	}
+
+	return ch, unsubscribe
+}
+
+func (b *balanceBroker) publish(update models.BalanceUpdate) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subscribers[update.UserID] {
+		select {
+		case ch <- update:
+		default:
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package services
+
+import (
+	"context"
+	"testing"
+
+	"go-projects/internal/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/rs/zerolog"
+)
+
+func TestBalanceBrokerDeliversToUserSubscribers(t *testing.T) {
+	broker := newBalanceBroker()
+
+	mine, unsubscribeMine := broker.subscribe(1)
+	defer unsubscribeMine()
+	other, unsubscribeOther := broker.subscribe(2)
+	defer unsubscribeOther()
+
+	broker.publish(models.BalanceUpdate{UserID: 1, Currency: "USD", Balance: 500})
+
+	select {
+	case update := <-mine:
+		if update.Balance != 500 {
+			t.Errorf("balance = %s, want 5.00", update.Balance)
+		}
+	default:
+		t.Fatal("subscriber did not receive its update")
+	}
+
+	select {
+	case update := <-other:
+		t.Errorf("another user's subscriber received %+v", update)
+	default:
+	}
+}
+
+func TestBalanceBrokerUnsubscribe(t *testing.T) {
+	broker := newBalanceBroker()
+
+	updates, unsubscribe := broker.subscribe(1)
+	unsubscribe()
+	unsubscribe()
+
+	broker.publish(models.BalanceUpdate{UserID: 1, Balance: 100})
+
+	select {
+	case update := <-updates:
+		t.Errorf("received %+v after unsubscribing", update)
+	default:
+	}
+	if len(broker.subscribers) != 0 {
+		t.Errorf("subscribers not cleaned up: %v", broker.subscribers)
+	}
+}
+
+func TestRollbackTxDropsQueuedUpdates(t *testing.T) {
+	db, mock := newMockDB(t)
+	service := NewBalanceService(db, zerolog.Nop())
+
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+
+	updates, unsubscribe := service.SubscribeUpdates(1)
+	defer unsubscribe()
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.queueUpdate(tx, models.BalanceUpdate{UserID: 1, Balance: 100})
+	service.rollbackTx(tx)
+
+	select {
+	case update := <-updates:
+		t.Errorf("rolled-back update was published: %+v", update)
+	default:
+	}
+	if len(service.pending) != 0 {
+		t.Error("pending updates kept after rollback")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUpdateBalanceDeliversCommittedUpdate(t *testing.T) {
+	db, mock := newMockDB(t)
+	service := NewBalanceService(db, zerolog.Nop())
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(balanceReadQuery).WithArgs(1, "USD").WillReturnRows(balanceRow("10.00", 3))
+	mock.ExpectExec(balanceUpdateQuery).WithArgs(models.Money(1500), 1, "USD", 3).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(historyInsertQuery).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	updates, unsubscribe := service.SubscribeUpdates(1)
+	defer unsubscribe()
+
+	if err := service.UpdateBalance(context.Background(), 1, "USD", 500); err != nil {
+		t.Fatalf("UpdateBalance: %v", err)
+	}
+
+	select {
+	case update := <-updates:
+		if update.Currency != "USD" || update.Balance != 1500 || update.ChangeAmount != 500 {
+			t.Errorf("update = %+v, want USD 15.00 after +5.00", update)
+		}
+	default:
+		t.Fatal("committed update was not delivered")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
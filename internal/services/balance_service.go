@@ -1,9 +1,11 @@
 package services
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -13,148 +15,339 @@ import (
 )
 
 type BalanceService struct {
-	db     *sql.DB
-	logger zerolog.Logger
-	mu     sync.Map
+	db      *sql.DB
+	logger  zerolog.Logger
+	updates *balanceBroker
+
+	// pending holds the updates made in each open DB transaction until
+	// commitTx publishes them or rollbackTx drops them.
+	pendingMu sync.Mutex
+	pending   map[*sql.Tx][]models.BalanceUpdate
 }
 
 func NewBalanceService(db *sql.DB, logger zerolog.Logger) *BalanceService {
 	return &BalanceService{
-		db:     db,
-		logger: logger,
+		db:      db,
+		logger:  logger,
+		updates: newBalanceBroker(),
+		pending: make(map[*sql.Tx][]models.BalanceUpdate),
 	}
 }
 
-func (s *BalanceService) getMutex(userID int) *sync.Mutex {
-	mu, _ := s.mu.LoadOrStore(userID, &sync.Mutex{})
-	return mu.(*sync.Mutex)
+// SubscribeUpdates streams the user's committed balance changes. The
+// returned func must be called to unsubscribe.
+func (s *BalanceService) SubscribeUpdates(userID int) (<-chan models.BalanceUpdate, func()) {
+	return s.updates.subscribe(userID)
 }
 
-func (s *BalanceService) GetBalance(userID int) (*models.Balance, error) {
-	var balance models.Balance
+// commitTx commits a transaction that went through updateBalanceInTx and
+// then publishes its balance updates, so subscribers never see a change
+// that was rolled back.
+func (s *BalanceService) commitTx(tx *sql.Tx) error {
+	err := tx.Commit()
+
+	s.pendingMu.Lock()
+	updates := s.pending[tx]
+	delete(s.pending, tx)
+	s.pendingMu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	for _, update := range updates {
+		s.updates.publish(update)
+	}
+	return nil
+}
 
-	err := s.db.QueryRow(
-		"SELECT user_id, amount, last_updated_at FROM balances WHERE user_id = ?",
-		userID,
-	).Scan(&balance.UserID, &balance.Amount, &balance.LastUpdatedAt)
+// rollbackTx is the deferred counterpart of commitTx; after a commit it is a
+// no-op.
+func (s *BalanceService) rollbackTx(tx *sql.Tx) {
+	tx.Rollback()
+
+	s.pendingMu.Lock()
+	delete(s.pending, tx)
+	s.pendingMu.Unlock()
+}
+
+// GetBalance returns the user's balance, creating a zero balance on first
+// access. Concurrent first reads may both try to create the row; the
+// no-op ON DUPLICATE KEY UPDATE lets the loser fall through, and both then
+// read back the committed row.
+func (s *BalanceService) GetBalance(ctx context.Context, userID int, currency string) (*models.Balance, error) {
+	balance, err := s.queryBalance(ctx, userID, currency)
 
 	if err == sql.ErrNoRows {
-		_, err = s.db.Exec("INSERT INTO balances (user_id, amount) VALUES (?, 0)", userID)
+		_, err = s.db.ExecContext(ctx,
+			"INSERT INTO balances (user_id, currency, amount) VALUES (?, ?, 0) ON DUPLICATE KEY UPDATE user_id = user_id",
+			userID, currency,
+		)
 		if err != nil {
-			s.logger.Error().Err(err).Int("user_id", userID).Msg("Error initializing balance")
+			s.logger.Error().Err(err).Int("user_id", userID).Str("currency", currency).Msg("Error initializing balance")
 			return nil, fmt.Errorf("failed to initialize balance: %w", err)
 		}
-		return &models.Balance{
-			UserID:       userID,
-			Amount:       0,
-			LastUpdatedAt: time.Now(),
-		}, nil
+		balance, err = s.queryBalance(ctx, userID, currency)
 	}
 
 	if err != nil {
-		s.logger.Error().Err(err).Int("user_id", userID).Msg("Error fetching balance")
+		s.logger.Error().Err(err).Int("user_id", userID).Str("currency", currency).Msg("Error fetching balance")
 		return nil, fmt.Errorf("database error: %w", err)
 	}
 
+	return balance, nil
+}
+
+func (s *BalanceService) queryBalance(ctx context.Context, userID int, currency string) (*models.Balance, error) {
+	var balance models.Balance
+
+	err := s.db.QueryRowContext(ctx,
+		"SELECT user_id, currency, amount, overdraft_limit, version, last_updated_at FROM balances WHERE user_id = ? AND currency = ?",
+		userID, currency,
+	).Scan(&balance.UserID, &balance.Currency, &balance.Amount, &balance.OverdraftLimit, &balance.Version, &balance.LastUpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
 	return &balance, nil
 }
 
-func (s *BalanceService) updateBalanceInTx(tx *sql.Tx, userID int, amount float64) error {
-	var currentBalance float64
-	err := tx.QueryRow(
-		"SELECT amount FROM balances WHERE user_id = ? FOR UPDATE",
-		userID,
-	).Scan(&currentBalance)
+// GetBalances reads many users' balances in one currency with a single
+// query. Unlike GetBalance it never creates rows: users without one get a
+// zero balance, and IDs that match no user are returned in missing.
+func (s *BalanceService) GetBalances(ctx context.Context, userIDs []int, currency string) ([]*models.Balance, []int, error) {
+	if len(userIDs) == 0 {
+		return []*models.Balance{}, []int{}, nil
+	}
 
-	if err == sql.ErrNoRows {
-		newBalance := amount
-		if newBalance < 0 {
-			return errors.New("insufficient balance")
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(userIDs)), ",")
+	args := make([]interface{}, 0, len(userIDs)+1)
+	args = append(args, currency)
+	for _, id := range userIDs {
+		args = append(args, id)
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT u.id, COALESCE(b.amount, 0), COALESCE(b.overdraft_limit, 0), b.last_updated_at
+		FROM users u
+		LEFT JOIN balances b ON b.user_id = u.id AND b.currency = ?
+		WHERE u.id IN (`+placeholders+`) AND u.deleted_at IS NULL`, args...)
+	if err != nil {
+		s.logger.Error().Err(err).Int("user_count", len(userIDs)).Msg("Error fetching balances")
+		return nil, nil, fmt.Errorf("database error: %w", err)
+	}
+	defer rows.Close()
+
+	found := make(map[int]*models.Balance, len(userIDs))
+	for rows.Next() {
+		balance := &models.Balance{Currency: currency}
+		var lastUpdatedAt sql.NullTime
+		if err := rows.Scan(&balance.UserID, &balance.Amount, &balance.OverdraftLimit, &lastUpdatedAt); err != nil {
+			return nil, nil, fmt.Errorf("error scanning balance: %w", err)
 		}
-		_, err = tx.Exec("INSERT INTO balances (user_id, amount) VALUES (?, ?)", userID, newBalance)
-		if err != nil {
-			return fmt.Errorf("failed to initialize balance: %w", err)
+		balance.LastUpdatedAt = lastUpdatedAt.Time
+		found[balance.UserID] = balance
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("error iterating balances: %w", err)
+	}
+
+	balances := make([]*models.Balance, 0, len(found))
+	missing := []int{}
+	seen := make(map[int]bool, len(userIDs))
+	for _, id := range userIDs {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		if balance, ok := found[id]; ok {
+			balances = append(balances, balance)
+		} else {
+			missing = append(missing, id)
 		}
+	}
 
-		_, err = tx.Exec(
-			"INSERT INTO balance_history (user_id, balance, change_amount, transaction_id) VALUES (?, ?, ?, NULL)",
-			userID, newBalance, amount,
-		)
-		if err != nil {
-			s.logger.Warn().Err(err).Msg("Failed to record balance history (non-critical)")
+	return balances, missing, nil
+}
+
+const maxBalanceUpdateAttempts = 3
+
+var errBalanceVersionConflict = errors.New("balance was modified concurrently")
+
+// Transactions change balances through updateBalanceInTx, which also writes
+// the history row; merges and reconciliation repairs use overwriteBalanceInTx.
+// Both queue their update for commitTx, so every caller must run them inside a
+// DB transaction. There is deliberately no in-process lock: the row version
+// guards the write, which also holds across replicas.
+//
+// The first attempt reads the row without locking it and writes with
+// UPDATE ... WHERE version = ?. If another writer committed in between, the
+// update matches no row and the change is retried. Retries read with
+// FOR UPDATE, because under REPEATABLE READ a plain re-read would return the
+// same stale snapshot.
+//
+// Each (user, currency) pair is its own balance row; currencies never mix.
+func (s *BalanceService) updateBalanceInTx(ctx context.Context, tx *sql.Tx, userID int, currency string, amount models.Money, transactionID *int64) error {
+	logger := loggerFromContext(ctx, s.logger)
+
+	var newBalance models.Money
+	var err error
+	for attempt := 1; attempt <= maxBalanceUpdateAttempts; attempt++ {
+		newBalance, err = s.applyBalanceChange(ctx, tx, userID, currency, amount, attempt > 1)
+		if err != errBalanceVersionConflict {
+			break
 		}
+		logger.Warn().Int("user_id", userID).Str("currency", currency).Int("attempt", attempt).Msg("Balance version conflict, retrying")
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO balance_history (user_id, currency, balance, change_amount, transaction_id) VALUES (?, ?, ?, ?, ?)",
+		userID, currency, newBalance, amount, transactionID,
+	)
+	if err != nil {
+		logger.Warn().Err(err).Msg("Failed to record balance history (non-critical)")
+	}
+
+	s.queueUpdate(tx, models.BalanceUpdate{
+		UserID:        userID,
+		Currency:      currency,
+		Balance:       newBalance,
+		ChangeAmount:  amount,
+		TransactionID: transactionID,
+		UpdatedAt:     time.Now(),
+	})
+
+	return nil
+}
+
+// overwriteBalanceInTx sets the stored balance to amount without a history
+// row. Reconciliation uses it to bring a balance back in line with the sum of
+// its history, which a history row would throw off again, and merges use it
+// because the moved history already accounts for the combined amount. The
+// caller must hold the row lock; previous is the balance it read under that
+// lock.
+func (s *BalanceService) overwriteBalanceInTx(ctx context.Context, tx *sql.Tx, userID int, currency string, previous, amount models.Money) error {
+	_, err := tx.ExecContext(ctx,
+		"INSERT INTO balances (user_id, currency, amount) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE amount = VALUES(amount), version = version + 1, last_updated_at = NOW()",
+		userID, currency, amount,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update balance: %w", err)
+	}
+
+	s.queueUpdate(tx, models.BalanceUpdate{
+		UserID:       userID,
+		Currency:     currency,
+		Balance:      amount,
+		ChangeAmount: amount - previous,
+		UpdatedAt:    time.Now(),
+	})
+
+	return nil
+}
+
+// queueUpdate holds update until commitTx publishes it.
+func (s *BalanceService) queueUpdate(tx *sql.Tx, update models.BalanceUpdate) {
+	s.pendingMu.Lock()
+	s.pending[tx] = append(s.pending[tx], update)
+	s.pendingMu.Unlock()
+}
+
+// applyBalanceChange makes one attempt at the versioned write and returns
+// errBalanceVersionConflict when the row changed after it was read.
+func (s *BalanceService) applyBalanceChange(ctx context.Context, tx *sql.Tx, userID int, currency string, amount models.Money, lock bool) (models.Money, error) {
+	query := "SELECT amount, overdraft_limit, version FROM balances WHERE user_id = ? AND currency = ?"
+	if lock {
+		query += " FOR UPDATE"
+	}
+
+	var currentBalance, overdraftLimit models.Money
+	var version int
+	err := tx.QueryRowContext(ctx, query, userID, currency).Scan(&currentBalance, &overdraftLimit, &version)
 
-		return nil
+	if err == sql.ErrNoRows {
+		if amount < 0 {
+			return 0, ErrInsufficientBalance
+		}
+		_, err = tx.ExecContext(ctx, "INSERT INTO balances (user_id, currency, amount) VALUES (?, ?, ?)", userID, currency, amount)
+		if isDuplicateKeyError(err) {
+			return 0, errBalanceVersionConflict
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to initialize balance: %w", err)
+		}
+		return amount, nil
 	}
 
 	if err != nil {
-		return fmt.Errorf("failed to fetch balance: %w", err)
+		return 0, fmt.Errorf("failed to fetch balance: %w", err)
 	}
 
 	newBalance := currentBalance + amount
-	if newBalance < 0 {
-		return errors.New("insufficient balance")
+	if newBalance < -overdraftLimit {
+		return 0, ErrInsufficientBalance
 	}
 
-	_, err = tx.Exec(
-		"UPDATE balances SET amount = ?, last_updated_at = NOW() WHERE user_id = ?",
-		newBalance, userID,
+	result, err := tx.ExecContext(ctx,
+		"UPDATE balances SET amount = ?, version = version + 1, last_updated_at = NOW() WHERE user_id = ? AND currency = ? AND version = ?",
+		newBalance, userID, currency, version,
 	)
 	if err != nil {
-		return fmt.Errorf("failed to update balance: %w", err)
+		return 0, fmt.Errorf("failed to update balance: %w", err)
 	}
 
-	_, err = tx.Exec(
-		"INSERT INTO balance_history (user_id, balance, change_amount, transaction_id) VALUES (?, ?, ?, NULL)",
-		userID, newBalance, amount,
-	)
+	affected, err := result.RowsAffected()
 	if err != nil {
-		s.logger.Warn().Err(err).Msg("Failed to record balance history (non-critical)")
+		return 0, fmt.Errorf("failed to update balance: %w", err)
+	}
+	if affected == 0 {
+		return 0, errBalanceVersionConflict
 	}
 
-	return nil
+	return newBalance, nil
 }
 
-func (s *BalanceService) UpdateBalance(userID int, amount float64) error {
-	mu := s.getMutex(userID)
-	mu.Lock()
-	defer mu.Unlock()
+func (s *BalanceService) UpdateBalance(ctx context.Context, userID int, currency string, amount models.Money) error {
+	logger := loggerFromContext(ctx, s.logger)
 
-	tx, err := s.db.Begin()
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		s.logger.Error().Err(err).Msg("Error starting balance update transaction")
+		logger.Error().Err(err).Msg("Error starting balance update transaction")
 		return fmt.Errorf("failed to start transaction: %w", err)
 	}
-	defer tx.Rollback()
+	defer s.rollbackTx(tx)
 
-	err = s.updateBalanceInTx(tx, userID, amount)
+	err = s.updateBalanceInTx(ctx, tx, userID, currency, amount, nil)
 	if err != nil {
 		return err
 	}
 
-	if err = tx.Commit(); err != nil {
-		s.logger.Error().Err(err).Msg("Error committing balance update")
+	if err = s.commitTx(tx); err != nil {
+		logger.Error().Err(err).Msg("Error committing balance update")
 		return fmt.Errorf("failed to commit balance update: %w", err)
 	}
 
-	s.logger.Info().
+	logger.Info().
 		Int("user_id", userID).
-		Float64("amount_change", amount).
+		Str("currency", currency).
+		Stringer("amount_change", amount).
 		Msg("Balance updated successfully")
 
 	return nil
 }
 
-func (s *BalanceService) GetBalanceHistory(userID int, limit, offset int) ([]*models.BalanceHistory, error) {
+func (s *BalanceService) GetBalanceHistory(ctx context.Context, userID int, limit, offset int) ([]*models.BalanceHistory, error) {
 	query := `
-		SELECT id, user_id, balance, change_amount, transaction_id, created_at
+		SELECT id, user_id, currency, balance, change_amount, transaction_id, created_at
 		FROM balance_history
 		WHERE user_id = ?
-		ORDER BY created_at DESC
+		ORDER BY created_at DESC, id DESC
 		LIMIT ? OFFSET ?
 	`
 
-	rows, err := s.db.Query(query, userID, limit, offset)
+	rows, err := s.db.QueryContext(ctx, query, userID, limit, offset)
 	if err != nil {
 		s.logger.Error().Err(err).Int("user_id", userID).Msg("Error fetching balance history")
 		return nil, fmt.Errorf("database error: %w", err)
@@ -167,7 +360,7 @@ func (s *BalanceService) GetBalanceHistory(userID int, limit, offset int) ([]*mo
 		var transactionID sql.NullInt64
 
 		err := rows.Scan(
-			&record.ID, &record.UserID, &record.Balance, &record.ChangeAmount,
+			&record.ID, &record.UserID, &record.Currency, &record.Balance, &record.ChangeAmount,
 			&transactionID, &record.CreatedAt,
 		)
 		if err != nil {
@@ -185,12 +378,12 @@ func (s *BalanceService) GetBalanceHistory(userID int, limit, offset int) ([]*mo
 	return history, nil
 }
 
-func (s *BalanceService) CalculateBalanceFromHistory(userID int) (float64, error) {
-	var totalBalance float64
+func (s *BalanceService) CalculateBalanceFromHistory(ctx context.Context, userID int, currency string) (models.Money, error) {
+	var totalBalance models.Money
 
-	err := s.db.QueryRow(
-		"SELECT COALESCE(SUM(change_amount), 0) FROM balance_history WHERE user_id = ?",
-		userID,
+	err := s.db.QueryRowContext(ctx,
+		"SELECT COALESCE(SUM(change_amount), 0) FROM balance_history WHERE user_id = ? AND currency = ?",
+		userID, currency,
 	).Scan(&totalBalance)
 
 	if err != nil {
@@ -201,37 +394,141 @@ func (s *BalanceService) CalculateBalanceFromHistory(userID int) (float64, error
 	return totalBalance, nil
 }
 
-func (s *BalanceService) ReconcileBalance(userID int) error {
-	currentBalance, err := s.GetBalance(userID)
+const maxTimelinePoints = 1000
+
+var ErrTimelineTooLarge = errors.New("timeline range has too many points for the interval")
+
+// GetBalanceTimeline samples the balance at every interval boundary from
+// from to to, inclusive. A user with no history yields zero balances.
+func (s *BalanceService) GetBalanceTimeline(ctx context.Context, userID int, currency string, from, to time.Time, interval time.Duration) ([]*models.BalancePoint, error) {
+	if int(to.Sub(from)/interval)+1 > maxTimelinePoints {
+		return nil, ErrTimelineTooLarge
+	}
+
+	opening, err := s.GetBalanceAtTime(ctx, userID, currency, from)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	calculatedBalance, err := s.CalculateBalanceFromHistory(userID)
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT balance, created_at FROM balance_history
+		WHERE user_id = ? AND currency = ? AND created_at > ? AND created_at <= ?
+		ORDER BY created_at ASC, id ASC
+	`, userID, currency, from, to)
 	if err != nil {
-		return err
+		s.logger.Error().Err(err).Int("user_id", userID).Msg("Error fetching balance history for timeline")
+		return nil, fmt.Errorf("database error: %w", err)
 	}
+	defer rows.Close()
+
+	points := []*models.BalancePoint{}
+	balance := opening
+	at := from
 
-	if currentBalance.Amount != calculatedBalance {
-		s.logger.Warn().
-			Int("user_id", userID).
-			Float64("current_balance", currentBalance.Amount).
-			Float64("calculated_balance", calculatedBalance).
-			Msg("Balance discrepancy detected")
+	for rows.Next() {
+		var rowBalance models.Money
+		var createdAt time.Time
+		if err := rows.Scan(&rowBalance, &createdAt); err != nil {
+			return nil, fmt.Errorf("error scanning balance history: %w", err)
+		}
+
+		for !at.After(to) && at.Before(createdAt) {
+			points = append(points, &models.BalancePoint{At: at, Balance: balance})
+			at = at.Add(interval)
+		}
+		balance = rowBalance
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating balance history: %w", err)
 	}
 
-	return nil
+	for !at.After(to) {
+		points = append(points, &models.BalancePoint{At: at, Balance: balance})
+		at = at.Add(interval)
+	}
+
+	return points, nil
 }
 
-func (s *BalanceService) GetBalanceAtTime(userID int, targetTime time.Time) (float64, error) {
-	var balance float64
+// ReconcileBalance compares the stored balance with the sum of its history.
+// With correct set, the stored balance is overwritten from history under a
+// row lock and the change is audited.
+func (s *BalanceService) ReconcileBalance(ctx context.Context, userID int, currency string, correct bool, adminID int) (*models.BalanceReconciliation, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer s.rollbackTx(tx)
+
+	result := &models.BalanceReconciliation{UserID: userID, Currency: currency}
+
+	err = tx.QueryRowContext(ctx,
+		"SELECT amount FROM balances WHERE user_id = ? AND currency = ? FOR UPDATE",
+		userID, currency,
+	).Scan(&result.StoredBalance)
+	if err != nil && err != sql.ErrNoRows {
+		s.logger.Error().Err(err).Int("user_id", userID).Msg("Error locking balance for reconciliation")
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	err = tx.QueryRowContext(ctx,
+		"SELECT COALESCE(SUM(change_amount), 0) FROM balance_history WHERE user_id = ? AND currency = ?",
+		userID, currency,
+	).Scan(&result.CalculatedBalance)
+	if err != nil {
+		s.logger.Error().Err(err).Int("user_id", userID).Msg("Error calculating balance from history")
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	result.Matches = result.StoredBalance == result.CalculatedBalance
+	if result.Matches {
+		return result, nil
+	}
+
+	s.logger.Warn().
+		Int("user_id", userID).
+		Str("currency", currency).
+		Stringer("current_balance", result.StoredBalance).
+		Stringer("calculated_balance", result.CalculatedBalance).
+		Msg("Balance discrepancy detected")
 
-	err := s.db.QueryRow(
+	if !correct {
+		return result, nil
+	}
+
+	if err = s.overwriteBalanceInTx(ctx, tx, userID, currency, result.StoredBalance, result.CalculatedBalance); err != nil {
+		return nil, err
+	}
+
+	err = writeAuditLog(tx, "balance", userID, "reconcile_repair", map[string]interface{}{
+		"actor_id":           adminID,
+		"currency":           currency,
+		"stored_balance":     result.StoredBalance,
+		"calculated_balance": result.CalculatedBalance,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err = s.commitTx(tx); err != nil {
+		s.logger.Error().Err(err).Int("user_id", userID).Msg("Error committing balance correction")
+		return nil, fmt.Errorf("failed to commit balance correction: %w", err)
+	}
+
+	result.Corrected = true
+	s.logger.Info().Int("user_id", userID).Str("currency", currency).Int("admin_id", adminID).Stringer("amount", result.CalculatedBalance).Msg("Balance corrected from history")
+	return result, nil
+}
+
+func (s *BalanceService) GetBalanceAtTime(ctx context.Context, userID int, currency string, targetTime time.Time) (models.Money, error) {
+	var balance models.Money
+
+	err := s.db.QueryRowContext(ctx,
 		`SELECT balance FROM balance_history 
-		 WHERE user_id = ? AND created_at <= ?
-		 ORDER BY created_at DESC
+		 WHERE user_id = ? AND currency = ? AND created_at <= ?
+		 ORDER BY created_at DESC, id DESC
 		 LIMIT 1`,
-		userID, targetTime,
+		userID, currency, targetTime,
 	).Scan(&balance)
 
 	if err == sql.ErrNoRows {
@@ -246,3 +543,57 @@ func (s *BalanceService) GetBalanceAtTime(userID int, targetTime time.Time) (flo
 	return balance, nil
 }
 
+// SetOverdraftLimit lets a balance go down to -limit. Lowering the limit below
+// an existing overdraft does not touch the balance; it only blocks further
+// withdrawals until the account is back within the limit.
+func (s *BalanceService) SetOverdraftLimit(ctx context.Context, userID int, currency string, limit models.Money, adminID int) (*models.Balance, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var exists int
+	err = tx.QueryRowContext(ctx, "SELECT 1 FROM users WHERE id = ? AND deleted_at IS NULL", userID).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	var oldLimit models.Money
+	err = tx.QueryRowContext(ctx,
+		"SELECT overdraft_limit FROM balances WHERE user_id = ? AND currency = ? FOR UPDATE",
+		userID, currency,
+	).Scan(&oldLimit)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO balances (user_id, currency, amount, overdraft_limit) VALUES (?, ?, 0, ?) ON DUPLICATE KEY UPDATE overdraft_limit = VALUES(overdraft_limit), version = version + 1",
+		userID, currency, limit,
+	)
+	if err != nil {
+		s.logger.Error().Err(err).Int("user_id", userID).Str("currency", currency).Msg("Error setting overdraft limit")
+		return nil, fmt.Errorf("failed to set overdraft limit: %w", err)
+	}
+
+	err = writeAuditLog(tx, "balance", userID, "overdraft_limit_changed", map[string]interface{}{
+		"actor_id":  adminID,
+		"currency":  currency,
+		"old_limit": oldLimit,
+		"new_limit": limit,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit overdraft limit: %w", err)
+	}
+
+	s.logger.Info().Int("user_id", userID).Str("currency", currency).Stringer("limit", limit).Int("admin_id", adminID).Msg("Overdraft limit updated")
+	return s.GetBalance(ctx, userID, currency)
+}
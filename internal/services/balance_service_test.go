@@ -0,0 +1,516 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"go-projects/internal/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/rs/zerolog"
+)
+
+var (
+	lockBalanceQuery   = regexp.QuoteMeta("SELECT amount FROM balances WHERE user_id = ? AND currency = ? FOR UPDATE")
+	balanceReadQuery   = regexp.QuoteMeta("SELECT amount, overdraft_limit, version FROM balances WHERE user_id = ? AND currency = ?") + "$"
+	balanceRelockQuery = regexp.QuoteMeta("SELECT amount, overdraft_limit, version FROM balances WHERE user_id = ? AND currency = ? FOR UPDATE")
+	balanceUpdateQuery = regexp.QuoteMeta("UPDATE balances SET amount = ?, version = version + 1, last_updated_at = NOW() WHERE user_id = ? AND currency = ? AND version = ?")
+	historyInsertQuery = regexp.QuoteMeta("INSERT INTO balance_history")
+)
+
+func balanceRow(amount string, version int) *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"amount", "overdraft_limit", "version"}).AddRow(amount, "0.00", version)
+}
+
+// TestBalanceWritesRunInTheirOwnTransactions runs UpdateBalance and the
+// in-transaction path the transaction service uses for the same user at the
+// same time. Both must make their versioned write inside their own DB
+// transaction, since there is no in-process mutex to serialize them.
+func TestBalanceWritesRunInTheirOwnTransactions(t *testing.T) {
+	db, mock := newMockDB(t)
+	mock.MatchExpectationsInOrder(false)
+	balances := NewBalanceService(db, zerolog.Nop())
+
+	const rounds = 5
+	for i := 0; i < 2*rounds; i++ {
+		mock.ExpectBegin()
+		mock.ExpectQuery(balanceReadQuery).WithArgs(5, "USD").WillReturnRows(balanceRow("100.00", i))
+		mock.ExpectExec(balanceUpdateQuery).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(historyInsertQuery).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*rounds)
+	for i := 0; i < rounds; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			errs <- balances.UpdateBalance(context.Background(), 5, "USD", 10)
+		}()
+		go func() {
+			defer wg.Done()
+			errs <- inTx(db, func(tx *sql.Tx) error {
+				return balances.updateBalanceInTx(context.Background(), tx, 5, "USD", 20, nil)
+			})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("concurrent balance write failed: %v", err)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func inTx(db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Two history rows written in the same second: the database returns them
+// newest id first, so the later change is the one reported.
+func TestGetBalanceAtTimeBreaksTimestampTiesByID(t *testing.T) {
+	db, mock := newMockDB(t)
+	balances := NewBalanceService(db, zerolog.Nop())
+	at := time.Date(2026, 10, 14, 9, 30, 0, 0, time.UTC)
+
+	mock.ExpectQuery(`ORDER BY created_at DESC, id DESC\s+LIMIT 1`).WithArgs(5, "USD", at).
+		WillReturnRows(sqlmock.NewRows([]string{"balance"}).AddRow("40.00").AddRow("25.00"))
+
+	balance, err := balances.GetBalanceAtTime(context.Background(), 5, "USD", at)
+	if err != nil {
+		t.Fatalf("GetBalanceAtTime: %v", err)
+	}
+	if balance != 4000 {
+		t.Errorf("balance = %v, want 40.00 from the later row", balance)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReconcileBalance(t *testing.T) {
+	historySumQuery := regexp.QuoteMeta("SELECT COALESCE(SUM(change_amount), 0) FROM balance_history WHERE user_id = ? AND currency = ?")
+
+	tests := []struct {
+		name          string
+		stored        string
+		correct       bool
+		wantMatches   bool
+		wantCorrected bool
+	}{
+		{name: "matching", stored: "50.00", wantMatches: true},
+		{name: "mismatch reported", stored: "80.00"},
+		{name: "mismatch corrected", stored: "80.00", correct: true, wantCorrected: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := newMockDB(t)
+			balances := NewBalanceService(db, zerolog.Nop())
+			updates, unsubscribe := balances.SubscribeUpdates(5)
+			defer unsubscribe()
+
+			mock.ExpectBegin()
+			mock.ExpectQuery(lockBalanceQuery).WithArgs(5, "USD").WillReturnRows(sqlmock.NewRows([]string{"amount"}).AddRow(tt.stored))
+			mock.ExpectQuery(historySumQuery).WithArgs(5, "USD").WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow("50.00"))
+			if tt.wantCorrected {
+				mock.ExpectExec(regexp.QuoteMeta("INSERT INTO balances (user_id, currency, amount)")).WithArgs(5, "USD", models.Money(5000)).
+					WillReturnResult(sqlmock.NewResult(0, 2))
+				mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_logs")).
+					WithArgs("balance", 5, "reconcile_repair", `{"actor_id":1,"calculated_balance":50.00,"currency":"USD","stored_balance":80.00}`).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+			} else {
+				mock.ExpectRollback()
+			}
+
+			result, err := balances.ReconcileBalance(context.Background(), 5, "USD", tt.correct, 1)
+			if err != nil {
+				t.Fatalf("ReconcileBalance: %v", err)
+			}
+			if result.Matches != tt.wantMatches || result.Corrected != tt.wantCorrected || result.CalculatedBalance != 5000 {
+				t.Errorf("result = %+v, want matches=%v corrected=%v calculated=50.00", *result, tt.wantMatches, tt.wantCorrected)
+			}
+			select {
+			case update := <-updates:
+				if !tt.wantCorrected {
+					t.Errorf("published %+v without a correction", update)
+				} else if update.Balance != 5000 || update.ChangeAmount != -3000 {
+					t.Errorf("update = %+v, want balance 50.00 changed by -30.00", update)
+				}
+			default:
+				if tt.wantCorrected {
+					t.Error("correction was not published to subscribers")
+				}
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// TestGetBalanceConcurrentFirstAccess has several callers miss the row for a
+// new user at once. Each must create it with the upsert rather than a plain
+// INSERT, which would fail for all but one of them, and get the committed row
+// back.
+func TestGetBalanceConcurrentFirstAccess(t *testing.T) {
+	db, mock := newMockDB(t)
+	mock.MatchExpectationsInOrder(false)
+	balances := NewBalanceService(db, zerolog.Nop())
+
+	selectQuery := regexp.QuoteMeta("SELECT user_id, currency, amount, overdraft_limit, version, last_updated_at FROM balances WHERE user_id = ? AND currency = ?")
+	upsertQuery := regexp.QuoteMeta("INSERT INTO balances (user_id, currency, amount) VALUES (?, ?, 0) ON DUPLICATE KEY UPDATE user_id = user_id")
+	created := time.Date(2026, 9, 1, 12, 0, 0, 0, time.UTC)
+
+	const callers = 4
+	for i := 0; i < callers; i++ {
+		mock.ExpectQuery(selectQuery).WithArgs(9, "EUR").WillReturnError(sql.ErrNoRows)
+	}
+	for i := 0; i < callers; i++ {
+		affected := int64(0)
+		if i == 0 {
+			affected = 1
+		}
+		// The delay keeps every caller's first read ahead of the re-reads.
+		mock.ExpectExec(upsertQuery).WithArgs(9, "EUR").WillDelayFor(50 * time.Millisecond).
+			WillReturnResult(sqlmock.NewResult(0, affected))
+	}
+	for i := 0; i < callers; i++ {
+		mock.ExpectQuery(selectQuery).WithArgs(9, "EUR").
+			WillReturnRows(sqlmock.NewRows([]string{"user_id", "currency", "amount", "overdraft_limit", "version", "last_updated_at"}).
+				AddRow(9, "EUR", "0.00", "5.00", 0, created))
+	}
+
+	start := make(chan struct{})
+	results := make(chan *models.Balance, callers)
+	errs := make(chan error, callers)
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			balance, err := balances.GetBalance(context.Background(), 9, "EUR")
+			if err != nil {
+				errs <- err
+				return
+			}
+			results <- balance
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(errs)
+	close(results)
+
+	for err := range errs {
+		t.Errorf("concurrent first access failed: %v", err)
+	}
+	for balance := range results {
+		if balance.Amount != 0 || balance.OverdraftLimit != 500 || !balance.LastUpdatedAt.Equal(created) {
+			t.Errorf("balance = %+v, want the committed row", *balance)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUpdateBalanceInTxRetriesStaleVersion(t *testing.T) {
+	db, mock := newMockDB(t)
+	service := NewBalanceService(db, zerolog.Nop())
+
+	mock.ExpectBegin()
+	// The unlocked read sees version 3, but another writer commits version 4
+	// before the write, so the versioned UPDATE matches nothing.
+	mock.ExpectQuery(balanceReadQuery).WithArgs(1, "USD").WillReturnRows(balanceRow("100.00", 3))
+	mock.ExpectExec(balanceUpdateQuery).WithArgs(models.Money(12500), 1, "USD", 3).WillReturnResult(sqlmock.NewResult(0, 0))
+	// The retry reads the current row and applies the change on top of it.
+	mock.ExpectQuery(balanceRelockQuery).WithArgs(1, "USD").WillReturnRows(balanceRow("150.00", 4))
+	mock.ExpectExec(balanceUpdateQuery).WithArgs(models.Money(17500), 1, "USD", 4).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(historyInsertQuery).WithArgs(1, "USD", models.Money(17500), models.Money(2500), nil).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	err := inTx(db, func(tx *sql.Tx) error {
+		return service.updateBalanceInTx(context.Background(), tx, 1, "USD", 2500, nil)
+	})
+	if err != nil {
+		t.Fatalf("updateBalanceInTx: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUpdateBalanceInTxGivesUpAfterMaxAttempts(t *testing.T) {
+	db, mock := newMockDB(t)
+	service := NewBalanceService(db, zerolog.Nop())
+
+	mock.ExpectBegin()
+	for attempt := 1; attempt <= maxBalanceUpdateAttempts; attempt++ {
+		read := balanceReadQuery
+		if attempt > 1 {
+			read = balanceRelockQuery
+		}
+		mock.ExpectQuery(read).WithArgs(1, "USD").WillReturnRows(balanceRow("100.00", attempt))
+		mock.ExpectExec(balanceUpdateQuery).WithArgs(models.Money(12500), 1, "USD", attempt).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	mock.ExpectRollback()
+
+	err := inTx(db, func(tx *sql.Tx) error {
+		return service.updateBalanceInTx(context.Background(), tx, 1, "USD", 2500, nil)
+	})
+	if !errors.Is(err, errBalanceVersionConflict) {
+		t.Fatalf("err = %v, want errBalanceVersionConflict", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUpdateBalanceInTxRespectsOverdraftLimit(t *testing.T) {
+	tests := []struct {
+		name   string
+		change models.Money
+		want   error
+	}{
+		{"down to the limit", -6000, nil},
+		{"one cent past the limit", -6001, ErrInsufficientBalance},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := newMockDB(t)
+			service := NewBalanceService(db, zerolog.Nop())
+
+			// 10.00 on hand with a 50.00 overdraft allowance.
+			mock.ExpectBegin()
+			mock.ExpectQuery(balanceReadQuery).WithArgs(1, "USD").
+				WillReturnRows(sqlmock.NewRows([]string{"amount", "overdraft_limit", "version"}).AddRow("10.00", "50.00", 2))
+			if tt.want == nil {
+				mock.ExpectExec(balanceUpdateQuery).WithArgs(models.Money(-5000), 1, "USD", 2).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(historyInsertQuery).WithArgs(1, "USD", models.Money(-5000), tt.change, nil).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+			} else {
+				mock.ExpectRollback()
+			}
+
+			err := inTx(db, func(tx *sql.Tx) error {
+				return service.updateBalanceInTx(context.Background(), tx, 1, "USD", tt.change, nil)
+			})
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("err = %v, want %v", err, tt.want)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestUpdateBalanceInTxWithoutOverdraftStopsAtZero(t *testing.T) {
+	db, mock := newMockDB(t)
+	service := NewBalanceService(db, zerolog.Nop())
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(balanceReadQuery).WithArgs(1, "USD").WillReturnRows(balanceRow("10.00", 2))
+	mock.ExpectRollback()
+
+	err := inTx(db, func(tx *sql.Tx) error {
+		return service.updateBalanceInTx(context.Background(), tx, 1, "USD", -1001, nil)
+	})
+	if !errors.Is(err, ErrInsufficientBalance) {
+		t.Fatalf("err = %v, want ErrInsufficientBalance", err)
+	}
+}
+
+func TestSetOverdraftLimitAudits(t *testing.T) {
+	db, mock := newMockDB(t)
+	service := NewBalanceService(db, zerolog.Nop())
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT 1 FROM users WHERE id = ? AND deleted_at IS NULL")).WithArgs(4).
+		WillReturnRows(sqlmock.NewRows([]string{"1"}).AddRow(1))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT overdraft_limit FROM balances WHERE user_id = ? AND currency = ? FOR UPDATE")).WithArgs(4, "USD").
+		WillReturnRows(sqlmock.NewRows([]string{"overdraft_limit"}).AddRow("0.00"))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO balances (user_id, currency, amount, overdraft_limit)")).
+		WithArgs(4, "USD", models.Money(2500)).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_logs")).
+		WithArgs("balance", 4, "overdraft_limit_changed", `{"actor_id":1,"currency":"USD","new_limit":25.00,"old_limit":0.00}`).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectQuery(balanceByIDQuery).WithArgs(4, "USD").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "currency", "amount", "overdraft_limit", "version", "last_updated_at"}).
+			AddRow(4, "USD", "0.00", "25.00", 1, time.Now()))
+
+	balance, err := service.SetOverdraftLimit(context.Background(), 4, "USD", 2500, 1)
+	if err != nil {
+		t.Fatalf("SetOverdraftLimit: %v", err)
+	}
+	if balance.OverdraftLimit != 2500 || balance.Available() != 2500 {
+		t.Errorf("balance = %+v, want a 25.00 limit available", balance)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGetBalanceTimelineDailyBuckets(t *testing.T) {
+	balanceAtQuery := regexp.QuoteMeta("SELECT balance FROM balance_history")
+	timelineQuery := regexp.QuoteMeta("SELECT balance, created_at FROM balance_history")
+	from := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(3 * 24 * time.Hour)
+
+	tests := []struct {
+		name    string
+		opening *sqlmock.Rows
+		history *sqlmock.Rows
+		want    []models.Money
+	}{
+		{
+			name:    "changes land in the next bucket",
+			opening: sqlmock.NewRows([]string{"balance"}).AddRow("10.00"),
+			history: sqlmock.NewRows([]string{"balance", "created_at"}).
+				AddRow("25.00", from.Add(5*time.Hour)).
+				AddRow("30.00", from.Add(30*time.Hour)).
+				AddRow("20.00", from.Add(47*time.Hour)),
+			want: []models.Money{1000, 2500, 2000, 2000},
+		},
+		{
+			name:    "change exactly on a boundary counts for it",
+			opening: sqlmock.NewRows([]string{"balance"}).AddRow("10.00"),
+			history: sqlmock.NewRows([]string{"balance", "created_at"}).
+				AddRow("40.00", from.Add(24*time.Hour)),
+			want: []models.Money{1000, 4000, 4000, 4000},
+		},
+		{
+			name:    "empty history",
+			opening: sqlmock.NewRows([]string{"balance"}),
+			history: sqlmock.NewRows([]string{"balance", "created_at"}),
+			want:    []models.Money{0, 0, 0, 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := newMockDB(t)
+			balances := NewBalanceService(db, zerolog.Nop())
+
+			mock.ExpectQuery(balanceAtQuery).WithArgs(5, "USD", from).WillReturnRows(tt.opening)
+			mock.ExpectQuery(timelineQuery).WithArgs(5, "USD", from, to).WillReturnRows(tt.history)
+
+			points, err := balances.GetBalanceTimeline(context.Background(), 5, "USD", from, to, 24*time.Hour)
+			if err != nil {
+				t.Fatalf("GetBalanceTimeline: %v", err)
+			}
+			if len(points) != len(tt.want) {
+				t.Fatalf("got %d points, want %d", len(points), len(tt.want))
+			}
+			for i, point := range points {
+				if !point.At.Equal(from.Add(time.Duration(i) * 24 * time.Hour)) {
+					t.Errorf("point %d at %v, want day %d", i, point.At, i)
+				}
+				if point.Balance != tt.want[i] {
+					t.Errorf("point %d balance = %s, want %s", i, point.Balance, tt.want[i])
+				}
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestGetBalanceTimelineRejectsTooManyPoints(t *testing.T) {
+	db, _ := newMockDB(t)
+	balances := NewBalanceService(db, zerolog.Nop())
+	from := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	if _, err := balances.GetBalanceTimeline(context.Background(), 5, "USD", from, from.Add(maxTimelinePoints*time.Hour), time.Hour); !errors.Is(err, ErrTimelineTooLarge) {
+		t.Errorf("err = %v, want ErrTimelineTooLarge", err)
+	}
+}
+
+func TestBalanceReadsStopOnCancelledContext(t *testing.T) {
+	db, mock := newMockDB(t)
+	service := NewBalanceService(db, zerolog.Nop())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := service.GetBalance(ctx, 1, "USD"); !errors.Is(err, context.Canceled) {
+		t.Errorf("GetBalance err = %v, want context.Canceled", err)
+	}
+	if _, err := service.GetBalanceHistory(ctx, 1, 10, 0); !errors.Is(err, context.Canceled) {
+		t.Errorf("GetBalanceHistory err = %v, want context.Canceled", err)
+	}
+	if _, err := service.GetBalanceAtTime(ctx, 1, "USD", time.Now()); !errors.Is(err, context.Canceled) {
+		t.Errorf("GetBalanceAtTime err = %v, want context.Canceled", err)
+	}
+	if _, err := service.ReconcileBalance(ctx, 1, "USD", true, 2); !errors.Is(err, context.Canceled) {
+		t.Errorf("ReconcileBalance err = %v, want context.Canceled", err)
+	}
+
+	// No statement may reach the database once the caller has gone away.
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGetBalancesMarksMissingUsers(t *testing.T) {
+	db, mock := newMockDB(t)
+	service := NewBalanceService(db, zerolog.Nop())
+
+	updated := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	mock.ExpectQuery(regexp.QuoteMeta("WHERE u.id IN (?,?,?,?) AND u.deleted_at IS NULL")).
+		WithArgs("USD", 3, 1, 9, 3).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "amount", "overdraft_limit", "last_updated_at"}).
+			AddRow(1, "25.00", "5.00", updated).
+			AddRow(3, "0", "0", nil))
+
+	balances, missing, err := service.GetBalances(context.Background(), []int{3, 1, 9, 3}, "USD")
+	if err != nil {
+		t.Fatalf("GetBalances: %v", err)
+	}
+
+	// Results follow request order with duplicates collapsed; user 3 has no
+	// balance row and reads as zero.
+	if len(balances) != 2 || balances[0].UserID != 3 || balances[1].UserID != 1 {
+		t.Fatalf("balances = %+v, want users 3 and 1 in request order", balances)
+	}
+	if balances[0].Amount != 0 || !balances[0].LastUpdatedAt.IsZero() {
+		t.Errorf("user 3 = %+v, want a zero balance", balances[0])
+	}
+	if balances[1].Amount != 2500 || balances[1].OverdraftLimit != 500 || !balances[1].LastUpdatedAt.Equal(updated) || balances[1].Currency != "USD" {
+		t.Errorf("user 1 = %+v, want 25.00 USD with a 5.00 overdraft", balances[1])
+	}
+	if len(missing) != 1 || missing[0] != 9 {
+		t.Errorf("missing = %v, want [9]", missing)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
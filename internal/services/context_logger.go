@@ -0,0 +1,21 @@
+package services
+
+import (
+	"context"
+
+	"go-projects/internal/middleware"
+
+	"github.com/rs/zerolog"
+)
+
+// loggerFromContext binds the HTTP request ID, when there is one, so service
+// logs can be correlated with the access log line for the same request.
+func loggerFromContext(ctx context.Context, base zerolog.Logger) zerolog.Logger {
+	if ctx == nil {
+		return base
+	}
+	if requestID, ok := middleware.RequestIDFromContext(ctx); ok {
+		return base.With().Str("request_id", requestID).Logger()
+	}
+	return base
+}
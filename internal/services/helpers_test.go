@@ -0,0 +1,30 @@
+package services
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/rs/zerolog"
+)
+
+func newMockDB(t *testing.T) (*sql.DB, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, mock
+}
+
+// mustAuthService builds an AuthService, failing the test if its token
+// settings are refused.
+func mustAuthService(t *testing.T, db *sql.DB, tokens TokenConfig) *AuthService {
+	t.Helper()
+	service, err := NewAuthService(db, zerolog.Nop(), tokens)
+	if err != nil {
+		t.Fatalf("NewAuthService: %v", err)
+	}
+	return service
+}
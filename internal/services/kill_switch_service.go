@@ -0,0 +1,145 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go-projects/internal/models"
+
+	"github.com/rs/zerolog"
+)
+
+const killSwitchSettingKey = "transaction_kill_switch"
+
+type KillSwitchService struct {
+	db     *sql.DB
+	logger zerolog.Logger
+	status models.KillSwitchStatus
+	mu     sync.RWMutex
+}
+
+func NewKillSwitchService(db *sql.DB, logger zerolog.Logger) *KillSwitchService {
+	s := &KillSwitchService{
+		db:     db,
+		logger: logger,
+	}
+
+	if err := s.load(); err != nil {
+		logger.Error().Err(err).Msg("Error loading kill switch state, defaulting to inactive")
+	}
+
+	return s
+}
+
+func (s *KillSwitchService) load() error {
+	var value string
+	err := s.db.QueryRow("SELECT setting_value FROM system_settings WHERE setting_key = ?", killSwitchSettingKey).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+
+	var status models.KillSwitchStatus
+	if err := json.Unmarshal([]byte(value), &status); err != nil {
+		return fmt.Errorf("invalid kill switch state: %w", err)
+	}
+
+	s.mu.Lock()
+	s.status = status
+	s.mu.Unlock()
+
+	if status.Active {
+		s.logger.Warn().Str("reason", status.Reason).Msg("Transaction kill switch is active")
+	}
+
+	return nil
+}
+
+func (s *KillSwitchService) Active() (bool, string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.status.Active, s.status.Reason
+}
+
+func (s *KillSwitchService) Status() models.KillSwitchStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.status
+}
+
+func (s *KillSwitchService) Activate(reason string, adminID int) (models.KillSwitchStatus, error) {
+	if reason == "" {
+		return models.KillSwitchStatus{}, errors.New("reason is required")
+	}
+
+	return s.set(true, reason, adminID)
+}
+
+func (s *KillSwitchService) Clear(adminID int) (models.KillSwitchStatus, error) {
+	return s.set(false, "", adminID)
+}
+
+func (s *KillSwitchService) set(active bool, reason string, adminID int) (models.KillSwitchStatus, error) {
+	now := time.Now()
+	status := models.KillSwitchStatus{
+		Active:    active,
+		Reason:    reason,
+		UpdatedBy: adminID,
+		UpdatedAt: &now,
+	}
+
+	value, err := json.Marshal(status)
+	if err != nil {
+		return models.KillSwitchStatus{}, fmt.Errorf("failed to encode kill switch state: %w", err)
+	}
+
+	action := "kill_switch_cleared"
+	if active {
+		action = "kill_switch_activated"
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return models.KillSwitchStatus{}, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		"INSERT INTO system_settings (setting_key, setting_value) VALUES (?, ?) ON DUPLICATE KEY UPDATE setting_value = VALUES(setting_value)",
+		killSwitchSettingKey, string(value),
+	)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Error persisting kill switch state")
+		return models.KillSwitchStatus{}, fmt.Errorf("failed to persist kill switch: %w", err)
+	}
+
+	err = writeAuditLog(tx, "system", 0, action, map[string]interface{}{
+		"admin_id": adminID,
+		"reason":   reason,
+	})
+	if err != nil {
+		return models.KillSwitchStatus{}, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return models.KillSwitchStatus{}, fmt.Errorf("failed to commit kill switch: %w", err)
+	}
+
+	s.mu.Lock()
+	s.status = status
+	s.mu.Unlock()
+
+	if active {
+		s.logger.Warn().Int("admin_id", adminID).Str("reason", reason).Msg("Transaction kill switch activated")
+	} else {
+		s.logger.Info().Int("admin_id", adminID).Msg("Transaction kill switch cleared")
+	}
+
+	return status, nil
+}
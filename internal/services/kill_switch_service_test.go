@@ -0,0 +1,60 @@
+package services
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/rs/zerolog"
+)
+
+var killSwitchLoadQuery = regexp.QuoteMeta("SELECT setting_value FROM system_settings WHERE setting_key = ?")
+
+func TestKillSwitchLoadsPersistedState(t *testing.T) {
+	db, mock := newMockDB(t)
+	mock.ExpectQuery(killSwitchLoadQuery).WithArgs(killSwitchSettingKey).
+		WillReturnRows(sqlmock.NewRows([]string{"setting_value"}).AddRow(`{"active":true,"reason":"incident","updated_by":1}`))
+
+	service := NewKillSwitchService(db, zerolog.Nop())
+
+	if active, reason := service.Active(); !active || reason != "incident" {
+		t.Errorf("Active() = %v, %q; want the persisted state", active, reason)
+	}
+}
+
+func TestKillSwitchActivateAndClear(t *testing.T) {
+	db, mock := newMockDB(t)
+	mock.ExpectQuery(killSwitchLoadQuery).WithArgs(killSwitchSettingKey).
+		WillReturnRows(sqlmock.NewRows([]string{"setting_value"}))
+	service := NewKillSwitchService(db, zerolog.Nop())
+
+	for _, action := range []string{"kill_switch_activated", "kill_switch_cleared"} {
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO system_settings")).
+			WithArgs(killSwitchSettingKey, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_logs")).
+			WithArgs("system", 0, action, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+	}
+
+	if _, err := service.Activate("", 1); err == nil {
+		t.Error("Activate accepted an empty reason")
+	}
+	if _, err := service.Activate("incident", 1); err != nil {
+		t.Fatalf("Activate: %v", err)
+	}
+	if active, _ := service.Active(); !active {
+		t.Error("kill switch inactive after Activate")
+	}
+	if _, err := service.Clear(1); err != nil {
+		t.Fatalf("Clear: %v", err)
+	}
+	if active, _ := service.Active(); active {
+		t.Error("kill switch active after Clear")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
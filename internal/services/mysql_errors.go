@@ -0,0 +1,29 @@
+package services
+
+import (
+	"errors"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+const (
+	mysqlErrDuplicateEntry   = 1062
+	mysqlErrLockWaitTimeout  = 1205
+	mysqlErrDeadlockDetected = 1213
+)
+
+func isDuplicateKeyError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlErrDuplicateEntry
+}
+
+// isLockConflictError reports whether InnoDB aborted the statement because of
+// a deadlock or a lock wait timeout. Either way the transaction can be retried
+// from the start.
+func isLockConflictError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) {
+		return false
+	}
+	return mysqlErr.Number == mysqlErrDeadlockDetected || mysqlErr.Number == mysqlErrLockWaitTimeout
+}
@@ -0,0 +1,248 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"go-projects/internal/models"
+
+	"github.com/rs/zerolog"
+)
+
+const reconciliationBatchSize = 500
+
+type ReconciliationService struct {
+	db             *sql.DB
+	logger         zerolog.Logger
+	balanceService *BalanceService
+	jobs           map[string]*models.ReconciliationReport
+	mu             sync.RWMutex
+}
+
+func NewReconciliationService(db *sql.DB, logger zerolog.Logger, balanceService *BalanceService) *ReconciliationService {
+	return &ReconciliationService{
+		db:             db,
+		logger:         logger,
+		balanceService: balanceService,
+		jobs:           make(map[string]*models.ReconciliationReport),
+	}
+}
+
+func (s *ReconciliationService) StartReconcileAll(repair bool) (*models.ReconciliationReport, error) {
+	var total int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM users").Scan(&total); err != nil {
+		s.logger.Error().Err(err).Msg("Error counting users for reconciliation")
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	report := &models.ReconciliationReport{
+		ID:            strconv.FormatInt(time.Now().UnixNano(), 36),
+		Status:        models.ReconciliationStatusPending,
+		Repair:        repair,
+		Total:         total,
+		Discrepancies: []*models.BalanceDiscrepancy{},
+		StartedAt:     time.Now(),
+	}
+
+	s.mu.Lock()
+	s.jobs[report.ID] = report
+	s.mu.Unlock()
+
+	created := s.snapshot(report)
+	go s.run(report)
+
+	return created, nil
+}
+
+func (s *ReconciliationService) GetJob(jobID string) (*models.ReconciliationReport, error) {
+	s.mu.RLock()
+	report, ok := s.jobs[jobID]
+	s.mu.RUnlock()
+
+	if !ok {
+		return nil, errors.New("reconciliation job not found")
+	}
+
+	return s.snapshot(report), nil
+}
+
+func (s *ReconciliationService) run(report *models.ReconciliationReport) {
+	s.mu.Lock()
+	report.Status = models.ReconciliationStatusRunning
+	s.mu.Unlock()
+
+	s.logger.Info().Str("job_id", report.ID).Bool("repair", report.Repair).Msg("Reconciliation job started")
+
+	lastUserID := 0
+	for {
+		discrepancies, processed, nextUserID, err := s.reconcileBatch(lastUserID, report.Repair)
+		if err != nil {
+			s.finish(report, err)
+			return
+		}
+		if processed == 0 {
+			break
+		}
+
+		s.mu.Lock()
+		report.Processed += processed
+		report.Discrepancies = append(report.Discrepancies, discrepancies...)
+		s.mu.Unlock()
+
+		lastUserID = nextUserID
+	}
+
+	s.finish(report, nil)
+}
+
+// reconcileBatch checks every currency balance of the next page of users. The
+// page is selected first so that a user's currencies never straddle batches.
+func (s *ReconciliationService) reconcileBatch(afterUserID int, repair bool) ([]*models.BalanceDiscrepancy, int, int, error) {
+	var processed, lastUserID int
+	err := s.db.QueryRow(`
+		SELECT COUNT(*), COALESCE(MAX(id), 0) FROM (
+			SELECT id FROM users WHERE id > ? ORDER BY id LIMIT ?
+		) page
+	`, afterUserID, reconciliationBatchSize).Scan(&processed, &lastUserID)
+	if err != nil {
+		return nil, 0, afterUserID, fmt.Errorf("database error: %w", err)
+	}
+	if processed == 0 {
+		return nil, 0, afterUserID, nil
+	}
+
+	rows, err := s.db.Query(`
+		SELECT k.user_id, k.currency, COALESCE(b.amount, 0),
+			COALESCE((SELECT SUM(h.change_amount) FROM balance_history h WHERE h.user_id = k.user_id AND h.currency = k.currency), 0)
+		FROM (
+			SELECT user_id, currency FROM balances WHERE user_id > ? AND user_id <= ?
+			UNION
+			SELECT user_id, currency FROM balance_history WHERE user_id > ? AND user_id <= ?
+		) k
+		JOIN users u ON u.id = k.user_id
+		LEFT JOIN balances b ON b.user_id = k.user_id AND b.currency = k.currency
+		ORDER BY k.user_id, k.currency
+	`, afterUserID, lastUserID, afterUserID, lastUserID)
+	if err != nil {
+		return nil, 0, afterUserID, fmt.Errorf("database error: %w", err)
+	}
+
+	var discrepancies []*models.BalanceDiscrepancy
+	for rows.Next() {
+		var d models.BalanceDiscrepancy
+		if err := rows.Scan(&d.UserID, &d.Currency, &d.StoredBalance, &d.CalculatedBalance); err != nil {
+			rows.Close()
+			return nil, 0, afterUserID, fmt.Errorf("error scanning balances: %w", err)
+		}
+
+		if d.StoredBalance != d.CalculatedBalance {
+			discrepancies = append(discrepancies, &d)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, 0, afterUserID, fmt.Errorf("error iterating balances: %w", err)
+	}
+
+	for _, d := range discrepancies {
+		s.logger.Warn().
+			Int("user_id", d.UserID).
+			Str("currency", d.Currency).
+			Stringer("stored_balance", d.StoredBalance).
+			Stringer("calculated_balance", d.CalculatedBalance).
+			Msg("Balance discrepancy detected")
+
+		if !repair {
+			continue
+		}
+
+		if err := s.repair(d); err != nil {
+			s.logger.Error().Err(err).Int("user_id", d.UserID).Msg("Error repairing balance")
+			continue
+		}
+		d.Repaired = true
+	}
+
+	return discrepancies, processed, lastUserID, nil
+}
+
+func (s *ReconciliationService) repair(d *models.BalanceDiscrepancy) error {
+	ctx := context.Background()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer s.balanceService.rollbackTx(tx)
+
+	// The batch read was unlocked; lock the row and repair from its
+	// current value.
+	var stored models.Money
+	err = tx.QueryRowContext(ctx,
+		"SELECT amount FROM balances WHERE user_id = ? AND currency = ? FOR UPDATE",
+		d.UserID, d.Currency,
+	).Scan(&stored)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("failed to lock balance: %w", err)
+	}
+
+	if err = s.balanceService.overwriteBalanceInTx(ctx, tx, d.UserID, d.Currency, stored, d.CalculatedBalance); err != nil {
+		return err
+	}
+
+	err = writeAuditLog(tx, "balance", d.UserID, "reconcile_repair", map[string]interface{}{
+		"currency":           d.Currency,
+		"stored_balance":     d.StoredBalance,
+		"calculated_balance": d.CalculatedBalance,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = s.balanceService.commitTx(tx); err != nil {
+		return fmt.Errorf("failed to commit repair: %w", err)
+	}
+
+	s.logger.Info().Int("user_id", d.UserID).Str("currency", d.Currency).Stringer("amount", d.CalculatedBalance).Msg("Balance repaired from history")
+	return nil
+}
+
+func (s *ReconciliationService) finish(report *models.ReconciliationReport, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	report.FinishedAt = &now
+	if err != nil {
+		report.Status = models.ReconciliationStatusFailed
+		report.Error = err.Error()
+		s.logger.Error().Err(err).Str("job_id", report.ID).Msg("Reconciliation job failed")
+		return
+	}
+
+	report.Status = models.ReconciliationStatusCompleted
+	s.logger.Info().
+		Str("job_id", report.ID).
+		Int("processed", report.Processed).
+		Int("discrepancies", len(report.Discrepancies)).
+		Msg("Reconciliation job completed")
+}
+
+func (s *ReconciliationService) snapshot(report *models.ReconciliationReport) *models.ReconciliationReport {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	copied := *report
+	copied.Discrepancies = make([]*models.BalanceDiscrepancy, len(report.Discrepancies))
+	for i, d := range report.Discrepancies {
+		dCopy := *d
+		copied.Discrepancies[i] = &dCopy
+	}
+
+	return &copied
+}
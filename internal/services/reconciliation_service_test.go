@@ -0,0 +1,128 @@
+package services
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"go-projects/internal/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/rs/zerolog"
+)
+
+var (
+	countUsersQuery     = regexp.QuoteMeta("SELECT COUNT(*) FROM users")
+	reconcilePageQuery  = regexp.QuoteMeta("SELECT COUNT(*), COALESCE(MAX(id), 0) FROM (")
+	reconcileBatchQuery = regexp.QuoteMeta("SELECT k.user_id, k.currency, COALESCE(b.amount, 0)")
+	repairBalanceQuery  = regexp.QuoteMeta("INSERT INTO balances (user_id, currency, amount)")
+	repairAuditQuery    = regexp.QuoteMeta("INSERT INTO audit_logs")
+)
+
+// waitForJob polls the job until it leaves the pending and running states.
+func waitForJob(t *testing.T, service *ReconciliationService, id string) *models.ReconciliationReport {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		report, err := service.GetJob(id)
+		if err != nil {
+			t.Fatalf("GetJob: %v", err)
+		}
+		if report.Status != models.ReconciliationStatusPending && report.Status != models.ReconciliationStatusRunning {
+			return report
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("reconciliation job did not finish")
+	return nil
+}
+
+func TestReconcileAllReportsAndRepairsDrift(t *testing.T) {
+	db, mock := newMockDB(t)
+	balances := NewBalanceService(db, zerolog.Nop())
+	service := NewReconciliationService(db, zerolog.Nop(), balances)
+	updates, unsubscribe := balances.SubscribeUpdates(2)
+	defer unsubscribe()
+
+	mock.ExpectQuery(countUsersQuery).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+	mock.ExpectQuery(reconcilePageQuery).WithArgs(0, reconciliationBatchSize).
+		WillReturnRows(sqlmock.NewRows([]string{"count", "max"}).AddRow(3, 3))
+	mock.ExpectQuery(reconcileBatchQuery).WithArgs(0, 3, 0, 3).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "currency", "stored", "calculated"}).
+			AddRow(1, "USD", 100.0, 100.0).
+			AddRow(2, "EUR", 10.0, 10.0).
+			AddRow(2, "USD", 80.0, 50.0).
+			AddRow(3, "USD", 0.0, 0.0))
+	mock.ExpectBegin()
+	mock.ExpectQuery(lockBalanceQuery).WithArgs(2, "USD").WillReturnRows(sqlmock.NewRows([]string{"amount"}).AddRow("80.00"))
+	mock.ExpectExec(repairBalanceQuery).WithArgs(2, "USD", models.Money(5000)).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(repairAuditQuery).WithArgs("balance", 2, "reconcile_repair", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectQuery(reconcilePageQuery).WithArgs(3, reconciliationBatchSize).
+		WillReturnRows(sqlmock.NewRows([]string{"count", "max"}).AddRow(0, 0))
+
+	created, err := service.StartReconcileAll(true)
+	if err != nil {
+		t.Fatalf("StartReconcileAll: %v", err)
+	}
+	if created.Status != models.ReconciliationStatusPending || created.Total != 3 {
+		t.Errorf("new job = %s with total %d, want pending with total 3", created.Status, created.Total)
+	}
+
+	report := waitForJob(t, service, created.ID)
+	if report.Status != models.ReconciliationStatusCompleted {
+		t.Fatalf("status = %s (%s), want completed", report.Status, report.Error)
+	}
+	if report.Processed != 3 || report.FinishedAt == nil {
+		t.Errorf("processed = %d, finished = %v; want 3 and a finish time", report.Processed, report.FinishedAt)
+	}
+	if len(report.Discrepancies) != 1 {
+		t.Fatalf("got %d discrepancies, want only the drifted account", len(report.Discrepancies))
+	}
+	if d := report.Discrepancies[0]; d.UserID != 2 || d.Currency != "USD" || d.StoredBalance != 8000 || d.CalculatedBalance != 5000 || !d.Repaired {
+		t.Errorf("discrepancy = %+v, want user 2 repaired from 80.00 to 50.00", *d)
+	}
+	select {
+	case update := <-updates:
+		if update.Currency != "USD" || update.Balance != 5000 {
+			t.Errorf("update = %+v, want USD at 50.00", update)
+		}
+	default:
+		t.Error("repair was not published to subscribers")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReconcileAllMarksJobFailed(t *testing.T) {
+	db, mock := newMockDB(t)
+	service := NewReconciliationService(db, zerolog.Nop(), NewBalanceService(db, zerolog.Nop()))
+
+	mock.ExpectQuery(countUsersQuery).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectQuery(reconcilePageQuery).WillReturnError(errors.New("connection reset"))
+
+	created, err := service.StartReconcileAll(false)
+	if err != nil {
+		t.Fatalf("StartReconcileAll: %v", err)
+	}
+
+	report := waitForJob(t, service, created.ID)
+	if report.Status != models.ReconciliationStatusFailed || report.Error == "" {
+		t.Errorf("status = %s with error %q, want failed with the cause", report.Status, report.Error)
+	}
+	if report.FinishedAt == nil {
+		t.Error("failed job has no finish time")
+	}
+}
+
+func TestGetJobUnknownID(t *testing.T) {
+	db, _ := newMockDB(t)
+	service := NewReconciliationService(db, zerolog.Nop(), NewBalanceService(db, zerolog.Nop()))
+
+	if _, err := service.GetJob("missing"); err == nil {
+		t.Error("GetJob returned no error for an unknown id")
+	}
+}
@@ -0,0 +1,109 @@
+package services
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// ReconciliationWorker periodically runs the same batch reconciliation as the
+// admin reconcile-all job and records every discrepancy in audit_logs.
+type ReconciliationWorker struct {
+	service    *ReconciliationService
+	logger     zerolog.Logger
+	interval   time.Duration
+	autoRepair bool
+	stop       chan struct{}
+	done       chan struct{}
+	once       sync.Once
+}
+
+func NewReconciliationWorker(db *sql.DB, logger zerolog.Logger, balanceService *BalanceService, interval time.Duration, autoRepair bool) *ReconciliationWorker {
+	return &ReconciliationWorker{
+		service:    NewReconciliationService(db, logger, balanceService),
+		logger:     logger,
+		interval:   interval,
+		autoRepair: autoRepair,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+func (w *ReconciliationWorker) Start() {
+	go w.loop()
+	w.logger.Info().Dur("interval", w.interval).Bool("auto_repair", w.autoRepair).Msg("Reconciliation worker started")
+}
+
+func (w *ReconciliationWorker) Stop() {
+	w.once.Do(func() {
+		close(w.stop)
+	})
+	<-w.done
+}
+
+func (w *ReconciliationWorker) loop() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			w.logger.Info().Msg("Reconciliation worker stopped")
+			return
+		case <-ticker.C:
+			w.runOnce()
+		}
+	}
+}
+
+func (w *ReconciliationWorker) runOnce() {
+	started := time.Now()
+	processed, found := 0, 0
+
+	lastUserID := 0
+	for {
+		select {
+		case <-w.stop:
+			return
+		default:
+		}
+
+		discrepancies, n, nextUserID, err := w.service.reconcileBatch(lastUserID, w.autoRepair)
+		if err != nil {
+			w.logger.Error().Err(err).Msg("Scheduled reconciliation failed")
+			return
+		}
+		if n == 0 {
+			break
+		}
+
+		// Repaired rows already got a reconcile_repair entry.
+		for _, d := range discrepancies {
+			if d.Repaired {
+				continue
+			}
+			err := writeAuditLog(w.service.db, "balance", d.UserID, "reconcile_discrepancy", map[string]interface{}{
+				"currency":           d.Currency,
+				"stored_balance":     d.StoredBalance,
+				"calculated_balance": d.CalculatedBalance,
+			})
+			if err != nil {
+				w.logger.Error().Err(err).Int("user_id", d.UserID).Msg("Error recording balance discrepancy")
+			}
+		}
+
+		processed += n
+		found += len(discrepancies)
+		lastUserID = nextUserID
+	}
+
+	w.logger.Info().
+		Int("processed", processed).
+		Int("discrepancies", found).
+		Dur("duration", time.Since(started)).
+		Msg("Scheduled reconciliation completed")
+}
@@ -0,0 +1,54 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/rs/zerolog"
+)
+
+func TestReconciliationWorkerRecordsSeededDiscrepancy(t *testing.T) {
+	db, mock := newMockDB(t)
+	worker := NewReconciliationWorker(db, zerolog.Nop(), NewBalanceService(db, zerolog.Nop()), time.Hour, false)
+
+	mock.ExpectQuery(reconcilePageQuery).WithArgs(0, reconciliationBatchSize).
+		WillReturnRows(sqlmock.NewRows([]string{"count", "max"}).AddRow(2, 2))
+	mock.ExpectQuery(reconcileBatchQuery).WithArgs(0, 2, 0, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "currency", "stored", "calculated"}).
+			AddRow(1, "USD", 100.0, 100.0).
+			AddRow(2, "USD", 80.0, 50.0))
+	mock.ExpectExec(repairAuditQuery).
+		WithArgs("balance", 2, "reconcile_discrepancy", `{"calculated_balance":50.00,"currency":"USD","stored_balance":80.00}`).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(reconcilePageQuery).WithArgs(2, reconciliationBatchSize).
+		WillReturnRows(sqlmock.NewRows([]string{"count", "max"}).AddRow(0, 0))
+
+	worker.runOnce()
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReconciliationWorkerStopsBeforeFirstTick(t *testing.T) {
+	db, mock := newMockDB(t)
+	worker := NewReconciliationWorker(db, zerolog.Nop(), NewBalanceService(db, zerolog.Nop()), time.Hour, false)
+
+	worker.Start()
+	stopped := make(chan struct{})
+	go func() {
+		worker.Stop()
+		worker.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Stop did not return")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
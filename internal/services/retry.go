@@ -0,0 +1,46 @@
+package services
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+
+	"go-projects/internal/tracing"
+
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// lockRetryAttempts counts the first try.
+	lockRetryAttempts = 3
+	lockRetryBaseWait = 20 * time.Millisecond
+)
+
+// retryOnLockConflict runs fn again when it fails on a deadlock or lock wait
+// timeout. fn must open and commit its own transaction so that each attempt
+// starts clean. The wait doubles per attempt with full jitter so competing
+// requests do not collide again in lockstep. Each attempt gets its own span,
+// so retried transactions show up in traces.
+func retryOnLockConflict[T any](ctx context.Context, logger zerolog.Logger, operation string, fn func(ctx context.Context) (T, error)) (T, error) {
+	wait := lockRetryBaseWait
+	for attempt := 1; ; attempt++ {
+		attemptCtx, span := tracing.Start(ctx, "db."+operation, attribute.Int("attempt", attempt))
+		result, err := fn(attemptCtx)
+		tracing.End(span, err)
+		if err == nil || !isLockConflictError(err) || attempt >= lockRetryAttempts {
+			return result, err
+		}
+
+		logger.Warn().Err(err).Str("operation", operation).Int("attempt", attempt).Msg("Lock conflict, retrying transaction")
+
+		timer := time.NewTimer(rand.N(wait) + 1)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return result, err
+		case <-timer.C:
+		}
+		wait *= 2
+	}
+}
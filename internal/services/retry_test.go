@@ -0,0 +1,73 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/rs/zerolog"
+)
+
+var errDeadlock = fmt.Errorf("database error: %w", &mysql.MySQLError{Number: mysqlErrDeadlockDetected, Message: "Deadlock found when trying to get lock"})
+
+func TestRetryOnLockConflictSucceedsAfterDeadlock(t *testing.T) {
+	calls := 0
+	result, err := retryOnLockConflict(context.Background(), zerolog.Nop(), "transfer", func(context.Context) (string, error) {
+		calls++
+		if calls < lockRetryAttempts {
+			return "", errDeadlock
+		}
+		return "committed", nil
+	})
+	if err != nil {
+		t.Fatalf("err = %v, want success on attempt %d", err, lockRetryAttempts)
+	}
+	if result != "committed" || calls != lockRetryAttempts {
+		t.Errorf("result = %q after %d calls, want committed after %d", result, calls, lockRetryAttempts)
+	}
+}
+
+func TestRetryOnLockConflictIsBounded(t *testing.T) {
+	lockWait := &mysql.MySQLError{Number: mysqlErrLockWaitTimeout}
+
+	calls := 0
+	_, err := retryOnLockConflict(context.Background(), zerolog.Nop(), "debit", func(context.Context) (int, error) {
+		calls++
+		return 0, lockWait
+	})
+	if !errors.Is(err, lockWait) {
+		t.Errorf("err = %v, want the last lock wait timeout", err)
+	}
+	if calls != lockRetryAttempts {
+		t.Errorf("fn called %d times, want %d", calls, lockRetryAttempts)
+	}
+}
+
+func TestRetryOnLockConflictIgnoresOtherErrors(t *testing.T) {
+	for _, want := range []error{ErrInsufficientBalance, &mysql.MySQLError{Number: mysqlErrDuplicateEntry}} {
+		calls := 0
+		_, err := retryOnLockConflict(context.Background(), zerolog.Nop(), "credit", func(context.Context) (int, error) {
+			calls++
+			return 0, want
+		})
+		if !errors.Is(err, want) || calls != 1 {
+			t.Errorf("got %v after %d calls, want %v after 1", err, calls, want)
+		}
+	}
+}
+
+func TestRetryOnLockConflictStopsWhenContextEnds(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	calls := 0
+	_, err := retryOnLockConflict(ctx, zerolog.Nop(), "transfer", func(context.Context) (int, error) {
+		calls++
+		cancel()
+		return 0, errDeadlock
+	})
+	if !errors.Is(err, errDeadlock) || calls != 1 {
+		t.Errorf("got %v after %d calls, want the deadlock after 1", err, calls)
+	}
+}
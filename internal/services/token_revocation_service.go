@@ -0,0 +1,55 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// TokenRevocationService keeps the IDs of access tokens that were revoked
+// before they expired. Rows are only needed until the token would have
+// expired anyway, so expired ones are purged on each revocation.
+type TokenRevocationService struct {
+	db     *sql.DB
+	logger zerolog.Logger
+}
+
+func NewTokenRevocationService(db *sql.DB, logger zerolog.Logger) *TokenRevocationService {
+	return &TokenRevocationService{
+		db:     db,
+		logger: logger,
+	}
+}
+
+func (s *TokenRevocationService) Revoke(ctx context.Context, jti string, userID int, expiresAt time.Time) error {
+	_, err := s.db.ExecContext(ctx,
+		"INSERT IGNORE INTO revoked_tokens (jti, user_id, expires_at) VALUES (?, ?, ?)",
+		jti, userID, expiresAt,
+	)
+	if err != nil {
+		s.logger.Error().Err(err).Int("user_id", userID).Msg("Error revoking token")
+		return fmt.Errorf("failed to revoke token: %w", err)
+	}
+
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM revoked_tokens WHERE expires_at < ?", time.Now()); err != nil {
+		s.logger.Warn().Err(err).Msg("Failed to purge expired revoked tokens (non-critical)")
+	}
+
+	s.logger.Info().Int("user_id", userID).Str("jti", jti).Msg("Token revoked")
+	return nil
+}
+
+func (s *TokenRevocationService) IsRevoked(ctx context.Context, jti string) (bool, error) {
+	var exists int
+	err := s.db.QueryRowContext(ctx, "SELECT 1 FROM revoked_tokens WHERE jti = ?", jti).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("database error: %w", err)
+	}
+	return true, nil
+}
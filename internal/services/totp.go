@@ -0,0 +1,234 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"go-projects/internal/models"
+)
+
+var (
+	ErrTOTPRequired       = errors.New("a two-factor authentication code is required")
+	ErrInvalidTOTPCode    = errors.New("invalid two-factor authentication code")
+	ErrTOTPNotEnrolled    = errors.New("two-factor authentication has not been enrolled")
+	ErrTOTPAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+)
+
+// RFC 6238 parameters as expected by common authenticator apps. Codes from
+// one step either side of the current one are accepted to allow for clock
+// drift.
+const (
+	totpPeriod = 30 * time.Second
+	totpDigits = 6
+	totpSkew   = 1
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpStep returns the RFC 6238 time step for t.
+func totpStep(t time.Time) int64 {
+	return t.Unix() / int64(totpPeriod/time.Second)
+}
+
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// matchTOTP returns the step code was generated for, or false if it does not
+// match any step within the allowed skew of t.
+func matchTOTP(encodedSecret, code string, t time.Time) (int64, bool) {
+	secret, err := totpEncoding.DecodeString(encodedSecret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := totpStep(t)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// EnrollTOTP creates a new secret for the user. Two-factor authentication is
+// not enforced until a code generated from it is confirmed with ConfirmTOTP.
+func (s *AuthService) EnrollTOTP(ctx context.Context, userID int) (*models.TOTPEnrollment, error) {
+	raw := make([]byte, 20)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, fmt.Errorf("failed to generate totp secret: %w", err)
+	}
+	secret := totpEncoding.EncodeToString(raw)
+
+	var email string
+	var enabled bool
+	err := s.db.QueryRowContext(ctx,
+		"SELECT email, totp_enabled FROM users WHERE id = ? AND deleted_at IS NULL",
+		userID,
+	).Scan(&email, &enabled)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	if enabled {
+		return nil, ErrTOTPAlreadyEnabled
+	}
+
+	_, err = s.db.ExecContext(ctx, "UPDATE users SET totp_secret = ?, totp_last_step = NULL WHERE id = ?", secret, userID)
+	if err != nil {
+		s.logger.Error().Err(err).Int("user_id", userID).Msg("Error storing totp secret")
+		return nil, fmt.Errorf("failed to store totp secret: %w", err)
+	}
+
+	issuer := s.tokens.Issuer
+	if issuer == "" {
+		issuer = "go-projects"
+	}
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(int(totpPeriod/time.Second)))
+
+	otpauthURL := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + email,
+		RawQuery: params.Encode(),
+	}
+
+	s.logger.Info().Int("user_id", userID).Msg("TOTP enrollment started")
+	return &models.TOTPEnrollment{Secret: secret, OTPAuthURL: otpauthURL.String()}, nil
+}
+
+// ConfirmTOTP turns on two-factor authentication once the user proves their
+// authenticator produces valid codes for the enrolled secret.
+func (s *AuthService) ConfirmTOTP(ctx context.Context, userID int, code string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var secret sql.NullString
+	var enabled bool
+	err = tx.QueryRowContext(ctx,
+		"SELECT totp_secret, totp_enabled FROM users WHERE id = ? AND deleted_at IS NULL FOR UPDATE",
+		userID,
+	).Scan(&secret, &enabled)
+	if err == sql.ErrNoRows {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	if enabled {
+		return ErrTOTPAlreadyEnabled
+	}
+	if !secret.Valid {
+		return ErrTOTPNotEnrolled
+	}
+
+	step, ok := matchTOTP(secret.String, code, time.Now())
+	if !ok {
+		return ErrInvalidTOTPCode
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE users SET totp_enabled = TRUE, totp_last_step = ? WHERE id = ?", step, userID)
+	if err != nil {
+		return fmt.Errorf("failed to enable totp: %w", err)
+	}
+
+	if err = writeAuditLog(tx, "user", userID, "totp_enabled", map[string]interface{}{
+		"actor_id": userID,
+	}); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit totp enrollment: %w", err)
+	}
+
+	s.logger.Info().Int("user_id", userID).Msg("TOTP enabled")
+	return nil
+}
+
+// VerifyLoginTOTP checks the second factor after the password has been
+// accepted; users without two-factor authentication pass straight through.
+// Each code is accepted only once, and wrong codes count as failed logins.
+// The failed-login counter is cleared here rather than in Authenticate, so a
+// correct password cannot reset it while codes are being guessed.
+func (s *AuthService) VerifyLoginTOTP(ctx context.Context, user *models.User, code string) error {
+	email := strings.ToLower(strings.TrimSpace(user.Email))
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var secret sql.NullString
+	var enabled bool
+	var lastStep sql.NullInt64
+	err = tx.QueryRowContext(ctx,
+		"SELECT totp_secret, totp_enabled, totp_last_step FROM users WHERE id = ? FOR UPDATE",
+		user.ID,
+	).Scan(&secret, &enabled, &lastStep)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	if !enabled {
+		s.userService.clearFailedLogins(ctx, email)
+		return nil
+	}
+	if code == "" {
+		return ErrTOTPRequired
+	}
+
+	step, ok := matchTOTP(secret.String, code, time.Now())
+	if !ok || (lastStep.Valid && step <= lastStep.Int64) {
+		s.logger.Warn().Int("user_id", user.ID).Msg("Invalid TOTP code")
+		tx.Rollback()
+		s.userService.recordFailedLogin(ctx, email)
+		return ErrInvalidTOTPCode
+	}
+
+	if _, err = tx.ExecContext(ctx, "UPDATE users SET totp_last_step = ? WHERE id = ?", step, user.ID); err != nil {
+		return fmt.Errorf("failed to record totp use: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit totp use: %w", err)
+	}
+
+	s.userService.clearFailedLogins(ctx, email)
+	return nil
+}
@@ -0,0 +1,200 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"go-projects/internal/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// RFC 6238 appendix B, SHA-1 column. The RFC lists 8-digit codes; a 6-digit
+// code is the same value mod 10^6.
+func TestTOTPCodeRFC6238Vectors(t *testing.T) {
+	secret := []byte("12345678901234567890")
+
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{unix: 59, want: "287082"},
+		{unix: 1111111109, want: "081804"},
+		{unix: 1111111111, want: "050471"},
+		{unix: 1234567890, want: "005924"},
+		{unix: 2000000000, want: "279037"},
+		{unix: 20000000000, want: "353130"},
+	}
+
+	for _, tt := range tests {
+		if got := totpCode(secret, totpStep(time.Unix(tt.unix, 0))); got != tt.want {
+			t.Errorf("T=%d: code = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	encoded := totpEncoding.EncodeToString(secret)
+	now := time.Unix(1234567890, 0)
+	code := totpCode(secret, totpStep(now))
+
+	if step, ok := matchTOTP(encoded, code, now); !ok || step != totpStep(now) {
+		t.Errorf("current code: step = %d, ok = %v", step, ok)
+	}
+
+	// One step either side is accepted for clock drift.
+	for _, at := range []time.Time{now.Add(-totpPeriod), now.Add(totpPeriod)} {
+		if _, ok := matchTOTP(encoded, code, at); !ok {
+			t.Errorf("code rejected at %s, within the allowed skew", at.Sub(now))
+		}
+	}
+
+	// Outside the skew the code has expired, or is not yet valid.
+	for _, at := range []time.Time{now.Add(-2 * totpPeriod), now.Add(2 * totpPeriod)} {
+		if _, ok := matchTOTP(encoded, code, at); ok {
+			t.Errorf("code accepted at %s, outside the allowed skew", at.Sub(now))
+		}
+	}
+
+	wrong := "000000"
+	if wrong == code {
+		wrong = "111111"
+	}
+	for _, invalid := range []string{wrong, code[:5], code + "0", ""} {
+		if _, ok := matchTOTP(encoded, invalid, now); ok {
+			t.Errorf("invalid code %q accepted", invalid)
+		}
+	}
+
+	if _, ok := matchTOTP("not base32!", code, now); ok {
+		t.Error("code accepted for an undecodable secret")
+	}
+}
+
+var (
+	totpStateQuery     = regexp.QuoteMeta("SELECT totp_secret, totp_enabled, totp_last_step FROM users WHERE id = ? FOR UPDATE")
+	clearLoginAttempts = regexp.QuoteMeta("DELETE FROM login_attempts WHERE email = ?")
+)
+
+func newTestAuthService(t *testing.T) (*AuthService, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock := newMockDB(t)
+	return mustAuthService(t, db, TokenConfig{Secret: "totp-test-secret", AccessTTL: time.Hour, RefreshTTL: time.Hour}), mock
+}
+
+// TestWrongTOTPCodesLockTheAccount guesses codes with the correct password.
+// The password must not reset the failed-login counter, so the guesses end
+// in a lockout like wrong passwords do.
+func TestWrongTOTPCodesLockTheAccount(t *testing.T) {
+	service, mock := newTestAuthService(t)
+	const email = "alice@example.com"
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	wrong := "000000"
+	if _, ok := matchTOTP(secret, wrong, time.Now()); ok {
+		wrong = "111111"
+	}
+	login := &models.LoginRequest{Email: email, Password: "password123"}
+
+	for attempt := 1; attempt <= maxFailedLogins; attempt++ {
+		if attempt == 1 {
+			mock.ExpectQuery(lockedUntilQuery).WithArgs(email).WillReturnError(sql.ErrNoRows)
+		} else {
+			mock.ExpectQuery(lockedUntilQuery).WithArgs(email).WillReturnRows(sqlmock.NewRows([]string{"locked_until"}).AddRow(nil))
+		}
+		mock.ExpectQuery(regexp.QuoteMeta("FROM users WHERE email = ? AND deleted_at IS NULL")).WithArgs(email).
+			WillReturnRows(loginUserRows(t, "password123"))
+		mock.ExpectBegin()
+		mock.ExpectQuery(totpStateQuery).WithArgs(7).
+			WillReturnRows(sqlmock.NewRows([]string{"totp_secret", "totp_enabled", "totp_last_step"}).AddRow(secret, true, nil))
+		mock.ExpectRollback()
+		expectFailedLogin(mock, email, attempt-1, attempt)
+		if attempt == maxFailedLogins {
+			mock.ExpectExec(auditInsertQuery).WithArgs("user", 0, "login_locked", sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+		}
+
+		user, err := service.userService.Authenticate(context.Background(), login)
+		if err != nil {
+			t.Fatalf("attempt %d: Authenticate: %v", attempt, err)
+		}
+		if err := service.VerifyLoginTOTP(context.Background(), user, wrong); !errors.Is(err, ErrInvalidTOTPCode) {
+			t.Fatalf("attempt %d: err = %v, want ErrInvalidTOTPCode", attempt, err)
+		}
+	}
+
+	// The right password is now refused before a code is even asked for.
+	mock.ExpectQuery(lockedUntilQuery).WithArgs(email).
+		WillReturnRows(sqlmock.NewRows([]string{"locked_until"}).AddRow(time.Now().Add(loginLockoutDuration)))
+	if _, err := service.userService.Authenticate(context.Background(), login); !errors.Is(err, ErrAccountLocked) {
+		t.Fatalf("after %d wrong codes: err = %v, want ErrAccountLocked", maxFailedLogins, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestVerifyLoginTOTPClearsFailedLoginsOnSuccess(t *testing.T) {
+	rawSecret := []byte("12345678901234567890")
+	user := &models.User{ID: 7, Email: "Alice@example.com"}
+
+	t.Run("correct code", func(t *testing.T) {
+		service, mock := newTestAuthService(t)
+		now := time.Now()
+		step := totpStep(now)
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(totpStateQuery).WithArgs(7).
+			WillReturnRows(sqlmock.NewRows([]string{"totp_secret", "totp_enabled", "totp_last_step"}).
+				AddRow(totpEncoding.EncodeToString(rawSecret), true, step-5))
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET totp_last_step = ? WHERE id = ?")).
+			WithArgs(sqlmock.AnyArg(), 7).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+		mock.ExpectExec(clearLoginAttempts).WithArgs("alice@example.com").WillReturnResult(sqlmock.NewResult(0, 1))
+
+		if err := service.VerifyLoginTOTP(context.Background(), user, totpCode(rawSecret, step)); err != nil {
+			t.Fatalf("VerifyLoginTOTP: %v", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("two-factor not enabled", func(t *testing.T) {
+		service, mock := newTestAuthService(t)
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(totpStateQuery).WithArgs(7).
+			WillReturnRows(sqlmock.NewRows([]string{"totp_secret", "totp_enabled", "totp_last_step"}).AddRow(nil, false, nil))
+		mock.ExpectExec(clearLoginAttempts).WithArgs("alice@example.com").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectRollback()
+
+		if err := service.VerifyLoginTOTP(context.Background(), user, ""); err != nil {
+			t.Fatalf("VerifyLoginTOTP: %v", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("missing code", func(t *testing.T) {
+		service, mock := newTestAuthService(t)
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(totpStateQuery).WithArgs(7).
+			WillReturnRows(sqlmock.NewRows([]string{"totp_secret", "totp_enabled", "totp_last_step"}).
+				AddRow(totpEncoding.EncodeToString(rawSecret), true, nil))
+		mock.ExpectRollback()
+
+		if err := service.VerifyLoginTOTP(context.Background(), user, ""); !errors.Is(err, ErrTOTPRequired) {
+			t.Fatalf("err = %v, want ErrTOTPRequired", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+}
@@ -0,0 +1,183 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"go-projects/internal/models"
+	"go-projects/internal/tracing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordSpans installs a tracer provider that keeps finished spans in memory
+// for the rest of the test.
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	provider := tracing.NewProvider(sdktrace.NewSimpleSpanProcessor(exporter), "test")
+
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previous)
+		provider.Shutdown(context.Background())
+	})
+	return exporter
+}
+
+func findSpan(t *testing.T, spans tracetest.SpanStubs, name string) tracetest.SpanStub {
+	t.Helper()
+	for _, span := range spans {
+		if span.Name == name {
+			return span
+		}
+	}
+	t.Fatalf("no %q span among %d recorded", name, len(spans))
+	return tracetest.SpanStub{}
+}
+
+func spanAttribute(span tracetest.SpanStub, key string) attribute.Value {
+	for _, attr := range span.Attributes {
+		if string(attr.Key) == key {
+			return attr.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestMoneyMovementSpans(t *testing.T) {
+	tests := []struct {
+		name      string
+		span      string
+		attempt   string
+		userID    int64
+		wantError bool
+		run       func(*TransactionService, sqlmock.Sqlmock) error
+	}{
+		{
+			name:    "credit",
+			span:    "TransactionService.Credit",
+			attempt: "db.credit",
+			userID:  1,
+			run: func(service *TransactionService, mock sqlmock.Sqlmock) error {
+				mock.ExpectBegin()
+				mock.ExpectExec(regexp.QuoteMeta("INSERT INTO transactions (from_user_id, to_user_id, amount, currency, type, status, reason)")).
+					WillReturnResult(sqlmock.NewResult(7, 1))
+				mock.ExpectExec(statusChangeQuery).WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectQuery(balanceReadQuery).WithArgs(1, "USD").WillReturnRows(balanceRow("25.00", 1))
+				mock.ExpectExec(balanceUpdateQuery).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(historyInsertQuery).WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec(regexp.QuoteMeta("UPDATE transactions SET status = ? WHERE id = ? AND status = ?")).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(statusChangeQuery).WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+				mock.ExpectQuery(transactionByIDQuery).WithArgs(7).WillReturnRows(transactionRow(7, "credit", "completed"))
+
+				_, err := service.Credit(context.Background(), &models.CreditRequest{UserID: 1, Amount: 1000, Currency: "USD", Reason: "top-up"}, nil)
+				return err
+			},
+		},
+		{
+			name:      "declined debit",
+			span:      "TransactionService.Debit",
+			attempt:   "db.debit",
+			userID:    1,
+			wantError: true,
+			run: func(service *TransactionService, mock sqlmock.Sqlmock) error {
+				mock.ExpectBegin()
+				mock.ExpectQuery(accountStatusQuery).WithArgs(1).WillReturnRows(accountStatus("active"))
+				mock.ExpectQuery(balanceByIDQuery).WithArgs(1, "USD").
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "currency", "amount", "overdraft_limit", "version", "last_updated_at"}).AddRow(1, "USD", "5.00", 0, 1, time.Now()))
+				mock.ExpectRollback()
+				expectFailedRecord(mock, 1, nil, 1000, "debit", ErrInsufficientBalance)
+
+				_, err := service.Debit(context.Background(), &models.DebitRequest{UserID: 1, Amount: 1000, Currency: "USD"}, nil)
+				if !errors.Is(err, ErrInsufficientBalance) {
+					t.Errorf("Debit err = %v, want ErrInsufficientBalance", err)
+				}
+				return nil
+			},
+		},
+		{
+			name:    "transfer",
+			span:    "TransactionService.Transfer",
+			attempt: "db.transfer",
+			userID:  2,
+			run: func(service *TransactionService, mock sqlmock.Sqlmock) error {
+				expectTransfer(mock, 2, 1, nil)
+				_, err := service.Transfer(context.Background(), &models.TransferRequest{FromUserID: 2, ToUserID: 1, Amount: 1000, Currency: "USD"}, nil)
+				return err
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exporter := recordSpans(t)
+			service, mock := newTestTransactionService(t)
+
+			if err := tt.run(service, mock); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+
+			spans := exporter.GetSpans()
+			span := findSpan(t, spans, tt.span)
+			if got := spanAttribute(span, "user.id").AsInt64(); got != tt.userID {
+				t.Errorf("user.id = %d, want %d", got, tt.userID)
+			}
+			if got := spanAttribute(span, "currency").AsString(); got != "USD" {
+				t.Errorf("currency = %q, want USD", got)
+			}
+			if failed := span.Status.Code == codes.Error; failed != tt.wantError {
+				t.Errorf("span status = %v, want error = %v", span.Status, tt.wantError)
+			}
+
+			attempt := findSpan(t, spans, tt.attempt)
+			if attempt.Parent.SpanID() != span.SpanContext.SpanID() {
+				t.Errorf("%s is not a child of %s", tt.attempt, tt.span)
+			}
+			if got := spanAttribute(attempt, "attempt").AsInt64(); got != 1 {
+				t.Errorf("attempt = %d, want 1", got)
+			}
+		})
+	}
+}
+
+// TestRetriedAttemptsGetTheirOwnSpans checks that a lock-conflict retry shows
+// up in traces as a second attempt span.
+func TestRetriedAttemptsGetTheirOwnSpans(t *testing.T) {
+	exporter := recordSpans(t)
+
+	calls := 0
+	_, err := retryOnLockConflict(context.Background(), zerolog.Nop(), "transfer", func(context.Context) (int, error) {
+		calls++
+		if calls == 1 {
+			return 0, errDeadlock
+		}
+		return 1, nil
+	})
+	if err != nil {
+		t.Fatalf("retryOnLockConflict: %v", err)
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("recorded %d spans, want one per attempt", len(spans))
+	}
+	if spans[0].Status.Code != codes.Error || spanAttribute(spans[1], "attempt").AsInt64() != 2 {
+		t.Errorf("spans = %+v, want a failed first attempt and a second attempt", spans)
+	}
+}
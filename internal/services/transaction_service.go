@@ -1,47 +1,129 @@
 package services
 
 import (
+	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
+	"go-projects/internal/lifecycle"
+	"go-projects/internal/metrics"
 	"go-projects/internal/models"
+	"go-projects/internal/tracing"
 
 	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
 )
 
+var (
+	ErrIdempotencyConflict      = errors.New("idempotency key was already used with a different request")
+	ErrTransactionLimitExceeded = errors.New("amount exceeds the per-transaction limit")
+	ErrDailyLimitExceeded       = errors.New("amount exceeds the rolling 24-hour limit")
+	ErrShuttingDown             = errors.New("service is shutting down")
+	ErrAlreadyRefunded          = errors.New("transaction has already been refunded")
+	ErrCurrencyMismatch         = errors.New("transfers between different currencies require an exchange rate")
+	ErrInvalidAmount            = errors.New("amount must be greater than zero")
+	ErrInvalidExchangeRate      = errors.New("rate must be greater than zero")
+	ErrSameAccount              = errors.New("cannot transfer to the same account")
+	ErrReceiverNotFound         = errors.New("receiver account does not exist")
+	ErrSameCurrency             = errors.New("cannot exchange a currency into itself")
+	ErrMissingDestination       = errors.New("destination is required")
+	ErrInsufficientBalance      = errors.New("insufficient balance")
+	ErrTransactionNotFound      = errors.New("transaction not found")
+	ErrInvalidTransactionState  = errors.New("invalid transaction state")
+	ErrAccountFrozen            = errors.New("account is frozen")
+	ErrMissingReference         = errors.New("settlement reference is required")
+	ErrInvalidCursor            = errors.New("invalid pagination cursor")
+)
+
+type TransactionLimits struct {
+	MaxAmount  models.Money
+	DailyLimit models.Money
+}
+
 type TransactionService struct {
-	db            *sql.DB
-	logger        zerolog.Logger
-	balanceService *BalanceService
+	db                *sql.DB
+	logger            zerolog.Logger
+	balanceService    *BalanceService
+	idempotencyWindow time.Duration
+	limits            TransactionLimits
+	inFlight          *lifecycle.Tracker
 }
 
-func NewTransactionService(db *sql.DB, logger zerolog.Logger, balanceService *BalanceService) *TransactionService {
+func NewTransactionService(db *sql.DB, logger zerolog.Logger, balanceService *BalanceService, idempotencyWindow time.Duration, limits TransactionLimits, inFlight *lifecycle.Tracker) *TransactionService {
 	return &TransactionService{
-		db:             db,
-		logger:         logger,
-		balanceService: balanceService,
+		db:                db,
+		logger:            logger,
+		balanceService:    balanceService,
+		idempotencyWindow: idempotencyWindow,
+		limits:            limits,
+		inFlight:          inFlight,
+	}
+}
+
+func (s *TransactionService) Credit(ctx context.Context, req *models.CreditRequest, idem *models.IdempotencyKey) (transaction *models.Transaction, err error) {
+	ctx, span := tracing.Start(ctx, "TransactionService.Credit",
+		attribute.Int("user.id", req.UserID),
+		attribute.String("currency", req.Currency),
+	)
+	defer func() { tracing.End(span, err) }()
+
+	done, ok := s.inFlight.Begin()
+	if !ok {
+		return nil, ErrShuttingDown
 	}
+	defer done()
+
+	transaction, err = retryOnLockConflict(ctx, loggerFromContext(ctx, s.logger), "credit", func(ctx context.Context) (*models.Transaction, error) {
+		return s.credit(ctx, req, idem)
+	})
+	metrics.RecordTransaction(string(models.TransactionTypeCredit), err)
+	return transaction, err
 }
 
-func (s *TransactionService) Credit(req *models.CreditRequest) (*models.Transaction, error) {
+func (s *TransactionService) credit(ctx context.Context, req *models.CreditRequest, idem *models.IdempotencyKey) (*models.Transaction, error) {
+	logger := loggerFromContext(ctx, s.logger)
+
 	if req.Amount <= 0 {
-		return nil, errors.New("amount must be greater than zero")
+		return nil, ErrInvalidAmount
+	}
+
+	currency, err := models.NormalizeCurrency(req.Currency)
+	if err != nil {
+		return nil, err
 	}
+	req.Currency = currency
 
-	tx, err := s.db.Begin()
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		s.logger.Error().Err(err).Msg("Error starting transaction")
+		logger.Error().Err(err).Msg("Error starting transaction")
 		return nil, fmt.Errorf("failed to start transaction: %w", err)
 	}
-	defer tx.Rollback()
+	defer s.balanceService.rollbackTx(tx)
 
-	result, err := tx.Exec(
-		"INSERT INTO transactions (from_user_id, to_user_id, amount, type, status) VALUES (?, ?, ?, ?, ?)",
-		nil, req.UserID, req.Amount, string(models.TransactionTypeCredit), string(models.TransactionStatusPending),
+	requestHash, existingID, err := s.checkIdempotencyKey(ctx, tx, idem, models.TransactionTypeCredit, req)
+	if err != nil {
+		return nil, err
+	}
+	if existingID != 0 {
+		tx.Rollback()
+		return s.GetTransactionByID(ctx, existingID)
+	}
+
+	result, err := tx.ExecContext(ctx,
+		"INSERT INTO transactions (from_user_id, to_user_id, amount, currency, type, status, reason) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		nil, req.UserID, req.Amount, req.Currency, string(models.TransactionTypeCredit), string(models.TransactionStatusPending),
+		nullIfEmpty(req.Reason),
 	)
 	if err != nil {
-		s.logger.Error().Err(err).Msg("Error creating credit transaction")
+		logger.Error().Err(err).Msg("Error creating credit transaction")
 		return nil, fmt.Errorf("failed to create transaction: %w", err)
 	}
 
@@ -50,64 +132,123 @@ func (s *TransactionService) Credit(req *models.CreditRequest) (*models.Transact
 		return nil, fmt.Errorf("failed to get transaction ID: %w", err)
 	}
 
-	err = s.balanceService.updateBalanceInTx(tx, req.UserID, req.Amount)
+	if err = recordStatusChange(ctx, tx, transactionID, "", models.TransactionStatusPending); err != nil {
+		return nil, err
+	}
+
+	err = s.balanceService.updateBalanceInTx(ctx, tx, req.UserID, req.Currency, req.Amount, &transactionID)
 	if err != nil {
-		s.logger.Error().Err(err).Int("user_id", req.UserID).Msg("Error updating balance for credit")
+		logger.Error().Err(err).Int("user_id", req.UserID).Msg("Error updating balance for credit")
 		return nil, fmt.Errorf("failed to update balance: %w", err)
 	}
 
-	_, err = tx.Exec("UPDATE transactions SET status = ? WHERE id = ?", string(models.TransactionStatusCompleted), transactionID)
+	err = setTransactionStatus(ctx, tx, transactionID, models.TransactionStatusPending, models.TransactionStatusCompleted)
 	if err != nil {
-		s.logger.Error().Err(err).Msg("Error updating transaction status")
-		return nil, fmt.Errorf("failed to update transaction status: %w", err)
+		logger.Error().Err(err).Msg("Error updating transaction status")
+		return nil, err
 	}
 
-	if err = tx.Commit(); err != nil {
-		s.logger.Error().Err(err).Msg("Error committing credit transaction")
+	if err = s.saveIdempotencyKey(ctx, tx, idem, requestHash, transactionID); err != nil {
+		return nil, err
+	}
+
+	if err = s.balanceService.commitTx(tx); err != nil {
+		logger.Error().Err(err).Msg("Error committing credit transaction")
 		return nil, fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
-	transaction, err := s.GetTransactionByID(int(transactionID))
+	transaction, err := s.GetTransactionByID(ctx, int(transactionID))
 	if err != nil {
 		return nil, err
 	}
 
-	s.logger.Info().
+	logger.Info().
 		Int("transaction_id", transaction.ID).
 		Int("user_id", req.UserID).
-		Float64("amount", req.Amount).
+		Stringer("amount", req.Amount).
+		Str("currency", req.Currency).
 		Msg("Credit transaction completed")
 
 	return transaction, nil
 }
 
-func (s *TransactionService) Debit(req *models.DebitRequest) (*models.Transaction, error) {
+// Settle credits a merchant's own account with funds settled outside the
+// system. The reference identifies the external payout and is unique per
+// merchant: settling it again returns the original transaction, and reusing
+// it for a different amount or currency is an idempotency conflict.
+func (s *TransactionService) Settle(ctx context.Context, merchantID int, req *models.SettlementRequest) (*models.Transaction, error) {
+	done, ok := s.inFlight.Begin()
+	if !ok {
+		return nil, ErrShuttingDown
+	}
+	defer done()
+
+	transaction, err := retryOnLockConflict(ctx, loggerFromContext(ctx, s.logger), "settle", func(ctx context.Context) (*models.Transaction, error) {
+		return s.settle(ctx, merchantID, req)
+	})
+	metrics.RecordTransaction(string(models.TransactionTypeCredit), err)
+	return transaction, err
+}
+
+func (s *TransactionService) settle(ctx context.Context, merchantID int, req *models.SettlementRequest) (*models.Transaction, error) {
+	logger := loggerFromContext(ctx, s.logger)
+
 	if req.Amount <= 0 {
-		return nil, errors.New("amount must be greater than zero")
+		return nil, ErrInvalidAmount
 	}
 
-	balance, err := s.balanceService.GetBalance(req.UserID)
-	if err != nil {
-		return nil, fmt.Errorf("failed to check balance: %w", err)
+	reference := strings.TrimSpace(req.Reference)
+	if reference == "" {
+		return nil, ErrMissingReference
 	}
 
-	if balance.Amount < req.Amount {
-		return nil, errors.New("insufficient balance")
+	currency, err := models.NormalizeCurrency(req.Currency)
+	if err != nil {
+		return nil, err
 	}
+	req.Currency = currency
 
-	tx, err := s.db.Begin()
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		s.logger.Error().Err(err).Msg("Error starting transaction")
+		logger.Error().Err(err).Msg("Error starting transaction")
 		return nil, fmt.Errorf("failed to start transaction: %w", err)
 	}
-	defer tx.Rollback()
+	defer s.balanceService.rollbackTx(tx)
+
+	// Locking the merchant's row serialises its settlements, so two requests
+	// with the same reference cannot both miss the lookup below.
+	var lockedID int
+	err = tx.QueryRowContext(ctx, "SELECT id FROM users WHERE id = ? AND deleted_at IS NULL FOR UPDATE", merchantID).Scan(&lockedID)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		logger.Error().Err(err).Int("user_id", merchantID).Msg("Error locking merchant for settlement")
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	existing, err := scanTransaction(tx.QueryRowContext(ctx,
+		"SELECT "+transactionColumns+" FROM transactions WHERE to_user_id = ? AND type = ? AND external_reference = ?",
+		merchantID, string(models.TransactionTypeCredit), reference,
+	))
+	if err == nil {
+		if existing.Amount != req.Amount || existing.Currency != req.Currency {
+			return nil, ErrIdempotencyConflict
+		}
+		logger.Info().Int("transaction_id", existing.ID).Str("reference", reference).Msg("Settlement already recorded")
+		return existing, nil
+	}
+	if err != sql.ErrNoRows {
+		logger.Error().Err(err).Str("reference", reference).Msg("Error looking up settlement reference")
+		return nil, fmt.Errorf("database error: %w", err)
+	}
 
-	result, err := tx.Exec(
-		"INSERT INTO transactions (from_user_id, to_user_id, amount, type, status) VALUES (?, ?, ?, ?, ?)",
-		req.UserID, nil, req.Amount, string(models.TransactionTypeDebit), string(models.TransactionStatusPending),
+	result, err := tx.ExecContext(ctx,
+		"INSERT INTO transactions (from_user_id, to_user_id, amount, currency, type, status, external_reference) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		nil, merchantID, req.Amount, req.Currency, string(models.TransactionTypeCredit), string(models.TransactionStatusPending), reference,
 	)
 	if err != nil {
-		s.logger.Error().Err(err).Msg("Error creating debit transaction")
+		logger.Error().Err(err).Msg("Error creating settlement transaction")
 		return nil, fmt.Errorf("failed to create transaction: %w", err)
 	}
 
@@ -116,68 +257,129 @@ func (s *TransactionService) Debit(req *models.DebitRequest) (*models.Transactio
 		return nil, fmt.Errorf("failed to get transaction ID: %w", err)
 	}
 
-	err = s.balanceService.updateBalanceInTx(tx, req.UserID, -req.Amount)
+	if err = recordStatusChange(ctx, tx, transactionID, "", models.TransactionStatusPending); err != nil {
+		return nil, err
+	}
+
+	err = s.balanceService.updateBalanceInTx(ctx, tx, merchantID, req.Currency, req.Amount, &transactionID)
 	if err != nil {
-		s.logger.Error().Err(err).Int("user_id", req.UserID).Msg("Error updating balance for debit")
+		logger.Error().Err(err).Int("user_id", merchantID).Msg("Error updating balance for settlement")
 		return nil, fmt.Errorf("failed to update balance: %w", err)
 	}
 
-	_, err = tx.Exec("UPDATE transactions SET status = ? WHERE id = ?", string(models.TransactionStatusCompleted), transactionID)
+	err = setTransactionStatus(ctx, tx, transactionID, models.TransactionStatusPending, models.TransactionStatusCompleted)
 	if err != nil {
-		s.logger.Error().Err(err).Msg("Error updating transaction status")
-		return nil, fmt.Errorf("failed to update transaction status: %w", err)
+		logger.Error().Err(err).Msg("Error updating transaction status")
+		return nil, err
 	}
 
-	if err = tx.Commit(); err != nil {
-		s.logger.Error().Err(err).Msg("Error committing debit transaction")
+	err = writeAuditLog(tx, "transaction", int(transactionID), "settled", map[string]interface{}{
+		"actor_id":  merchantID,
+		"amount":    req.Amount,
+		"currency":  req.Currency,
+		"reference": reference,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err = s.balanceService.commitTx(tx); err != nil {
+		logger.Error().Err(err).Msg("Error committing settlement transaction")
 		return nil, fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
-	transaction, err := s.GetTransactionByID(int(transactionID))
+	transaction, err := s.GetTransactionByID(ctx, int(transactionID))
 	if err != nil {
 		return nil, err
 	}
 
-	s.logger.Info().
+	logger.Info().
 		Int("transaction_id", transaction.ID).
-		Int("user_id", req.UserID).
-		Float64("amount", req.Amount).
-		Msg("Debit transaction completed")
+		Int("user_id", merchantID).
+		Stringer("amount", req.Amount).
+		Str("currency", req.Currency).
+		Str("reference", reference).
+		Msg("Settlement completed")
 
 	return transaction, nil
 }
 
-func (s *TransactionService) Transfer(req *models.TransferRequest) (*models.Transaction, error) {
+func (s *TransactionService) Debit(ctx context.Context, req *models.DebitRequest, idem *models.IdempotencyKey) (transaction *models.Transaction, err error) {
+	ctx, span := tracing.Start(ctx, "TransactionService.Debit",
+		attribute.Int("user.id", req.UserID),
+		attribute.String("currency", req.Currency),
+	)
+	defer func() { tracing.End(span, err) }()
+
+	done, ok := s.inFlight.Begin()
+	if !ok {
+		return nil, ErrShuttingDown
+	}
+	defer done()
+
+	transaction, err = retryOnLockConflict(ctx, loggerFromContext(ctx, s.logger), "debit", func(ctx context.Context) (*models.Transaction, error) {
+		return s.debit(ctx, req, idem)
+	})
+	if isDecline(err) {
+		s.recordFailedTransaction(ctx, req.UserID, nil, req.Amount, req.Currency, models.TransactionTypeDebit, err)
+	}
+	metrics.RecordTransaction(string(models.TransactionTypeDebit), err)
+	return transaction, err
+}
+
+func (s *TransactionService) debit(ctx context.Context, req *models.DebitRequest, idem *models.IdempotencyKey) (*models.Transaction, error) {
+	logger := loggerFromContext(ctx, s.logger)
+
 	if req.Amount <= 0 {
-		return nil, errors.New("amount must be greater than zero")
+		return nil, ErrInvalidAmount
 	}
 
-	if req.FromUserID == req.ToUserID {
-		return nil, errors.New("cannot transfer to the same account")
+	currency, err := models.NormalizeCurrency(req.Currency)
+	if err != nil {
+		return nil, err
 	}
+	req.Currency = currency
 
-	balance, err := s.balanceService.GetBalance(req.FromUserID)
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to check balance: %w", err)
+		logger.Error().Err(err).Msg("Error starting transaction")
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer s.balanceService.rollbackTx(tx)
+
+	requestHash, existingID, err := s.checkIdempotencyKey(ctx, tx, idem, models.TransactionTypeDebit, req)
+	if err != nil {
+		return nil, err
+	}
+	if existingID != 0 {
+		tx.Rollback()
+		return s.GetTransactionByID(ctx, existingID)
+	}
+
+	if err = checkAccountActive(ctx, tx, req.UserID); err != nil {
+		return nil, err
 	}
 
-	if balance.Amount < req.Amount {
-		return nil, errors.New("insufficient balance")
+	if err = s.checkLimits(ctx, tx, req.UserID, req.Currency, req.Amount); err != nil {
+		return nil, err
 	}
 
-	tx, err := s.db.Begin()
+	balance, err := s.balanceService.GetBalance(ctx, req.UserID, req.Currency)
 	if err != nil {
-		s.logger.Error().Err(err).Msg("Error starting transfer transaction")
-		return nil, fmt.Errorf("failed to start transaction: %w", err)
+		return nil, fmt.Errorf("failed to check balance: %w", err)
 	}
-	defer tx.Rollback()
 
-	result, err := tx.Exec(
-		"INSERT INTO transactions (from_user_id, to_user_id, amount, type, status) VALUES (?, ?, ?, ?, ?)",
-		req.FromUserID, req.ToUserID, req.Amount, string(models.TransactionTypeTransfer), string(models.TransactionStatusPending),
+	if balance.Available() < req.Amount {
+		return nil, ErrInsufficientBalance
+	}
+
+	result, err := tx.ExecContext(ctx,
+		"INSERT INTO transactions (from_user_id, to_user_id, amount, currency, type, status, reason) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		req.UserID, nil, req.Amount, req.Currency, string(models.TransactionTypeDebit), string(models.TransactionStatusPending),
+		nullIfEmpty(req.Reason),
 	)
 	if err != nil {
-		s.logger.Error().Err(err).Msg("Error creating transfer transaction")
+		logger.Error().Err(err).Msg("Error creating debit transaction")
 		return nil, fmt.Errorf("failed to create transaction: %w", err)
 	}
 
@@ -186,187 +388,1508 @@ func (s *TransactionService) Transfer(req *models.TransferRequest) (*models.Tran
 		return nil, fmt.Errorf("failed to get transaction ID: %w", err)
 	}
 
-	err = s.balanceService.updateBalanceInTx(tx, req.FromUserID, -req.Amount)
-	if err != nil {
-		s.logger.Error().Err(err).Int("from_user_id", req.FromUserID).Msg("Error debiting from sender")
-		return nil, fmt.Errorf("failed to debit from sender: %w", err)
+	if err = recordStatusChange(ctx, tx, transactionID, "", models.TransactionStatusPending); err != nil {
+		return nil, err
 	}
 
-	err = s.balanceService.updateBalanceInTx(tx, req.ToUserID, req.Amount)
+	err = s.balanceService.updateBalanceInTx(ctx, tx, req.UserID, req.Currency, -req.Amount, &transactionID)
 	if err != nil {
-		s.logger.Error().Err(err).Int("to_user_id", req.ToUserID).Msg("Error crediting to receiver")
-		return nil, fmt.Errorf("failed to credit to receiver: %w", err)
+		logger.Error().Err(err).Int("user_id", req.UserID).Msg("Error updating balance for debit")
+		return nil, fmt.Errorf("failed to update balance: %w", err)
 	}
 
-	_, err = tx.Exec("UPDATE transactions SET status = ? WHERE id = ?", string(models.TransactionStatusCompleted), transactionID)
+	err = setTransactionStatus(ctx, tx, transactionID, models.TransactionStatusPending, models.TransactionStatusCompleted)
 	if err != nil {
-		s.logger.Error().Err(err).Msg("Error updating transaction status")
-		return nil, fmt.Errorf("failed to update transaction status: %w", err)
+		logger.Error().Err(err).Msg("Error updating transaction status")
+		return nil, err
 	}
 
-	if err = tx.Commit(); err != nil {
-		s.logger.Error().Err(err).Msg("Error committing transfer transaction")
+	if err = s.saveIdempotencyKey(ctx, tx, idem, requestHash, transactionID); err != nil {
+		return nil, err
+	}
+
+	if err = s.balanceService.commitTx(tx); err != nil {
+		logger.Error().Err(err).Msg("Error committing debit transaction")
 		return nil, fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
-	transaction, err := s.GetTransactionByID(int(transactionID))
+	transaction, err := s.GetTransactionByID(ctx, int(transactionID))
 	if err != nil {
 		return nil, err
 	}
 
-	s.logger.Info().
+	logger.Info().
 		Int("transaction_id", transaction.ID).
-		Int("from_user_id", req.FromUserID).
-		Int("to_user_id", req.ToUserID).
-		Float64("amount", req.Amount).
-		Msg("Transfer transaction completed")
+		Int("user_id", req.UserID).
+		Stringer("amount", req.Amount).
+		Str("currency", req.Currency).
+		Msg("Debit transaction completed")
 
 	return transaction, nil
 }
 
-func (s *TransactionService) RollbackTransaction(transactionID int) error {
-	transaction, err := s.GetTransactionByID(transactionID)
-	if err != nil {
-		return err
+func (s *TransactionService) Withdraw(ctx context.Context, req *models.WithdrawRequest, idem *models.IdempotencyKey) (*models.Transaction, error) {
+	done, ok := s.inFlight.Begin()
+	if !ok {
+		return nil, ErrShuttingDown
 	}
+	defer done()
 
-	if transaction.Status == string(models.TransactionStatusRolledBack) {
-		return errors.New("transaction already rolled back")
+	transaction, err := retryOnLockConflict(ctx, loggerFromContext(ctx, s.logger), "withdrawal", func(ctx context.Context) (*models.Transaction, error) {
+		return s.withdraw(ctx, req, idem)
+	})
+	if isDecline(err) {
+		s.recordFailedTransaction(ctx, req.UserID, nil, req.Amount, req.Currency, models.TransactionTypeWithdrawal, err)
 	}
+	metrics.RecordTransaction(string(models.TransactionTypeWithdrawal), err)
+	return transaction, err
+}
 
-	if transaction.Status != string(models.TransactionStatusCompleted) {
-		return errors.New("only completed transactions can be rolled back")
+func (s *TransactionService) withdraw(ctx context.Context, req *models.WithdrawRequest, idem *models.IdempotencyKey) (*models.Transaction, error) {
+	logger := loggerFromContext(ctx, s.logger)
+
+	if req.Amount <= 0 {
+		return nil, ErrInvalidAmount
 	}
 
-	tx, err := s.db.Begin()
+	currency, err := models.NormalizeCurrency(req.Currency)
 	if err != nil {
-		s.logger.Error().Err(err).Msg("Error starting rollback transaction")
-		return fmt.Errorf("failed to start transaction: %w", err)
+		return nil, err
 	}
-	defer tx.Rollback()
+	req.Currency = currency
 
-	switch transaction.Type {
-	case string(models.TransactionTypeCredit):
-		if transaction.ToUserID != nil {
-			err = s.balanceService.updateBalanceInTx(tx, *transaction.ToUserID, -transaction.Amount)
-			if err != nil {
-				return fmt.Errorf("failed to reverse credit: %w", err)
-			}
-		}
+	if req.Destination == "" {
+		return nil, ErrMissingDestination
+	}
 
-	case string(models.TransactionTypeDebit):
-		if transaction.FromUserID != nil {
-			err = s.balanceService.updateBalanceInTx(tx, *transaction.FromUserID, transaction.Amount)
-			if err != nil {
-				return fmt.Errorf("failed to reverse debit: %w", err)
-			}
-		}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.Error().Err(err).Msg("Error starting transaction")
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer s.balanceService.rollbackTx(tx)
 
-	case string(models.TransactionTypeTransfer):
-		if transaction.FromUserID != nil && transaction.ToUserID != nil {
-			err = s.balanceService.updateBalanceInTx(tx, *transaction.FromUserID, transaction.Amount)
-			if err != nil {
-				return fmt.Errorf("failed to reverse transfer (sender): %w", err)
-			}
+	requestHash, existingID, err := s.checkIdempotencyKey(ctx, tx, idem, models.TransactionTypeWithdrawal, req)
+	if err != nil {
+		return nil, err
+	}
+	if existingID != 0 {
+		tx.Rollback()
+		return s.GetTransactionByID(ctx, existingID)
+	}
 
-			err = s.balanceService.updateBalanceInTx(tx, *transaction.ToUserID, -transaction.Amount)
-			if err != nil {
-				return fmt.Errorf("failed to reverse transfer (receiver): %w", err)
-			}
-		}
+	if err = checkAccountActive(ctx, tx, req.UserID); err != nil {
+		return nil, err
+	}
 
-	default:
-		return errors.New("unknown transaction type")
+	if err = s.checkLimits(ctx, tx, req.UserID, req.Currency, req.Amount); err != nil {
+		return nil, err
 	}
 
-	_, err = tx.Exec("UPDATE transactions SET status = ? WHERE id = ?", string(models.TransactionStatusRolledBack), transactionID)
+	balance, err := s.balanceService.GetBalance(ctx, req.UserID, req.Currency)
 	if err != nil {
-		s.logger.Error().Err(err).Msg("Error updating transaction status to rolled_back")
-		return fmt.Errorf("failed to update transaction status: %w", err)
+		return nil, fmt.Errorf("failed to check balance: %w", err)
 	}
 
-	if err = tx.Commit(); err != nil {
-		s.logger.Error().Err(err).Msg("Error committing rollback transaction")
-		return fmt.Errorf("failed to commit rollback: %w", err)
+	if balance.Available() < req.Amount {
+		return nil, ErrInsufficientBalance
 	}
 
-	s.logger.Info().Int("transaction_id", transactionID).Msg("Transaction rolled back successfully")
-	return nil
-}
+	result, err := tx.ExecContext(ctx,
+		"INSERT INTO transactions (from_user_id, to_user_id, amount, currency, type, status, external_reference) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		req.UserID, nil, req.Amount, req.Currency, string(models.TransactionTypeWithdrawal), string(models.TransactionStatusPending), req.Destination,
+	)
+	if err != nil {
+		logger.Error().Err(err).Msg("Error creating withdrawal transaction")
+		return nil, fmt.Errorf("failed to create transaction: %w", err)
+	}
 
-func (s *TransactionService) GetTransactionByID(transactionID int) (*models.Transaction, error) {
-	var transaction models.Transaction
-	var fromUserID, toUserID sql.NullInt64
+	transactionID, err := result.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transaction ID: %w", err)
+	}
 
-	err := s.db.QueryRow(
-		"SELECT id, from_user_id, to_user_id, amount, type, status, created_at FROM transactions WHERE id = ?",
-		transactionID,
-	).Scan(
-		&transaction.ID, &fromUserID, &toUserID, &transaction.Amount,
-		&transaction.Type, &transaction.Status, &transaction.CreatedAt,
-	)
+	if err = recordStatusChange(ctx, tx, transactionID, "", models.TransactionStatusPending); err != nil {
+		return nil, err
+	}
 
-	if err == sql.ErrNoRows {
-		return nil, errors.New("transaction not found")
+	err = s.balanceService.updateBalanceInTx(ctx, tx, req.UserID, req.Currency, -req.Amount, &transactionID)
+	if err != nil {
+		logger.Error().Err(err).Int("user_id", req.UserID).Msg("Error updating balance for withdrawal")
+		return nil, fmt.Errorf("failed to update balance: %w", err)
 	}
+
+	err = setTransactionStatus(ctx, tx, transactionID, models.TransactionStatusPending, models.TransactionStatusCompleted)
 	if err != nil {
-		s.logger.Error().Err(err).Int("transaction_id", transactionID).Msg("Error fetching transaction")
-		return nil, fmt.Errorf("database error: %w", err)
+		logger.Error().Err(err).Msg("Error updating transaction status")
+		return nil, err
 	}
 
-	if fromUserID.Valid {
-		val := int(fromUserID.Int64)
-		transaction.FromUserID = &val
+	if err = s.saveIdempotencyKey(ctx, tx, idem, requestHash, transactionID); err != nil {
+		return nil, err
 	}
-	if toUserID.Valid {
-		val := int(toUserID.Int64)
-		transaction.ToUserID = &val
+
+	if err = s.balanceService.commitTx(tx); err != nil {
+		logger.Error().Err(err).Msg("Error committing withdrawal transaction")
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
-	return &transaction, nil
+	transaction, err := s.GetTransactionByID(ctx, int(transactionID))
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info().
+		Int("transaction_id", transaction.ID).
+		Int("user_id", req.UserID).
+		Stringer("amount", req.Amount).
+		Str("currency", req.Currency).
+		Str("destination", req.Destination).
+		Msg("Withdrawal transaction completed")
+
+	return transaction, nil
 }
 
-func (s *TransactionService) GetUserTransactions(userID int, limit, offset int) ([]*models.Transaction, error) {
-	query := `
-		SELECT id, from_user_id, to_user_id, amount, type, status, created_at 
-		FROM transactions 
-		WHERE from_user_id = ? OR to_user_id = ?
-		ORDER BY created_at DESC
-		LIMIT ? OFFSET ?
-	`
+func (s *TransactionService) Transfer(ctx context.Context, req *models.TransferRequest, idem *models.IdempotencyKey) (transaction *models.Transaction, err error) {
+	ctx, span := tracing.Start(ctx, "TransactionService.Transfer",
+		attribute.Int("user.id", req.FromUserID),
+		attribute.String("currency", req.Currency),
+	)
+	defer func() { tracing.End(span, err) }()
 
-	rows, err := s.db.Query(query, userID, userID, limit, offset)
-	if err != nil {
-		s.logger.Error().Err(err).Int("user_id", userID).Msg("Error fetching user transactions")
-		return nil, fmt.Errorf("database error: %w", err)
+	done, ok := s.inFlight.Begin()
+	if !ok {
+		return nil, ErrShuttingDown
 	}
-	defer rows.Close()
+	defer done()
 
-	var transactions []*models.Transaction
-	for rows.Next() {
-		var transaction models.Transaction
-		var fromUserID, toUserID sql.NullInt64
+	transaction, err = retryOnLockConflict(ctx, loggerFromContext(ctx, s.logger), "transfer", func(ctx context.Context) (*models.Transaction, error) {
+		return s.transfer(ctx, req, idem)
+	})
+	if isDecline(err) {
+		s.recordFailedTransaction(ctx, req.FromUserID, &req.ToUserID, req.Amount, req.Currency, models.TransactionTypeTransfer, err)
+	}
+	metrics.RecordTransaction(string(models.TransactionTypeTransfer), err)
+	return transaction, err
+}
 
-		err := rows.Scan(
-			&transaction.ID, &fromUserID, &toUserID, &transaction.Amount,
-			&transaction.Type, &transaction.Status, &transaction.CreatedAt,
-		)
-		if err != nil {
-			return nil, fmt.Errorf("error scanning transaction: %w", err)
-		}
+func (s *TransactionService) transfer(ctx context.Context, req *models.TransferRequest, idem *models.IdempotencyKey) (*models.Transaction, error) {
+	logger := loggerFromContext(ctx, s.logger)
+
+	if req.Amount <= 0 {
+		return nil, ErrInvalidAmount
+	}
 
-		if fromUserID.Valid {
-			val := int(fromUserID.Int64)
-			transaction.FromUserID = &val
+	if req.FromUserID == req.ToUserID {
+		return nil, ErrSameAccount
+	}
+
+	currency, err := models.NormalizeCurrency(req.Currency)
+	if err != nil {
+		return nil, err
+	}
+	toCurrency := currency
+	if req.ToCurrency != "" {
+		if toCurrency, err = models.NormalizeCurrency(req.ToCurrency); err != nil {
+			return nil, err
+		}
+	}
+	req.Currency, req.ToCurrency = currency, toCurrency
+
+	// Same-currency transfers leave the to_* columns NULL and credit the
+	// receiver the sent amount.
+	toAmount := req.Amount
+	var toCurrencyCol, toAmountCol, exchangeRateCol interface{}
+	if toCurrency != currency {
+		if req.ExchangeRate <= 0 {
+			return nil, ErrCurrencyMismatch
 		}
-		if toUserID.Valid {
-			val := int(toUserID.Int64)
-			transaction.ToUserID = &val
+		toAmount = req.Amount.Convert(req.ExchangeRate)
+		if toAmount <= 0 {
+			return nil, fmt.Errorf("%w: converted amount rounds to zero", ErrInvalidAmount)
 		}
+		toCurrencyCol, toAmountCol, exchangeRateCol = toCurrency, toAmount, req.ExchangeRate
+	}
 
-		transactions = append(transactions, &transaction)
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.Error().Err(err).Msg("Error starting transfer transaction")
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
 	}
+	defer s.balanceService.rollbackTx(tx)
 
-	return transactions, nil
-}
+	requestHash, existingID, err := s.checkIdempotencyKey(ctx, tx, idem, models.TransactionTypeTransfer, req)
+	if err != nil {
+		return nil, err
+	}
+	if existingID != 0 {
+		tx.Rollback()
+		return s.GetTransactionByID(ctx, existingID)
+	}
+
+	if err = checkAccountActive(ctx, tx, req.FromUserID); err != nil {
+		return nil, err
+	}
+
+	if err = checkReceiverExists(ctx, tx, req.ToUserID); err != nil {
+		return nil, err
+	}
+
+	if err = s.checkLimits(ctx, tx, req.FromUserID, req.Currency, req.Amount); err != nil {
+		return nil, err
+	}
+
+	balance, err := s.balanceService.GetBalance(ctx, req.FromUserID, req.Currency)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check balance: %w", err)
+	}
+
+	if balance.Available() < req.Amount {
+		return nil, ErrInsufficientBalance
+	}
 
+	result, err := tx.ExecContext(ctx,
+		"INSERT INTO transactions (from_user_id, to_user_id, amount, currency, to_currency, to_amount, exchange_rate, type, status, memo) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		req.FromUserID, req.ToUserID, req.Amount, req.Currency, toCurrencyCol, toAmountCol, exchangeRateCol,
+		string(models.TransactionTypeTransfer), string(models.TransactionStatusPending), nullIfEmpty(req.Memo),
+	)
+	if err != nil {
+		logger.Error().Err(err).Msg("Error creating transfer transaction")
+		return nil, fmt.Errorf("failed to create transaction: %w", err)
+	}
+
+	transactionID, err := result.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transaction ID: %w", err)
+	}
+
+	if err = recordStatusChange(ctx, tx, transactionID, "", models.TransactionStatusPending); err != nil {
+		return nil, err
+	}
+
+	// Balance rows are always locked lower user_id first, so two opposing
+	// transfers queue on the same row instead of deadlocking.
+	debitSender := func() error {
+		err := s.balanceService.updateBalanceInTx(ctx, tx, req.FromUserID, req.Currency, -req.Amount, &transactionID)
+		if err != nil {
+			logger.Error().Err(err).Int("from_user_id", req.FromUserID).Msg("Error debiting from sender")
+			return fmt.Errorf("failed to debit from sender: %w", err)
+		}
+		return nil
+	}
+	creditReceiver := func() error {
+		err := s.balanceService.updateBalanceInTx(ctx, tx, req.ToUserID, toCurrency, toAmount, &transactionID)
+		if err != nil {
+			logger.Error().Err(err).Int("to_user_id", req.ToUserID).Msg("Error crediting to receiver")
+			return fmt.Errorf("failed to credit to receiver: %w", err)
+		}
+		return nil
+	}
+	legs := []func() error{debitSender, creditReceiver}
+	if req.ToUserID < req.FromUserID {
+		legs[0], legs[1] = creditReceiver, debitSender
+	}
+	for _, apply := range legs {
+		if err = apply(); err != nil {
+			return nil, err
+		}
+	}
+
+	err = setTransactionStatus(ctx, tx, transactionID, models.TransactionStatusPending, models.TransactionStatusCompleted)
+	if err != nil {
+		logger.Error().Err(err).Msg("Error updating transaction status")
+		return nil, err
+	}
+
+	if err = s.saveIdempotencyKey(ctx, tx, idem, requestHash, transactionID); err != nil {
+		return nil, err
+	}
+
+	if err = s.balanceService.commitTx(tx); err != nil {
+		logger.Error().Err(err).Msg("Error committing transfer transaction")
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	transaction, err := s.GetTransactionByID(ctx, int(transactionID))
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info().
+		Int("transaction_id", transaction.ID).
+		Int("from_user_id", req.FromUserID).
+		Int("to_user_id", req.ToUserID).
+		Stringer("amount", req.Amount).
+		Str("currency", req.Currency).
+		Str("to_currency", toCurrency).
+		Msg("Transfer transaction completed")
+
+	return transaction, nil
+}
+
+func (s *TransactionService) Exchange(ctx context.Context, req *models.ExchangeRequest, idem *models.IdempotencyKey) (*models.Transaction, error) {
+	done, ok := s.inFlight.Begin()
+	if !ok {
+		return nil, ErrShuttingDown
+	}
+	defer done()
+
+	transaction, err := retryOnLockConflict(ctx, loggerFromContext(ctx, s.logger), "exchange", func(ctx context.Context) (*models.Transaction, error) {
+		return s.exchange(ctx, req, idem)
+	})
+	if isDecline(err) {
+		s.recordFailedTransaction(ctx, req.UserID, &req.UserID, req.Amount, req.FromCurrency, models.TransactionTypeExchange, err)
+	}
+	metrics.RecordTransaction(string(models.TransactionTypeExchange), err)
+	return transaction, err
+}
+
+// exchange converts between two of the user's own currency balances. Both
+// legs and their history rows are written in one DB transaction, so a failed
+// credit leg leaves the source balance untouched.
+func (s *TransactionService) exchange(ctx context.Context, req *models.ExchangeRequest, idem *models.IdempotencyKey) (*models.Transaction, error) {
+	logger := loggerFromContext(ctx, s.logger)
+
+	if req.Amount <= 0 {
+		return nil, ErrInvalidAmount
+	}
+
+	if req.Rate <= 0 {
+		return nil, ErrInvalidExchangeRate
+	}
+
+	fromCurrency, err := models.NormalizeCurrency(req.FromCurrency)
+	if err != nil {
+		return nil, err
+	}
+	toCurrency, err := models.NormalizeCurrency(req.ToCurrency)
+	if err != nil {
+		return nil, err
+	}
+	if fromCurrency == toCurrency {
+		return nil, ErrSameCurrency
+	}
+	req.FromCurrency, req.ToCurrency = fromCurrency, toCurrency
+
+	toAmount := req.Amount.Convert(req.Rate)
+	if toAmount <= 0 {
+		return nil, fmt.Errorf("%w: converted amount rounds to zero", ErrInvalidAmount)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.Error().Err(err).Msg("Error starting exchange transaction")
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer s.balanceService.rollbackTx(tx)
+
+	requestHash, existingID, err := s.checkIdempotencyKey(ctx, tx, idem, models.TransactionTypeExchange, req)
+	if err != nil {
+		return nil, err
+	}
+	if existingID != 0 {
+		tx.Rollback()
+		return s.GetTransactionByID(ctx, existingID)
+	}
+
+	if err = checkAccountActive(ctx, tx, req.UserID); err != nil {
+		return nil, err
+	}
+
+	if err = s.checkLimits(ctx, tx, req.UserID, fromCurrency, req.Amount); err != nil {
+		return nil, err
+	}
+
+	balance, err := s.balanceService.GetBalance(ctx, req.UserID, fromCurrency)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check balance: %w", err)
+	}
+
+	if balance.Available() < req.Amount {
+		return nil, ErrInsufficientBalance
+	}
+
+	result, err := tx.ExecContext(ctx,
+		"INSERT INTO transactions (from_user_id, to_user_id, amount, currency, to_currency, to_amount, exchange_rate, type, status) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		req.UserID, req.UserID, req.Amount, fromCurrency, toCurrency, toAmount, req.Rate,
+		string(models.TransactionTypeExchange), string(models.TransactionStatusPending),
+	)
+	if err != nil {
+		logger.Error().Err(err).Msg("Error creating exchange transaction")
+		return nil, fmt.Errorf("failed to create transaction: %w", err)
+	}
+
+	transactionID, err := result.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transaction ID: %w", err)
+	}
+
+	if err = recordStatusChange(ctx, tx, transactionID, "", models.TransactionStatusPending); err != nil {
+		return nil, err
+	}
+
+	err = s.balanceService.updateBalanceInTx(ctx, tx, req.UserID, fromCurrency, -req.Amount, &transactionID)
+	if err != nil {
+		logger.Error().Err(err).Int("user_id", req.UserID).Str("currency", fromCurrency).Msg("Error debiting source currency")
+		return nil, fmt.Errorf("failed to debit source currency: %w", err)
+	}
+
+	err = s.balanceService.updateBalanceInTx(ctx, tx, req.UserID, toCurrency, toAmount, &transactionID)
+	if err != nil {
+		logger.Error().Err(err).Int("user_id", req.UserID).Str("currency", toCurrency).Msg("Error crediting target currency")
+		return nil, fmt.Errorf("failed to credit target currency: %w", err)
+	}
+
+	err = setTransactionStatus(ctx, tx, transactionID, models.TransactionStatusPending, models.TransactionStatusCompleted)
+	if err != nil {
+		logger.Error().Err(err).Msg("Error updating transaction status")
+		return nil, err
+	}
+
+	if err = s.saveIdempotencyKey(ctx, tx, idem, requestHash, transactionID); err != nil {
+		return nil, err
+	}
+
+	if err = s.balanceService.commitTx(tx); err != nil {
+		logger.Error().Err(err).Msg("Error committing exchange transaction")
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	transaction, err := s.GetTransactionByID(ctx, int(transactionID))
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info().
+		Int("transaction_id", transaction.ID).
+		Int("user_id", req.UserID).
+		Stringer("amount", req.Amount).
+		Str("from_currency", fromCurrency).
+		Str("to_currency", toCurrency).
+		Stringer("to_amount", toAmount).
+		Float64("rate", req.Rate).
+		Msg("Exchange transaction completed")
+
+	return transaction, nil
+}
+
+// checkAccountActive rejects outgoing money movements from frozen accounts.
+// The shared lock keeps a concurrent freeze from slipping in before commit.
+func checkAccountActive(ctx context.Context, tx *sql.Tx, userID int) error {
+	var status string
+	err := tx.QueryRowContext(ctx, "SELECT status FROM users WHERE id = ? LOCK IN SHARE MODE", userID).Scan(&status)
+	if err == sql.ErrNoRows {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	if status == string(models.UserStatusFrozen) {
+		return ErrAccountFrozen
+	}
+	return nil
+}
+
+// checkReceiverExists rejects transfers to unknown or deleted users before any
+// balance is touched. The shared lock keeps the receiver from being deleted
+// before commit.
+func checkReceiverExists(ctx context.Context, tx *sql.Tx, userID int) error {
+	var id int
+	err := tx.QueryRowContext(ctx, "SELECT id FROM users WHERE id = ? AND deleted_at IS NULL LOCK IN SHARE MODE", userID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return ErrReceiverNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	return nil
+}
+
+// checkLimits applies the configured limits per currency; amounts in
+// different currencies are never added together.
+func (s *TransactionService) checkLimits(ctx context.Context, tx *sql.Tx, userID int, currency string, amount models.Money) error {
+	if s.limits.MaxAmount > 0 && amount > s.limits.MaxAmount {
+		return ErrTransactionLimitExceeded
+	}
+
+	if s.limits.DailyLimit <= 0 {
+		return nil
+	}
+
+	var spent models.Money
+	err := tx.QueryRowContext(ctx, `
+		SELECT COALESCE(SUM(amount), 0)
+		FROM transactions
+		WHERE from_user_id = ?
+			AND currency = ?
+			AND type IN (?, ?, ?, ?)
+			AND status IN (?, ?)
+			AND created_at >= ?
+	`,
+		userID, currency,
+		string(models.TransactionTypeDebit), string(models.TransactionTypeTransfer), string(models.TransactionTypeWithdrawal), string(models.TransactionTypeExchange),
+		string(models.TransactionStatusPending), string(models.TransactionStatusCompleted),
+		time.Now().Add(-24*time.Hour),
+	).Scan(&spent)
+	if err != nil {
+		s.logger.Error().Err(err).Int("user_id", userID).Msg("Error computing rolling 24-hour total")
+		return fmt.Errorf("database error: %w", err)
+	}
+
+	if spent+amount > s.limits.DailyLimit {
+		s.logger.Warn().
+			Int("user_id", userID).
+			Str("currency", currency).
+			Stringer("spent", spent).
+			Stringer("amount", amount).
+			Msg("Daily transaction limit exceeded")
+		return ErrDailyLimitExceeded
+	}
+
+	return nil
+}
+
+func (s *TransactionService) checkIdempotencyKey(ctx context.Context, tx *sql.Tx, idem *models.IdempotencyKey, transactionType models.TransactionType, req interface{}) (string, int, error) {
+	if idem == nil || idem.Key == "" {
+		return "", 0, nil
+	}
+
+	requestHash, err := idempotencyRequestHash(transactionType, req)
+	if err != nil {
+		return "", 0, err
+	}
+
+	var storedHash string
+	var transactionID int
+	var createdAt time.Time
+	err = tx.QueryRowContext(ctx,
+		"SELECT request_hash, transaction_id, created_at FROM idempotency_keys WHERE user_id = ? AND idempotency_key = ? FOR UPDATE",
+		idem.UserID, idem.Key,
+	).Scan(&storedHash, &transactionID, &createdAt)
+
+	if err == sql.ErrNoRows {
+		return requestHash, 0, nil
+	}
+	if err != nil {
+		s.logger.Error().Err(err).Int("user_id", idem.UserID).Msg("Error looking up idempotency key")
+		return "", 0, fmt.Errorf("database error: %w", err)
+	}
+
+	if time.Since(createdAt) > s.idempotencyWindow {
+		_, err = tx.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE user_id = ? AND idempotency_key = ?", idem.UserID, idem.Key)
+		if err != nil {
+			return "", 0, fmt.Errorf("failed to expire idempotency key: %w", err)
+		}
+		return requestHash, 0, nil
+	}
+
+	if storedHash != requestHash {
+		return "", 0, ErrIdempotencyConflict
+	}
+
+	s.logger.Info().
+		Int("user_id", idem.UserID).
+		Int("transaction_id", transactionID).
+		Msg("Idempotent replay, returning original transaction")
+
+	return requestHash, transactionID, nil
+}
+
+// idempotencyRequestHash fingerprints a request so that a reused key can be
+// told apart from a retry of the same request.
+func idempotencyRequestHash(transactionType models.TransactionType, req interface{}) (string, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash request: %w", err)
+	}
+	sum := sha256.Sum256(append([]byte(string(transactionType)+":"), body...))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (s *TransactionService) saveIdempotencyKey(ctx context.Context, tx *sql.Tx, idem *models.IdempotencyKey, requestHash string, transactionID int64) error {
+	if idem == nil || idem.Key == "" {
+		return nil
+	}
+
+	_, err := tx.ExecContext(ctx,
+		"INSERT INTO idempotency_keys (user_id, idempotency_key, request_hash, transaction_id) VALUES (?, ?, ?, ?)",
+		idem.UserID, idem.Key, requestHash, transactionID,
+	)
+	if err != nil {
+		s.logger.Error().Err(err).Int("user_id", idem.UserID).Msg("Error storing idempotency key")
+		return fmt.Errorf("failed to store idempotency key: %w", err)
+	}
+
+	return nil
+}
+
+func (s *TransactionService) RollbackTransaction(ctx context.Context, transactionID int, actorID int) error {
+	logger := loggerFromContext(ctx, s.logger)
+
+	done, ok := s.inFlight.Begin()
+	if !ok {
+		return ErrShuttingDown
+	}
+	defer done()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.Error().Err(err).Msg("Error starting rollback transaction")
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer s.balanceService.rollbackTx(tx)
+
+	// Locked like in Refund, so a concurrent refund or rollback of the same
+	// transaction waits for this one and then sees its outcome.
+	transaction, err := scanTransaction(tx.QueryRowContext(ctx,
+		"SELECT "+transactionColumns+" FROM transactions WHERE id = ? FOR UPDATE",
+		transactionID,
+	))
+	if err == sql.ErrNoRows {
+		return ErrTransactionNotFound
+	}
+	if err != nil {
+		logger.Error().Err(err).Int("transaction_id", transactionID).Msg("Error locking transaction for rollback")
+		return fmt.Errorf("database error: %w", err)
+	}
+
+	if transaction.Status == string(models.TransactionStatusRolledBack) {
+		return fmt.Errorf("%w: transaction already rolled back", ErrInvalidTransactionState)
+	}
+
+	if transaction.Status != string(models.TransactionStatusCompleted) {
+		return fmt.Errorf("%w: only completed transactions can be rolled back", ErrInvalidTransactionState)
+	}
+
+	// A refund leaves the original completed; reversing it again here would
+	// pay the money back twice.
+	refunded, err := hasCompletedRefund(ctx, tx, transactionID)
+	if err != nil {
+		return err
+	}
+	if refunded {
+		return ErrAlreadyRefunded
+	}
+
+	rolledBackID := int64(transactionID)
+
+	switch transaction.Type {
+	case string(models.TransactionTypeCredit):
+		if transaction.ToUserID != nil {
+			err = s.balanceService.updateBalanceInTx(ctx, tx, *transaction.ToUserID, transaction.Currency, -transaction.Amount, &rolledBackID)
+			if err != nil {
+				return fmt.Errorf("failed to reverse credit: %w", err)
+			}
+		}
+
+	case string(models.TransactionTypeDebit), string(models.TransactionTypeWithdrawal):
+		if transaction.FromUserID != nil {
+			err = s.balanceService.updateBalanceInTx(ctx, tx, *transaction.FromUserID, transaction.Currency, transaction.Amount, &rolledBackID)
+			if err != nil {
+				return fmt.Errorf("failed to reverse %s: %w", transaction.Type, err)
+			}
+		}
+
+	case string(models.TransactionTypeTransfer), string(models.TransactionTypeExchange):
+		if transaction.FromUserID != nil && transaction.ToUserID != nil {
+			err = s.balanceService.updateBalanceInTx(ctx, tx, *transaction.FromUserID, transaction.Currency, transaction.Amount, &rolledBackID)
+			if err != nil {
+				return fmt.Errorf("failed to reverse %s (sender): %w", transaction.Type, err)
+			}
+
+			err = s.balanceService.updateBalanceInTx(ctx, tx, *transaction.ToUserID, transaction.CreditedCurrency(), -transaction.CreditedAmount(), &rolledBackID)
+			if err != nil {
+				return fmt.Errorf("failed to reverse %s (receiver): %w", transaction.Type, err)
+			}
+		}
+
+	default:
+		return fmt.Errorf("%w: %s transactions cannot be rolled back", ErrInvalidTransactionState, transaction.Type)
+	}
+
+	err = setTransactionStatus(ctx, tx, int64(transactionID), models.TransactionStatusCompleted, models.TransactionStatusRolledBack)
+	if err != nil {
+		logger.Error().Err(err).Msg("Error updating transaction status to rolled_back")
+		return err
+	}
+
+	err = writeAuditLog(tx, "transaction", transactionID, "rolled_back", map[string]interface{}{
+		"actor_id": actorID,
+		"type":     transaction.Type,
+		"amount":   transaction.Amount,
+		"currency": transaction.Currency,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = s.balanceService.commitTx(tx); err != nil {
+		logger.Error().Err(err).Msg("Error committing rollback transaction")
+		return fmt.Errorf("failed to commit rollback: %w", err)
+	}
+
+	logger.Info().Int("transaction_id", transactionID).Int("actor_id", actorID).Msg("Transaction rolled back successfully")
+	return nil
+}
+
+// Refund reverses a completed transaction by booking a new refund transaction
+// in the opposite direction, linked through parent_transaction_id. Unlike
+// RollbackTransaction the original row is left untouched.
+func (s *TransactionService) Refund(ctx context.Context, transactionID int, actorID int, reason string) (*models.Transaction, error) {
+	done, ok := s.inFlight.Begin()
+	if !ok {
+		return nil, ErrShuttingDown
+	}
+	defer done()
+
+	logger := loggerFromContext(ctx, s.logger)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.Error().Err(err).Msg("Error starting refund transaction")
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer s.balanceService.rollbackTx(tx)
+
+	original, err := scanTransaction(tx.QueryRowContext(ctx,
+		"SELECT "+transactionColumns+" FROM transactions WHERE id = ? FOR UPDATE",
+		transactionID,
+	))
+	if err == sql.ErrNoRows {
+		return nil, ErrTransactionNotFound
+	}
+	if err != nil {
+		logger.Error().Err(err).Int("transaction_id", transactionID).Msg("Error locking transaction for refund")
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	if original.Status != string(models.TransactionStatusCompleted) {
+		return nil, fmt.Errorf("%w: only completed transactions can be refunded", ErrInvalidTransactionState)
+	}
+
+	var refundFrom, refundTo *int
+	switch original.Type {
+	case string(models.TransactionTypeCredit):
+		refundFrom = original.ToUserID
+	case string(models.TransactionTypeDebit), string(models.TransactionTypeWithdrawal):
+		refundTo = original.FromUserID
+	case string(models.TransactionTypeTransfer):
+		refundFrom, refundTo = original.ToUserID, original.FromUserID
+	default:
+		return nil, fmt.Errorf("%w: %s transactions cannot be refunded", ErrInvalidTransactionState, original.Type)
+	}
+
+	refunded, err := hasCompletedRefund(ctx, tx, transactionID)
+	if err != nil {
+		return nil, err
+	}
+	if refunded {
+		return nil, ErrAlreadyRefunded
+	}
+
+	// The refund runs the original in reverse: the side that was credited
+	// pays back what it received, and the other side gets its original
+	// amount back, so a cross-currency refund uses the inverse rate.
+	refundCurrency, refundAmount := original.CreditedCurrency(), original.CreditedAmount()
+	var toCurrencyCol, toAmountCol, exchangeRateCol interface{}
+	if refundCurrency != original.Currency {
+		toCurrencyCol, toAmountCol = original.Currency, original.Amount
+		if original.ExchangeRate != nil && *original.ExchangeRate != 0 {
+			exchangeRateCol = 1 / *original.ExchangeRate
+		}
+	}
+
+	result, err := tx.ExecContext(ctx,
+		"INSERT INTO transactions (from_user_id, to_user_id, amount, currency, to_currency, to_amount, exchange_rate, type, status, parent_transaction_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		refundFrom, refundTo, refundAmount, refundCurrency, toCurrencyCol, toAmountCol, exchangeRateCol,
+		string(models.TransactionTypeRefund), string(models.TransactionStatusPending), transactionID,
+	)
+	if err != nil {
+		logger.Error().Err(err).Msg("Error creating refund transaction")
+		return nil, fmt.Errorf("failed to create transaction: %w", err)
+	}
+
+	refundID, err := result.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transaction ID: %w", err)
+	}
+
+	if err = recordStatusChange(ctx, tx, refundID, "", models.TransactionStatusPending); err != nil {
+		return nil, err
+	}
+
+	if refundFrom != nil {
+		if err = s.balanceService.updateBalanceInTx(ctx, tx, *refundFrom, refundCurrency, -refundAmount, &refundID); err != nil {
+			return nil, fmt.Errorf("failed to refund (payer): %w", err)
+		}
+	}
+	if refundTo != nil {
+		if err = s.balanceService.updateBalanceInTx(ctx, tx, *refundTo, original.Currency, original.Amount, &refundID); err != nil {
+			return nil, fmt.Errorf("failed to refund (payee): %w", err)
+		}
+	}
+
+	err = setTransactionStatus(ctx, tx, refundID, models.TransactionStatusPending, models.TransactionStatusCompleted)
+	if err != nil {
+		logger.Error().Err(err).Msg("Error updating refund status")
+		return nil, err
+	}
+
+	err = writeAuditLog(tx, "transaction", transactionID, "refunded", map[string]interface{}{
+		"actor_id":  actorID,
+		"refund_id": refundID,
+		"amount":    original.Amount,
+		"currency":  original.Currency,
+		"reason":    reason,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err = s.balanceService.commitTx(tx); err != nil {
+		logger.Error().Err(err).Msg("Error committing refund transaction")
+		return nil, fmt.Errorf("failed to commit refund: %w", err)
+	}
+
+	refund, err := s.GetTransactionByID(ctx, int(refundID))
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info().
+		Int("transaction_id", transactionID).
+		Int("refund_id", refund.ID).
+		Int("actor_id", actorID).
+		Stringer("amount", original.Amount).
+		Msg("Transaction refunded")
+
+	return refund, nil
+}
+
+// hasCompletedRefund reports whether a completed refund points at
+// transactionID. The caller must hold the original's row lock.
+func hasCompletedRefund(ctx context.Context, tx *sql.Tx, transactionID int) (bool, error) {
+	var existing int
+	err := tx.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM transactions WHERE parent_transaction_id = ? AND type = ? AND status = ?",
+		transactionID, string(models.TransactionTypeRefund), string(models.TransactionStatusCompleted),
+	).Scan(&existing)
+	if err != nil {
+		return false, fmt.Errorf("database error: %w", err)
+	}
+	return existing > 0, nil
+}
+
+func setTransactionStatus(ctx context.Context, tx *sql.Tx, transactionID int64, from, to models.TransactionStatus) error {
+	result, err := tx.ExecContext(ctx,
+		"UPDATE transactions SET status = ? WHERE id = ? AND status = ?",
+		string(to), transactionID, string(from),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update transaction status: %w", err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to update transaction status: %w", err)
+	}
+	if affected == 0 {
+		return fmt.Errorf("transaction is no longer %s", from)
+	}
+
+	return recordStatusChange(ctx, tx, transactionID, from, to)
+}
+
+type ctxExecer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+func recordStatusChange(ctx context.Context, db ctxExecer, transactionID int64, from, to models.TransactionStatus) error {
+	var fromStatus interface{}
+	if from != "" {
+		fromStatus = string(from)
+	}
+
+	_, err := db.ExecContext(ctx,
+		"INSERT INTO transaction_status_history (transaction_id, from_status, to_status) VALUES (?, ?, ?)",
+		transactionID, fromStatus, string(to),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record status change: %w", err)
+	}
+
+	return nil
+}
+
+// isDecline reports whether err is a decision about the request itself, as
+// opposed to an internal failure, and so should be kept as a failed attempt.
+func isDecline(err error) bool {
+	return errors.Is(err, ErrInsufficientBalance) ||
+		errors.Is(err, ErrAccountFrozen) ||
+		errors.Is(err, ErrTransactionLimitExceeded) ||
+		errors.Is(err, ErrDailyLimitExceeded)
+}
+
+// recordFailedTransaction keeps a declined attempt visible to the user. The
+// attempt's own transaction has already been rolled back, so this is a
+// separate write; if it fails the caller still gets the original error.
+func (s *TransactionService) recordFailedTransaction(ctx context.Context, fromUserID int, toUserID *int, amount models.Money, currency string, transactionType models.TransactionType, reason error) {
+	logger := loggerFromContext(ctx, s.logger)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		logger.Error().Err(err).Msg("Error starting failed transaction record")
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx,
+		"INSERT INTO transactions (from_user_id, to_user_id, amount, currency, type, status, failure_reason) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		fromUserID, toUserID, amount, currency, string(transactionType), string(models.TransactionStatusFailed), reason.Error(),
+	)
+	if err != nil {
+		logger.Error().Err(err).Msg("Error recording failed transaction")
+		return
+	}
+
+	transactionID, err := result.LastInsertId()
+	if err != nil {
+		logger.Error().Err(err).Msg("Error recording failed transaction")
+		return
+	}
+
+	if err = recordStatusChange(ctx, tx, transactionID, "", models.TransactionStatusFailed); err != nil {
+		logger.Error().Err(err).Msg("Error recording failed transaction")
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		logger.Error().Err(err).Msg("Error committing failed transaction record")
+		return
+	}
+
+	logger.Info().
+		Int64("transaction_id", transactionID).
+		Int("user_id", fromUserID).
+		Str("type", string(transactionType)).
+		Str("reason", reason.Error()).
+		Msg("Declined transaction recorded")
+}
+
+func (s *TransactionService) GetStatusHistory(ctx context.Context, transactionID int) ([]*models.TransactionStatusChange, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, transaction_id, from_status, to_status, created_at
+		FROM transaction_status_history
+		WHERE transaction_id = ?
+		ORDER BY id ASC
+	`, transactionID)
+	if err != nil {
+		s.logger.Error().Err(err).Int("transaction_id", transactionID).Msg("Error fetching status history")
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	defer rows.Close()
+
+	history := []*models.TransactionStatusChange{}
+	for rows.Next() {
+		var change models.TransactionStatusChange
+		var fromStatus sql.NullString
+
+		err := rows.Scan(&change.ID, &change.TransactionID, &fromStatus, &change.ToStatus, &change.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning status history: %w", err)
+		}
+
+		if fromStatus.Valid {
+			change.FromStatus = &fromStatus.String
+		}
+
+		history = append(history, &change)
+	}
+
+	return history, nil
+}
+
+const transactionColumns = "id, from_user_id, to_user_id, amount, currency, to_currency, to_amount, exchange_rate, type, status, failure_reason, reason, memo, external_reference, parent_transaction_id, created_at"
+
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanTransaction(row rowScanner) (*models.Transaction, error) {
+	var transaction models.Transaction
+	var fromUserID, toUserID, parentID sql.NullInt64
+	var externalReference, toCurrency, failureReason, reason, memo sql.NullString
+	var toAmount models.NullMoney
+	var exchangeRate sql.NullFloat64
+
+	err := row.Scan(
+		&transaction.ID, &fromUserID, &toUserID, &transaction.Amount,
+		&transaction.Currency, &toCurrency, &toAmount, &exchangeRate,
+		&transaction.Type, &transaction.Status, &failureReason, &reason, &memo, &externalReference, &parentID, &transaction.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if failureReason.Valid {
+		transaction.FailureReason = &failureReason.String
+	}
+	if reason.Valid {
+		transaction.Reason = &reason.String
+	}
+	if memo.Valid {
+		transaction.Memo = &memo.String
+	}
+	if externalReference.Valid {
+		transaction.ExternalReference = &externalReference.String
+	}
+	if toCurrency.Valid {
+		transaction.ToCurrency = &toCurrency.String
+	}
+	if toAmount.Valid {
+		transaction.ToAmount = &toAmount.Money
+	}
+	if exchangeRate.Valid {
+		transaction.ExchangeRate = &exchangeRate.Float64
+	}
+	if parentID.Valid {
+		val := int(parentID.Int64)
+		transaction.ParentTransactionID = &val
+	}
+
+	if fromUserID.Valid {
+		val := int(fromUserID.Int64)
+		transaction.FromUserID = &val
+	}
+	if toUserID.Valid {
+		val := int(toUserID.Int64)
+		transaction.ToUserID = &val
+	}
+
+	return &transaction, nil
+}
+
+func scanTransactionRows(rows *sql.Rows) ([]*models.Transaction, error) {
+	transactions := []*models.Transaction{}
+	for rows.Next() {
+		transaction, err := scanTransaction(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning transaction: %w", err)
+		}
+		transactions = append(transactions, transaction)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating transactions: %w", err)
+	}
+
+	return transactions, nil
+}
+
+func (s *TransactionService) GetTransactionByID(ctx context.Context, transactionID int) (*models.Transaction, error) {
+	transaction, err := scanTransaction(s.db.QueryRowContext(ctx,
+		"SELECT "+transactionColumns+" FROM transactions WHERE id = ?",
+		transactionID,
+	))
+
+	if err == sql.ErrNoRows {
+		return nil, ErrTransactionNotFound
+	}
+	if err != nil {
+		s.logger.Error().Err(err).Int("transaction_id", transactionID).Msg("Error fetching transaction")
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	return transaction, nil
+}
+
+func (s *TransactionService) GetUserTransactions(ctx context.Context, userID int, limit, offset int) ([]*models.Transaction, error) {
+	query := `
+		SELECT ` + transactionColumns + `
+		FROM transactions
+		WHERE from_user_id = ? OR to_user_id = ?
+		ORDER BY created_at DESC
+		LIMIT ? OFFSET ?
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, userID, userID, limit, offset)
+	if err != nil {
+		s.logger.Error().Err(err).Int("user_id", userID).Msg("Error fetching user transactions")
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	defer rows.Close()
+
+	return scanTransactionRows(rows)
+}
+
+// GetUserTransactionsCursor pages through a user's transactions newest first,
+// keyed on (created_at, id) so rows inserted while a client iterates neither
+// shift nor repeat later pages. An empty cursor starts from the newest row;
+// the returned cursor is empty once there are no more rows.
+func (s *TransactionService) GetUserTransactionsCursor(ctx context.Context, userID int, cursor string, limit int) ([]*models.Transaction, string, error) {
+	where := "(from_user_id = ? OR to_user_id = ?)"
+	args := []interface{}{userID, userID}
+	if cursor != "" {
+		createdAt, id, err := decodeTransactionCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		where += " AND (created_at < ? OR (created_at = ? AND id < ?))"
+		args = append(args, createdAt, createdAt, id)
+	}
+	// One extra row tells us whether another page follows.
+	args = append(args, limit+1)
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+transactionColumns+`
+		FROM transactions
+		WHERE `+where+`
+		ORDER BY created_at DESC, id DESC
+		LIMIT ?`, args...)
+	if err != nil {
+		s.logger.Error().Err(err).Int("user_id", userID).Msg("Error fetching user transactions")
+		return nil, "", fmt.Errorf("database error: %w", err)
+	}
+	defer rows.Close()
+
+	transactions, err := scanTransactionRows(rows)
+	if err != nil {
+		return nil, "", err
+	}
+
+	nextCursor := ""
+	if len(transactions) > limit {
+		transactions = transactions[:limit]
+		last := transactions[len(transactions)-1]
+		nextCursor = encodeTransactionCursor(last.CreatedAt, last.ID)
+	}
+
+	return transactions, nextCursor, nil
+}
+
+// encodeTransactionCursor packs a row's sort key into an opaque token.
+func encodeTransactionCursor(createdAt time.Time, id int) string {
+	raw := strconv.FormatInt(createdAt.UnixNano(), 10) + ":" + strconv.Itoa(id)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeTransactionCursor(cursor string) (time.Time, int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, 0, ErrInvalidCursor
+	}
+	nanosStr, idStr, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return time.Time{}, 0, ErrInvalidCursor
+	}
+	nanos, err := strconv.ParseInt(nanosStr, 10, 64)
+	if err != nil {
+		return time.Time{}, 0, ErrInvalidCursor
+	}
+	id, err := strconv.Atoi(idStr)
+	if err != nil || id <= 0 {
+		return time.Time{}, 0, ErrInvalidCursor
+	}
+	return time.Unix(0, nanos).UTC(), id, nil
+}
+
+func (s *TransactionService) CountUserTransactions(ctx context.Context, userID int) (int, error) {
+	var count int
+	err := s.db.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM transactions WHERE from_user_id = ? OR to_user_id = ?",
+		userID, userID,
+	).Scan(&count)
+	if err != nil {
+		s.logger.Error().Err(err).Int("user_id", userID).Msg("Error counting user transactions")
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+
+	return count, nil
+}
+
+// ledgerBalanceSQL sums one user's side of each transaction in one currency;
+// the credited side of a cross-currency transaction is in to_currency and
+// to_amount. It takes (userID, currency) twice.
+const ledgerBalanceSQL = `COALESCE(SUM(CASE WHEN to_user_id = ? AND COALESCE(to_currency, currency) = ? THEN COALESCE(to_amount, amount) ELSE 0 END), 0)
+			- COALESCE(SUM(CASE WHEN from_user_id = ? AND currency = ? THEN amount ELSE 0 END), 0)`
+
+// ledgerFilterSQL matches the transactions that touch a user's balance in one
+// currency. It takes (userID, currency) twice.
+const ledgerFilterSQL = `((from_user_id = ? AND currency = ?) OR (to_user_id = ? AND COALESCE(to_currency, currency) = ?))`
+
+func (s *TransactionService) GetAccountStateAt(ctx context.Context, userID, transactionID int, limit, offset int) (*models.AccountState, error) {
+	target, err := s.GetTransactionByID(ctx, transactionID)
+	if err != nil {
+		return nil, err
+	}
+
+	// The balance is reconstructed in the currency the user was affected in.
+	currency := target.Currency
+	if target.ToUserID != nil && *target.ToUserID == userID {
+		currency = target.CreditedCurrency()
+	}
+
+	state := &models.AccountState{
+		UserID:           userID,
+		TransactionID:    transactionID,
+		Currency:         currency,
+		TargetRolledBack: target.Status == string(models.TransactionStatusRolledBack),
+	}
+
+	// A transaction that was rolled back later was still in effect right after
+	// it happened, so the target itself counts even when rolled back.
+	err = s.db.QueryRowContext(ctx, `
+		SELECT `+ledgerBalanceSQL+`
+		FROM transactions
+		WHERE `+ledgerFilterSQL+`
+			AND id <= ?
+			AND (status = ? OR id = ?)
+	`, userID, currency, userID, currency, userID, currency, userID, currency,
+		transactionID, string(models.TransactionStatusCompleted), transactionID).Scan(&state.Balance)
+	if err != nil {
+		s.logger.Error().Err(err).Int("user_id", userID).Int("transaction_id", transactionID).Msg("Error reconstructing balance")
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+transactionColumns+`
+		FROM transactions
+		WHERE (from_user_id = ? OR to_user_id = ?) AND id <= ?
+		ORDER BY id DESC
+		LIMIT ? OFFSET ?
+	`, userID, userID, transactionID, limit, offset)
+	if err != nil {
+		s.logger.Error().Err(err).Int("user_id", userID).Msg("Error fetching transactions up to target")
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	defer rows.Close()
+
+	state.Transactions, err = scanTransactionRows(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+func (s *TransactionService) GetAccountSummary(ctx context.Context, userID int, currency string) (*models.AccountSummary, error) {
+	now := time.Now()
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+
+	summary := &models.AccountSummary{UserID: userID, Currency: currency}
+	var lastTransactionAt sql.NullTime
+
+	err := s.db.QueryRowContext(ctx, `
+		SELECT COUNT(*),
+			COALESCE(SUM(status = ?), 0),
+			COALESCE(SUM(created_at >= ?), 0),
+			MAX(created_at)
+		FROM transactions
+		WHERE from_user_id = ? OR to_user_id = ?
+	`, string(models.TransactionStatusPending), monthStart, userID, userID).Scan(
+		&summary.TotalTransactions, &summary.PendingTransactions,
+		&summary.MonthTransactions, &lastTransactionAt,
+	)
+	if err != nil {
+		s.logger.Error().Err(err).Int("user_id", userID).Msg("Error fetching account summary")
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	if lastTransactionAt.Valid {
+		summary.LastTransactionAt = &lastTransactionAt.Time
+	}
+
+	balance, err := s.balanceService.GetBalance(ctx, userID, currency)
+	if err != nil {
+		return nil, err
+	}
+	summary.Balance = balance.Amount
+
+	return summary, nil
+}
+
+// GetUserStats totals a user's completed transactions in one currency. A zero
+// from or to leaves that end of the range open.
+func (s *TransactionService) GetUserStats(ctx context.Context, userID int, currency string, from, to time.Time) (*models.TransactionStats, error) {
+	stats := &models.TransactionStats{
+		UserID:        userID,
+		Currency:      currency,
+		CountByType:   map[string]int{},
+		CountByStatus: map[string]int{},
+	}
+
+	where := ledgerFilterSQL
+	args := []interface{}{userID, currency, userID, currency}
+	if !from.IsZero() {
+		where += " AND created_at >= ?"
+		args = append(args, from)
+		stats.From = &from
+	}
+	if !to.IsZero() {
+		where += " AND created_at <= ?"
+		args = append(args, to)
+		stats.To = &to
+	}
+
+	totalsArgs := append([]interface{}{userID, currency, userID, currency}, args...)
+	totalsArgs = append(totalsArgs, string(models.TransactionStatusCompleted))
+	err := s.db.QueryRowContext(ctx, `
+		SELECT COUNT(*),
+			COALESCE(SUM(CASE WHEN to_user_id = ? AND COALESCE(to_currency, currency) = ? THEN COALESCE(to_amount, amount) ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN from_user_id = ? AND currency = ? THEN amount ELSE 0 END), 0)
+		FROM transactions
+		WHERE `+where+` AND status = ?`, totalsArgs...).Scan(&stats.TransactionCount, &stats.TotalCredited, &stats.TotalDebited)
+	if err != nil {
+		s.logger.Error().Err(err).Int("user_id", userID).Msg("Error computing transaction stats")
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	stats.Net = stats.TotalCredited - stats.TotalDebited
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT type, status, COUNT(*)
+		FROM transactions
+		WHERE `+where+`
+		GROUP BY type, status`, args...)
+	if err != nil {
+		s.logger.Error().Err(err).Int("user_id", userID).Msg("Error counting transactions by type and status")
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var transactionType, status string
+		var count int
+		if err := rows.Scan(&transactionType, &status, &count); err != nil {
+			return nil, fmt.Errorf("error scanning transaction stats: %w", err)
+		}
+		stats.CountByType[transactionType] += count
+		stats.CountByStatus[status] += count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating transaction stats: %w", err)
+	}
+
+	return stats, nil
+}
+
+// GetMerchantStats totals a merchant's completed inflows in one currency:
+// settlements, which are the credits carrying an external reference, and
+// payments received as transfers. A zero from or to leaves that end of the
+// range open.
+func (s *TransactionService) GetMerchantStats(ctx context.Context, merchantID int, currency string, from, to time.Time) (*models.MerchantStats, error) {
+	stats := &models.MerchantStats{UserID: merchantID, Currency: currency}
+
+	credit, transfer := string(models.TransactionTypeCredit), string(models.TransactionTypeTransfer)
+	where := "to_user_id = ? AND COALESCE(to_currency, currency) = ? AND status = ?" +
+		" AND ((type = ? AND external_reference IS NOT NULL) OR type = ?)"
+	args := []interface{}{
+		credit, credit, transfer, transfer,
+		merchantID, currency, string(models.TransactionStatusCompleted), credit, transfer,
+	}
+	if !from.IsZero() {
+		where += " AND created_at >= ?"
+		args = append(args, from)
+		stats.From = &from
+	}
+	if !to.IsZero() {
+		where += " AND created_at <= ?"
+		args = append(args, to)
+		stats.To = &to
+	}
+
+	err := s.db.QueryRowContext(ctx, `
+		SELECT COUNT(CASE WHEN type = ? THEN 1 END),
+			COALESCE(SUM(CASE WHEN type = ? THEN amount END), 0),
+			COUNT(CASE WHEN type = ? THEN 1 END),
+			COALESCE(SUM(CASE WHEN type = ? THEN COALESCE(to_amount, amount) END), 0)
+		FROM transactions
+		WHERE `+where, args...).Scan(&stats.SettlementCount, &stats.TotalSettled, &stats.PaymentCount, &stats.TotalReceived)
+	if err != nil {
+		s.logger.Error().Err(err).Int("user_id", merchantID).Msg("Error computing merchant stats")
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	return stats, nil
+}
+
+// GetStatement lists the completed transactions in [from, to] with signed
+// amounts and a running balance. Like GetAccountStateAt it derives balances
+// from the transactions table rather than balance_history. A statement covers
+// a single currency.
+func (s *TransactionService) GetStatement(ctx context.Context, userID int, currency string, from, to time.Time) (*models.Statement, error) {
+	statement := &models.Statement{
+		UserID:   userID,
+		Currency: currency,
+		From:     from,
+		To:       to,
+		Entries:  []*models.StatementEntry{},
+	}
+
+	err := s.db.QueryRowContext(ctx, `
+		SELECT `+ledgerBalanceSQL+`
+		FROM transactions
+		WHERE `+ledgerFilterSQL+`
+			AND status = ?
+			AND created_at < ?
+	`, userID, currency, userID, currency, userID, currency, userID, currency,
+		string(models.TransactionStatusCompleted), from).Scan(&statement.OpeningBalance)
+	if err != nil {
+		s.logger.Error().Err(err).Int("user_id", userID).Msg("Error computing opening balance")
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+transactionColumns+`
+		FROM transactions
+		WHERE `+ledgerFilterSQL+`
+			AND status = ?
+			AND created_at >= ? AND created_at <= ?
+		ORDER BY created_at ASC, id ASC
+	`, userID, currency, userID, currency, string(models.TransactionStatusCompleted), from, to)
+	if err != nil {
+		s.logger.Error().Err(err).Int("user_id", userID).Msg("Error fetching statement transactions")
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	defer rows.Close()
+
+	transactions, err := scanTransactionRows(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	balance := statement.OpeningBalance
+	for _, t := range transactions {
+		entry := &models.StatementEntry{
+			TransactionID: t.ID,
+			Date:          t.CreatedAt,
+			Type:          t.Type,
+			Amount:        t.CreditedAmount(),
+		}
+
+		if t.FromUserID != nil && *t.FromUserID == userID && t.Currency == currency {
+			entry.Amount = -t.Amount
+			if t.ToUserID != nil {
+				entry.Counterparty = fmt.Sprintf("user:%d", *t.ToUserID)
+			}
+		} else if t.FromUserID != nil {
+			entry.Counterparty = fmt.Sprintf("user:%d", *t.FromUserID)
+		}
+		if entry.Counterparty == "" && t.ExternalReference != nil {
+			entry.Counterparty = *t.ExternalReference
+		}
+
+		balance += entry.Amount
+		entry.RunningBalance = balance
+		statement.Entries = append(statement.Entries, entry)
+	}
+	statement.ClosingBalance = balance
+
+	return statement, nil
+}
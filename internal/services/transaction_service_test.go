@@ -0,0 +1,1206 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"go-projects/internal/lifecycle"
+	"go-projects/internal/metrics"
+	"go-projects/internal/middleware"
+	"go-projects/internal/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+)
+
+var (
+	transactionByIDQuery = regexp.QuoteMeta("SELECT " + transactionColumns + " FROM transactions WHERE id = ?")
+	summaryQuery         = regexp.QuoteMeta("COALESCE(SUM(status = ?), 0)")
+	statusChangeQuery    = regexp.QuoteMeta("INSERT INTO transaction_status_history (transaction_id, from_status, to_status) VALUES (?, ?, ?)")
+	balanceByIDQuery     = regexp.QuoteMeta("SELECT user_id, currency, amount, overdraft_limit, version, last_updated_at FROM balances WHERE user_id = ? AND currency = ?")
+	lockTransactionQuery = regexp.QuoteMeta("SELECT " + transactionColumns + " FROM transactions WHERE id = ? FOR UPDATE")
+	refundCountQuery     = regexp.QuoteMeta("SELECT COUNT(*) FROM transactions WHERE parent_transaction_id = ? AND type = ? AND status = ?")
+	accountStatusQuery   = regexp.QuoteMeta("SELECT status FROM users WHERE id = ? LOCK IN SHARE MODE")
+	receiverQuery        = regexp.QuoteMeta("SELECT id FROM users WHERE id = ? AND deleted_at IS NULL LOCK IN SHARE MODE")
+)
+
+func accountStatus(status string) *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"status"}).AddRow(status)
+}
+
+func newTestTransactionService(t *testing.T) (*TransactionService, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock := newMockDB(t)
+	balances := NewBalanceService(db, zerolog.Nop())
+	return NewTransactionService(db, zerolog.Nop(), balances, time.Minute, TransactionLimits{}, lifecycle.NewTracker()), mock
+}
+
+func transactionRows() *sqlmock.Rows {
+	return sqlmock.NewRows(strings.Split(transactionColumns, ", "))
+}
+
+// transactionRow is a single transaction of 10.00 to user 1.
+func transactionRow(id int, txType, status string) *sqlmock.Rows {
+	return transactionRows().AddRow(id, nil, 1, 10.0, "USD", nil, nil, nil, txType, status, nil, nil, nil, nil, nil, time.Now())
+}
+
+func TestGetAccountSummary(t *testing.T) {
+	service, mock := newTestTransactionService(t)
+	last := time.Date(2026, 10, 14, 9, 30, 0, 0, time.UTC)
+
+	mock.ExpectQuery(summaryQuery).WithArgs("pending", sqlmock.AnyArg(), 3, 3).
+		WillReturnRows(sqlmock.NewRows([]string{"total", "pending", "month", "last"}).AddRow(12, 2, 5, last))
+	mock.ExpectQuery(balanceByIDQuery).WithArgs(3, "USD").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "currency", "amount", "overdraft_limit", "version", "last_updated_at"}).AddRow(3, "USD", 250.5, 0, 4, last))
+
+	summary, err := service.GetAccountSummary(context.Background(), 3, "USD")
+	if err != nil {
+		t.Fatalf("GetAccountSummary: %v", err)
+	}
+	if summary.UserID != 3 || summary.TotalTransactions != 12 || summary.PendingTransactions != 2 || summary.MonthTransactions != 5 {
+		t.Errorf("counts = %+v, want 12 total, 2 pending, 5 this month", summary)
+	}
+	if summary.Balance != 25050 {
+		t.Errorf("balance = %s, want 250.50", summary.Balance)
+	}
+	if summary.LastTransactionAt == nil || !summary.LastTransactionAt.Equal(last) {
+		t.Errorf("last transaction = %v, want %v", summary.LastTransactionAt, last)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGetAccountSummaryWithoutTransactions(t *testing.T) {
+	service, mock := newTestTransactionService(t)
+
+	mock.ExpectQuery(summaryQuery).
+		WillReturnRows(sqlmock.NewRows([]string{"total", "pending", "month", "last"}).AddRow(0, 0, 0, nil))
+	mock.ExpectQuery(balanceByIDQuery).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "currency", "amount", "overdraft_limit", "version", "last_updated_at"}).AddRow(4, "USD", 0.0, 0, 1, time.Now()))
+
+	summary, err := service.GetAccountSummary(context.Background(), 4, "USD")
+	if err != nil {
+		t.Fatalf("GetAccountSummary: %v", err)
+	}
+	if summary.TotalTransactions != 0 || summary.LastTransactionAt != nil {
+		t.Errorf("summary = %+v, want no transactions and no last timestamp", summary)
+	}
+}
+
+var idempotencyLookupQuery = regexp.QuoteMeta("SELECT request_hash, transaction_id, created_at FROM idempotency_keys WHERE user_id = ? AND idempotency_key = ? FOR UPDATE")
+
+func TestCreditReplaysIdempotentRequest(t *testing.T) {
+	service, mock := newTestTransactionService(t)
+	req := &models.CreditRequest{UserID: 1, Amount: 10, Currency: "USD"}
+	hash, err := idempotencyRequestHash(models.TransactionTypeCredit, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(idempotencyLookupQuery).WithArgs(1, "key-1").
+		WillReturnRows(sqlmock.NewRows([]string{"request_hash", "transaction_id", "created_at"}).AddRow(hash, 9, time.Now()))
+	mock.ExpectRollback()
+	mock.ExpectQuery(transactionByIDQuery).WithArgs(9).WillReturnRows(transactionRow(9, "credit", "completed"))
+
+	transaction, err := service.Credit(context.Background(), req, &models.IdempotencyKey{UserID: 1, Key: "key-1"})
+	if err != nil {
+		t.Fatalf("Credit: %v", err)
+	}
+	if transaction.ID != 9 {
+		t.Errorf("replay returned transaction %d, want the original 9", transaction.ID)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCreditRejectsReusedKeyWithDifferentBody(t *testing.T) {
+	service, mock := newTestTransactionService(t)
+	original, err := idempotencyRequestHash(models.TransactionTypeCredit, &models.CreditRequest{UserID: 1, Amount: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(idempotencyLookupQuery).WithArgs(1, "key-1").
+		WillReturnRows(sqlmock.NewRows([]string{"request_hash", "transaction_id", "created_at"}).AddRow(original, 9, time.Now()))
+	mock.ExpectRollback()
+
+	_, err = service.Credit(context.Background(), &models.CreditRequest{UserID: 1, Amount: 25}, &models.IdempotencyKey{UserID: 1, Key: "key-1"})
+	if !errors.Is(err, ErrIdempotencyConflict) {
+		t.Errorf("err = %v, want ErrIdempotencyConflict", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCreditTreatsExpiredKeyAsNew(t *testing.T) {
+	service, mock := newTestTransactionService(t)
+	req := &models.CreditRequest{UserID: 1, Amount: 10, Currency: "USD"}
+	hash, err := idempotencyRequestHash(models.TransactionTypeCredit, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(idempotencyLookupQuery).WithArgs(1, "key-1").
+		WillReturnRows(sqlmock.NewRows([]string{"request_hash", "transaction_id", "created_at"}).AddRow(hash, 9, time.Now().Add(-time.Hour)))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM idempotency_keys")).WithArgs(1, "key-1").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO transactions")).WillReturnResult(sqlmock.NewResult(10, 1))
+	mock.ExpectExec(statusChangeQuery).WithArgs(int64(10), nil, "pending").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(balanceReadQuery).WithArgs(1, "USD").WillReturnRows(balanceRow("0.00", 1))
+	mock.ExpectExec(balanceUpdateQuery).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(historyInsertQuery).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE transactions SET status = ? WHERE id = ? AND status = ?")).
+		WithArgs("completed", int64(10), "pending").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(statusChangeQuery).WithArgs(int64(10), "pending", "completed").WillReturnResult(sqlmock.NewResult(2, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO idempotency_keys")).WithArgs(1, "key-1", hash, int64(10)).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectQuery(transactionByIDQuery).WithArgs(10).WillReturnRows(transactionRow(10, "credit", "completed"))
+
+	transaction, err := service.Credit(context.Background(), req, &models.IdempotencyKey{UserID: 1, Key: "key-1"})
+	if err != nil {
+		t.Fatalf("Credit: %v", err)
+	}
+	if transaction.ID != 10 {
+		t.Errorf("got transaction %d, want a new one", transaction.ID)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGetAccountStateAt(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     string
+		rolledBack bool
+	}{
+		{"completed target", "completed", false},
+		{"target rolled back later", "rolled_back", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service, mock := newTestTransactionService(t)
+
+			// Ledger for user 1: +100 (id 1), -30 (id 2), +10 (id 3, the target).
+			mock.ExpectQuery(transactionByIDQuery).WithArgs(3).WillReturnRows(transactionRow(3, "credit", tt.status))
+			mock.ExpectQuery(regexp.QuoteMeta("AND (status = ? OR id = ?)")).
+				WithArgs(1, "USD", 1, "USD", 1, "USD", 1, "USD", 3, "completed", 3).
+				WillReturnRows(sqlmock.NewRows([]string{"balance"}).AddRow(80.0))
+			now := time.Now()
+			mock.ExpectQuery(regexp.QuoteMeta("WHERE (from_user_id = ? OR to_user_id = ?) AND id <= ?")).
+				WithArgs(1, 1, 3, 50, 0).
+				WillReturnRows(transactionRows().
+					AddRow(3, nil, 1, 10.0, "USD", nil, nil, nil, "credit", tt.status, nil, nil, nil, nil, nil, now).
+					AddRow(2, 1, nil, 30.0, "USD", nil, nil, nil, "debit", "completed", nil, nil, nil, nil, nil, now).
+					AddRow(1, nil, 1, 100.0, "USD", nil, nil, nil, "credit", "completed", nil, nil, nil, nil, nil, now))
+
+			state, err := service.GetAccountStateAt(context.Background(), 1, 3, 50, 0)
+			if err != nil {
+				t.Fatalf("GetAccountStateAt: %v", err)
+			}
+			if state.Balance != 8000 || len(state.Transactions) != 3 {
+				t.Errorf("state = %s with %d transactions, want 80.00 after 3", state.Balance, len(state.Transactions))
+			}
+			if state.TargetRolledBack != tt.rolledBack {
+				t.Errorf("TargetRolledBack = %v, want %v", state.TargetRolledBack, tt.rolledBack)
+			}
+			if state.Transactions[0].ID != 3 {
+				t.Errorf("newest transaction = %d, want the target", state.Transactions[0].ID)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestWithdrawValidatesRequest(t *testing.T) {
+	service, mock := newTestTransactionService(t)
+
+	tests := []struct {
+		name string
+		req  models.WithdrawRequest
+	}{
+		{"zero amount", models.WithdrawRequest{UserID: 3, Amount: 0, Destination: "IBAN-1"}},
+		{"negative amount", models.WithdrawRequest{UserID: 3, Amount: -500, Destination: "IBAN-1"}},
+		{"no destination", models.WithdrawRequest{UserID: 3, Amount: 500}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := service.Withdraw(context.Background(), &tt.req, nil); err == nil {
+				t.Error("Withdraw accepted an invalid request")
+			}
+		})
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTransferAcrossCurrenciesRequiresExchangeRate(t *testing.T) {
+	service, mock := newTestTransactionService(t)
+
+	req := &models.TransferRequest{FromUserID: 1, ToUserID: 2, Amount: 1000, Currency: "usd", ToCurrency: "EUR"}
+	if _, err := service.Transfer(context.Background(), req, nil); !errors.Is(err, ErrCurrencyMismatch) {
+		t.Errorf("Transfer error = %v, want ErrCurrencyMismatch", err)
+	}
+
+	req = &models.TransferRequest{FromUserID: 1, ToUserID: 2, Amount: 1000, Currency: "US"}
+	if _, err := service.Transfer(context.Background(), req, nil); !errors.Is(err, models.ErrInvalidCurrency) {
+		t.Errorf("Transfer error = %v, want ErrInvalidCurrency", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSetTransactionStatusRejectsStaleStatus(t *testing.T) {
+	db, mock := newMockDB(t)
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE transactions SET status = ? WHERE id = ? AND status = ?")).
+		WithArgs("rolled_back", int64(4), "completed").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	if err := setTransactionStatus(context.Background(), tx, 4, models.TransactionStatusCompleted, models.TransactionStatusRolledBack); err == nil {
+		t.Error("status change applied to a transaction that had already moved on")
+	}
+}
+
+func TestGetStatusHistory(t *testing.T) {
+	service, mock := newTestTransactionService(t)
+	now := time.Now()
+	mock.ExpectQuery(regexp.QuoteMeta("FROM transaction_status_history")).WithArgs(4).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "transaction_id", "from_status", "to_status", "created_at"}).
+			AddRow(1, 4, nil, "pending", now).
+			AddRow(2, 4, "pending", "completed", now).
+			AddRow(3, 4, "completed", "rolled_back", now))
+
+	history, err := service.GetStatusHistory(context.Background(), 4)
+	if err != nil {
+		t.Fatalf("GetStatusHistory: %v", err)
+	}
+	if len(history) != 3 {
+		t.Fatalf("got %d changes, want 3", len(history))
+	}
+	if history[0].FromStatus != nil || history[0].ToStatus != "pending" {
+		t.Errorf("first change = %v -> %s, want creation as pending", history[0].FromStatus, history[0].ToStatus)
+	}
+	if last := history[2]; last.FromStatus == nil || *last.FromStatus != "completed" || last.ToStatus != "rolled_back" {
+		t.Errorf("last change = %+v, want completed -> rolled_back", last)
+	}
+}
+
+func TestCheckLimitsBoundaries(t *testing.T) {
+	limits := TransactionLimits{MaxAmount: 10000, DailyLimit: 50000}
+	spentQuery := regexp.QuoteMeta("SELECT COALESCE(SUM(amount), 0)")
+
+	tests := []struct {
+		name   string
+		spent  models.Money
+		amount models.Money
+		want   error
+	}{
+		{"at the per-transaction limit", 0, 10000, nil},
+		{"one cent over the per-transaction limit", 0, 10001, ErrTransactionLimitExceeded},
+		{"reaching the daily limit exactly", 40000, 10000, nil},
+		{"one cent over the daily limit", 40001, 10000, ErrDailyLimitExceeded},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := newMockDB(t)
+			service := NewTransactionService(db, zerolog.Nop(), NewBalanceService(db, zerolog.Nop()), time.Minute, limits, lifecycle.NewTracker())
+
+			mock.ExpectBegin()
+			if tt.want != ErrTransactionLimitExceeded {
+				mock.ExpectQuery(spentQuery).WithArgs(1, "USD", "debit", "transfer", "withdrawal", "exchange", "pending", "completed", sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"spent"}).AddRow(tt.spent.String()))
+			}
+			tx, err := db.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tx.Rollback()
+
+			if err := service.checkLimits(context.Background(), tx, 1, "USD", tt.amount); !errors.Is(err, tt.want) {
+				t.Errorf("checkLimits = %v, want %v", err, tt.want)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestRollbackCreditReversesBalanceAndAudits(t *testing.T) {
+	service, mock := newTestTransactionService(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(lockTransactionQuery).WithArgs(4).WillReturnRows(transactionRow(4, "credit", "completed"))
+	mock.ExpectQuery(refundCountQuery).WithArgs(4, "refund", "completed").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectQuery(balanceReadQuery).WithArgs(1, "USD").WillReturnRows(balanceRow("25.00", 1))
+	mock.ExpectExec(balanceUpdateQuery).WithArgs(models.Money(1500), 1, "USD", 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(historyInsertQuery).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE transactions SET status = ? WHERE id = ? AND status = ?")).
+		WithArgs("rolled_back", int64(4), "completed").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(statusChangeQuery).WithArgs(int64(4), "completed", "rolled_back").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_logs")).
+		WithArgs("transaction", 4, "rolled_back", `{"actor_id":9,"amount":10.00,"currency":"USD","type":"credit"}`).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	if err := service.RollbackTransaction(context.Background(), 4, 9); err != nil {
+		t.Fatalf("RollbackTransaction: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRollbackTransactionRejectsRefunded(t *testing.T) {
+	service, mock := newTestTransactionService(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(lockTransactionQuery).WithArgs(4).WillReturnRows(transactionRow(4, "credit", "completed"))
+	mock.ExpectQuery(refundCountQuery).WithArgs(4, "refund", "completed").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectRollback()
+
+	if err := service.RollbackTransaction(context.Background(), 4, 9); !errors.Is(err, ErrAlreadyRefunded) {
+		t.Fatalf("err = %v, want ErrAlreadyRefunded", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRefundCreditBooksLinkedReversal(t *testing.T) {
+	service, mock := newTestTransactionService(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(lockTransactionQuery).WithArgs(4).WillReturnRows(transactionRow(4, "credit", "completed"))
+	mock.ExpectQuery(refundCountQuery).WithArgs(4, "refund", "completed").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO transactions (from_user_id, to_user_id, amount, currency, to_currency, to_amount, exchange_rate, type, status, parent_transaction_id)")).
+		WithArgs(1, nil, models.Money(1000), "USD", nil, nil, nil, "refund", "pending", 4).
+		WillReturnResult(sqlmock.NewResult(11, 1))
+	mock.ExpectExec(statusChangeQuery).WithArgs(int64(11), nil, "pending").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(balanceReadQuery).WithArgs(1, "USD").WillReturnRows(balanceRow("25.00", 1))
+	mock.ExpectExec(balanceUpdateQuery).WithArgs(models.Money(1500), 1, "USD", 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(historyInsertQuery).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE transactions SET status = ? WHERE id = ? AND status = ?")).
+		WithArgs("completed", int64(11), "pending").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(statusChangeQuery).WithArgs(int64(11), "pending", "completed").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_logs")).
+		WithArgs("transaction", 4, "refunded", `{"actor_id":9,"amount":10.00,"currency":"USD","reason":"duplicate","refund_id":11}`).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectQuery(transactionByIDQuery).WithArgs(11).
+		WillReturnRows(transactionRows().AddRow(11, 1, nil, 10.0, "USD", nil, nil, nil, "refund", "completed", nil, nil, nil, nil, 4, time.Now()))
+
+	refund, err := service.Refund(context.Background(), 4, 9, "duplicate")
+	if err != nil {
+		t.Fatalf("Refund: %v", err)
+	}
+	if refund.Type != "refund" || refund.ParentTransactionID == nil || *refund.ParentTransactionID != 4 {
+		t.Errorf("refund = %+v, want a refund linked to transaction 4", refund)
+	}
+	if refund.Amount != 1000 {
+		t.Errorf("refund amount = %v, want the original 10.00", refund.Amount)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// A second refund would pay back more than the original amount.
+func TestRefundRejectsAlreadyRefundedTransaction(t *testing.T) {
+	service, mock := newTestTransactionService(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(lockTransactionQuery).WithArgs(4).WillReturnRows(transactionRow(4, "credit", "completed"))
+	mock.ExpectQuery(refundCountQuery).WithArgs(4, "refund", "completed").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectRollback()
+
+	if _, err := service.Refund(context.Background(), 4, 9, "again"); !errors.Is(err, ErrAlreadyRefunded) {
+		t.Fatalf("err = %v, want ErrAlreadyRefunded", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// The credit also stores the adjustment reason on the transaction row.
+func TestCreditLinksBalanceHistoryToTransaction(t *testing.T) {
+	service, mock := newTestTransactionService(t)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO transactions (from_user_id, to_user_id, amount, currency, type, status, reason)")).
+		WithArgs(nil, 1, models.Money(1000), "USD", "credit", "pending", "chargeback won").WillReturnResult(sqlmock.NewResult(7, 1))
+	mock.ExpectExec(statusChangeQuery).WithArgs(int64(7), nil, "pending").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(balanceReadQuery).WithArgs(1, "USD").WillReturnRows(balanceRow("25.00", 1))
+	mock.ExpectExec(balanceUpdateQuery).WithArgs(models.Money(3500), 1, "USD", 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(historyInsertQuery).WithArgs(1, "USD", models.Money(3500), models.Money(1000), int64(7)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE transactions SET status = ? WHERE id = ? AND status = ?")).
+		WithArgs("completed", int64(7), "pending").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(statusChangeQuery).WithArgs(int64(7), "pending", "completed").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectQuery(transactionByIDQuery).WithArgs(7).WillReturnRows(transactionRow(7, "credit", "completed"))
+
+	if _, err := service.Credit(context.Background(), &models.CreditRequest{UserID: 1, Amount: 1000, Reason: "chargeback won"}, nil); err != nil {
+		t.Fatalf("Credit: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDebitStoresReason(t *testing.T) {
+	service, mock := newTestTransactionService(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(accountStatusQuery).WithArgs(1).WillReturnRows(accountStatus("active"))
+	mock.ExpectQuery(balanceByIDQuery).WithArgs(1, "USD").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "currency", "amount", "overdraft_limit", "version", "last_updated_at"}).AddRow(1, "USD", "25.00", 0, 1, time.Now()))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO transactions (from_user_id, to_user_id, amount, currency, type, status, reason)")).
+		WithArgs(1, nil, models.Money(1000), "USD", "debit", "pending", "duplicate payout").WillReturnResult(sqlmock.NewResult(8, 1))
+	mock.ExpectExec(statusChangeQuery).WithArgs(int64(8), nil, "pending").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(balanceReadQuery).WithArgs(1, "USD").WillReturnRows(balanceRow("25.00", 1))
+	mock.ExpectExec(balanceUpdateQuery).WithArgs(models.Money(1500), 1, "USD", 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(historyInsertQuery).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE transactions SET status = ? WHERE id = ? AND status = ?")).
+		WithArgs("completed", int64(8), "pending").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(statusChangeQuery).WithArgs(int64(8), "pending", "completed").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectQuery(transactionByIDQuery).WithArgs(8).
+		WillReturnRows(transactionRows().AddRow(8, 1, nil, 10.0, "USD", nil, nil, nil, "debit", "completed", nil, "duplicate payout", nil, nil, nil, time.Now()))
+
+	transaction, err := service.Debit(context.Background(), &models.DebitRequest{UserID: 1, Amount: 1000, Reason: "duplicate payout"}, nil)
+	if err != nil {
+		t.Fatalf("Debit: %v", err)
+	}
+	if transaction.Reason == nil || *transaction.Reason != "duplicate payout" {
+		t.Errorf("reason = %v, want the stored reason", transaction.Reason)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+var (
+	lockMerchantQuery     = regexp.QuoteMeta("SELECT id FROM users WHERE id = ? AND deleted_at IS NULL FOR UPDATE")
+	settlementLookupQuery = regexp.QuoteMeta("SELECT " + transactionColumns + " FROM transactions WHERE to_user_id = ? AND type = ? AND external_reference = ?")
+)
+
+// settlementRow is a completed settlement of 10.00 to user 1.
+func settlementRow(id int, reference string) *sqlmock.Rows {
+	return transactionRows().AddRow(id, nil, 1, 10.0, "USD", nil, nil, nil, "credit", "completed", nil, nil, nil, reference, nil, time.Now())
+}
+
+func TestSettleCreditsAndAudits(t *testing.T) {
+	service, mock := newTestTransactionService(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(lockMerchantQuery).WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(settlementLookupQuery).WithArgs(1, "credit", "payout-1").WillReturnRows(transactionRows())
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO transactions (from_user_id, to_user_id, amount, currency, type, status, external_reference)")).
+		WithArgs(nil, 1, models.Money(1000), "USD", "credit", "pending", "payout-1").WillReturnResult(sqlmock.NewResult(7, 1))
+	mock.ExpectExec(statusChangeQuery).WithArgs(int64(7), nil, "pending").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(balanceReadQuery).WithArgs(1, "USD").WillReturnRows(balanceRow("25.00", 1))
+	mock.ExpectExec(balanceUpdateQuery).WithArgs(models.Money(3500), 1, "USD", 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(historyInsertQuery).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE transactions SET status = ? WHERE id = ? AND status = ?")).
+		WithArgs("completed", int64(7), "pending").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(statusChangeQuery).WithArgs(int64(7), "pending", "completed").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_logs")).
+		WithArgs("transaction", 7, "settled", `{"actor_id":1,"amount":10.00,"currency":"USD","reference":"payout-1"}`).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectQuery(transactionByIDQuery).WithArgs(7).WillReturnRows(settlementRow(7, "payout-1"))
+
+	transaction, err := service.Settle(context.Background(), 1, &models.SettlementRequest{Amount: 1000, Reference: " payout-1 "})
+	if err != nil {
+		t.Fatalf("Settle: %v", err)
+	}
+	if transaction.ExternalReference == nil || *transaction.ExternalReference != "payout-1" {
+		t.Errorf("external reference = %v, want payout-1", transaction.ExternalReference)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSettleReplaysKnownReference(t *testing.T) {
+	service, mock := newTestTransactionService(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(lockMerchantQuery).WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(settlementLookupQuery).WithArgs(1, "credit", "payout-1").WillReturnRows(settlementRow(7, "payout-1"))
+	mock.ExpectRollback()
+
+	transaction, err := service.Settle(context.Background(), 1, &models.SettlementRequest{Amount: 1000, Currency: "usd", Reference: "payout-1"})
+	if err != nil {
+		t.Fatalf("Settle: %v", err)
+	}
+	if transaction.ID != 7 {
+		t.Errorf("replay returned transaction %d, want the original 7", transaction.ID)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSettleRejectsReusedReferenceWithDifferentAmount(t *testing.T) {
+	service, mock := newTestTransactionService(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(lockMerchantQuery).WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(settlementLookupQuery).WithArgs(1, "credit", "payout-1").WillReturnRows(settlementRow(7, "payout-1"))
+	mock.ExpectRollback()
+
+	_, err := service.Settle(context.Background(), 1, &models.SettlementRequest{Amount: 2000, Reference: "payout-1"})
+	if !errors.Is(err, ErrIdempotencyConflict) {
+		t.Fatalf("err = %v, want ErrIdempotencyConflict", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSettleRequiresReference(t *testing.T) {
+	service, mock := newTestTransactionService(t)
+
+	if _, err := service.Settle(context.Background(), 1, &models.SettlementRequest{Amount: 1000, Reference: "  "}); !errors.Is(err, ErrMissingReference) {
+		t.Fatalf("err = %v, want ErrMissingReference", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGetMerchantStats(t *testing.T) {
+	service, mock := newTestTransactionService(t)
+	from := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+
+	mock.ExpectQuery(regexp.QuoteMeta("WHERE to_user_id = ? AND COALESCE(to_currency, currency) = ? AND status = ? AND ((type = ? AND external_reference IS NOT NULL) OR type = ?) AND created_at >= ?")).
+		WithArgs("credit", "credit", "transfer", "transfer", 5, "USD", "completed", "credit", "transfer", from).
+		WillReturnRows(sqlmock.NewRows([]string{"settlements", "settled", "payments", "received"}).AddRow(2, 150.0, 3, 42.5))
+
+	stats, err := service.GetMerchantStats(context.Background(), 5, "USD", from, time.Time{})
+	if err != nil {
+		t.Fatalf("GetMerchantStats: %v", err)
+	}
+	if stats.SettlementCount != 2 || stats.TotalSettled != 15000 || stats.PaymentCount != 3 || stats.TotalReceived != 4250 {
+		t.Errorf("stats = %+v, want 2 settlements of 150.00 and 3 payments of 42.50", stats)
+	}
+	if stats.From == nil || !stats.From.Equal(from) || stats.To != nil {
+		t.Errorf("range = %v..%v, want from %v and an open end", stats.From, stats.To, from)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGetUserStats(t *testing.T) {
+	service, mock := newTestTransactionService(t)
+	from := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2026, 10, 31, 0, 0, 0, 0, time.UTC)
+
+	// Seeded ledger for user 1: credits of 100.00 and 20.00 received, a
+	// debit of 30.00, a failed debit and a rolled-back transfer.
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*),")).
+		WithArgs(1, "USD", 1, "USD", 1, "USD", 1, "USD", from, to, "completed").
+		WillReturnRows(sqlmock.NewRows([]string{"count", "credited", "debited"}).AddRow(3, 120.0, 30.0))
+	mock.ExpectQuery(regexp.QuoteMeta("GROUP BY type, status")).
+		WithArgs(1, "USD", 1, "USD", from, to).
+		WillReturnRows(sqlmock.NewRows([]string{"type", "status", "count"}).
+			AddRow("credit", "completed", 2).
+			AddRow("debit", "completed", 1).
+			AddRow("debit", "failed", 1).
+			AddRow("transfer", "rolled_back", 1))
+
+	stats, err := service.GetUserStats(context.Background(), 1, "USD", from, to)
+	if err != nil {
+		t.Fatalf("GetUserStats: %v", err)
+	}
+	if stats.TransactionCount != 3 || stats.TotalCredited != 12000 || stats.TotalDebited != 3000 || stats.Net != 9000 {
+		t.Errorf("totals = %+v, want 3 completed, 120.00 in, 30.00 out, 90.00 net", stats)
+	}
+	wantTypes := map[string]int{"credit": 2, "debit": 2, "transfer": 1}
+	wantStatuses := map[string]int{"completed": 3, "failed": 1, "rolled_back": 1}
+	for k, v := range wantTypes {
+		if stats.CountByType[k] != v {
+			t.Errorf("count_by_type[%s] = %d, want %d", k, stats.CountByType[k], v)
+		}
+	}
+	for k, v := range wantStatuses {
+		if stats.CountByStatus[k] != v {
+			t.Errorf("count_by_status[%s] = %d, want %d", k, stats.CountByStatus[k], v)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTransactionCursorRoundTrip(t *testing.T) {
+	createdAt := time.Date(2026, 10, 14, 9, 30, 0, 123456000, time.UTC)
+	gotAt, gotID, err := decodeTransactionCursor(encodeTransactionCursor(createdAt, 42))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !gotAt.Equal(createdAt) || gotID != 42 {
+		t.Errorf("decoded (%v, %d), want (%v, 42)", gotAt, gotID, createdAt)
+	}
+
+	for _, cursor := range []string{"not base64!", "bm8tY29sb24", "YWJjOjE", "MTIzOmFiYw", "MTIzOjA"} {
+		if _, _, err := decodeTransactionCursor(cursor); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("decode(%q) err = %v, want ErrInvalidCursor", cursor, err)
+		}
+	}
+}
+
+// TestGetUserTransactionsCursorIsStable pages through a history while a new
+// transaction arrives between the two pages. The second page continues
+// below the last row seen, so nothing repeats and nothing is skipped.
+func TestGetUserTransactionsCursorIsStable(t *testing.T) {
+	service, mock := newTestTransactionService(t)
+	base := time.Date(2026, 10, 14, 9, 0, 0, 0, time.UTC)
+	row := func(rows *sqlmock.Rows, id int) *sqlmock.Rows {
+		return rows.AddRow(id, nil, 1, 10.0, "USD", nil, nil, nil, "credit", "completed", nil, nil, nil, nil, nil, base.Add(time.Duration(id)*time.Minute))
+	}
+	pageQuery := regexp.QuoteMeta("ORDER BY created_at DESC, id DESC")
+
+	mock.ExpectQuery(pageQuery).WithArgs(1, 1, 3).
+		WillReturnRows(row(row(row(transactionRows(), 5), 4), 3))
+	// Transaction 6 is inserted now; the cursor keeps it off page two.
+	cursorAt := base.Add(4 * time.Minute)
+	mock.ExpectQuery(pageQuery).WithArgs(1, 1, cursorAt, cursorAt, 4, 3).
+		WillReturnRows(row(row(transactionRows(), 3), 2))
+
+	first, next, err := service.GetUserTransactionsCursor(context.Background(), 1, "", 2)
+	if err != nil {
+		t.Fatalf("first page: %v", err)
+	}
+	if len(first) != 2 || first[0].ID != 5 || first[1].ID != 4 || next == "" {
+		t.Fatalf("first page = %d rows, next %q; want 5, 4 and a cursor", len(first), next)
+	}
+
+	second, last, err := service.GetUserTransactionsCursor(context.Background(), 1, next, 2)
+	if err != nil {
+		t.Fatalf("second page: %v", err)
+	}
+	if len(second) != 2 || second[0].ID != 3 || second[1].ID != 2 {
+		t.Errorf("second page = %+v, want 3, 2", second)
+	}
+	if last != "" {
+		t.Errorf("next cursor = %q, want none on the last page", last)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// expectExchangeStart expects an exchange of 100.00 USD into EUR by user 1
+// up to the source-currency debit.
+func expectExchangeStart(mock sqlmock.Sqlmock) {
+	mock.ExpectBegin()
+	mock.ExpectQuery(accountStatusQuery).WithArgs(1).WillReturnRows(accountStatus("active"))
+	mock.ExpectQuery(balanceByIDQuery).WithArgs(1, "USD").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "currency", "amount", "overdraft_limit", "version", "last_updated_at"}).AddRow(1, "USD", "250.00", 0, 3, time.Now()))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO transactions (from_user_id, to_user_id, amount, currency, to_currency, to_amount, exchange_rate, type, status)")).
+		WithArgs(1, 1, models.Money(10000), "USD", "EUR", models.Money(9050), 0.905, "exchange", "pending").
+		WillReturnResult(sqlmock.NewResult(12, 1))
+	mock.ExpectExec(statusChangeQuery).WithArgs(int64(12), nil, "pending").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(balanceReadQuery).WithArgs(1, "USD").WillReturnRows(balanceRow("250.00", 3))
+	mock.ExpectExec(balanceUpdateQuery).WithArgs(models.Money(15000), 1, "USD", 3).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(historyInsertQuery).WithArgs(1, "USD", models.Money(15000), models.Money(-10000), int64(12)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+}
+
+func TestExchangeWritesBothLegsAtTheRate(t *testing.T) {
+	service, mock := newTestTransactionService(t)
+
+	expectExchangeStart(mock)
+	mock.ExpectQuery(balanceReadQuery).WithArgs(1, "EUR").WillReturnRows(balanceRow("5.00", 1))
+	mock.ExpectExec(balanceUpdateQuery).WithArgs(models.Money(9550), 1, "EUR", 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(historyInsertQuery).WithArgs(1, "EUR", models.Money(9550), models.Money(9050), int64(12)).
+		WillReturnResult(sqlmock.NewResult(2, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE transactions SET status = ? WHERE id = ? AND status = ?")).
+		WithArgs("completed", int64(12), "pending").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(statusChangeQuery).WithArgs(int64(12), "pending", "completed").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectQuery(transactionByIDQuery).WithArgs(12).
+		WillReturnRows(transactionRows().AddRow(12, 1, 1, "100.00", "USD", "EUR", "90.50", 0.905, "exchange", "completed", nil, nil, nil, nil, nil, time.Now()))
+
+	req := &models.ExchangeRequest{UserID: 1, FromCurrency: "usd", ToCurrency: "eur", Amount: 10000, Rate: 0.905}
+	transaction, err := service.Exchange(context.Background(), req, nil)
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if transaction.ToAmount == nil || *transaction.ToAmount != 9050 {
+		t.Errorf("to_amount = %v, want 90.50", transaction.ToAmount)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExchangeRollsBackWhenTheCreditLegFails(t *testing.T) {
+	service, mock := newTestTransactionService(t)
+
+	expectExchangeStart(mock)
+	mock.ExpectQuery(balanceReadQuery).WithArgs(1, "EUR").WillReturnError(errors.New("connection reset"))
+	mock.ExpectRollback()
+
+	req := &models.ExchangeRequest{UserID: 1, FromCurrency: "USD", ToCurrency: "EUR", Amount: 10000, Rate: 0.905}
+	if _, err := service.Exchange(context.Background(), req, nil); err == nil {
+		t.Fatal("Exchange succeeded with a failed credit leg")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExchangeValidatesRequest(t *testing.T) {
+	service, mock := newTestTransactionService(t)
+
+	tests := []struct {
+		name string
+		req  models.ExchangeRequest
+	}{
+		{"zero rate", models.ExchangeRequest{UserID: 1, FromCurrency: "USD", ToCurrency: "EUR", Amount: 10000}},
+		{"negative rate", models.ExchangeRequest{UserID: 1, FromCurrency: "USD", ToCurrency: "EUR", Amount: 10000, Rate: -1}},
+		{"same currency", models.ExchangeRequest{UserID: 1, FromCurrency: "USD", ToCurrency: "usd", Amount: 10000, Rate: 1}},
+		{"rounds to zero", models.ExchangeRequest{UserID: 1, FromCurrency: "USD", ToCurrency: "EUR", Amount: 1, Rate: 0.001}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := service.Exchange(context.Background(), &tt.req, nil); err == nil {
+				t.Error("Exchange accepted an invalid request")
+			}
+		})
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWithdrawRecordsFailureMetric(t *testing.T) {
+	service, _ := newTestTransactionService(t)
+	failures := metrics.TransactionsTotal.WithLabelValues("withdrawal", "failure")
+	before := testutil.ToFloat64(failures)
+
+	if _, err := service.Withdraw(context.Background(), &models.WithdrawRequest{UserID: 3, Amount: 500}, nil); err == nil {
+		t.Fatal("Withdraw accepted a request without a destination")
+	}
+
+	if got := testutil.ToFloat64(failures) - before; got != 1 {
+		t.Errorf("withdrawal failures grew by %v, want 1", got)
+	}
+}
+
+var failedTransactionInsert = regexp.QuoteMeta("INSERT INTO transactions (from_user_id, to_user_id, amount, currency, type, status, failure_reason) VALUES (?, ?, ?, ?, ?, ?, ?)")
+
+// expectFailedRecord expects the separate write that keeps a declined attempt.
+func expectFailedRecord(mock sqlmock.Sqlmock, fromUserID int, toUserID interface{}, amount models.Money, txType string, reason error) {
+	mock.ExpectBegin()
+	mock.ExpectExec(failedTransactionInsert).
+		WithArgs(fromUserID, toUserID, amount, "USD", txType, "failed", reason.Error()).
+		WillReturnResult(sqlmock.NewResult(30, 1))
+	mock.ExpectExec(statusChangeQuery).WithArgs(int64(30), nil, "failed").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+}
+
+func TestDeclinedTransactionsLeaveFailedRow(t *testing.T) {
+	balance := func(amount string) *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"user_id", "currency", "amount", "overdraft_limit", "version", "last_updated_at"}).AddRow(1, "USD", amount, 0, 1, time.Now())
+	}
+
+	t.Run("debit", func(t *testing.T) {
+		service, mock := newTestTransactionService(t)
+		mock.ExpectBegin()
+		mock.ExpectQuery(accountStatusQuery).WithArgs(1).WillReturnRows(accountStatus("active"))
+		mock.ExpectQuery(balanceByIDQuery).WithArgs(1, "USD").WillReturnRows(balance("5.00"))
+		mock.ExpectRollback()
+		expectFailedRecord(mock, 1, nil, 1000, "debit", ErrInsufficientBalance)
+
+		_, err := service.Debit(context.Background(), &models.DebitRequest{UserID: 1, Amount: 1000, Currency: "usd"}, nil)
+		if !errors.Is(err, ErrInsufficientBalance) {
+			t.Fatalf("Debit err = %v, want ErrInsufficientBalance", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("withdrawal", func(t *testing.T) {
+		service, mock := newTestTransactionService(t)
+		mock.ExpectBegin()
+		mock.ExpectQuery(accountStatusQuery).WithArgs(1).WillReturnRows(accountStatus("active"))
+		mock.ExpectQuery(balanceByIDQuery).WithArgs(1, "USD").WillReturnRows(balance("5.00"))
+		mock.ExpectRollback()
+		expectFailedRecord(mock, 1, nil, 1000, "withdrawal", ErrInsufficientBalance)
+
+		_, err := service.Withdraw(context.Background(), &models.WithdrawRequest{UserID: 1, Amount: 1000, Currency: "USD", Destination: "IBAN-1"}, nil)
+		if !errors.Is(err, ErrInsufficientBalance) {
+			t.Fatalf("Withdraw err = %v, want ErrInsufficientBalance", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("exchange", func(t *testing.T) {
+		service, mock := newTestTransactionService(t)
+		mock.ExpectBegin()
+		mock.ExpectQuery(accountStatusQuery).WithArgs(1).WillReturnRows(accountStatus("active"))
+		mock.ExpectQuery(balanceByIDQuery).WithArgs(1, "USD").WillReturnRows(balance("5.00"))
+		mock.ExpectRollback()
+		expectFailedRecord(mock, 1, 1, 1000, "exchange", ErrInsufficientBalance)
+
+		_, err := service.Exchange(context.Background(), &models.ExchangeRequest{UserID: 1, FromCurrency: "USD", ToCurrency: "EUR", Amount: 1000, Rate: 0.9}, nil)
+		if !errors.Is(err, ErrInsufficientBalance) {
+			t.Fatalf("Exchange err = %v, want ErrInsufficientBalance", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("internal errors are not recorded", func(t *testing.T) {
+		service, mock := newTestTransactionService(t)
+		mock.ExpectBegin()
+		mock.ExpectQuery(accountStatusQuery).WithArgs(1).WillReturnRows(accountStatus("active"))
+		mock.ExpectQuery(balanceByIDQuery).WithArgs(1, "USD").WillReturnError(errors.New("connection reset"))
+		mock.ExpectRollback()
+
+		if _, err := service.Debit(context.Background(), &models.DebitRequest{UserID: 1, Amount: 1000}, nil); err == nil {
+			t.Fatal("Debit succeeded without a balance")
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+// TestFrozenAccountCannotSendMoney checks that money can leave a frozen
+// account by no route, while credits into it, which never read the status,
+// still go through.
+func TestFrozenAccountCannotSendMoney(t *testing.T) {
+	tests := []struct {
+		name   string
+		txType string
+		to     interface{}
+		call   func(*TransactionService) error
+	}{
+		{"debit", "debit", nil, func(s *TransactionService) error {
+			_, err := s.Debit(context.Background(), &models.DebitRequest{UserID: 1, Amount: 1000}, nil)
+			return err
+		}},
+		{"withdrawal", "withdrawal", nil, func(s *TransactionService) error {
+			_, err := s.Withdraw(context.Background(), &models.WithdrawRequest{UserID: 1, Amount: 1000, Destination: "IBAN-1"}, nil)
+			return err
+		}},
+		{"transfer", "transfer", 2, func(s *TransactionService) error {
+			_, err := s.Transfer(context.Background(), &models.TransferRequest{FromUserID: 1, ToUserID: 2, Amount: 1000}, nil)
+			return err
+		}},
+		{"exchange", "exchange", 1, func(s *TransactionService) error {
+			_, err := s.Exchange(context.Background(), &models.ExchangeRequest{UserID: 1, FromCurrency: "USD", ToCurrency: "EUR", Amount: 1000, Rate: 0.9}, nil)
+			return err
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service, mock := newTestTransactionService(t)
+			mock.ExpectBegin()
+			mock.ExpectQuery(accountStatusQuery).WithArgs(1).WillReturnRows(accountStatus("frozen"))
+			mock.ExpectRollback()
+			expectFailedRecord(mock, 1, tt.to, 1000, tt.txType, ErrAccountFrozen)
+
+			if err := tt.call(service); !errors.Is(err, ErrAccountFrozen) {
+				t.Fatalf("err = %v, want ErrAccountFrozen", err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestTransactionsRefusedWhileDraining(t *testing.T) {
+	db, mock := newMockDB(t)
+	inFlight := lifecycle.NewTracker()
+	service := NewTransactionService(db, zerolog.Nop(), NewBalanceService(db, zerolog.Nop()), time.Minute, TransactionLimits{}, inFlight)
+	inFlight.Drain()
+
+	if _, err := service.Credit(context.Background(), &models.CreditRequest{UserID: 1, Amount: 1000}, nil); !errors.Is(err, ErrShuttingDown) {
+		t.Errorf("Credit = %v, want ErrShuttingDown", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGetStatementRunningBalance(t *testing.T) {
+	service, mock := newTestTransactionService(t)
+	from := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 1, 0)
+
+	mock.ExpectQuery(regexp.QuoteMeta("AND created_at < ?")).
+		WithArgs(1, "USD", 1, "USD", 1, "USD", 1, "USD", "completed", from).
+		WillReturnRows(sqlmock.NewRows([]string{"opening"}).AddRow("50.00"))
+	mock.ExpectQuery(regexp.QuoteMeta("AND created_at >= ? AND created_at <= ?")).
+		WithArgs(1, "USD", 1, "USD", "completed", from, to).
+		WillReturnRows(transactionRows().
+			AddRow(1, 2, 1, 20.0, "USD", nil, nil, nil, "transfer", "completed", nil, nil, nil, nil, nil, from.Add(time.Hour)).
+			AddRow(2, 1, nil, 30.0, "USD", nil, nil, nil, "withdrawal", "completed", nil, nil, nil, "IBAN-1", nil, from.Add(2*time.Hour)).
+			AddRow(3, nil, 1, 5.0, "USD", nil, nil, nil, "credit", "completed", nil, nil, nil, nil, nil, from.Add(3*time.Hour)))
+
+	statement, err := service.GetStatement(context.Background(), 1, "USD", from, to)
+	if err != nil {
+		t.Fatalf("GetStatement: %v", err)
+	}
+
+	want := []struct {
+		amount, balance models.Money
+		counterparty    string
+	}{
+		{2000, 7000, "user:2"},
+		{-3000, 4000, "IBAN-1"},
+		{500, 4500, ""},
+	}
+	if len(statement.Entries) != len(want) {
+		t.Fatalf("got %d entries, want %d", len(statement.Entries), len(want))
+	}
+	for i, w := range want {
+		e := statement.Entries[i]
+		if e.Amount != w.amount || e.RunningBalance != w.balance || e.Counterparty != w.counterparty {
+			t.Errorf("entry %d = %s / %s / %q, want %s / %s / %q",
+				i, e.Amount, e.RunningBalance, e.Counterparty, w.amount, w.balance, w.counterparty)
+		}
+	}
+	if statement.OpeningBalance != 5000 || statement.ClosingBalance != 4500 {
+		t.Errorf("opening %s, closing %s; want 50.00 and 45.00", statement.OpeningBalance, statement.ClosingBalance)
+	}
+}
+
+func TestCreditLogsCarryRequestID(t *testing.T) {
+	service, mock := newTestTransactionService(t)
+	var buf bytes.Buffer
+	service.logger = zerolog.New(&buf)
+
+	mock.ExpectBegin().WillReturnError(errors.New("connection refused"))
+
+	ctx := context.WithValue(context.Background(), middleware.RequestIDKey, "req-42")
+	if _, err := service.Credit(ctx, &models.CreditRequest{UserID: 1, Amount: 1000}, nil); err == nil {
+		t.Fatal("Credit succeeded without a transaction")
+	}
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(bytes.TrimSpace(buf.Bytes()), &entry); err != nil {
+		t.Fatalf("log output is not a single JSON event: %v\n%s", err, buf.String())
+	}
+	if entry["request_id"] != "req-42" {
+		t.Errorf("request_id = %v, want req-42 in %s", entry["request_id"], buf.String())
+	}
+}
+
+func TestQueriesStopOnCancelledContext(t *testing.T) {
+	service, mock := newTestTransactionService(t)
+	users := NewUserService(service.db, zerolog.Nop())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := service.GetTransactionByID(ctx, 1); !errors.Is(err, context.Canceled) {
+		t.Errorf("GetTransactionByID err = %v, want context.Canceled", err)
+	}
+	if _, err := service.GetUserTransactions(ctx, 1, 10, 0); !errors.Is(err, context.Canceled) {
+		t.Errorf("GetUserTransactions err = %v, want context.Canceled", err)
+	}
+	if _, err := service.Debit(ctx, &models.DebitRequest{UserID: 1, Amount: 1000}, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("Debit err = %v, want context.Canceled", err)
+	}
+	if _, err := users.GetUserByID(ctx, 1); !errors.Is(err, context.Canceled) {
+		t.Errorf("GetUserByID err = %v, want context.Canceled", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWithdrawAndExchangeRetryDeadlocks(t *testing.T) {
+	// The first attempt deadlocks and is retried; the second is declined and
+	// recorded once.
+	expectDeadlockThenDecline := func(mock sqlmock.Sqlmock) {
+		mock.ExpectBegin()
+		mock.ExpectQuery(accountStatusQuery).WithArgs(1).WillReturnError(&mysql.MySQLError{Number: mysqlErrDeadlockDetected})
+		mock.ExpectRollback()
+		mock.ExpectBegin()
+		mock.ExpectQuery(accountStatusQuery).WithArgs(1).WillReturnRows(accountStatus("active"))
+		mock.ExpectQuery(balanceByIDQuery).WithArgs(1, "USD").
+			WillReturnRows(sqlmock.NewRows([]string{"user_id", "currency", "amount", "overdraft_limit", "version", "last_updated_at"}).AddRow(1, "USD", "5.00", 0, 1, time.Now()))
+		mock.ExpectRollback()
+	}
+
+	t.Run("withdrawal", func(t *testing.T) {
+		service, mock := newTestTransactionService(t)
+		expectDeadlockThenDecline(mock)
+		expectFailedRecord(mock, 1, nil, 1000, "withdrawal", ErrInsufficientBalance)
+
+		_, err := service.Withdraw(context.Background(), &models.WithdrawRequest{UserID: 1, Amount: 1000, Currency: "USD", Destination: "IBAN-1"}, nil)
+		if !errors.Is(err, ErrInsufficientBalance) {
+			t.Fatalf("Withdraw err = %v, want ErrInsufficientBalance", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("exchange", func(t *testing.T) {
+		service, mock := newTestTransactionService(t)
+		expectDeadlockThenDecline(mock)
+		expectFailedRecord(mock, 1, 1, 1000, "exchange", ErrInsufficientBalance)
+
+		_, err := service.Exchange(context.Background(), &models.ExchangeRequest{UserID: 1, FromCurrency: "USD", ToCurrency: "EUR", Amount: 1000, Rate: 0.9}, nil)
+		if !errors.Is(err, ErrInsufficientBalance) {
+			t.Fatalf("Exchange err = %v, want ErrInsufficientBalance", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+// expectTransfer expects a completed 10.00 USD transfer between users 1 and
+// 2 that locks their balance rows in user_id order whichever way the money
+// moves. memo is the stored memo, or nil.
+func expectTransfer(mock sqlmock.Sqlmock, from, to int, memo interface{}) {
+	mock.ExpectBegin()
+	mock.ExpectQuery(accountStatusQuery).WithArgs(from).WillReturnRows(accountStatus("active"))
+	mock.ExpectQuery(receiverQuery).WithArgs(to).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(to))
+	mock.ExpectQuery(balanceByIDQuery).WithArgs(from, "USD").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "currency", "amount", "overdraft_limit", "version", "last_updated_at"}).AddRow(from, "USD", "50.00", 0, 1, time.Now()))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO transactions (from_user_id, to_user_id, amount, currency, to_currency, to_amount, exchange_rate, type, status, memo)")).
+		WithArgs(from, to, models.Money(1000), "USD", nil, nil, nil, "transfer", "pending", memo).WillReturnResult(sqlmock.NewResult(9, 1))
+	mock.ExpectExec(statusChangeQuery).WithArgs(int64(9), nil, "pending").WillReturnResult(sqlmock.NewResult(1, 1))
+	for userID := 1; userID <= 2; userID++ {
+		change := models.Money(1000)
+		if userID == from {
+			change = -1000
+		}
+		mock.ExpectQuery(balanceReadQuery).WithArgs(userID, "USD").WillReturnRows(balanceRow("50.00", 1))
+		mock.ExpectExec(balanceUpdateQuery).WithArgs(models.Money(5000)+change, userID, "USD", 1).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(historyInsertQuery).WithArgs(userID, "USD", models.Money(5000)+change, change, int64(9)).WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE transactions SET status = ? WHERE id = ? AND status = ?")).
+		WithArgs("completed", int64(9), "pending").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(statusChangeQuery).WithArgs(int64(9), "pending", "completed").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectQuery(transactionByIDQuery).WithArgs(9).
+		WillReturnRows(transactionRows().AddRow(9, from, to, 10.0, "USD", nil, nil, nil, "transfer", "completed", nil, nil, memo, nil, nil, time.Now()))
+}
+
+// TestTransferToMissingReceiver checks that an unknown or deleted receiver is
+// refused before any balance is read, and that no failed row is recorded
+// against a user that does not exist.
+func TestTransferToMissingReceiver(t *testing.T) {
+	service, mock := newTestTransactionService(t)
+	mock.ExpectBegin()
+	mock.ExpectQuery(accountStatusQuery).WithArgs(1).WillReturnRows(accountStatus("active"))
+	mock.ExpectQuery(receiverQuery).WithArgs(99).WillReturnError(sql.ErrNoRows)
+	mock.ExpectRollback()
+
+	_, err := service.Transfer(context.Background(), &models.TransferRequest{FromUserID: 1, ToUserID: 99, Amount: 1000, Currency: "USD"}, nil)
+	if !errors.Is(err, ErrReceiverNotFound) {
+		t.Fatalf("err = %v, want ErrReceiverNotFound", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOpposingTransfersLockBalancesInUserIDOrder(t *testing.T) {
+	forward, forwardMock := newTestTransactionService(t)
+	expectTransfer(forwardMock, 1, 2, nil)
+	reverse, reverseMock := newTestTransactionService(t)
+	expectTransfer(reverseMock, 2, 1, nil)
+
+	errs := make(chan error, 2)
+	go func() {
+		_, err := forward.Transfer(context.Background(), &models.TransferRequest{FromUserID: 1, ToUserID: 2, Amount: 1000, Currency: "USD"}, nil)
+		errs <- err
+	}()
+	go func() {
+		_, err := reverse.Transfer(context.Background(), &models.TransferRequest{FromUserID: 2, ToUserID: 1, Amount: 1000, Currency: "USD"}, nil)
+		errs <- err
+	}()
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("Transfer: %v", err)
+		}
+	}
+
+	for name, mock := range map[string]sqlmock.Sqlmock{"1 -> 2": forwardMock, "2 -> 1": reverseMock} {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestTransferMemoRoundTrips(t *testing.T) {
+	service, mock := newTestTransactionService(t)
+	expectTransfer(mock, 1, 2, "rent")
+
+	transaction, err := service.Transfer(context.Background(), &models.TransferRequest{FromUserID: 1, ToUserID: 2, Amount: 1000, Currency: "USD", Memo: "rent"}, nil)
+	if err != nil {
+		t.Fatalf("Transfer: %v", err)
+	}
+	if transaction.Memo == nil || *transaction.Memo != "rent" {
+		t.Errorf("memo = %v, want rent", transaction.Memo)
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta("WHERE from_user_id = ? OR to_user_id = ?")).WithArgs(2, 2, 10, 0).
+		WillReturnRows(transactionRows().
+			AddRow(9, 1, 2, 10.0, "USD", nil, nil, nil, "transfer", "completed", nil, nil, "rent", nil, nil, time.Now()).
+			AddRow(8, nil, 2, 10.0, "USD", nil, nil, nil, "credit", "completed", nil, nil, nil, nil, nil, time.Now()))
+	history, err := service.GetUserTransactions(context.Background(), 2, 10, 0)
+	if err != nil {
+		t.Fatalf("GetUserTransactions: %v", err)
+	}
+	if len(history) != 2 || history[0].Memo == nil || *history[0].Memo != "rent" || history[1].Memo != nil {
+		t.Errorf("history = %+v, want the memo on the transfer only", history)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -1,9 +1,15 @@
 package services
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	"go-projects/internal/models"
 
@@ -11,53 +17,167 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
+var (
+	ErrInvalidRole         = errors.New("invalid role")
+	ErrUserExists          = errors.New("user with this email or username already exists")
+	ErrUserNotFound        = errors.New("user not found")
+	ErrAdminRequired       = errors.New("only admins can perform this action")
+	ErrCannotDeleteSelf    = errors.New("admins cannot delete their own account")
+	ErrSameUser            = errors.New("source and target must be different users")
+	ErrMergeCrossTransfers = errors.New("accounts have transfers between each other; merging would create self-transfers")
+
+	ErrInvalidResetToken = errors.New("invalid or expired password reset token")
+	ErrAccountLocked     = errors.New("too many failed login attempts; try again later")
+)
+
+const passwordResetTTL = time.Hour
+
+// PasswordResetNotifier delivers a freshly issued reset token to the account
+// owner. The token must never be written anywhere else.
+type PasswordResetNotifier interface {
+	SendPasswordReset(email, token string) error
+}
+
+// NoopResetNotifier discards reset tokens; it is used until mail delivery is
+// configured.
+type NoopResetNotifier struct{}
+
+func (NoopResetNotifier) SendPasswordReset(email, token string) error {
+	return nil
+}
+
+// Failed logins are counted per email within a window; reaching the maximum
+// locks the email out for loginLockoutDuration, whether or not it belongs to
+// an account, so the lockout cannot be used to probe for registered emails.
+const (
+	maxFailedLogins      = 5
+	failedLoginWindow    = 15 * time.Minute
+	loginLockoutDuration = 15 * time.Minute
+)
+
+// RegistrationPolicy decides which roles clients may pick for themselves when
+// registering. Admin is never one of them; admins are appointed by an
+// existing admin.
+type RegistrationPolicy struct {
+	AllowMerchant bool
+}
+
+func (p RegistrationPolicy) allows(role models.UserRole) bool {
+	switch role {
+	case models.RoleUser:
+		return true
+	case models.RoleMerchant:
+		return p.AllowMerchant
+	default:
+		return false
+	}
+}
+
 type UserService struct {
-	db     *sql.DB
-	logger zerolog.Logger
+	db            *sql.DB
+	logger        zerolog.Logger
+	auditService  *AuditService
+	resetNotifier PasswordResetNotifier
 }
 
 func NewUserService(db *sql.DB, logger zerolog.Logger) *UserService {
 	return &UserService{
-		db:     db,
-		logger: logger,
+		db:            db,
+		logger:        logger,
+		auditService:  NewAuditService(db, logger),
+		resetNotifier: NoopResetNotifier{},
 	}
 }
 
-func (s *UserService) Register(req *models.RegisterRequest) (*models.User, error) {
+// SetResetNotifier replaces the notifier used to deliver password reset tokens.
+func (s *UserService) SetResetNotifier(notifier PasswordResetNotifier) {
+	s.resetNotifier = notifier
+}
+
+// Register creates a self-registered account. A valid role the policy does
+// not allow, such as admin, is ignored and the account gets the user role.
+func (s *UserService) Register(ctx context.Context, req *models.RegisterRequest, policy RegistrationPolicy) (*models.User, error) {
 	if req.Username == "" || req.Email == "" || req.Password == "" {
 		return nil, errors.New("username, email, and password are required")
 	}
 
-	validRole := false
-	validRoles := []string{string(models.RoleUser), string(models.RoleAdmin), string(models.RoleMerchant)}
-	for _, r := range validRoles {
-		if req.Role == r {
-			validRole = true
-			break
-		}
+	if req.Role == "" {
+		req.Role = string(models.RoleUser)
 	}
-	if !validRole {
+	if !models.UserRole(req.Role).IsValid() {
+		return nil, ErrInvalidRole
+	}
+	if !policy.allows(models.UserRole(req.Role)) {
+		s.logger.Warn().Str("email", req.Email).Str("requested_role", req.Role).Msg("Ignoring role not allowed at registration")
 		req.Role = string(models.RoleUser)
 	}
+
+	user, err := s.insertUser(ctx, req.Username, req.Email, req.Password, req.Role)
+	if err != nil {
+		return nil, err
+	}
+
+	s.logger.Info().Int("user_id", user.ID).Str("email", user.Email).Msg("User registered successfully")
+	return user, nil
+}
+
+// CreateUser lets an admin open an account with any valid role. Without a
+// password a temporary one is generated; it is returned only here and never
+// stored in plain text.
+func (s *UserService) CreateUser(ctx context.Context, req *models.CreateUserRequest, adminID int) (*models.User, string, error) {
+	if !models.UserRole(req.Role).IsValid() {
+		return nil, "", ErrInvalidRole
+	}
+
+	password, temporaryPassword := req.Password, ""
+	if password == "" {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return nil, "", fmt.Errorf("failed to generate temporary password: %w", err)
+		}
+		temporaryPassword = hex.EncodeToString(b)
+		password = temporaryPassword
+	}
+
+	user, err := s.insertUser(ctx, req.Username, req.Email, password, req.Role)
+	if err != nil {
+		return nil, "", err
+	}
+
+	s.auditService.Log("user", user.ID, "created", map[string]interface{}{
+		"actor_id":           adminID,
+		"role":               user.Role,
+		"temporary_password": temporaryPassword != "",
+	})
+
+	s.logger.Info().Int("user_id", user.ID).Str("role", user.Role).Int("admin_id", adminID).Msg("User created by admin")
+	return user, temporaryPassword, nil
+}
+
+func (s *UserService) insertUser(ctx context.Context, username, email, password, role string) (*models.User, error) {
 	var existingID int
-	err := s.db.QueryRow("SELECT id FROM users WHERE email = ? OR username = ?", req.Email, req.Username).Scan(&existingID)
+	err := s.db.QueryRowContext(ctx, "SELECT id FROM users WHERE email = ? OR username = ?", email, username).Scan(&existingID)
 	if err == nil {
-		return nil, errors.New("user with this email or username already exists")
+		return nil, ErrUserExists
 	} else if err != sql.ErrNoRows {
 		s.logger.Error().Err(err).Msg("Error checking existing user")
 		return nil, fmt.Errorf("database error: %w", err)
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
 		s.logger.Error().Err(err).Msg("Error hashing password")
 		return nil, fmt.Errorf("failed to hash password: %w", err)
 	}
 
-	result, err := s.db.Exec(
+	result, err := s.db.ExecContext(ctx,
 		"INSERT INTO users (username, email, password_hash, role) VALUES (?, ?, ?, ?)",
-		req.Username, req.Email, string(hashedPassword), req.Role,
+		username, email, string(hashedPassword), role,
 	)
+	if isDuplicateKeyError(err) {
+		// A concurrent registration won the race after our pre-check.
+		return nil, ErrUserExists
+	}
 	if err != nil {
 		s.logger.Error().Err(err).Msg("Error creating user")
 		return nil, fmt.Errorf("failed to create user: %w", err)
@@ -69,31 +189,41 @@ func (s *UserService) Register(req *models.RegisterRequest) (*models.User, error
 		return nil, fmt.Errorf("failed to get user ID: %w", err)
 	}
 
-	user, err := s.GetUserByID(int(userID))
-	if err != nil {
-		return nil, err
-	}
-
-	s.logger.Info().Int("user_id", user.ID).Str("email", user.Email).Msg("User registered successfully")
-	return user, nil
+	return s.GetUserByID(ctx, int(userID))
 }
 
-func (s *UserService) Authenticate(req *models.LoginRequest) (*models.User, error) {
+func (s *UserService) Authenticate(ctx context.Context, req *models.LoginRequest) (*models.User, error) {
 	if req.Email == "" || req.Password == "" {
 		return nil, errors.New("email and password are required")
 	}
 
+	email := strings.ToLower(strings.TrimSpace(req.Email))
+
+	locked, err := s.isLoginLocked(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+	if locked {
+		s.logger.Warn().Str("email", req.Email).Msg("Login attempt on locked account")
+		return nil, ErrAccountLocked
+	}
+
 	var user models.User
 	var passwordHash string
 
-	err := s.db.QueryRow(
-		"SELECT id, username, email, password_hash, role, created_at, updated_at FROM users WHERE email = ?",
+	err = s.db.QueryRowContext(ctx,
+		"SELECT id, username, email, password_hash, role, created_at, updated_at FROM users WHERE email = ? AND deleted_at IS NULL",
 		req.Email,
 	).Scan(
 		&user.ID, &user.Username, &user.Email, &passwordHash, &user.Role, &user.CreatedAt, &user.UpdatedAt,
 	)
 
 	if err == sql.ErrNoRows {
+		s.auditService.Log("user", 0, "login_failed", map[string]interface{}{
+			"email":  req.Email,
+			"reason": "unknown_email",
+		})
+		s.recordFailedLogin(ctx, email)
 		return nil, errors.New("invalid email or password")
 	}
 	if err != nil {
@@ -104,6 +234,11 @@ func (s *UserService) Authenticate(req *models.LoginRequest) (*models.User, erro
 	err = bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(req.Password))
 	if err != nil {
 		s.logger.Warn().Str("email", req.Email).Msg("Failed authentication attempt")
+		s.auditService.Log("user", user.ID, "login_failed", map[string]interface{}{
+			"email":  req.Email,
+			"reason": "invalid_password",
+		})
+		s.recordFailedLogin(ctx, email)
 		return nil, errors.New("invalid email or password")
 	}
 
@@ -111,28 +246,304 @@ func (s *UserService) Authenticate(req *models.LoginRequest) (*models.User, erro
 	return &user, nil
 }
 
-func (s *UserService) GetUserByID(userID int) (*models.User, error) {
+// clearFailedLogins forgets an email's failed attempts. It runs only once the
+// whole login, second factor included, has succeeded.
+func (s *UserService) clearFailedLogins(ctx context.Context, email string) {
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM login_attempts WHERE email = ?", email); err != nil {
+		s.logger.Warn().Err(err).Str("email", email).Msg("Failed to reset login attempts (non-critical)")
+	}
+}
+
+func (s *UserService) isLoginLocked(ctx context.Context, email string) (bool, error) {
+	var lockedUntil sql.NullTime
+	err := s.db.QueryRowContext(ctx, "SELECT locked_until FROM login_attempts WHERE email = ?", email).Scan(&lockedUntil)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Error checking login lockout")
+		return false, fmt.Errorf("database error: %w", err)
+	}
+	return lockedUntil.Valid && time.Now().Before(lockedUntil.Time), nil
+}
+
+// recordFailedLogin counts a failed attempt and locks the email once the
+// limit is reached. Errors are logged only; the login has failed either way.
+func (s *UserService) recordFailedLogin(ctx context.Context, email string) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Error starting login attempt transaction")
+		return
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	count := 0
+	firstFailedAt := now
+
+	var storedCount int
+	var storedFirst time.Time
+	err = tx.QueryRowContext(ctx,
+		"SELECT failed_count, first_failed_at FROM login_attempts WHERE email = ? FOR UPDATE",
+		email,
+	).Scan(&storedCount, &storedFirst)
+	if err != nil && err != sql.ErrNoRows {
+		s.logger.Error().Err(err).Msg("Error reading login attempts")
+		return
+	}
+	if err == nil && now.Sub(storedFirst) < failedLoginWindow {
+		count, firstFailedAt = storedCount, storedFirst
+	}
+	count++
+
+	var lockedUntil interface{}
+	if count >= maxFailedLogins {
+		lockedUntil = now.Add(loginLockoutDuration)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO login_attempts (email, failed_count, first_failed_at, locked_until) VALUES (?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE failed_count = VALUES(failed_count), first_failed_at = VALUES(first_failed_at), locked_until = VALUES(locked_until)
+	`, email, count, firstFailedAt, lockedUntil)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Error recording failed login")
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		s.logger.Error().Err(err).Msg("Error committing failed login")
+		return
+	}
+
+	if lockedUntil != nil {
+		s.logger.Warn().Str("email", email).Int("failed_attempts", count).Msg("Login locked after repeated failures")
+		s.auditService.Log("user", 0, "login_locked", map[string]interface{}{
+			"email":           email,
+			"failed_attempts": count,
+		})
+	}
+}
+
+// RequestPasswordReset issues a reset token and hands it to the notifier. It
+// returns no error for unknown emails so callers cannot tell which addresses
+// are registered.
+func (s *UserService) RequestPasswordReset(ctx context.Context, email string) error {
+	var userID int
+	err := s.db.QueryRowContext(ctx, "SELECT id FROM users WHERE email = ? AND deleted_at IS NULL", email).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Error looking up user for password reset")
+		return fmt.Errorf("database error: %w", err)
+	}
+
+	b := make([]byte, 32)
+	if _, err = rand.Read(b); err != nil {
+		return fmt.Errorf("failed to generate reset token: %w", err)
+	}
+	token := hex.EncodeToString(b)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Only the newest token stays usable.
+	_, err = tx.ExecContext(ctx, "UPDATE password_resets SET used_at = NOW() WHERE user_id = ? AND used_at IS NULL", userID)
+	if err != nil {
+		return fmt.Errorf("failed to invalidate previous reset tokens: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO password_resets (user_id, token_hash, expires_at) VALUES (?, ?, ?)",
+		userID, hashResetToken(token), time.Now().Add(passwordResetTTL),
+	)
+	if err != nil {
+		s.logger.Error().Err(err).Int("user_id", userID).Msg("Error storing password reset token")
+		return fmt.Errorf("failed to store reset token: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit reset token: %w", err)
+	}
+
+	if err = s.resetNotifier.SendPasswordReset(email, token); err != nil {
+		s.logger.Error().Err(err).Int("user_id", userID).Msg("Error delivering password reset token")
+		return fmt.Errorf("failed to deliver reset token: %w", err)
+	}
+
+	s.logger.Info().Int("user_id", userID).Msg("Password reset token issued")
+	return nil
+}
+
+func (s *UserService) ResetPassword(ctx context.Context, token, newPassword string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Error hashing password")
+		return fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var resetID, userID int
+	var expiresAt time.Time
+	var usedAt sql.NullTime
+	err = tx.QueryRowContext(ctx,
+		"SELECT id, user_id, expires_at, used_at FROM password_resets WHERE token_hash = ? FOR UPDATE",
+		hashResetToken(token),
+	).Scan(&resetID, &userID, &expiresAt, &usedAt)
+	if err == sql.ErrNoRows {
+		return ErrInvalidResetToken
+	}
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Error looking up password reset token")
+		return fmt.Errorf("database error: %w", err)
+	}
+
+	if usedAt.Valid || time.Now().After(expiresAt) {
+		return ErrInvalidResetToken
+	}
+
+	result, err := tx.ExecContext(ctx, "UPDATE users SET password_hash = ? WHERE id = ? AND deleted_at IS NULL", string(hashedPassword), userID)
+	if err != nil {
+		s.logger.Error().Err(err).Int("user_id", userID).Msg("Error updating password")
+		return fmt.Errorf("failed to update password: %w", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrInvalidResetToken
+	}
+
+	if _, err = tx.ExecContext(ctx, "UPDATE password_resets SET used_at = NOW() WHERE id = ?", resetID); err != nil {
+		return fmt.Errorf("failed to consume reset token: %w", err)
+	}
+
+	// Sessions opened with the old password should not outlive the reset.
+	if _, err = tx.ExecContext(ctx, "UPDATE refresh_tokens SET revoked_at = NOW() WHERE user_id = ? AND revoked_at IS NULL", userID); err != nil {
+		return fmt.Errorf("failed to revoke refresh tokens: %w", err)
+	}
+
+	if err = writeAuditLog(tx, "user", userID, "password_reset", map[string]interface{}{
+		"actor_id": userID,
+	}); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		s.logger.Error().Err(err).Msg("Error committing password reset")
+		return fmt.Errorf("failed to commit password reset: %w", err)
+	}
+
+	s.logger.Info().Int("user_id", userID).Msg("Password reset completed")
+	return nil
+}
+
+func hashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+const userColumns = "id, username, email, full_name, phone, avatar_url, password_hash, role, status, created_at, updated_at"
+
+func scanUser(row rowScanner) (*models.User, error) {
 	var user models.User
-	err := s.db.QueryRow(
-		"SELECT id, username, email, password_hash, role, created_at, updated_at FROM users WHERE id = ?",
-		userID,
-	).Scan(
-		&user.ID, &user.Username, &user.Email, &user.PasswordHash, &user.Role, &user.CreatedAt, &user.UpdatedAt,
+	err := row.Scan(
+		&user.ID, &user.Username, &user.Email, &user.FullName, &user.Phone, &user.AvatarURL,
+		&user.PasswordHash, &user.Role, &user.Status, &user.CreatedAt, &user.UpdatedAt,
 	)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (s *UserService) GetUserByID(ctx context.Context, userID int) (*models.User, error) {
+	user, err := scanUser(s.db.QueryRowContext(ctx,
+		"SELECT "+userColumns+" FROM users WHERE id = ? AND deleted_at IS NULL",
+		userID,
+	))
 
 	if err == sql.ErrNoRows {
-		return nil, errors.New("user not found")
+		return nil, ErrUserNotFound
 	}
 	if err != nil {
 		s.logger.Error().Err(err).Int("user_id", userID).Msg("Error fetching user")
 		return nil, fmt.Errorf("database error: %w", err)
 	}
 
-	return &user, nil
+	return user, nil
+}
+
+func (s *UserService) GetUserByEmail(ctx context.Context, email string) (*models.User, error) {
+	user, err := scanUser(s.db.QueryRowContext(ctx,
+		"SELECT "+userColumns+" FROM users WHERE email = ? AND deleted_at IS NULL",
+		email,
+	))
+
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Error fetching user by email")
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	return user, nil
+}
+
+func (s *UserService) ListUsers(ctx context.Context, limit, offset int, roleFilter string) ([]*models.User, int, error) {
+	where := "WHERE deleted_at IS NULL"
+	args := []interface{}{}
+	if roleFilter != "" {
+		where += " AND role = ?"
+		args = append(args, roleFilter)
+	}
+
+	var total int
+	err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM users "+where, args...).Scan(&total)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Error counting users")
+		return nil, 0, fmt.Errorf("database error: %w", err)
+	}
+
+	query := `
+		SELECT id, username, email, full_name, phone, avatar_url, role, status, created_at, updated_at
+		FROM users
+		` + where + `
+		ORDER BY created_at DESC, id DESC
+		LIMIT ? OFFSET ?
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, append(args, limit, offset)...)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Error listing users")
+		return nil, 0, fmt.Errorf("database error: %w", err)
+	}
+	defer rows.Close()
+
+	users := []*models.User{}
+	for rows.Next() {
+		var user models.User
+		err := rows.Scan(&user.ID, &user.Username, &user.Email, &user.FullName, &user.Phone, &user.AvatarURL, &user.Role, &user.Status, &user.CreatedAt, &user.UpdatedAt)
+		if err != nil {
+			return nil, 0, fmt.Errorf("error scanning user: %w", err)
+		}
+		users = append(users, &user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("error iterating users: %w", err)
+	}
+
+	return users, total, nil
 }
 
-func (s *UserService) HasRole(userID int, requiredRole string) (bool, error) {
-	user, err := s.GetUserByID(userID)
+func (s *UserService) HasRole(ctx context.Context, userID int, requiredRole string) (bool, error) {
+	user, err := s.GetUserByID(ctx, userID)
 	if err != nil {
 		return false, err
 	}
@@ -140,23 +551,28 @@ func (s *UserService) HasRole(userID int, requiredRole string) (bool, error) {
 	return user.Role == requiredRole, nil
 }
 
-func (s *UserService) IsAuthorized(userID int, action string, resourceID *int) (bool, error) {
-	user, err := s.GetUserByID(userID)
+func (s *UserService) IsAuthorized(ctx context.Context, userID int, action string, resourceID *int) (bool, error) {
+	user, err := s.GetUserByID(ctx, userID)
 	if err != nil {
 		return false, err
 	}
 
-	if user.Role == string(models.RoleAdmin) {
-		return true, nil
+	isOwn := resourceID != nil && user.ID == *resourceID
+
+	// Merchant capabilities are not implied by owning the account, and even
+	// an admin may only use them on its own account.
+	switch action {
+	case "settle_own_account", "view_own_stats":
+		return isOwn && (user.Role == string(models.RoleMerchant) || user.Role == string(models.RoleAdmin)), nil
 	}
 
-	if resourceID != nil && user.ID == *resourceID {
+	if user.Role == string(models.RoleAdmin) || isOwn {
 		return true, nil
 	}
 
 	switch action {
 	case "view_own_account", "update_own_account", "view_own_transactions":
-		return resourceID != nil && user.ID == *resourceID, nil
+		return isOwn, nil
 	case "view_all_accounts", "view_all_transactions", "manage_users":
 		return user.Role == string(models.RoleAdmin), nil
 	default:
@@ -164,34 +580,458 @@ func (s *UserService) IsAuthorized(userID int, action string, resourceID *int) (
 	}
 }
 
-func (s *UserService) UpdateUserRole(userID int, newRole string, adminID int) error {
-	isAdmin, err := s.HasRole(adminID, string(models.RoleAdmin))
+// UpdateProfile changes the username and email, leaving either one alone
+// when it is empty, and returns the row as stored.
+func (s *UserService) UpdateProfile(ctx context.Context, userID int, username, email string) (*models.User, error) {
+	var sets, conflicts []string
+	var setArgs, conflictArgs []interface{}
+	if username != "" {
+		sets = append(sets, "username = ?")
+		conflicts = append(conflicts, "username = ?")
+		setArgs = append(setArgs, username)
+		conflictArgs = append(conflictArgs, username)
+	}
+	if email != "" {
+		sets = append(sets, "email = ?")
+		conflicts = append(conflicts, "email = ?")
+		setArgs = append(setArgs, email)
+		conflictArgs = append(conflictArgs, email)
+	}
+	if len(sets) == 0 {
+		return s.GetUserByID(ctx, userID)
+	}
+
+	var existingID int
+	err := s.db.QueryRowContext(ctx,
+		"SELECT id FROM users WHERE ("+strings.Join(conflicts, " OR ")+") AND id <> ? LIMIT 1",
+		append(conflictArgs, userID)...,
+	).Scan(&existingID)
+	if err == nil {
+		return nil, ErrUserExists
+	} else if err != sql.ErrNoRows {
+		s.logger.Error().Err(err).Msg("Error checking existing user")
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	_, err = s.db.ExecContext(ctx,
+		"UPDATE users SET "+strings.Join(sets, ", ")+" WHERE id = ? AND deleted_at IS NULL",
+		append(setArgs, userID)...,
+	)
+	if isDuplicateKeyError(err) {
+		// Another account took the name or address after our pre-check.
+		return nil, ErrUserExists
+	}
+	if err != nil {
+		s.logger.Error().Err(err).Int("user_id", userID).Msg("Error updating user profile")
+		return nil, fmt.Errorf("failed to update user profile: %w", err)
+	}
+
+	// MySQL reports zero affected rows when nothing changed, so the re-read
+	// is what tells a missing user apart.
+	return s.GetUserByID(ctx, userID)
+}
+
+// UpdateProfileDetails writes only the fields set in details; an empty string
+// is stored as NULL.
+func (s *UserService) UpdateProfileDetails(ctx context.Context, userID int, details models.ProfileDetails) error {
+	var sets []string
+	var args []interface{}
+	for _, field := range []struct {
+		column string
+		value  *string
+	}{
+		{"full_name", details.FullName},
+		{"phone", details.Phone},
+		{"avatar_url", details.AvatarURL},
+	} {
+		if field.value != nil {
+			sets = append(sets, field.column+" = ?")
+			args = append(args, nullIfEmpty(*field.value))
+		}
+	}
+	if len(sets) == 0 {
+		return nil
+	}
+
+	_, err := s.db.ExecContext(ctx,
+		"UPDATE users SET "+strings.Join(sets, ", ")+" WHERE id = ? AND deleted_at IS NULL",
+		append(args, userID)...,
+	)
+	if err != nil {
+		s.logger.Error().Err(err).Int("user_id", userID).Msg("Error updating profile details")
+		return fmt.Errorf("failed to update profile details: %w", err)
+	}
+
+	return nil
+}
+
+func (s *UserService) UpdateUserRole(ctx context.Context, userID int, newRole string, adminID int) error {
+	isAdmin, err := s.HasRole(ctx, adminID, string(models.RoleAdmin))
 	if err != nil {
 		return err
 	}
 	if !isAdmin {
-		return errors.New("only admins can update user roles")
+		return ErrAdminRequired
 	}
 
-	validRoles := []string{string(models.RoleUser), string(models.RoleAdmin), string(models.RoleMerchant)}
-	validRole := false
-	for _, r := range validRoles {
-		if newRole == r {
-			validRole = true
-			break
-		}
+	if !models.UserRole(newRole).IsValid() {
+		return ErrInvalidRole
 	}
-	if !validRole {
-		return errors.New("invalid role")
+
+	var oldRole string
+	err = s.db.QueryRowContext(ctx, "SELECT role FROM users WHERE id = ? AND deleted_at IS NULL", userID).Scan(&oldRole)
+	if err == sql.ErrNoRows {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		s.logger.Error().Err(err).Int("user_id", userID).Msg("Error reading current user role")
+		return fmt.Errorf("database error: %w", err)
 	}
 
-	_, err = s.db.Exec("UPDATE users SET role = ? WHERE id = ?", newRole, userID)
+	_, err = s.db.ExecContext(ctx, "UPDATE users SET role = ? WHERE id = ? AND deleted_at IS NULL", newRole, userID)
 	if err != nil {
 		s.logger.Error().Err(err).Int("user_id", userID).Str("new_role", newRole).Msg("Error updating user role")
 		return fmt.Errorf("failed to update user role: %w", err)
 	}
 
+	s.auditService.Log("user", userID, "role_changed", map[string]interface{}{
+		"actor_id": adminID,
+		"old_role": oldRole,
+		"new_role": newRole,
+	})
+
 	s.logger.Info().Int("user_id", userID).Str("new_role", newRole).Int("admin_id", adminID).Msg("User role updated")
 	return nil
 }
 
+// SetUserStatus freezes or unfreezes an account. Setting the status it
+// already has is a no-op and is not audited.
+func (s *UserService) SetUserStatus(ctx context.Context, userID int, status models.UserStatus, adminID int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var oldStatus string
+	err = tx.QueryRowContext(ctx, "SELECT status FROM users WHERE id = ? AND deleted_at IS NULL FOR UPDATE", userID).Scan(&oldStatus)
+	if err == sql.ErrNoRows {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		s.logger.Error().Err(err).Int("user_id", userID).Msg("Error reading user status")
+		return fmt.Errorf("database error: %w", err)
+	}
+	if oldStatus == string(status) {
+		return nil
+	}
+
+	if _, err = tx.ExecContext(ctx, "UPDATE users SET status = ? WHERE id = ?", string(status), userID); err != nil {
+		s.logger.Error().Err(err).Int("user_id", userID).Msg("Error updating user status")
+		return fmt.Errorf("failed to update user status: %w", err)
+	}
+
+	action := "unfrozen"
+	if status == models.UserStatusFrozen {
+		action = "frozen"
+	}
+	err = writeAuditLog(tx, "user", userID, action, map[string]interface{}{
+		"actor_id":   adminID,
+		"old_status": oldStatus,
+		"new_status": string(status),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit user status: %w", err)
+	}
+
+	s.logger.Info().Int("user_id", userID).Str("status", string(status)).Int("admin_id", adminID).Msg("User status changed")
+	return nil
+}
+
+func (s *UserService) DeleteUser(ctx context.Context, userID int, adminID int) error {
+	isAdmin, err := s.HasRole(ctx, adminID, string(models.RoleAdmin))
+	if err != nil {
+		return err
+	}
+	if !isAdmin {
+		return ErrAdminRequired
+	}
+
+	if userID == adminID {
+		return ErrCannotDeleteSelf
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Error starting user deletion transaction")
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, "UPDATE users SET deleted_at = NOW() WHERE id = ? AND deleted_at IS NULL", userID)
+	if err != nil {
+		s.logger.Error().Err(err).Int("user_id", userID).Msg("Error soft-deleting user")
+		return fmt.Errorf("failed to delete user: %w", err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to delete user: %w", err)
+	}
+	if affected == 0 {
+		return ErrUserNotFound
+	}
+
+	// Completed transactions and the balance row are kept for the ledger;
+	// anything still pending can no longer complete.
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO transaction_status_history (transaction_id, from_status, to_status)
+		SELECT id, status, ? FROM transactions
+		WHERE status = ? AND (from_user_id = ? OR to_user_id = ?)
+	`, string(models.TransactionStatusFailed), string(models.TransactionStatusPending), userID, userID)
+	if err != nil {
+		s.logger.Error().Err(err).Int("user_id", userID).Msg("Error recording status changes")
+		return fmt.Errorf("failed to record status changes: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"UPDATE transactions SET status = ? WHERE status = ? AND (from_user_id = ? OR to_user_id = ?)",
+		string(models.TransactionStatusFailed), string(models.TransactionStatusPending), userID, userID,
+	)
+	if err != nil {
+		s.logger.Error().Err(err).Int("user_id", userID).Msg("Error failing pending transactions")
+		return fmt.Errorf("failed to update pending transactions: %w", err)
+	}
+
+	err = writeAuditLog(tx, "user", userID, "deleted", map[string]interface{}{
+		"actor_id": adminID,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		s.logger.Error().Err(err).Msg("Error committing user deletion")
+		return fmt.Errorf("failed to commit user deletion: %w", err)
+	}
+
+	s.logger.Info().Int("user_id", userID).Int("admin_id", adminID).Msg("User soft-deleted")
+	return nil
+}
+
+// MergeUsers folds the source account into the target. The combined balances
+// are written through balances, so subscribers to the target's balance stream
+// see them once the merge commits.
+func (s *UserService) MergeUsers(ctx context.Context, req *models.MergeUsersRequest, adminID int, balances *BalanceService) (*models.MergeUsersResult, error) {
+	if req.SourceUserID == req.TargetUserID {
+		return nil, ErrSameUser
+	}
+
+	// A frozen account must not have its money moved out, or be handed
+	// the history of one that is.
+	for _, id := range []int{req.SourceUserID, req.TargetUserID} {
+		user, err := s.GetUserByID(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if user.Status == string(models.UserStatusFrozen) {
+			return nil, ErrAccountFrozen
+		}
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Error starting merge transaction")
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer balances.rollbackTx(tx)
+
+	var crossTransfers int
+	err = tx.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM transactions WHERE (from_user_id = ? AND to_user_id = ?) OR (from_user_id = ? AND to_user_id = ?)",
+		req.SourceUserID, req.TargetUserID, req.TargetUserID, req.SourceUserID,
+	).Scan(&crossTransfers)
+	if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+	if crossTransfers > 0 {
+		return nil, ErrMergeCrossTransfers
+	}
+
+	locked := map[int]map[string]models.Money{}
+	lockOrder := []int{req.SourceUserID, req.TargetUserID}
+	if lockOrder[0] > lockOrder[1] {
+		lockOrder[0], lockOrder[1] = lockOrder[1], lockOrder[0]
+	}
+	for _, id := range lockOrder {
+		locked[id], err = lockUserBalances(ctx, tx, id)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result := &models.MergeUsersResult{
+		SourceUserID:     req.SourceUserID,
+		TargetUserID:     req.TargetUserID,
+		CombinedBalances: map[string]models.Money{},
+	}
+	for _, id := range lockOrder {
+		for currency, amount := range locked[id] {
+			result.CombinedBalances[currency] += amount
+		}
+	}
+
+	for _, column := range []string{"from_user_id", "to_user_id"} {
+		res, err := tx.ExecContext(ctx, "UPDATE transactions SET "+column+" = ? WHERE "+column+" = ?", req.TargetUserID, req.SourceUserID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to reassign transactions: %w", err)
+		}
+		moved, _ := res.RowsAffected()
+		result.MovedTransactions += moved
+	}
+
+	result.MovedHistoryEntries, err = mergeBalanceHistory(ctx, tx, req.SourceUserID, req.TargetUserID)
+	if err != nil {
+		return nil, err
+	}
+
+	for currency, amount := range result.CombinedBalances {
+		err = balances.overwriteBalanceInTx(ctx, tx, req.TargetUserID, currency, locked[req.TargetUserID][currency], amount)
+		if err != nil {
+			return nil, fmt.Errorf("failed to combine balances: %w", err)
+		}
+	}
+
+	if _, err = tx.ExecContext(ctx, "DELETE FROM balances WHERE user_id = ?", req.SourceUserID); err != nil {
+		return nil, fmt.Errorf("failed to remove source balance: %w", err)
+	}
+
+	if _, err = tx.ExecContext(ctx, "UPDATE users SET deleted_at = NOW() WHERE id = ?", req.SourceUserID); err != nil {
+		return nil, fmt.Errorf("failed to delete source user: %w", err)
+	}
+
+	err = writeAuditLog(tx, "user", req.TargetUserID, "merge", map[string]interface{}{
+		"admin_id":              adminID,
+		"source_user_id":        req.SourceUserID,
+		"source_balances":       locked[req.SourceUserID],
+		"target_balances":       locked[req.TargetUserID],
+		"moved_transactions":    result.MovedTransactions,
+		"moved_history_entries": result.MovedHistoryEntries,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err = balances.commitTx(tx); err != nil {
+		s.logger.Error().Err(err).Msg("Error committing user merge")
+		return nil, fmt.Errorf("failed to commit merge: %w", err)
+	}
+
+	s.logger.Info().
+		Int("source_user_id", req.SourceUserID).
+		Int("target_user_id", req.TargetUserID).
+		Int("admin_id", adminID).
+		Msg("User accounts merged")
+
+	return result, nil
+}
+
+// historySnapshot is one balance_history row read for a merge.
+type historySnapshot struct {
+	id      int64
+	userID  int
+	balance models.Money
+}
+
+// combinedSnapshots takes both accounts' history for one currency, oldest
+// first, and returns for each row the sum of the two accounts' balances at
+// that point.
+func combinedSnapshots(rows []historySnapshot) []models.Money {
+	latest := map[int]models.Money{}
+	combined := make([]models.Money, len(rows))
+	for i, row := range rows {
+		latest[row.userID] = row.balance
+		for _, balance := range latest {
+			combined[i] += balance
+		}
+	}
+	return combined
+}
+
+// mergeBalanceHistory moves the source's balance history to the target and
+// rewrites every snapshot of both accounts to their combined balance, so
+// balance-at-time lookups on the target describe the merged account. It
+// returns how many rows were moved.
+func mergeBalanceHistory(ctx context.Context, tx *sql.Tx, sourceID, targetID int) (int64, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, user_id, currency, balance FROM balance_history
+		WHERE user_id IN (?, ?)
+		ORDER BY currency, created_at, id
+		FOR UPDATE`, sourceID, targetID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read balance history: %w", err)
+	}
+
+	var currencies []string
+	byCurrency := map[string][]historySnapshot{}
+	for rows.Next() {
+		var row historySnapshot
+		var currency string
+		if err := rows.Scan(&row.id, &row.userID, &currency, &row.balance); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to read balance history: %w", err)
+		}
+		if _, seen := byCurrency[currency]; !seen {
+			currencies = append(currencies, currency)
+		}
+		byCurrency[currency] = append(byCurrency[currency], row)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to read balance history: %w", err)
+	}
+
+	var moved int64
+	for _, currency := range currencies {
+		history := byCurrency[currency]
+		for i, balance := range combinedSnapshots(history) {
+			row := history[i]
+			if row.userID == targetID && row.balance == balance {
+				continue
+			}
+			_, err := tx.ExecContext(ctx, "UPDATE balance_history SET user_id = ?, balance = ? WHERE id = ?", targetID, balance, row.id)
+			if err != nil {
+				return 0, fmt.Errorf("failed to reassign balance history: %w", err)
+			}
+			if row.userID == sourceID {
+				moved++
+			}
+		}
+	}
+
+	return moved, nil
+}
+
+func lockUserBalances(ctx context.Context, tx *sql.Tx, userID int) (map[string]models.Money, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT currency, amount FROM balances WHERE user_id = ? ORDER BY currency FOR UPDATE", userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock balance: %w", err)
+	}
+	defer rows.Close()
+
+	balances := map[string]models.Money{}
+	for rows.Next() {
+		var currency string
+		var amount models.Money
+		if err := rows.Scan(&currency, &amount); err != nil {
+			return nil, fmt.Errorf("failed to lock balance: %w", err)
+		}
+		balances[currency] = amount
+	}
+
+	return balances, rows.Err()
+}
@@ -0,0 +1,1032 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"regexp"
+	"testing"
+	"time"
+
+	"go-projects/internal/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+	"github.com/rs/zerolog"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	userByIDQuery    = regexp.QuoteMeta("SELECT " + userColumns + " FROM users WHERE id = ? AND deleted_at IS NULL")
+	updateRoleQuery  = regexp.QuoteMeta("UPDATE users SET role = ? WHERE id = ? AND deleted_at IS NULL")
+	roleLookupQuery  = regexp.QuoteMeta("SELECT role FROM users WHERE id = ? AND deleted_at IS NULL")
+	auditInsertQuery = regexp.QuoteMeta("INSERT INTO audit_logs (entity_type, entity_id, action, details) VALUES (?, ?, ?, ?)")
+)
+
+func userRow(id int, role string) *sqlmock.Rows {
+	now := time.Now()
+	return sqlmock.NewRows([]string{"id", "username", "email", "full_name", "phone", "avatar_url", "password_hash", "role", "status", "created_at", "updated_at"}).
+		AddRow(id, "user", "user@example.com", nil, nil, nil, "hash", role, "active", now, now)
+}
+
+func TestRegisterRejectsUnknownRole(t *testing.T) {
+	db, mock := newMockDB(t)
+	service := NewUserService(db, zerolog.Nop())
+
+	_, err := service.Register(context.Background(), &models.RegisterRequest{
+		Username: "eve",
+		Email:    "eve@example.com",
+		Password: "password123",
+		Role:     "superuser",
+	}, RegistrationPolicy{})
+	if !errors.Is(err, ErrInvalidRole) {
+		t.Errorf("err = %v, want ErrInvalidRole", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestRegisterRoleSelection checks that a client can only pick the roles the
+// registration policy allows; anything else, admin above all, is quietly
+// downgraded to user rather than rejected.
+func TestRegisterRoleSelection(t *testing.T) {
+	tests := []struct {
+		name     string
+		role     string
+		policy   RegistrationPolicy
+		wantRole string
+	}{
+		{name: "no role", role: "", wantRole: "user"},
+		{name: "user", role: "user", wantRole: "user"},
+		{name: "admin is downgraded", role: "admin", wantRole: "user"},
+		{name: "admin is downgraded even with merchant signup", role: "admin", policy: RegistrationPolicy{AllowMerchant: true}, wantRole: "user"},
+		{name: "merchant without merchant signup", role: "merchant", wantRole: "user"},
+		{name: "merchant with merchant signup", role: "merchant", policy: RegistrationPolicy{AllowMerchant: true}, wantRole: "merchant"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := newMockDB(t)
+			service := NewUserService(db, zerolog.Nop())
+
+			mock.ExpectQuery(regexp.QuoteMeta("SELECT id FROM users WHERE email = ? OR username = ?")).
+				WithArgs("eve@example.com", "eve").WillReturnError(sql.ErrNoRows)
+			mock.ExpectExec(regexp.QuoteMeta("INSERT INTO users (username, email, password_hash, role) VALUES (?, ?, ?, ?)")).
+				WithArgs("eve", "eve@example.com", sqlmock.AnyArg(), tt.wantRole).WillReturnResult(sqlmock.NewResult(42, 1))
+			mock.ExpectQuery(userByIDQuery).WithArgs(42).WillReturnRows(userRow(42, tt.wantRole))
+
+			user, err := service.Register(context.Background(), &models.RegisterRequest{
+				Username: "eve",
+				Email:    "eve@example.com",
+				Password: "password123",
+				Role:     tt.role,
+			}, tt.policy)
+			if err != nil {
+				t.Fatalf("Register: %v", err)
+			}
+			if string(user.Role) != tt.wantRole {
+				t.Errorf("role = %s, want %s", user.Role, tt.wantRole)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestUpdateUserRoleAcceptsEachRole(t *testing.T) {
+	for _, role := range []models.UserRole{models.RoleUser, models.RoleMerchant, models.RoleAdmin} {
+		t.Run(string(role), func(t *testing.T) {
+			db, mock := newMockDB(t)
+			service := NewUserService(db, zerolog.Nop())
+
+			mock.ExpectQuery(userByIDQuery).WithArgs(1).WillReturnRows(userRow(1, "admin"))
+			mock.ExpectQuery(roleLookupQuery).WithArgs(7).WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow("user"))
+			mock.ExpectExec(updateRoleQuery).WithArgs(string(role), 7).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec(auditInsertQuery).
+				WithArgs("user", 7, "role_changed", `{"actor_id":1,"new_role":"`+string(role)+`","old_role":"user"}`).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+
+			if err := service.UpdateUserRole(context.Background(), 7, string(role), 1); err != nil {
+				t.Fatalf("UpdateUserRole: %v", err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestUpdateUserRoleRejectsUnknownRole(t *testing.T) {
+	db, mock := newMockDB(t)
+	service := NewUserService(db, zerolog.Nop())
+
+	mock.ExpectQuery(userByIDQuery).WithArgs(1).WillReturnRows(userRow(1, "admin"))
+
+	if err := service.UpdateUserRole(context.Background(), 7, "superuser", 1); !errors.Is(err, ErrInvalidRole) {
+		t.Errorf("err = %v, want ErrInvalidRole", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUpdateUserRoleUnknownUser(t *testing.T) {
+	db, mock := newMockDB(t)
+	service := NewUserService(db, zerolog.Nop())
+
+	mock.ExpectQuery(userByIDQuery).WithArgs(1).WillReturnRows(userRow(1, "admin"))
+	mock.ExpectQuery(roleLookupQuery).WithArgs(99).WillReturnError(sql.ErrNoRows)
+
+	if err := service.UpdateUserRole(context.Background(), 99, "merchant", 1); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("err = %v, want ErrUserNotFound", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+var (
+	profileConflictQuery = regexp.QuoteMeta("SELECT id FROM users WHERE (username = ? OR email = ?) AND id <> ? LIMIT 1")
+	profileUpdateQuery   = regexp.QuoteMeta("UPDATE users SET username = ?, email = ? WHERE id = ? AND deleted_at IS NULL")
+)
+
+func renamedUserRow(username, email string) *sqlmock.Rows {
+	now := time.Now()
+	return sqlmock.NewRows([]string{"id", "username", "email", "full_name", "phone", "avatar_url", "password_hash", "role", "status", "created_at", "updated_at"}).
+		AddRow(7, username, email, nil, nil, nil, "hash", "user", "active", now, now)
+}
+
+func TestUpdateProfileReturnsStoredRow(t *testing.T) {
+	db, mock := newMockDB(t)
+	service := NewUserService(db, zerolog.Nop())
+
+	mock.ExpectQuery(profileConflictQuery).WithArgs("renamed", "renamed@example.com", 7).WillReturnError(sql.ErrNoRows)
+	mock.ExpectExec(profileUpdateQuery).WithArgs("renamed", "renamed@example.com", 7).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(userByIDQuery).WithArgs(7).WillReturnRows(renamedUserRow("renamed", "renamed@example.com"))
+
+	user, err := service.UpdateProfile(context.Background(), 7, "renamed", "renamed@example.com")
+	if err != nil {
+		t.Fatalf("UpdateProfile: %v", err)
+	}
+	if user.Username != "renamed" || user.Email != "renamed@example.com" {
+		t.Errorf("got %s <%s>, want the re-read row", user.Username, user.Email)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUpdateProfileOnlyWritesGivenFields(t *testing.T) {
+	db, mock := newMockDB(t)
+	service := NewUserService(db, zerolog.Nop())
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id FROM users WHERE (email = ?) AND id <> ? LIMIT 1")).
+		WithArgs("new@example.com", 7).WillReturnError(sql.ErrNoRows)
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET email = ? WHERE id = ? AND deleted_at IS NULL")).
+		WithArgs("new@example.com", 7).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(userByIDQuery).WithArgs(7).WillReturnRows(renamedUserRow("alice", "new@example.com"))
+
+	if _, err := service.UpdateProfile(context.Background(), 7, "", "new@example.com"); err != nil {
+		t.Fatalf("UpdateProfile: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUpdateProfileRejectsTakenValues(t *testing.T) {
+	t.Run("pre-check", func(t *testing.T) {
+		db, mock := newMockDB(t)
+		service := NewUserService(db, zerolog.Nop())
+
+		mock.ExpectQuery(profileConflictQuery).WithArgs("bob", "bob@example.com", 7).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(8))
+
+		_, err := service.UpdateProfile(context.Background(), 7, "bob", "bob@example.com")
+		if !errors.Is(err, ErrUserExists) {
+			t.Fatalf("err = %v, want ErrUserExists", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("unique index", func(t *testing.T) {
+		db, mock := newMockDB(t)
+		service := NewUserService(db, zerolog.Nop())
+
+		mock.ExpectQuery(profileConflictQuery).WithArgs("bob", "bob@example.com", 7).WillReturnError(sql.ErrNoRows)
+		mock.ExpectExec(profileUpdateQuery).WithArgs("bob", "bob@example.com", 7).
+			WillReturnError(&mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'bob' for key 'uq_users_username'"})
+
+		_, err := service.UpdateProfile(context.Background(), 7, "bob", "bob@example.com")
+		if !errors.Is(err, ErrUserExists) {
+			t.Fatalf("err = %v, want ErrUserExists", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestUpdateProfileDetailsWritesOnlyProvidedFields(t *testing.T) {
+	name, empty := "Ayşe Yılmaz", ""
+	tests := []struct {
+		name    string
+		details models.ProfileDetails
+		query   string
+		args    []driver.Value
+	}{
+		{
+			name:    "one field",
+			details: models.ProfileDetails{FullName: &name},
+			query:   "UPDATE users SET full_name = ? WHERE id = ? AND deleted_at IS NULL",
+			args:    []driver.Value{name, 7},
+		},
+		{
+			name:    "set one and clear another",
+			details: models.ProfileDetails{FullName: &name, AvatarURL: &empty},
+			query:   "UPDATE users SET full_name = ?, avatar_url = ? WHERE id = ? AND deleted_at IS NULL",
+			args:    []driver.Value{name, nil, 7},
+		},
+		{name: "nothing provided"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := newMockDB(t)
+			service := NewUserService(db, zerolog.Nop())
+			if tt.query != "" {
+				mock.ExpectExec("^" + regexp.QuoteMeta(tt.query) + "$").WithArgs(tt.args...).WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+
+			if err := service.UpdateProfileDetails(context.Background(), 7, tt.details); err != nil {
+				t.Fatalf("UpdateProfileDetails: %v", err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestIsAuthorizedMerchantCapabilities(t *testing.T) {
+	other := 9
+	tests := []struct {
+		name     string
+		role     string
+		action   string
+		resource *int
+		want     bool
+	}{
+		{"merchant settles own account", "merchant", "settle_own_account", nil, true},
+		{"admin settles own account", "admin", "settle_own_account", nil, true},
+		{"user cannot settle", "user", "settle_own_account", nil, false},
+		{"merchant cannot settle for another", "merchant", "settle_own_account", &other, false},
+		{"admin cannot settle for another", "admin", "settle_own_account", &other, false},
+		{"merchant views own stats", "merchant", "view_own_stats", nil, true},
+		{"user cannot view merchant stats", "user", "view_own_stats", nil, false},
+		{"user views own account", "user", "view_own_account", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := newMockDB(t)
+			service := NewUserService(db, zerolog.Nop())
+			mock.ExpectQuery(userByIDQuery).WithArgs(4).WillReturnRows(userRow(4, tt.role))
+
+			resource := tt.resource
+			if resource == nil {
+				own := 4
+				resource = &own
+			}
+			allowed, err := service.IsAuthorized(context.Background(), 4, tt.action, resource)
+			if err != nil {
+				t.Fatalf("IsAuthorized: %v", err)
+			}
+			if allowed != tt.want {
+				t.Errorf("allowed = %v, want %v", allowed, tt.want)
+			}
+		})
+	}
+}
+
+var listColumns = []string{"id", "username", "email", "full_name", "phone", "avatar_url", "role", "status", "created_at", "updated_at"}
+
+func TestListUsers(t *testing.T) {
+	db, mock := newMockDB(t)
+	service := NewUserService(db, zerolog.Nop())
+
+	now := time.Now()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM users WHERE deleted_at IS NULL") + "$").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(12))
+	mock.ExpectQuery(`FROM users\s+WHERE deleted_at IS NULL\s+ORDER BY created_at DESC, id DESC\s+LIMIT \? OFFSET \?`).
+		WithArgs(2, 4).
+		WillReturnRows(sqlmock.NewRows(listColumns).
+			AddRow(9, "carol", "carol@example.com", nil, nil, nil, "user", "active", now, now).
+			AddRow(8, "dave", "dave@example.com", nil, nil, nil, "merchant", "active", now, now))
+
+	users, total, err := service.ListUsers(context.Background(), 2, 4, "")
+	if err != nil {
+		t.Fatalf("ListUsers: %v", err)
+	}
+	if total != 12 || len(users) != 2 {
+		t.Fatalf("got %d users of %d, want 2 of 12", len(users), total)
+	}
+	if users[0].ID != 9 || users[1].Role != "merchant" {
+		t.Errorf("rows not returned in query order: %+v, %+v", users[0], users[1])
+	}
+	for _, user := range users {
+		if user.PasswordHash != "" {
+			t.Errorf("user %d has a password hash", user.ID)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestListUsersFiltersByRole(t *testing.T) {
+	db, mock := newMockDB(t)
+	service := NewUserService(db, zerolog.Nop())
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM users WHERE deleted_at IS NULL AND role = ?")).
+		WithArgs("merchant").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectQuery(regexp.QuoteMeta("WHERE deleted_at IS NULL AND role = ?")).
+		WithArgs("merchant", 50, 0).
+		WillReturnRows(sqlmock.NewRows(listColumns))
+
+	users, total, err := service.ListUsers(context.Background(), 50, 0, "merchant")
+	if err != nil {
+		t.Fatalf("ListUsers: %v", err)
+	}
+	if total != 0 || users == nil || len(users) != 0 {
+		t.Errorf("got %v (total %d), want an empty, non-nil slice", users, total)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestListUsersReportsRowErrors(t *testing.T) {
+	db, mock := newMockDB(t)
+	service := NewUserService(db, zerolog.Nop())
+
+	now := time.Now()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM users")).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+	mock.ExpectQuery(regexp.QuoteMeta("ORDER BY created_at DESC")).
+		WillReturnRows(sqlmock.NewRows(listColumns).
+			AddRow(1, "alice", "alice@example.com", nil, nil, nil, "user", "active", now, now).
+			AddRow(2, "bob", "bob@example.com", nil, nil, nil, "user", "active", now, now).
+			RowError(1, errors.New("connection lost")))
+
+	if _, _, err := service.ListUsers(context.Background(), 10, 0, ""); err == nil {
+		t.Error("ListUsers returned a partial page without an error")
+	}
+}
+
+var softDeleteQuery = regexp.QuoteMeta("UPDATE users SET deleted_at = NOW() WHERE id = ? AND deleted_at IS NULL")
+
+func TestDeleteUserSoftDeletes(t *testing.T) {
+	db, mock := newMockDB(t)
+	service := NewUserService(db, zerolog.Nop())
+
+	mock.ExpectQuery(userByIDQuery).WithArgs(1).WillReturnRows(userRow(1, "admin"))
+	mock.ExpectBegin()
+	mock.ExpectExec(softDeleteQuery).WithArgs(7).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO transaction_status_history")).
+		WithArgs("failed", "pending", 7, 7).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE transactions SET status = ? WHERE status = ?")).
+		WithArgs("failed", "pending", 7, 7).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(auditInsertQuery).WithArgs("user", 7, "deleted", `{"actor_id":1}`).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	if err := service.DeleteUser(context.Background(), 7, 1); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDeleteUserRejections(t *testing.T) {
+	t.Run("non-admin", func(t *testing.T) {
+		db, mock := newMockDB(t)
+		service := NewUserService(db, zerolog.Nop())
+		mock.ExpectQuery(userByIDQuery).WithArgs(2).WillReturnRows(userRow(2, "user"))
+
+		if err := service.DeleteUser(context.Background(), 7, 2); err == nil {
+			t.Error("a regular user deleted an account")
+		}
+	})
+
+	t.Run("own account", func(t *testing.T) {
+		db, mock := newMockDB(t)
+		service := NewUserService(db, zerolog.Nop())
+		mock.ExpectQuery(userByIDQuery).WithArgs(1).WillReturnRows(userRow(1, "admin"))
+
+		if err := service.DeleteUser(context.Background(), 1, 1); err == nil {
+			t.Error("an admin deleted their own account")
+		}
+	})
+
+	t.Run("already deleted", func(t *testing.T) {
+		db, mock := newMockDB(t)
+		service := NewUserService(db, zerolog.Nop())
+		mock.ExpectQuery(userByIDQuery).WithArgs(1).WillReturnRows(userRow(1, "admin"))
+		mock.ExpectBegin()
+		mock.ExpectExec(softDeleteQuery).WithArgs(7).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectRollback()
+
+		if err := service.DeleteUser(context.Background(), 7, 1); err == nil {
+			t.Error("deleting a missing user succeeded")
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestAuthenticateSkipsDeletedUsers(t *testing.T) {
+	db, mock := newMockDB(t)
+	service := NewUserService(db, zerolog.Nop())
+
+	mock.ExpectQuery(lockedUntilQuery).WithArgs("gone@example.com").WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery(regexp.QuoteMeta("FROM users WHERE email = ? AND deleted_at IS NULL")).
+		WithArgs("gone@example.com").WillReturnError(sql.ErrNoRows)
+	mock.ExpectExec(auditInsertQuery).
+		WithArgs("user", 0, "login_failed", `{"email":"gone@example.com","reason":"unknown_email"}`).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectFailedLogin(mock, "gone@example.com", 0, 1)
+
+	_, err := service.Authenticate(context.Background(), &models.LoginRequest{Email: "gone@example.com", Password: "password123"})
+	if err == nil {
+		t.Fatal("a deleted user authenticated")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+var (
+	lockedUntilQuery   = regexp.QuoteMeta("SELECT locked_until FROM login_attempts WHERE email = ?")
+	loginAttemptsQuery = regexp.QuoteMeta("SELECT failed_count, first_failed_at FROM login_attempts WHERE email = ? FOR UPDATE")
+	loginAttemptsWrite = regexp.QuoteMeta("INSERT INTO login_attempts (email, failed_count, first_failed_at, locked_until) VALUES (?, ?, ?, ?)")
+)
+
+// lockArg matches the locked_until argument of a login_attempts write: NULL
+// while the email is still allowed to try, a time once it is locked.
+type lockArg struct{ locked bool }
+
+func (a lockArg) Match(v driver.Value) bool {
+	_, isTime := v.(time.Time)
+	return isTime == a.locked && (isTime || v == nil)
+}
+
+// expectFailedLogin expects the write for failure number count, with
+// previous failures already stored in the current window.
+func expectFailedLogin(mock sqlmock.Sqlmock, email string, previous, count int) {
+	mock.ExpectBegin()
+	if previous == 0 {
+		mock.ExpectQuery(loginAttemptsQuery).WithArgs(email).WillReturnError(sql.ErrNoRows)
+	} else {
+		mock.ExpectQuery(loginAttemptsQuery).WithArgs(email).
+			WillReturnRows(sqlmock.NewRows([]string{"failed_count", "first_failed_at"}).AddRow(previous, time.Now().Add(-time.Minute)))
+	}
+	mock.ExpectExec(loginAttemptsWrite).
+		WithArgs(email, count, sqlmock.AnyArg(), lockArg{locked: count >= maxFailedLogins}).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+}
+
+func loginUserRows(t *testing.T, password string) *sqlmock.Rows {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	return sqlmock.NewRows([]string{"id", "username", "email", "password_hash", "role", "created_at", "updated_at"}).
+		AddRow(7, "alice", "alice@example.com", string(hash), "user", now, now)
+}
+
+// TestRepeatedFailedLoginsLockTheEmail fails maxFailedLogins times and then
+// tries the right password: the lockout must hold regardless.
+func TestRepeatedFailedLoginsLockTheEmail(t *testing.T) {
+	db, mock := newMockDB(t)
+	service := NewUserService(db, zerolog.Nop())
+	const email = "alice@example.com"
+	userQuery := regexp.QuoteMeta("FROM users WHERE email = ? AND deleted_at IS NULL")
+
+	for attempt := 1; attempt <= maxFailedLogins; attempt++ {
+		if attempt == 1 {
+			mock.ExpectQuery(lockedUntilQuery).WithArgs(email).WillReturnError(sql.ErrNoRows)
+		} else {
+			mock.ExpectQuery(lockedUntilQuery).WithArgs(email).WillReturnRows(sqlmock.NewRows([]string{"locked_until"}).AddRow(nil))
+		}
+		mock.ExpectQuery(userQuery).WithArgs(email).WillReturnRows(loginUserRows(t, "password123"))
+		mock.ExpectExec(auditInsertQuery).WithArgs("user", 7, "login_failed", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+		expectFailedLogin(mock, email, attempt-1, attempt)
+		if attempt == maxFailedLogins {
+			mock.ExpectExec(auditInsertQuery).
+				WithArgs("user", 0, "login_locked", fmt.Sprintf(`{"email":"alice@example.com","failed_attempts":%d}`, maxFailedLogins)).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+		}
+
+		_, err := service.Authenticate(context.Background(), &models.LoginRequest{Email: email, Password: "wrong-password"})
+		if err == nil || errors.Is(err, ErrAccountLocked) {
+			t.Fatalf("attempt %d: err = %v, want invalid credentials", attempt, err)
+		}
+	}
+
+	// The correct password is refused without the user row even being read.
+	mock.ExpectQuery(lockedUntilQuery).WithArgs(email).
+		WillReturnRows(sqlmock.NewRows([]string{"locked_until"}).AddRow(time.Now().Add(loginLockoutDuration)))
+	if _, err := service.Authenticate(context.Background(), &models.LoginRequest{Email: email, Password: "password123"}); !errors.Is(err, ErrAccountLocked) {
+		t.Fatalf("correct password during lockout: err = %v, want ErrAccountLocked", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFailedLoginWindowRestarts(t *testing.T) {
+	db, mock := newMockDB(t)
+	service := NewUserService(db, zerolog.Nop())
+
+	// Four failures long ago do not count towards a lockout now.
+	mock.ExpectBegin()
+	mock.ExpectQuery(loginAttemptsQuery).WithArgs("bob@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"failed_count", "first_failed_at"}).AddRow(maxFailedLogins-1, time.Now().Add(-2*failedLoginWindow)))
+	mock.ExpectExec(loginAttemptsWrite).
+		WithArgs("bob@example.com", 1, sqlmock.AnyArg(), lockArg{locked: false}).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	service.recordFailedLogin(context.Background(), "bob@example.com")
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExpiredLockoutAllowsLogin(t *testing.T) {
+	db, mock := newMockDB(t)
+	service := NewUserService(db, zerolog.Nop())
+
+	mock.ExpectQuery(lockedUntilQuery).WithArgs("alice@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"locked_until"}).AddRow(time.Now().Add(-time.Second)))
+	mock.ExpectQuery(regexp.QuoteMeta("FROM users WHERE email = ? AND deleted_at IS NULL")).
+		WithArgs("alice@example.com").WillReturnRows(loginUserRows(t, "password123"))
+
+	user, err := service.Authenticate(context.Background(), &models.LoginRequest{Email: "alice@example.com", Password: "password123"})
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if user.ID != 7 {
+		t.Errorf("user = %+v, want user 7", user)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCombinedSnapshots(t *testing.T) {
+	const source, target = 1, 2
+
+	tests := []struct {
+		name string
+		rows []historySnapshot
+		want []models.Money
+	}{
+		{
+			name: "interleaved histories",
+			// Source: +100.00, then -30.00. Target: +50.00, then -20.00.
+			rows: []historySnapshot{
+				{id: 1, userID: source, balance: 10000},
+				{id: 2, userID: target, balance: 5000},
+				{id: 3, userID: source, balance: 7000},
+				{id: 4, userID: target, balance: 3000},
+			},
+			want: []models.Money{10000, 15000, 12000, 10000},
+		},
+		{
+			name: "source only",
+			rows: []historySnapshot{
+				{id: 7, userID: source, balance: 2500},
+				{id: 9, userID: source, balance: 1000},
+			},
+			want: []models.Money{2500, 1000},
+		},
+		{
+			name: "target history before the source's",
+			rows: []historySnapshot{
+				{id: 1, userID: target, balance: 4000},
+				{id: 2, userID: target, balance: -500},
+				{id: 3, userID: source, balance: 1500},
+			},
+			want: []models.Money{4000, -500, 1000},
+		},
+		{
+			name: "no history",
+			rows: nil,
+			want: []models.Money{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := combinedSnapshots(tt.rows)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d snapshots, want %d", len(got), len(tt.want))
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("row %d: balance = %s, want %s", tt.rows[i].id, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+var (
+	mergeHistoryQuery = regexp.QuoteMeta("SELECT id, user_id, currency, balance FROM balance_history")
+	historyUpdate     = regexp.QuoteMeta("UPDATE balance_history SET user_id = ?, balance = ? WHERE id = ?")
+)
+
+// Each currency's history is combined on its own; a EUR snapshot never adds
+// to a USD one.
+func TestMergeBalanceHistoryCombinesPerCurrency(t *testing.T) {
+	db, mock := newMockDB(t)
+	const source, target = 3, 5
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(mergeHistoryQuery).WithArgs(source, target).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "currency", "balance"}).
+			AddRow(4, target, "EUR", 20.0).
+			AddRow(6, source, "EUR", 5.0).
+			AddRow(1, source, "USD", 50.0).
+			AddRow(2, target, "USD", 100.0))
+	mock.ExpectExec(historyUpdate).WithArgs(target, models.Money(2500), 6).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(historyUpdate).WithArgs(target, models.Money(5000), 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(historyUpdate).WithArgs(target, models.Money(15000), 2).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	var moved int64
+	err := inTx(db, func(tx *sql.Tx) error {
+		var err error
+		moved, err = mergeBalanceHistory(context.Background(), tx, source, target)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("mergeBalanceHistory: %v", err)
+	}
+	if moved != 2 {
+		t.Errorf("moved = %d, want the two source rows", moved)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMergeUsersMovesBalanceAndHistory(t *testing.T) {
+	db, mock := newMockDB(t)
+	service := NewUserService(db, zerolog.Nop())
+	balances := NewBalanceService(db, zerolog.Nop())
+	updates, unsubscribe := balances.SubscribeUpdates(5)
+	defer unsubscribe()
+	const source, target = 3, 5
+
+	mock.ExpectQuery(userByIDQuery).WithArgs(source).WillReturnRows(userRow(source, "user"))
+	mock.ExpectQuery(userByIDQuery).WithArgs(target).WillReturnRows(userRow(target, "user"))
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM transactions")).
+		WithArgs(source, target, target, source).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	lockBalancesQuery := regexp.QuoteMeta("SELECT currency, amount FROM balances WHERE user_id = ? ORDER BY currency FOR UPDATE")
+	mock.ExpectQuery(lockBalancesQuery).WithArgs(source).
+		WillReturnRows(sqlmock.NewRows([]string{"currency", "amount"}).AddRow("USD", 40.0))
+	mock.ExpectQuery(lockBalancesQuery).WithArgs(target).
+		WillReturnRows(sqlmock.NewRows([]string{"currency", "amount"}).AddRow("USD", 100.0))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE transactions SET from_user_id = ? WHERE from_user_id = ?")).
+		WithArgs(target, source).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE transactions SET to_user_id = ? WHERE to_user_id = ?")).
+		WithArgs(target, source).WillReturnResult(sqlmock.NewResult(0, 1))
+	// Source: +50, then -10. Target: +100 in between.
+	mock.ExpectQuery(mergeHistoryQuery).
+		WithArgs(source, target).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "currency", "balance"}).
+			AddRow(1, source, "USD", 50.0).
+			AddRow(2, target, "USD", 100.0).
+			AddRow(3, source, "USD", 40.0))
+	mock.ExpectExec(historyUpdate).WithArgs(target, models.Money(5000), 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(historyUpdate).WithArgs(target, models.Money(15000), 2).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(historyUpdate).WithArgs(target, models.Money(14000), 3).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO balances (user_id, currency, amount)")).
+		WithArgs(target, "USD", models.Money(14000)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM balances WHERE user_id = ?")).
+		WithArgs(source).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET deleted_at = NOW() WHERE id = ?")).
+		WithArgs(source).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_logs")).
+		WithArgs("user", target, "merge", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	result, err := service.MergeUsers(context.Background(), &models.MergeUsersRequest{SourceUserID: source, TargetUserID: target}, 1, balances)
+	if err != nil {
+		t.Fatalf("MergeUsers: %v", err)
+	}
+	if len(result.CombinedBalances) != 1 || result.CombinedBalances["USD"] != 14000 {
+		t.Errorf("CombinedBalances = %v, want USD 140.00", result.CombinedBalances)
+	}
+	if result.MovedTransactions != 3 {
+		t.Errorf("MovedTransactions = %d, want 3", result.MovedTransactions)
+	}
+	if result.MovedHistoryEntries != 2 {
+		t.Errorf("MovedHistoryEntries = %d, want 2", result.MovedHistoryEntries)
+	}
+	select {
+	case update := <-updates:
+		if update.Balance != 14000 || update.ChangeAmount != 4000 {
+			t.Errorf("update = %+v, want 140.00 after the 40.00 merged in", update)
+		}
+	default:
+		t.Error("merged balance was not published to the target's subscribers")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMergeUsersRejectsSelfMerge(t *testing.T) {
+	db, mock := newMockDB(t)
+	service := NewUserService(db, zerolog.Nop())
+
+	_, err := service.MergeUsers(context.Background(), &models.MergeUsersRequest{SourceUserID: 4, TargetUserID: 4}, 1, NewBalanceService(db, zerolog.Nop()))
+	if err == nil {
+		t.Fatal("an account was merged into itself")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMergeUsersRefusesFrozenAccounts(t *testing.T) {
+	frozen := func(id int) *sqlmock.Rows {
+		now := time.Now()
+		return sqlmock.NewRows([]string{"id", "username", "email", "full_name", "phone", "avatar_url", "password_hash", "role", "status", "created_at", "updated_at"}).
+			AddRow(id, "user", "user@example.com", nil, nil, nil, "hash", "user", "frozen", now, now)
+	}
+
+	t.Run("frozen source", func(t *testing.T) {
+		db, mock := newMockDB(t)
+		mock.ExpectQuery(userByIDQuery).WithArgs(3).WillReturnRows(frozen(3))
+
+		_, err := NewUserService(db, zerolog.Nop()).MergeUsers(context.Background(), &models.MergeUsersRequest{SourceUserID: 3, TargetUserID: 5}, 1, NewBalanceService(db, zerolog.Nop()))
+		if !errors.Is(err, ErrAccountFrozen) {
+			t.Fatalf("err = %v, want ErrAccountFrozen", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("frozen target", func(t *testing.T) {
+		db, mock := newMockDB(t)
+		mock.ExpectQuery(userByIDQuery).WithArgs(3).WillReturnRows(userRow(3, "user"))
+		mock.ExpectQuery(userByIDQuery).WithArgs(5).WillReturnRows(frozen(5))
+
+		_, err := NewUserService(db, zerolog.Nop()).MergeUsers(context.Background(), &models.MergeUsersRequest{SourceUserID: 3, TargetUserID: 5}, 1, NewBalanceService(db, zerolog.Nop()))
+		if !errors.Is(err, ErrAccountFrozen) {
+			t.Fatalf("err = %v, want ErrAccountFrozen", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestSetUserStatus(t *testing.T) {
+	statusForUpdate := regexp.QuoteMeta("SELECT status FROM users WHERE id = ? AND deleted_at IS NULL FOR UPDATE")
+
+	t.Run("freeze is audited", func(t *testing.T) {
+		db, mock := newMockDB(t)
+		mock.ExpectBegin()
+		mock.ExpectQuery(statusForUpdate).WithArgs(4).WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("active"))
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET status = ? WHERE id = ?")).WithArgs("frozen", 4).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(auditInsertQuery).
+			WithArgs("user", 4, "frozen", `{"actor_id":1,"new_status":"frozen","old_status":"active"}`).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+
+		if err := NewUserService(db, zerolog.Nop()).SetUserStatus(context.Background(), 4, models.UserStatusFrozen, 1); err != nil {
+			t.Fatalf("SetUserStatus: %v", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("unchanged status is not audited", func(t *testing.T) {
+		db, mock := newMockDB(t)
+		mock.ExpectBegin()
+		mock.ExpectQuery(statusForUpdate).WithArgs(4).WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("active"))
+		mock.ExpectRollback()
+
+		if err := NewUserService(db, zerolog.Nop()).SetUserStatus(context.Background(), 4, models.UserStatusActive, 1); err != nil {
+			t.Fatalf("SetUserStatus: %v", err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("unknown user", func(t *testing.T) {
+		db, mock := newMockDB(t)
+		mock.ExpectBegin()
+		mock.ExpectQuery(statusForUpdate).WithArgs(4).WillReturnError(sql.ErrNoRows)
+		mock.ExpectRollback()
+
+		if err := NewUserService(db, zerolog.Nop()).SetUserStatus(context.Background(), 4, models.UserStatusFrozen, 1); !errors.Is(err, ErrUserNotFound) {
+			t.Fatalf("err = %v, want ErrUserNotFound", err)
+		}
+	})
+}
+
+func TestRegisterMapsDuplicateKeyRace(t *testing.T) {
+	db, mock := newMockDB(t)
+	service := NewUserService(db, zerolog.Nop())
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id FROM users WHERE email = ? OR username = ?")).
+		WithArgs("eve@example.com", "eve").WillReturnError(sql.ErrNoRows)
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO users")).
+		WillReturnError(&mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'eve@example.com' for key 'uq_users_email'"})
+
+	_, err := service.Register(context.Background(), &models.RegisterRequest{Username: "eve", Email: "eve@example.com", Password: "password123"}, RegistrationPolicy{})
+	if !errors.Is(err, ErrUserExists) {
+		t.Errorf("err = %v, want ErrUserExists", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+type recordingResetNotifier struct {
+	email, token string
+}
+
+func (n *recordingResetNotifier) SendPasswordReset(email, token string) error {
+	n.email, n.token = email, token
+	return nil
+}
+
+func TestRequestPasswordResetDeliversTokenThroughNotifier(t *testing.T) {
+	db, mock := newMockDB(t)
+	service := NewUserService(db, zerolog.Nop())
+	notifier := &recordingResetNotifier{}
+	service.SetResetNotifier(notifier)
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id FROM users WHERE email = ? AND deleted_at IS NULL")).
+		WithArgs("eve@example.com").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(5))
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE password_resets SET used_at = NOW() WHERE user_id = ? AND used_at IS NULL")).
+		WithArgs(5).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO password_resets (user_id, token_hash, expires_at) VALUES (?, ?, ?)")).
+		WithArgs(5, sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	if err := service.RequestPasswordReset(context.Background(), "eve@example.com"); err != nil {
+		t.Fatalf("RequestPasswordReset: %v", err)
+	}
+	if notifier.email != "eve@example.com" || len(notifier.token) != 64 {
+		t.Errorf("notifier got email=%q token length %d", notifier.email, len(notifier.token))
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestResetPasswordRejectsUnusableTokens(t *testing.T) {
+	resetLookupQuery := regexp.QuoteMeta("SELECT id, user_id, expires_at, used_at FROM password_resets WHERE token_hash = ? FOR UPDATE")
+	columns := []string{"id", "user_id", "expires_at", "used_at"}
+
+	tests := []struct {
+		name   string
+		expect func(mock sqlmock.Sqlmock)
+	}{
+		{"unknown", func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery(resetLookupQuery).WithArgs(hashResetToken("some-token")).WillReturnError(sql.ErrNoRows)
+		}},
+		{"expired", func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery(resetLookupQuery).WithArgs(hashResetToken("some-token")).
+				WillReturnRows(sqlmock.NewRows(columns).AddRow(1, 5, time.Now().Add(-time.Minute), nil))
+		}},
+		{"reused", func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery(resetLookupQuery).WithArgs(hashResetToken("some-token")).
+				WillReturnRows(sqlmock.NewRows(columns).AddRow(1, 5, time.Now().Add(time.Hour), time.Now().Add(-time.Minute)))
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := newMockDB(t)
+			service := NewUserService(db, zerolog.Nop())
+
+			mock.ExpectBegin()
+			tt.expect(mock)
+			mock.ExpectRollback()
+
+			if err := service.ResetPassword(context.Background(), "some-token", "new-password-123"); !errors.Is(err, ErrInvalidResetToken) {
+				t.Errorf("err = %v, want ErrInvalidResetToken", err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// capturedArg matches any argument and keeps it, for values such as a password
+// hash that can only be checked after the call.
+type capturedArg struct{ value *driver.Value }
+
+func (a capturedArg) Match(v driver.Value) bool {
+	*a.value = v
+	return true
+}
+
+func TestCreateUser(t *testing.T) {
+	tests := []struct {
+		name          string
+		password      string
+		role          string
+		wantTemporary bool
+	}{
+		{name: "admin with a password", password: "password123", role: "admin"},
+		{name: "merchant with a generated password", role: "merchant", wantTemporary: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := newMockDB(t)
+			service := NewUserService(db, zerolog.Nop())
+
+			var hash driver.Value
+			mock.ExpectQuery(regexp.QuoteMeta("SELECT id FROM users WHERE email = ? OR username = ?")).
+				WithArgs("carol@example.com", "carol").WillReturnError(sql.ErrNoRows)
+			mock.ExpectExec(regexp.QuoteMeta("INSERT INTO users (username, email, password_hash, role) VALUES (?, ?, ?, ?)")).
+				WithArgs("carol", "carol@example.com", capturedArg{&hash}, tt.role).WillReturnResult(sqlmock.NewResult(42, 1))
+			mock.ExpectQuery(userByIDQuery).WithArgs(42).WillReturnRows(userRow(42, tt.role))
+			mock.ExpectExec(auditInsertQuery).
+				WithArgs("user", 42, "created", fmt.Sprintf(`{"actor_id":1,"role":%q,"temporary_password":%t}`, tt.role, tt.wantTemporary)).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+
+			user, temporary, err := service.CreateUser(context.Background(), &models.CreateUserRequest{
+				Username: "carol",
+				Email:    "carol@example.com",
+				Password: tt.password,
+				Role:     tt.role,
+			}, 1)
+			if err != nil {
+				t.Fatalf("CreateUser: %v", err)
+			}
+			if user.Role != tt.role {
+				t.Errorf("role = %s, want %s", user.Role, tt.role)
+			}
+			if (temporary != "") != tt.wantTemporary {
+				t.Errorf("temporary password = %q, want one generated: %t", temporary, tt.wantTemporary)
+			}
+
+			password := tt.password
+			if tt.wantTemporary {
+				password = temporary
+			}
+			stored, _ := hash.(string)
+			if stored == password || bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) != nil {
+				t.Errorf("stored password_hash %q is not a bcrypt hash of the password", stored)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestCreateUserRejectsUnknownRole(t *testing.T) {
+	db, mock := newMockDB(t)
+	service := NewUserService(db, zerolog.Nop())
+
+	_, _, err := service.CreateUser(context.Background(), &models.CreateUserRequest{Username: "carol", Email: "carol@example.com", Role: "superuser"}, 1)
+	if !errors.Is(err, ErrInvalidRole) {
+		t.Errorf("err = %v, want ErrInvalidRole", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
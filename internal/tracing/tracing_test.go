@@ -0,0 +1,63 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestStartAndEnd(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := NewProvider(sdktrace.NewSimpleSpanProcessor(exporter), "wallet")
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	ctx, parent := Start(context.Background(), "parent", attribute.Int("user.id", 7))
+	_, child := Start(ctx, "child")
+	End(child, errors.New("deadlock"))
+	End(parent, nil)
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("recorded %d spans, want 2", len(spans))
+	}
+	childSpan, parentSpan := spans[0], spans[1]
+
+	if childSpan.Parent.SpanID() != parentSpan.SpanContext.SpanID() {
+		t.Error("child span does not point at its parent")
+	}
+	if childSpan.Status.Code != codes.Error || childSpan.Status.Description != "deadlock" || len(childSpan.Events) != 1 {
+		t.Errorf("failed span status = %+v with %d events, want an error with the recorded cause", childSpan.Status, len(childSpan.Events))
+	}
+	if parentSpan.Status.Code != codes.Unset {
+		t.Errorf("successful span status = %+v, want unset", parentSpan.Status)
+	}
+	if len(parentSpan.Attributes) != 1 || parentSpan.Attributes[0] != attribute.Int("user.id", 7) {
+		t.Errorf("attributes = %v, want user.id=7", parentSpan.Attributes)
+	}
+	if name, ok := parentSpan.Resource.Set().Value("service.name"); !ok || name.AsString() != "wallet" {
+		t.Errorf("service.name = %v, want wallet", name)
+	}
+}
+
+func TestSetupWithoutEndpointKeepsNoopProvider(t *testing.T) {
+	previous := otel.GetTracerProvider()
+
+	shutdown, err := Setup(context.Background(), "", "wallet")
+	if err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+	if otel.GetTracerProvider() != previous {
+		t.Error("Setup replaced the tracer provider without an endpoint")
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Errorf("shutdown = %v, want nil", err)
+	}
+}
@@ -2,47 +2,126 @@ package main
 
 import (
 	"context"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"syscall"
 	"time"
 
 	"go-projects/internal/config"
 	"go-projects/internal/db"
+	"go-projects/internal/lifecycle"
 	"go-projects/internal/logger"
+	"go-projects/internal/middleware"
 	"go-projects/internal/router"
+	"go-projects/internal/services"
+	"go-projects/internal/tracing"
 )
 
 func main() {
-	cfg := config.LoadConfig()
+	startedAt := time.Now()
+	cfg, cfgErr := config.LoadConfig()
 
-	log := logger.InitLogger()
-	database := db.InitDB(cfg.DBUrl)
+	log := logger.InitLogger(logger.Options{
+		Format:    cfg.LogFormat,
+		Level:     cfg.LogLevel,
+		File:      cfg.LogFile,
+		MaxSizeMB: cfg.LogMaxSizeMB,
+
+		StandardFieldNames: cfg.AccessLogFormat == middleware.AccessLogFormatJSON,
+	})
+	if cfgErr != nil {
+		log.Fatal().Err(cfgErr).Msg("Invalid configuration")
+	}
+
+	startup := lifecycle.NewPhases(log, "startup", startedAt)
+	startup.Done("config loaded")
+
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.TracingEndpoint, cfg.TracingServiceName)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Tracing setup failed")
+	}
+
+	database, err := db.InitDB(cfg.DBUrl, db.PoolOptions{
+		MaxOpenConns:    cfg.DBMaxOpenConns,
+		MaxIdleConns:    cfg.DBMaxIdleConns,
+		ConnMaxLifetime: cfg.DBConnMaxLifetime,
+	})
+	if err != nil {
+		log.Fatal().Err(err).Msg("Database initialization failed")
+	}
 	defer database.Close()
+	startup.Done("database connected")
 
-	db.RunMigrations(database)
-	r := router.SetupRouter(database, log)
+	if err := db.RunMigrations(database); err != nil {
+		log.Error().Err(err).Msg("Database migration failed")
+		database.Close()
+		os.Exit(1)
+	}
+	startup.Done("migrations applied")
+
+	inFlight := lifecycle.NewTracker()
+	balanceService := services.NewBalanceService(database, log)
+	r, stopRouter, err := router.SetupRouter(database, log, cfg, inFlight, balanceService)
+	if err != nil {
+		log.Error().Err(err).Msg("Router setup failed")
+		database.Close()
+		os.Exit(1)
+	}
+
+	var reconciler *services.ReconciliationWorker
+	if cfg.ReconcileInterval > 0 {
+		reconciler = services.NewReconciliationWorker(database, log, balanceService, cfg.ReconcileInterval, cfg.ReconcileAutoRepair)
+		reconciler.Start()
+	}
 
 	server := &http.Server{
-		Addr:    ":" + cfg.Port,
+		Addr:    cfg.Addr(),
 		Handler: r,
 	}
 
+	// Binding before serving makes a taken port fail startup here, and means
+	// the listening phase is only logged once connections can be accepted.
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		log.Error().Err(err).Str("addr", server.Addr).Msg("Failed to listen")
+		database.Close()
+		os.Exit(1)
+	}
+	startup.Done("server listening")
+	startup.Complete()
+
 	go func() {
-		log.Info().Msgf("Server running on port %s", cfg.Port)
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
 			log.Fatal().Err(err).Msg("Server error")
 		}
 	}()
 
 	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, os.Interrupt)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
 	<-quit
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	shutdown := lifecycle.NewPhases(log, "shutdown", time.Now())
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
 	defer cancel()
 
-	if err := server.Shutdown(ctx); err != nil {
-		log.Error().Err(err).Msg("Shutdown failed")
+	err = lifecycle.Shutdown(ctx, shutdown, inFlight, func(ctx context.Context) error {
+		defer stopRouter()
+		return server.Shutdown(ctx)
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Shutdown did not finish cleanly")
+	}
+
+	if reconciler != nil {
+		reconciler.Stop()
+		shutdown.Done("reconciler stopped")
+	}
+
+	if err := shutdownTracing(ctx); err != nil {
+		log.Error().Err(err).Msg("Failed to flush traces")
 	}
+	shutdown.Complete()
 }